@@ -25,3 +25,38 @@ type API interface {
 	Del(args *cniSkel.CmdArgs) error
 	GetVersion() cniVersion.PluginInfo
 }
+
+// CheckAPI is implemented by CNI plugins that support the CHECK command introduced in CNI spec
+// version 0.4.0.
+type CheckAPI interface {
+	Check(args *cniSkel.CmdArgs) error
+}
+
+// ReconcileAPI is implemented by CNI plugins that support the RECONCILE command. It is not part of
+// the CNI spec: it repairs the network configuration of an existing container, where CHECK only
+// reports on it.
+type ReconcileAPI interface {
+	Reconcile(args *cniSkel.CmdArgs) error
+}
+
+// FootprintAPI is implemented by CNI plugins that support the FOOTPRINT command. It is not part of
+// the CNI spec: it reports the kernel resources used by the plugin across all containers on the
+// host, and takes no arguments.
+type FootprintAPI interface {
+	Footprint() (interface{}, error)
+}
+
+// Well-known CNI error codes, as defined in the CNI spec. Codes of 100 and above are plugin
+// specific.
+const (
+	ErrCodeUnknownContainer     uint = 3
+	ErrCodeInvalidNetworkConfig uint = 7
+	ErrCodeTryAgainLater        uint = 11
+)
+
+// CodedError is implemented by errors returned by CNI command handlers that map to a well-known
+// CNI error code, so that the container runtime can tell them apart from other failures.
+type CodedError interface {
+	error
+	CNIErrorCode() uint
+}
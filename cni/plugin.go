@@ -14,8 +14,10 @@
 package cni
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"runtime"
 
@@ -115,11 +117,41 @@ func (plugin *Plugin) Run() *cniTypes.Error {
 		}
 	}()
 
+	logger.SetField("command", os.Getenv("CNI_COMMAND"))
 	log.Infof("Plugin %s version %s executing CNI command.", plugin.Name, version.Version)
 
+	// The vendored CNI library does not dispatch CHECK, so handle it here if supported.
+	if checker, ok := plugin.Commands.(CheckAPI); ok && os.Getenv("CNI_COMMAND") == "CHECK" {
+		cniErr := plugin.runCommand(checker.Check)
+		if cniErr != nil {
+			log.Errorf("CNI command failed: %+v", cniErr)
+		}
+		return cniErr
+	}
+
+	// Likewise for RECONCILE, which is not part of the CNI spec.
+	if reconciler, ok := plugin.Commands.(ReconcileAPI); ok && os.Getenv("CNI_COMMAND") == "RECONCILE" {
+		cniErr := plugin.runCommand(reconciler.Reconcile)
+		if cniErr != nil {
+			log.Errorf("CNI command failed: %+v", cniErr)
+		}
+		return cniErr
+	}
+
+	// Likewise for FOOTPRINT, which reports on the whole host.
+	if reporter, ok := plugin.Commands.(FootprintAPI); ok && os.Getenv("CNI_COMMAND") == "FOOTPRINT" {
+		cniErr := plugin.printFootprint(reporter)
+		if cniErr != nil {
+			log.Errorf("CNI command failed: %+v", cniErr)
+		}
+		return cniErr
+	}
+
 	// Execute CNI command handlers.
 	cniErr := cniSkel.PluginMainWithError(
-		plugin.Commands.Add, plugin.Commands.Del, plugin.Commands.GetVersion())
+		withErrorCode(plugin.Commands.Add),
+		withErrorCode(plugin.Commands.Del),
+		plugin.Commands.GetVersion())
 	if cniErr != nil {
 		log.Errorf("CNI command failed: %+v", cniErr)
 	}
@@ -127,6 +159,70 @@ func (plugin *Plugin) Run() *cniTypes.Error {
 	return cniErr
 }
 
+// runCommand executes a CNI command handler not dispatched by the vendored CNI library, such as
+// CHECK, with the arguments passed in the environment.
+func (plugin *Plugin) runCommand(handler func(*cniSkel.CmdArgs) error) *cniTypes.Error {
+	stdinData, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return &cniTypes.Error{Code: 100, Msg: fmt.Sprintf("error reading from stdin: %v", err)}
+	}
+
+	args := &cniSkel.CmdArgs{
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		Netns:       os.Getenv("CNI_NETNS"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+		Args:        os.Getenv("CNI_ARGS"),
+		Path:        os.Getenv("CNI_PATH"),
+		StdinData:   stdinData,
+	}
+
+	if args.IfName == "" {
+		return &cniTypes.Error{Code: 100, Msg: "required env variables missing: CNI_IFNAME"}
+	}
+
+	err = withErrorCode(handler)(args)
+	if err != nil {
+		if e, ok := err.(*cniTypes.Error); ok {
+			return e
+		}
+		return &cniTypes.Error{Code: 100, Msg: err.Error()}
+	}
+
+	return nil
+}
+
+// printFootprint prints the footprint reported by the plugin to stdout in JSON.
+func (plugin *Plugin) printFootprint(reporter FootprintAPI) *cniTypes.Error {
+	footprint, err := reporter.Footprint()
+	if err != nil {
+		return &cniTypes.Error{Code: 100, Msg: err.Error()}
+	}
+
+	data, err := json.MarshalIndent(footprint, "", "    ")
+	if err != nil {
+		return &cniTypes.Error{Code: 100, Msg: fmt.Sprintf("error encoding footprint: %v", err)}
+	}
+
+	_, err = os.Stdout.Write(append(data, '\n'))
+	if err != nil {
+		return &cniTypes.Error{Code: 100, Msg: fmt.Sprintf("error writing footprint: %v", err)}
+	}
+
+	return nil
+}
+
+// withErrorCode wraps a CNI command handler to report the errors it returns with their CNI error
+// code, if any. Other errors are reported with the generic error code.
+func withErrorCode(handler func(*cniSkel.CmdArgs) error) func(*cniSkel.CmdArgs) error {
+	return func(args *cniSkel.CmdArgs) error {
+		err := handler(args)
+		if e, ok := err.(CodedError); ok {
+			return &cniTypes.Error{Code: e.CNIErrorCode(), Msg: e.Error()}
+		}
+		return err
+	}
+}
+
 // Add is an empty CNI ADD command handler to ensure all CNI plugins implement CNIAPI.
 func (plugin *Plugin) Add(args *cniSkel.CmdArgs) error {
 	return nil
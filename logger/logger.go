@@ -14,8 +14,11 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	log "github.com/cihub/seelog"
 )
@@ -24,6 +27,10 @@ const (
 	// Environment variables for custom log settings.
 	envLogLevel    = "VPC_CNI_LOG_LEVEL"
 	envLogFilePath = "VPC_CNI_LOG_FILE"
+	envLogFormat   = "VPC_CNI_LOG_FORMAT"
+
+	// logFormatJSON is the log format that selects JSON log lines instead of text.
+	logFormatJSON = "json"
 
 	// Log configuration used by seelog.
 	logConfigFormat = `
@@ -32,15 +39,30 @@ const (
   <rollingfile filename="%s" type="date" datepattern="2006-01-02-15" archivetype="none" maxrolls="24" />
  </outputs>
  <formats>
-  <format id="main" format="%%UTCDate(2006-01-02T15:04:05Z07:00) [%%LEVEL] %%Msg%%n" />
+  <format id="main" format="%s" />
  </formats>
 </seelog>
 `
+
+	// Log line formats used by seelog.
+	textLogLineFormat = "%UTCDate(2006-01-02T15:04:05Z07:00) [%LEVEL] %Msg%n"
+	jsonLogLineFormat = "%JSON%n"
 )
 
+var (
+	// fields are added to every log line in JSON format.
+	fields     = make(map[string]interface{})
+	fieldsLock sync.Mutex
+)
+
+func init() {
+	log.RegisterCustomFormatter("JSON", newJSONFormatter)
+}
+
 // Setup sets up a file logger.
 func Setup(logFilePath string) {
-	config := fmt.Sprintf(logConfigFormat, getLogLevel(), getLogFilePath(logFilePath))
+	config := fmt.Sprintf(logConfigFormat, getLogLevel(), getLogFilePath(logFilePath),
+		getLogLineFormat())
 
 	logger, err := log.LoggerFromConfigAsString(config)
 	if err != nil {
@@ -70,3 +92,44 @@ func getLogFilePath(defaultLogFilePath string) string {
 
 	return logFilePath
 }
+
+// getLogLineFormat returns the seelog format of log lines in the effective log format.
+func getLogLineFormat() string {
+	if os.Getenv(envLogFormat) == logFormatJSON {
+		return jsonLogLineFormat
+	}
+
+	return textLogLineFormat
+}
+
+// SetField sets a field that is added to every subsequent log line in JSON format, such as the
+// CNI command being executed. Text format log lines are not affected.
+func SetField(name string, value interface{}) {
+	fieldsLock.Lock()
+	defer fieldsLock.Unlock()
+
+	fields[name] = value
+}
+
+// newJSONFormatter creates a seelog formatter that formats log lines as JSON objects.
+func newJSONFormatter(param string) log.FormatterFunc {
+	return func(message string, level log.LogLevel, context log.LogContextInterface) interface{} {
+		fieldsLock.Lock()
+		defer fieldsLock.Unlock()
+
+		line := make(map[string]interface{}, len(fields)+3)
+		for name, value := range fields {
+			line[name] = value
+		}
+		line["timestamp"] = context.CallTime().UTC().Format(time.RFC3339Nano)
+		line["level"] = level.String()
+		line["message"] = message
+
+		buf, err := json.Marshal(line)
+		if err != nil {
+			return fmt.Sprintf(`{"level":"error","message":%q}`, err.Error())
+		}
+
+		return string(buf)
+	}
+}
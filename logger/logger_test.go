@@ -14,11 +14,15 @@
 package logger
 
 import (
+	"bytes"
+	"encoding/json"
 	"os"
+	"strings"
 	"testing"
 
 	log "github.com/cihub/seelog"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetLogFilePathReturnsOverriddenPath(t *testing.T) {
@@ -57,3 +61,42 @@ func TestLogLevelReturnsDefaultLevelWhenEnvSetToInvalidValue(t *testing.T) {
 	expectedLogLevel = log.InfoLvl
 	assert.Equal(t, expectedLogLevel.String(), getLogLevel())
 }
+
+func TestLogLineFormatReturnsJSONWhenEnvSet(t *testing.T) {
+	assert.Equal(t, textLogLineFormat, getLogLineFormat())
+
+	os.Setenv(envLogFormat, "json")
+	defer os.Unsetenv(envLogFormat)
+
+	assert.Equal(t, jsonLogLineFormat, getLogLineFormat())
+}
+
+func TestJSONLogLines(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := log.LoggerFromWriterWithMinLevelAndFormat(&buf, log.TraceLvl, jsonLogLineFormat)
+	require.NoError(t, err)
+	defer logger.Close()
+
+	SetField("command", "ADD")
+	SetField("vlanID", 101)
+	defer func() { fields = make(map[string]interface{}) }()
+
+	logger.Infof("Creating branch link %s.", "eth1.101")
+	logger.Debugf("Message with \"quotes\" and a\nnewline.")
+	logger.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &line))
+	assert.Equal(t, "info", line["level"])
+	assert.Equal(t, "Creating branch link eth1.101.", line["message"])
+	assert.Equal(t, "ADD", line["command"])
+	assert.Equal(t, float64(101), line["vlanID"])
+	assert.NotEmpty(t, line["timestamp"])
+
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &line))
+	assert.Equal(t, "debug", line["level"])
+	assert.Equal(t, "Message with \"quotes\" and a\nnewline.", line["message"])
+}
@@ -202,6 +202,16 @@ func (snat *SNATTarget) String() string {
 	return s
 }
 
+// CheckAvailable returns an error if the ebtables executable is not available on this host.
+func CheckAvailable() error {
+	_, err := exec.LookPath(ebtablesExe)
+	if err != nil {
+		return fmt.Errorf("ebtables is not available, %s not found: %v", ebtablesExe, err)
+	}
+
+	return nil
+}
+
 // Append appends a rule to the table.
 func (table *Table) Append(chain Chain, rule *Rule) error {
 	return execute(table.append(chain, rule))
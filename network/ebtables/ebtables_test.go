@@ -15,6 +15,7 @@ package ebtables
 
 import (
 	"net"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -97,3 +98,12 @@ func TestRuleWithSNATTarget(t *testing.T) {
 		),
 	)
 }
+
+// TestCheckAvailableMissingExecutable tests that a missing ebtables executable is reported.
+func TestCheckAvailableMissingExecutable(t *testing.T) {
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", "")
+
+	assert.Error(t, CheckAvailable())
+}
@@ -22,6 +22,7 @@ import (
 
 	log "github.com/cihub/seelog"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 // Branch represents a VPC branch ENI.
@@ -55,50 +56,139 @@ func NewBranch(trunk *Trunk, linkName string, macAddress net.HardwareAddr, isola
 
 // AttachToLink attaches the branch ENI to a link.
 func (branch *Branch) AttachToLink(setMACAddress bool) error {
-	// Create the VLAN link.
+	// Create the branch link.
 	la := netlink.NewLinkAttrs()
 	la.Name = branch.linkName
 	la.ParentIndex = branch.trunk.linkIndex
 	if setMACAddress && branch.macAddress != nil {
-		// Set VLAN link MAC address to customer branch ENI MAC address.
+		// Set branch link MAC address to customer branch ENI MAC address.
 		la.HardwareAddr = branch.macAddress
+	} else if branch.trunk.isolationMode == TrunkIsolationModeMACVLAN {
+		// MACVLAN branches are isolated by their MAC address, so it can't be skipped.
+		return fmt.Errorf("MAC address is required for MACVLAN branch %s", branch.linkName)
 	} else {
 		log.Debugf("Skip setting hardware address for branch [%s] overrideMAC: %t",
 			branch.linkName, setMACAddress)
 	}
 
-	vlanLink := &netlink.Vlan{LinkAttrs: la, VlanId: branch.isolationID}
+	link := branch.newLink(la)
+	kind := link.Type()
 
-	log.Infof("Creating VLAN link for branch %s: %+v", branch.linkName, vlanLink)
-	err := netlink.LinkAdd(vlanLink)
+	log.Infof("Creating %s link for branch %s: %+v", kind, branch.linkName, link)
+	err := netlink.LinkAdd(link)
 	if err != nil {
 		if os.IsExist(err) {
-			log.Infof("Found existing VLAN link for branch %s.", branch.linkName)
+			log.Infof("Found existing %s link for branch %s.", kind, branch.linkName)
 		} else {
-			log.Errorf("Failed to add VLAN link for branch %s: %v", branch.linkName, err)
+			log.Errorf("Failed to add %s link for branch %s: %v", kind, branch.linkName, err)
 		}
 		return err
 	}
 
-	branch.linkIndex = vlanLink.Index
+	branch.linkIndex = link.Attrs().Index
 	return nil
 }
 
+// AttachToExistingLink attaches the branch ENI to an existing link, such as one left behind by an
+// earlier process. The link must be a branch of the trunk with the branch's isolation ID, and
+// must also have the branch's MAC address if checkMACAddress is set.
+func (branch *Branch) AttachToExistingLink(checkMACAddress bool) error {
+	link, err := netlink.LinkByName(branch.linkName)
+	if err != nil {
+		return err
+	}
+
+	la := link.Attrs()
+	if la.ParentIndex != branch.trunk.linkIndex {
+		return fmt.Errorf("link %s is not a branch of trunk %s", branch.linkName, branch.trunk.linkName)
+	}
+
+	expected := branch.newLink(netlink.LinkAttrs{})
+	if link.Type() != expected.Type() {
+		return fmt.Errorf("link %s is a %s link, expected %s", branch.linkName, link.Type(), expected.Type())
+	}
+	if vlan, ok := link.(*netlink.Vlan); ok && vlan.VlanId != branch.isolationID {
+		return fmt.Errorf("link %s has VLAN ID %d, expected %d", branch.linkName, vlan.VlanId, branch.isolationID)
+	}
+	if checkMACAddress && branch.macAddress != nil && la.HardwareAddr.String() != branch.macAddress.String() {
+		return fmt.Errorf("link %s has MAC address %s, expected %s",
+			branch.linkName, la.HardwareAddr, branch.macAddress)
+	}
+
+	log.Infof("Attaching branch %s to existing %s link.", branch.linkName, link.Type())
+	branch.linkIndex = la.Index
+	return nil
+}
+
+// AttachToLinkIfAbsent attaches the branch ENI to a link, creating the link only if it does not
+// already exist. An existing link is reused if it is compatible with the branch, as checked by
+// AttachToExistingLink, so that retried attachments succeed.
+func (branch *Branch) AttachToLinkIfAbsent(setMACAddress bool) error {
+	err := branch.AttachToLink(setMACAddress)
+	if !os.IsExist(err) {
+		return err
+	}
+
+	return branch.AttachToExistingLink(setMACAddress)
+}
+
 // DetachFromLink detaches the branch ENI from a link.
 func (branch *Branch) DetachFromLink() error {
-	// Delete the VLAN link.
+	// Delete the branch link.
 	la := netlink.NewLinkAttrs()
 	la.Name = branch.linkName
 	la.ParentIndex = branch.trunk.linkIndex
-	vlanLink := &netlink.Vlan{LinkAttrs: la, VlanId: branch.isolationID}
+	link := branch.newLink(la)
+	kind := link.Type()
 
-	log.Infof("Deleting VLAN link for branch %s: %+v", branch.linkName, vlanLink)
-	err := netlink.LinkDel(vlanLink)
+	log.Infof("Deleting %s link for branch %s: %+v", kind, branch.linkName, link)
+	err := netlink.LinkDel(link)
 	if err != nil {
-		log.Errorf("Failed to delete VLAN link for branch %s: %v", branch.linkName, err)
+		log.Errorf("Failed to delete %s link for branch %s: %v", kind, branch.linkName, err)
 		return err
 	}
 
 	branch.linkIndex = 0
 	return nil
 }
+
+// Delete deletes the branch link, which also detaches the branch from the trunk. Deleting a
+// branch link that no longer exists is not an error, so that Delete is idempotent.
+func (branch *Branch) Delete() error {
+	link, err := netlink.LinkByName(branch.linkName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			log.Infof("Branch link %s is already deleted.", branch.linkName)
+			branch.linkIndex = 0
+			return nil
+		}
+		log.Errorf("Failed to find branch link %s: %v", branch.linkName, err)
+		return err
+	}
+
+	// Do not delete an unrelated link that happens to have the same name.
+	if link.Attrs().ParentIndex != branch.trunk.linkIndex {
+		return fmt.Errorf("link %s is not a branch of trunk %s", branch.linkName, branch.trunk.linkName)
+	}
+
+	log.Infof("Deleting %s link for branch %s.", link.Type(), branch.linkName)
+	err = netlink.LinkDel(link)
+	if err != nil && err != unix.ENODEV {
+		log.Errorf("Failed to delete %s link for branch %s: %v", link.Type(), branch.linkName, err)
+		return err
+	}
+
+	branch.linkIndex = 0
+	return nil
+}
+
+// newLink returns the link object for the branch in the trunk's isolation mode. VLAN branches
+// are 802.1Q VLAN links tagged with the isolation ID. MACVLAN branches are private-mode
+// MACVLAN links, which isolate branches on the same trunk from each other.
+func (branch *Branch) newLink(la netlink.LinkAttrs) netlink.Link {
+	if branch.trunk.isolationMode == TrunkIsolationModeMACVLAN {
+		return &netlink.Macvlan{LinkAttrs: la, Mode: netlink.MACVLAN_MODE_PRIVATE}
+	}
+
+	return &netlink.Vlan{LinkAttrs: la, VlanId: branch.isolationID}
+}
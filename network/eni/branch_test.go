@@ -0,0 +1,149 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// +build linux
+
+package eni
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestBranchDelete(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-branch-delete")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		trunkLink := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "trunk0"}}
+		require.NoError(t, netlink.LinkAdd(trunkLink))
+
+		trunk, err := NewTrunk("trunk0", nil, TrunkIsolationModeMACVLAN)
+		require.NoError(t, err)
+
+		macAddress, _ := net.ParseMAC("02:00:00:00:01:01")
+		branch, err := NewBranch(trunk, "trunk0.101", macAddress, 101)
+		require.NoError(t, err)
+		require.NoError(t, branch.AttachToLink(true))
+
+		// Delete removes the branch link and is safe to call again after it is gone.
+		require.NoError(t, branch.Delete())
+		_, err = netlink.LinkByName("trunk0.101")
+		assert.IsType(t, netlink.LinkNotFoundError{}, err)
+		assert.NoError(t, branch.Delete())
+
+		// Delete refuses to remove a link with the branch name that is not on the trunk.
+		other := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "trunk0.101"}}
+		require.NoError(t, netlink.LinkAdd(other))
+		assert.Error(t, branch.Delete())
+		_, err = netlink.LinkByName("trunk0.101")
+		assert.NoError(t, err)
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestBranchAttachToExistingLink(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-branch-existing")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		trunkLink := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "trunk0"}}
+		require.NoError(t, netlink.LinkAdd(trunkLink))
+
+		trunk, err := NewTrunk("trunk0", nil, TrunkIsolationModeMACVLAN)
+		require.NoError(t, err)
+
+		macAddress, _ := net.ParseMAC("02:00:00:00:01:01")
+		stray, err := NewBranch(trunk, "trunk0.101", macAddress, 101)
+		require.NoError(t, err)
+
+		// There is no existing link to attach to yet.
+		assert.Error(t, stray.AttachToExistingLink(true))
+		require.NoError(t, stray.AttachToLink(true))
+
+		// A branch with the same MAC address attaches to the existing link.
+		branch, err := NewBranch(trunk, "trunk0.101", macAddress, 101)
+		require.NoError(t, err)
+		assert.True(t, os.IsExist(branch.AttachToLink(true)))
+		require.NoError(t, branch.AttachToExistingLink(true))
+		assert.Equal(t, stray.GetLinkIndex(), branch.GetLinkIndex())
+
+		// A branch with a different MAC address does not, unless the MAC address is not checked.
+		otherMACAddress, _ := net.ParseMAC("02:00:00:00:01:02")
+		branch, err = NewBranch(trunk, "trunk0.101", otherMACAddress, 101)
+		require.NoError(t, err)
+		assert.Error(t, branch.AttachToExistingLink(true))
+		assert.NoError(t, branch.AttachToExistingLink(false))
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestBranchAttachToLinkIfAbsent(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-branch-if-absent")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		trunkLink := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "trunk0"}}
+		require.NoError(t, netlink.LinkAdd(trunkLink))
+
+		trunk, err := NewTrunk("trunk0", nil, TrunkIsolationModeMACVLAN)
+		require.NoError(t, err)
+
+		macAddress, _ := net.ParseMAC("02:00:00:00:01:01")
+		branch, err := NewBranch(trunk, "trunk0.101", macAddress, 101)
+		require.NoError(t, err)
+
+		// The first attach creates the link, and the second attaches to it.
+		require.NoError(t, branch.AttachToLinkIfAbsent(true))
+		linkIndex := branch.GetLinkIndex()
+		assert.NotZero(t, linkIndex)
+		require.NoError(t, branch.AttachToLinkIfAbsent(true))
+		assert.Equal(t, linkIndex, branch.GetLinkIndex())
+
+		// An existing link of the wrong kind is not reused.
+		vlanTrunk, err := NewTrunk("trunk0", nil, TrunkIsolationModeVLAN)
+		require.NoError(t, err)
+		vlanBranch, err := NewBranch(vlanTrunk, "trunk0.101", macAddress, 101)
+		require.NoError(t, err)
+		assert.Error(t, vlanBranch.AttachToLinkIfAbsent(true))
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
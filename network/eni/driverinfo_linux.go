@@ -0,0 +1,169 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package eni
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ethtoolGetDriverInfo is the ethtool command to get driver information (ETHTOOL_GDRVINFO).
+	ethtoolGetDriverInfo = 0x3
+
+	// ethtoolGetPermAddr is the ethtool command to get the permanent hardware address
+	// (ETHTOOL_GPERMADDR).
+	ethtoolGetPermAddr = 0x20
+
+	// Length of the string fields in ethtool_drvinfo.
+	ethtoolDriverInfoStringLen = 32
+
+	// Maximum length of a hardware address (MAX_ADDR_LEN).
+	maxHardwareAddrLen = 32
+)
+
+// DriverInfo represents the driver information of a link, as reported by ethtool.
+type DriverInfo struct {
+	Driver          string
+	Version         string
+	FirmwareVersion string
+	BusInfo         string
+}
+
+// ethtoolDriverInfo is the ethtool_drvinfo structure passed to the SIOCETHTOOL ioctl.
+type ethtoolDriverInfo struct {
+	Cmd         uint32
+	Driver      [ethtoolDriverInfoStringLen]byte
+	Version     [ethtoolDriverInfoStringLen]byte
+	FwVersion   [ethtoolDriverInfoStringLen]byte
+	BusInfo     [ethtoolDriverInfoStringLen]byte
+	EromVersion [ethtoolDriverInfoStringLen]byte
+	Reserved2   [12]byte
+	NPrivFlags  uint32
+	NStats      uint32
+	TestInfoLen uint32
+	EedumpLen   uint32
+	RegdumpLen  uint32
+}
+
+// ethtoolPermAddr is the ethtool_perm_addr structure passed to the SIOCETHTOOL ioctl.
+type ethtoolPermAddr struct {
+	Cmd  uint32
+	Size uint32
+	Data [maxHardwareAddrLen]byte
+}
+
+// ethtoolIfReq is the ifreq structure passed to the SIOCETHTOOL ioctl.
+type ethtoolIfReq struct {
+	Name [unix.IFNAMSIZ]byte
+	Data uintptr
+	_    [16]byte
+}
+
+// GetDriverInfo returns the driver name, driver version and firmware version of the ENI link.
+// This is useful for correlating behavior with specific driver versions.
+func (eni *ENI) GetDriverInfo() (*DriverInfo, error) {
+	return GetLinkDriverInfo(eni.linkName)
+}
+
+// GetLinkDriverInfo returns the driver information of the link with the given name in the
+// current netns.
+func GetLinkDriverInfo(linkName string) (*DriverInfo, error) {
+	if len(linkName) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("invalid link name %s", linkName)
+	}
+
+	drvInfo := ethtoolDriverInfo{Cmd: ethtoolGetDriverInfo}
+	err := ethtoolIoctl(linkName, unsafe.Pointer(&drvInfo))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get driver info of link %s: %v", linkName, err)
+	}
+
+	return newDriverInfo(&drvInfo), nil
+}
+
+// GetLinkPermanentMACAddress returns the permanent MAC address of the link with the given name in
+// the current netns. Unlike the current MAC address, the permanent one is assigned by the device
+// and can't be changed. Virtual links have no permanent MAC address, and nil is returned for them.
+func GetLinkPermanentMACAddress(linkName string) (net.HardwareAddr, error) {
+	if len(linkName) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("invalid link name %s", linkName)
+	}
+
+	permAddr := ethtoolPermAddr{Cmd: ethtoolGetPermAddr, Size: maxHardwareAddrLen}
+	err := ethtoolIoctl(linkName, unsafe.Pointer(&permAddr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get permanent MAC address of link %s: %v", linkName, err)
+	}
+
+	return newPermanentMACAddress(&permAddr), nil
+}
+
+// newPermanentMACAddress converts an ethtool_perm_addr structure to a MAC address. It returns
+// nil if the address is unset.
+func newPermanentMACAddress(permAddr *ethtoolPermAddr) net.HardwareAddr {
+	size := int(permAddr.Size)
+	if size > maxHardwareAddrLen {
+		size = maxHardwareAddrLen
+	}
+
+	addr := permAddr.Data[:size]
+	for _, octet := range addr {
+		if octet != 0 {
+			return net.HardwareAddr(append([]byte(nil), addr...))
+		}
+	}
+
+	return nil
+}
+
+// ethtoolIoctl issues the ethtool command in the given structure on the link with the given name
+// in the current netns. The command's results are returned in the same structure.
+func ethtoolIoctl(linkName string, data unsafe.Pointer) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var req ethtoolIfReq
+	copy(req.Name[:], linkName)
+	req.Data = uintptr(data)
+
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL, uintptr(fd), uintptr(unix.SIOCETHTOOL), uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// newDriverInfo converts an ethtool_drvinfo structure to a DriverInfo object.
+func newDriverInfo(drvInfo *ethtoolDriverInfo) *DriverInfo {
+	str := func(b []byte) string {
+		return string(bytes.TrimRight(b, "\x00"))
+	}
+
+	return &DriverInfo{
+		Driver:          str(drvInfo.Driver[:]),
+		Version:         str(drvInfo.Version[:]),
+		FirmwareVersion: str(drvInfo.FwVersion[:]),
+		BusInfo:         str(drvInfo.BusInfo[:]),
+	}
+}
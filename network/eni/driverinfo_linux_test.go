@@ -0,0 +1,75 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package eni
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestNewDriverInfo(t *testing.T) {
+	var drvInfo ethtoolDriverInfo
+	copy(drvInfo.Driver[:], "ena")
+	copy(drvInfo.Version[:], "2.0.3K")
+	copy(drvInfo.BusInfo[:], "0000:00:05.0")
+
+	info := newDriverInfo(&drvInfo)
+	assert.Equal(t, &DriverInfo{
+		Driver:          "ena",
+		Version:         "2.0.3K",
+		FirmwareVersion: "",
+		BusInfo:         "0000:00:05.0",
+	}, info)
+}
+
+func TestNewPermanentMACAddress(t *testing.T) {
+	permAddr := ethtoolPermAddr{Size: 6}
+	copy(permAddr.Data[:], []byte{0x02, 0, 0, 0, 0x01, 0x01})
+	assert.Equal(t, "02:00:00:00:01:01", newPermanentMACAddress(&permAddr).String())
+
+	// Virtual links report an all-zero permanent MAC address.
+	assert.Nil(t, newPermanentMACAddress(&ethtoolPermAddr{Size: 6}))
+}
+
+func TestGetLinkDriverInfo(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-driver-info")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+		require.NoError(t, netlink.LinkAdd(bridge))
+
+		info, err := GetLinkDriverInfo("br0")
+		require.NoError(t, err)
+		assert.Equal(t, "bridge", info.Driver)
+		assert.NotEmpty(t, info.Version)
+
+		_, err = GetLinkDriverInfo("missing0")
+		assert.Error(t, err)
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
@@ -21,6 +21,11 @@ import (
 	"github.com/vishvananda/netlink"
 )
 
+var (
+	// linkByName looks up a link by name. It is a variable so that it can be replaced in tests.
+	linkByName = netlink.LinkByName
+)
+
 // SetLinkName sets the name of the ENI.
 func (eni *ENI) SetLinkName(name string) error {
 	la := netlink.NewLinkAttrs()
@@ -62,6 +67,40 @@ func (eni *ENI) SetOpState(up bool) error {
 	return err
 }
 
+// GetOpState returns whether the ENI link is up. The link is up if it is administratively up and
+// its operational state is not down, which it is for example when its trunk link has no carrier.
+// Virtual links that do not report an operational state are considered up when set up.
+func (eni *ENI) GetOpState() (bool, error) {
+	link, err := linkByName(eni.linkName)
+	if err != nil {
+		return false, err
+	}
+
+	attrs := link.Attrs()
+	if attrs.Flags&net.FlagUp == 0 {
+		return false, nil
+	}
+
+	switch attrs.OperState {
+	case netlink.OperDown, netlink.OperLowerLayerDown, netlink.OperNotPresent:
+		return false, nil
+	default:
+		return true, nil
+	}
+}
+
+// GetLinkMACAddress returns the MAC address currently programmed on the ENI link. Unlike
+// GetMACAddress, which returns the MAC address the ENI object was created or attached with, it
+// reflects changes made to the link since.
+func (eni *ENI) GetLinkMACAddress() (net.HardwareAddr, error) {
+	link, err := linkByName(eni.linkName)
+	if err != nil {
+		return nil, err
+	}
+
+	return link.Attrs().HardwareAddr, nil
+}
+
 // SetNetNS sets the network namespace of the ENI.
 func (eni *ENI) SetNetNS(ns netns.NetNS) error {
 	la := netlink.NewLinkAttrs()
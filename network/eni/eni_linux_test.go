@@ -0,0 +1,86 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package eni
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+// mockLinkByName replaces netlink link lookups with the given link until the returned function
+// is called.
+func mockLinkByName(link netlink.Link) func() {
+	saved := linkByName
+	linkByName = func(name string) (netlink.Link, error) {
+		if link == nil || link.Attrs().Name != name {
+			return nil, netlink.LinkNotFoundError{}
+		}
+		return link, nil
+	}
+	return func() { linkByName = saved }
+}
+
+func TestGetOpState(t *testing.T) {
+	branch := &ENI{linkName: "eth1.101"}
+
+	for _, tc := range []struct {
+		flags     net.Flags
+		operState netlink.LinkOperState
+		up        bool
+	}{
+		{net.FlagUp, netlink.OperUp, true},
+		{net.FlagUp, netlink.OperUnknown, true},
+		{net.FlagUp, netlink.OperLowerLayerDown, false},
+		{net.FlagUp, netlink.OperDown, false},
+		{0, netlink.OperDown, false},
+		{0, netlink.OperUnknown, false},
+	} {
+		restore := mockLinkByName(&netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{Name: "eth1.101", Flags: tc.flags, OperState: tc.operState},
+		})
+		up, err := branch.GetOpState()
+		restore()
+
+		require.NoError(t, err)
+		assert.Equal(t, tc.up, up, "flags %v oper state %v", tc.flags, tc.operState)
+	}
+
+	defer mockLinkByName(nil)()
+	_, err := branch.GetOpState()
+	assert.Error(t, err)
+}
+
+func TestGetLinkMACAddress(t *testing.T) {
+	configured, _ := net.ParseMAC("02:00:00:00:01:01")
+	programmed, _ := net.ParseMAC("02:00:00:00:01:02")
+	branch := &ENI{linkName: "eth1.101", macAddress: configured}
+
+	restore := mockLinkByName(&netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{Name: "eth1.101", HardwareAddr: programmed},
+	})
+	macAddress, err := branch.GetLinkMACAddress()
+	restore()
+
+	require.NoError(t, err)
+	assert.Equal(t, programmed, macAddress)
+	assert.Equal(t, configured, branch.GetMACAddress())
+
+	defer mockLinkByName(nil)()
+	_, err = branch.GetLinkMACAddress()
+	assert.Error(t, err)
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package eni
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ethtool commands to get and set the ring buffer sizes (ETHTOOL_GRINGPARAM, ETHTOOL_SRINGPARAM).
+	ethtoolGetRingParam = 0x10
+	ethtoolSetRingParam = 0x11
+)
+
+// RingParams represents the rx/tx ring buffer sizes of a link, as reported by ethtool.
+type RingParams struct {
+	RxMaxPending uint32
+	TxMaxPending uint32
+	RxPending    uint32
+	TxPending    uint32
+}
+
+// ethtoolRingParam is the ethtool_ringparam structure passed to the SIOCETHTOOL ioctl.
+type ethtoolRingParam struct {
+	Cmd               uint32
+	RxMaxPending      uint32
+	RxMiniMaxPending  uint32
+	RxJumboMaxPending uint32
+	TxMaxPending      uint32
+	RxPending         uint32
+	RxMiniPending     uint32
+	RxJumboPending    uint32
+	TxPending         uint32
+}
+
+// GetLinkRingParams returns the current and maximum rx/tx ring buffer sizes of the link with the
+// given name in the current netns.
+func GetLinkRingParams(linkName string) (*RingParams, error) {
+	ringParam, err := getLinkRingParam(linkName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RingParams{
+		RxMaxPending: ringParam.RxMaxPending,
+		TxMaxPending: ringParam.TxMaxPending,
+		RxPending:    ringParam.RxPending,
+		TxPending:    ringParam.TxPending,
+	}, nil
+}
+
+// SetLinkRingParams sets the rx/tx ring buffer sizes of the link with the given name in the
+// current netns. A size of zero leaves that ring unchanged. Sizes larger than the maximums
+// supported by the driver are rejected.
+func SetLinkRingParams(linkName string, rxPending uint32, txPending uint32) error {
+	ringParam, err := getLinkRingParam(linkName)
+	if err != nil {
+		return err
+	}
+
+	err = updateRingParam(ringParam, rxPending, txPending)
+	if err != nil {
+		return fmt.Errorf("invalid ring sizes for link %s: %v", linkName, err)
+	}
+
+	ringParam.Cmd = ethtoolSetRingParam
+	err = ethtoolIoctl(linkName, unsafe.Pointer(ringParam))
+	if err != nil {
+		return fmt.Errorf("failed to set ring sizes of link %s: %v", linkName, err)
+	}
+
+	return nil
+}
+
+// updateRingParam updates the given ethtool_ringparam structure with the given ring sizes, after
+// validating them against the driver maximums in it. A size of zero leaves that ring unchanged.
+func updateRingParam(ringParam *ethtoolRingParam, rxPending uint32, txPending uint32) error {
+	if rxPending > ringParam.RxMaxPending {
+		return fmt.Errorf("rx ring size %d exceeds the driver maximum %d", rxPending, ringParam.RxMaxPending)
+	}
+	if txPending > ringParam.TxMaxPending {
+		return fmt.Errorf("tx ring size %d exceeds the driver maximum %d", txPending, ringParam.TxMaxPending)
+	}
+
+	if rxPending != 0 {
+		ringParam.RxPending = rxPending
+	}
+	if txPending != 0 {
+		ringParam.TxPending = txPending
+	}
+
+	return nil
+}
+
+// getLinkRingParam returns the ethtool_ringparam structure of the link with the given name.
+func getLinkRingParam(linkName string) (*ethtoolRingParam, error) {
+	if len(linkName) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("invalid link name %s", linkName)
+	}
+
+	ringParam := &ethtoolRingParam{Cmd: ethtoolGetRingParam}
+	err := ethtoolIoctl(linkName, unsafe.Pointer(ringParam))
+	if err != nil {
+		if err == unix.EOPNOTSUPP {
+			return nil, fmt.Errorf("link %s does not support ring size configuration", linkName)
+		}
+		return nil, fmt.Errorf("failed to get ring sizes of link %s: %v", linkName, err)
+	}
+
+	return ringParam, nil
+}
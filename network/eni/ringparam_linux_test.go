@@ -0,0 +1,75 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package eni
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestUpdateRingParam(t *testing.T) {
+	ringParam := &ethtoolRingParam{
+		RxMaxPending: 8192,
+		TxMaxPending: 1024,
+		RxPending:    1024,
+		TxPending:    1024,
+	}
+
+	// Rings are resized up to the driver maximums.
+	require.NoError(t, updateRingParam(ringParam, 8192, 512))
+	assert.Equal(t, uint32(8192), ringParam.RxPending)
+	assert.Equal(t, uint32(512), ringParam.TxPending)
+
+	// Zero leaves a ring unchanged.
+	require.NoError(t, updateRingParam(ringParam, 0, 1024))
+	assert.Equal(t, uint32(8192), ringParam.RxPending)
+	assert.Equal(t, uint32(1024), ringParam.TxPending)
+
+	// Sizes beyond the driver maximums are rejected.
+	err := updateRingParam(ringParam, 16384, 0)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "rx ring size 16384 exceeds the driver maximum 8192")
+
+	err = updateRingParam(ringParam, 0, 2048)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tx ring size 2048 exceeds the driver maximum 1024")
+}
+
+func TestSetLinkRingParamsUnsupported(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-ring-params")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		// Links without rings, such as bridges, fail with a clear error.
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+		require.NoError(t, netlink.LinkAdd(bridge))
+		err = SetLinkRingParams("br0", 256, 256)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "link br0 does not support ring size configuration")
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
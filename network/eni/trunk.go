@@ -19,15 +19,24 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/aws/amazon-vpc-cni-plugins/network/vpc"
+
 	log "github.com/cihub/seelog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
+// isolationModeProbeLinkName is the name of the link used to probe kernel support for an
+// isolation mode.
+const isolationModeProbeLinkName = "eni-probe0"
+
 // IsolationMode represents the trunk's isolation mode.
 type IsolationMode uint
 
 const (
 	TrunkIsolationModeVLAN    IsolationMode = 1
 	TrunkIsolationModeGRE     IsolationMode = 2
+	TrunkIsolationModeMACVLAN IsolationMode = 3
 	TrunkIsolationModeDefault IsolationMode = TrunkIsolationModeVLAN
 )
 
@@ -38,10 +47,19 @@ type Trunk struct {
 	branches      []Branch
 }
 
+// BranchLink describes a branch link found in a netns. MACVLAN branch links are isolated by
+// their MAC address and have no VLAN ID.
+type BranchLink struct {
+	LinkName      string
+	VlanID        int
+	TrunkIndex    int
+	IsolationMode IsolationMode
+}
+
 // NewTrunk creates a new Trunk object. One of linkName or macAddress must be specified.
 func NewTrunk(linkName string, macAddress net.HardwareAddr, isolationMode IsolationMode) (*Trunk, error) {
 	// Trunk ENI specific validations.
-	if isolationMode != TrunkIsolationModeVLAN {
+	if isolationMode != TrunkIsolationModeVLAN && isolationMode != TrunkIsolationModeMACVLAN {
 		log.Errorf("Invalid isolation mode: %v", isolationMode)
 		return nil, fmt.Errorf("invalid isolation mode")
 	}
@@ -64,3 +82,175 @@ func NewTrunk(linkName string, macAddress net.HardwareAddr, isolationMode Isolat
 
 	return trunk, nil
 }
+
+// NewTrunkByMAC creates a new Trunk object for the link with the given permanent MAC address.
+// Link names are not stable across reboots, while the permanent MAC address of an ENI is.
+func NewTrunkByMAC(macAddress net.HardwareAddr, isolationMode IsolationMode) (*Trunk, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	link := getLinkByPermanentMACAddress(macAddress, links, GetLinkPermanentMACAddress)
+	if link == nil {
+		log.Errorf("Failed to find a trunk interface with MAC address %s.", macAddress)
+		return nil, fmt.Errorf("no interface with MAC address %s", macAddress)
+	}
+
+	return NewTrunk(link.Attrs().Name, nil, isolationMode)
+}
+
+// getLinkByPermanentMACAddress returns the link with the given permanent MAC address, or nil if
+// there is none. Links without a permanent MAC address, which includes virtual links, are matched
+// on their current MAC address only if no link matches on its permanent one. If there are multiple
+// matches, the one with the shortest name is picked.
+func getLinkByPermanentMACAddress(
+	macAddress net.HardwareAddr,
+	links []netlink.Link,
+	getPermanentMACAddress func(string) (net.HardwareAddr, error)) netlink.Link {
+
+	var permMatch, currentMatch netlink.Link
+	pick := func(chosen, link netlink.Link) netlink.Link {
+		if chosen == nil || len(chosen.Attrs().Name) > len(link.Attrs().Name) {
+			return link
+		}
+		return chosen
+	}
+
+	for _, link := range links {
+		permAddr, err := getPermanentMACAddress(link.Attrs().Name)
+		if err == nil && permAddr != nil {
+			if vpc.CompareMACAddress(permAddr, macAddress) {
+				permMatch = pick(permMatch, link)
+			}
+		} else if vpc.CompareMACAddress(link.Attrs().HardwareAddr, macAddress) {
+			currentMatch = pick(currentMatch, link)
+		}
+	}
+
+	if permMatch != nil {
+		return permMatch
+	}
+	return currentMatch
+}
+
+// String returns the name of the isolation mode.
+func (mode IsolationMode) String() string {
+	switch mode {
+	case TrunkIsolationModeVLAN:
+		return "VLAN"
+	case TrunkIsolationModeGRE:
+		return "GRE"
+	case TrunkIsolationModeMACVLAN:
+		return "MACVLAN"
+	default:
+		return fmt.Sprintf("IsolationMode(%d)", uint(mode))
+	}
+}
+
+// CheckKernelIsolationModeSupport returns an error if the running kernel does not support
+// creating branch links in the given isolation mode.
+func CheckKernelIsolationModeSupport(isolationMode IsolationMode) error {
+	var kind string
+	var probe netlink.Link
+
+	switch isolationMode {
+	case TrunkIsolationModeVLAN:
+		kind = "vlan"
+		probe = &netlink.Vlan{VlanId: 1}
+	case TrunkIsolationModeMACVLAN:
+		kind = "macvlan"
+		probe = &netlink.Macvlan{Mode: netlink.MACVLAN_MODE_PRIVATE}
+	default:
+		return fmt.Errorf("unsupported isolation mode %v", isolationMode)
+	}
+
+	// Probe by creating a branch link on top of the loopback link. A kernel that supports the
+	// link kind rejects the loopback parent with EINVAL, while a kernel that does not rejects
+	// the link kind itself with EOPNOTSUPP. Either way, no link is created.
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return err
+	}
+	probe.Attrs().Name = isolationModeProbeLinkName
+	probe.Attrs().ParentIndex = lo.Attrs().Index
+
+	err = netlink.LinkAdd(probe)
+	switch err {
+	case unix.EINVAL:
+		return nil
+	case nil:
+		netlink.LinkDel(probe)
+		return nil
+	case unix.EOPNOTSUPP:
+		return fmt.Errorf("%s isolation mode is not supported by the running kernel: "+
+			"%s links are not available", isolationMode, kind)
+	default:
+		return fmt.Errorf("failed to probe kernel support for %s isolation mode: %v", isolationMode, err)
+	}
+}
+
+// CheckIsolationMode returns an error if the trunk link does not support its isolation mode.
+func (trunk *Trunk) CheckIsolationMode() error {
+	link, err := netlink.LinkByIndex(trunk.linkIndex)
+	if err != nil {
+		return err
+	}
+
+	return checkIsolationModeSupport(link, trunk.isolationMode)
+}
+
+// checkIsolationModeSupport returns an error if the given trunk link does not support the given
+// isolation mode.
+func checkIsolationModeSupport(link netlink.Link, isolationMode IsolationMode) error {
+	attrs := link.Attrs()
+
+	switch isolationMode {
+	case TrunkIsolationModeVLAN, TrunkIsolationModeMACVLAN:
+		// VLAN and MACVLAN links can only be created on top of Ethernet links other than loopback.
+		if attrs.EncapType != "ether" || attrs.Flags&net.FlagLoopback != 0 {
+			return fmt.Errorf("trunk link %s with type %s and encapsulation %s "+
+				"does not support %s isolation mode", attrs.Name, link.Type(), attrs.EncapType, isolationMode)
+		}
+	default:
+		return fmt.Errorf("unsupported isolation mode %v", isolationMode)
+	}
+
+	return nil
+}
+
+// ListBranchLinks lists the VLAN and MACVLAN branch links in the current netns. The trunk index of each branch
+// is the interface index of its parent link, which can be in a different netns.
+func ListBranchLinks() ([]BranchLink, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	return GetBranchLinks(links), nil
+}
+
+// GetBranchLinks returns the VLAN and MACVLAN branch links in the given list of links.
+func GetBranchLinks(links []netlink.Link) []BranchLink {
+	var branches []BranchLink
+
+	for _, link := range links {
+		switch l := link.(type) {
+		case *netlink.Vlan:
+			branches = append(branches, BranchLink{
+				LinkName:      l.Name,
+				VlanID:        l.VlanId,
+				TrunkIndex:    l.ParentIndex,
+				IsolationMode: TrunkIsolationModeVLAN,
+			})
+		case *netlink.Macvlan:
+			branches = append(branches, BranchLink{
+				LinkName:      l.Name,
+				TrunkIndex:    l.ParentIndex,
+				IsolationMode: TrunkIsolationModeMACVLAN,
+			})
+		}
+	}
+
+	return branches
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// +build linux
+
+package eni
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestGetBranchLinks(t *testing.T) {
+	links := []netlink.Link{
+		&netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: 2, Name: "eth1"}},
+		&netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Index: 3, Name: "eth1.101", ParentIndex: 2}, VlanId: 101},
+		&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Index: 4, Name: "virbr0"}},
+		&netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Index: 5, Name: "eth1.102", ParentIndex: 2}, VlanId: 102},
+		&netlink.Macvlan{LinkAttrs: netlink.LinkAttrs{Index: 6, Name: "eth1.103", ParentIndex: 2}},
+	}
+
+	branches := GetBranchLinks(links)
+	assert.Equal(t, []BranchLink{
+		{LinkName: "eth1.101", VlanID: 101, TrunkIndex: 2, IsolationMode: TrunkIsolationModeVLAN},
+		{LinkName: "eth1.102", VlanID: 102, TrunkIndex: 2, IsolationMode: TrunkIsolationModeVLAN},
+		{LinkName: "eth1.103", TrunkIndex: 2, IsolationMode: TrunkIsolationModeMACVLAN},
+	}, branches)
+}
+
+func TestGetLinkByPermanentMACAddress(t *testing.T) {
+	mac := func(s string) net.HardwareAddr {
+		macAddress, _ := net.ParseMAC(s)
+		return macAddress
+	}
+
+	links := []netlink.Link{
+		&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "lo"}},
+		&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", HardwareAddr: mac("02:00:00:00:00:01")}},
+		// eth1's current MAC address was changed, but its permanent one is still the ENI's.
+		&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", HardwareAddr: mac("02:00:00:00:00:99")}},
+		// VLAN links inherit the current MAC address of their parent.
+		&netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "eth0.1", HardwareAddr: mac("02:00:00:00:00:01")}},
+		&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "virbr0", HardwareAddr: mac("02:00:00:00:00:03")}},
+	}
+	permAddrs := map[string]net.HardwareAddr{
+		"eth0": mac("02:00:00:00:00:01"),
+		"eth1": mac("02:00:00:00:00:02"),
+	}
+	getPermanentMACAddress := func(linkName string) (net.HardwareAddr, error) {
+		if linkName == "lo" {
+			return nil, unix.EOPNOTSUPP
+		}
+		return permAddrs[linkName], nil
+	}
+
+	link := getLinkByPermanentMACAddress(mac("02:00:00:00:00:01"), links, getPermanentMACAddress)
+	require.NotNil(t, link)
+	assert.Equal(t, "eth0", link.Attrs().Name)
+
+	link = getLinkByPermanentMACAddress(mac("02:00:00:00:00:02"), links, getPermanentMACAddress)
+	require.NotNil(t, link)
+	assert.Equal(t, "eth1", link.Attrs().Name)
+
+	// The current MAC address of a link with a permanent one is not matched.
+	link = getLinkByPermanentMACAddress(mac("02:00:00:00:00:99"), links, getPermanentMACAddress)
+	assert.Nil(t, link)
+
+	// Links without a permanent MAC address are matched on their current one.
+	link = getLinkByPermanentMACAddress(mac("02:00:00:00:00:03"), links, getPermanentMACAddress)
+	require.NotNil(t, link)
+	assert.Equal(t, "virbr0", link.Attrs().Name)
+
+	assert.Nil(t, getLinkByPermanentMACAddress(mac("02:00:00:00:00:04"), links, getPermanentMACAddress))
+}
+
+func TestNewTrunkByMACNoMatch(t *testing.T) {
+	_, err := NewTrunkByMAC(net.HardwareAddr{0x02, 0, 0, 0, 0xff, 0xfe}, TrunkIsolationModeVLAN)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no interface with MAC address 02:00:00:00:ff:fe")
+}
+
+func TestCheckIsolationModeSupport(t *testing.T) {
+	ethernet := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth1", EncapType: "ether"}}
+	assert.NoError(t, checkIsolationModeSupport(ethernet, TrunkIsolationModeVLAN))
+	assert.NoError(t, checkIsolationModeSupport(ethernet, TrunkIsolationModeMACVLAN))
+
+	loopback := &netlink.Device{
+		LinkAttrs: netlink.LinkAttrs{Name: "lo", EncapType: "loopback", Flags: net.FlagLoopback},
+	}
+	assert.Error(t, checkIsolationModeSupport(loopback, TrunkIsolationModeVLAN))
+	assert.Error(t, checkIsolationModeSupport(loopback, TrunkIsolationModeMACVLAN))
+
+	tunnel := &netlink.Iptun{LinkAttrs: netlink.LinkAttrs{Name: "tunl0", EncapType: "ipip"}}
+	assert.Error(t, checkIsolationModeSupport(tunnel, TrunkIsolationModeVLAN))
+
+	assert.Error(t, checkIsolationModeSupport(ethernet, TrunkIsolationModeGRE))
+}
+
+func TestMACVLANBranch(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-macvlan-branch")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		require.NoError(t, CheckKernelIsolationModeSupport(TrunkIsolationModeMACVLAN))
+		_, err := netlink.LinkByName(isolationModeProbeLinkName)
+		assert.Error(t, err, "probe link left behind")
+
+		trunkLink := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "trunk0"}}
+		require.NoError(t, netlink.LinkAdd(trunkLink))
+
+		trunk, err := NewTrunk("trunk0", nil, TrunkIsolationModeMACVLAN)
+		require.NoError(t, err)
+
+		// MACVLAN branches require a MAC address.
+		branch, err := NewBranch(trunk, "trunk0.101", nil, 101)
+		require.NoError(t, err)
+		assert.Error(t, branch.AttachToLink(true))
+
+		macAddress, _ := net.ParseMAC("02:00:00:00:01:01")
+		branch, err = NewBranch(trunk, "trunk0.101", macAddress, 101)
+		require.NoError(t, err)
+		require.NoError(t, branch.AttachToLink(true))
+
+		link, err := netlink.LinkByName("trunk0.101")
+		require.NoError(t, err)
+		assert.Equal(t, "macvlan", link.Type())
+		assert.Equal(t, macAddress, link.Attrs().HardwareAddr)
+
+		branches, err := ListBranchLinks()
+		require.NoError(t, err)
+		assert.Equal(t, []BranchLink{{
+			LinkName:      "trunk0.101",
+			TrunkIndex:    trunkLink.Index,
+			IsolationMode: TrunkIsolationModeMACVLAN,
+		}}, branches)
+
+		require.NoError(t, branch.DetachFromLink())
+		_, err = netlink.LinkByName("trunk0.101")
+		assert.Error(t, err)
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
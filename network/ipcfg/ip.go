@@ -24,9 +24,13 @@ const (
 	ipv4Forwarding = "/proc/sys/net/ipv4/conf/%s/forwarding"
 	ipv4ProxyARP   = "/proc/sys/net/ipv4/conf/%s/proxy_arp"
 
-	ipv6Forwarding = "/proc/sys/net/ipv6/conf/%s/forwarding"
-	ipv6AcceptRA   = "/proc/sys/net/ipv6/conf/%s/accept_ra"
-	ipv6AcceptDAD  = "/proc/sys/net/ipv6/conf/%s/accept_dad"
+	ipv6Forwarding  = "/proc/sys/net/ipv6/conf/%s/forwarding"
+	ipv6AcceptRA    = "/proc/sys/net/ipv6/conf/%s/accept_ra"
+	ipv6AcceptDAD   = "/proc/sys/net/ipv6/conf/%s/accept_dad"
+	ipv6UseTempAddr = "/proc/sys/net/ipv6/conf/%s/use_tempaddr"
+
+	ipv4NeighBaseReachableTimeMs = "/proc/sys/net/ipv4/neigh/%s/base_reachable_time_ms"
+	ipv4NeighGCStaleTime         = "/proc/sys/net/ipv4/neigh/%s/gc_stale_time"
 )
 
 // SetIPv4Forwarding sets the IPv4 forwarding property of an interface to the given value.
@@ -54,6 +58,23 @@ func SetIPv6AcceptDAD(ifName string, value int) error {
 	return set(fmt.Sprintf(ipv6AcceptDAD, ifName), value)
 }
 
+// SetIPv6UseTempAddr sets the IPv6 privacy extensions property of an interface to the given value.
+func SetIPv6UseTempAddr(ifName string, value int) error {
+	return set(fmt.Sprintf(ipv6UseTempAddr, ifName), value)
+}
+
+// SetIPv4NeighBaseReachableTimeMs sets the IPv4 neighbor base reachable time of an interface
+// to the given value in milliseconds.
+func SetIPv4NeighBaseReachableTimeMs(ifName string, value int) error {
+	return set(fmt.Sprintf(ipv4NeighBaseReachableTimeMs, ifName), value)
+}
+
+// SetIPv4NeighGCStaleTime sets the IPv4 neighbor garbage collection stale time of an interface
+// to the given value in seconds.
+func SetIPv4NeighGCStaleTime(ifName string, value int) error {
+	return set(fmt.Sprintf(ipv4NeighGCStaleTime, ifName), value)
+}
+
 // Set sets a system variable to the given value.
 func set(name string, value int) error {
 	valueStr := strconv.Itoa(value)
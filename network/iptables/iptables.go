@@ -18,16 +18,33 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Protocol is the IP protocol family an iptables session applies to.
+type Protocol int
+
 const (
-	// Name of the iptables restore command.
-	restoreCmd = "iptables-restore"
+	ProtocolIPv4 Protocol = iota
+	ProtocolIPv6
+)
+
+const (
+	// Names of the iptables restore commands for each protocol.
+	restoreCmd     = "iptables-restore"
+	restoreCmdIPv6 = "ip6tables-restore"
+
+	// Names of the iptables save commands for each protocol.
+	saveCmd     = "iptables-save"
+	saveCmdIPv6 = "ip6tables-save"
 
 	// Well-known iptables table names.
 	filter = "filter"
 	nat    = "nat"
 	mangle = "mangle"
+	raw    = "raw"
 
 	// Built-in iptables chain names.
 	prerouting  = "PREROUTING"
@@ -38,6 +55,21 @@ const (
 
 	// Default chain policy.
 	defaultPolicy = "ACCEPT"
+
+	// Prefixes of serialized rules that append to and delete from a chain.
+	appendRulePrefix = "-A "
+	deleteRulePrefix = "-D "
+
+	// Restore command flag to keep the existing rules in a table.
+	noflushFlag = "--noflush"
+
+	// Restore command flag to wait for the xtables lock held by another process, and the
+	// default time to wait.
+	waitFlag           = "-w"
+	defaultWaitTimeout = 5 * time.Second
+
+	// Maximum length of a rule comment accepted by the iptables comment match.
+	maxCommentLength = 256
 )
 
 const (
@@ -49,11 +81,19 @@ const (
 )
 
 // Session represents an iptables session.
+//
+// The tables are serialized, and applied by Commit, in the order filter, nat, mangle and raw.
+// This order does not affect packet processing: the kernel always traverses the raw table first,
+// before connection tracking and the other tables, so NOTRACK and CT rules in Raw apply to
+// packets before any rule in the other tables sees them.
 type Session struct {
 	restorePath string
+	waitTimeout time.Duration
+	comment     string
 	Filter      *Table
 	Nat         *Table
 	Mangle      *Table
+	Raw         *Table
 }
 
 // Table represents an iptables table.
@@ -80,15 +120,85 @@ type Rule struct {
 	args []string
 }
 
-// NewSession creates a new Session object.
+// getRestoreCmd returns the name of the restore command for the given protocol.
+func getRestoreCmd(proto Protocol) (string, error) {
+	switch proto {
+	case ProtocolIPv4:
+		return restoreCmd, nil
+	case ProtocolIPv6:
+		return restoreCmdIPv6, nil
+	default:
+		return "", fmt.Errorf("invalid protocol %d", proto)
+	}
+}
+
+// Save returns the rules in all tables for the given protocol in the current netns, in the
+// format of the save command.
+func Save(proto Protocol) (string, error) {
+	var name string
+	switch proto {
+	case ProtocolIPv4:
+		name = saveCmd
+	case ProtocolIPv6:
+		name = saveCmdIPv6
+	default:
+		return "", fmt.Errorf("invalid protocol %d", proto)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s failed: %v %s", name, err, stderr.String())
+	}
+
+	return stdout.String(), nil
+}
+
+// CheckAvailable returns an error if the iptables restore command is not available on this host.
+func CheckAvailable() error {
+	return CheckAvailableForProtocol(ProtocolIPv4)
+}
+
+// CheckAvailableForProtocol returns an error if the restore command for the given protocol is
+// not available on this host.
+func CheckAvailableForProtocol(proto Protocol) error {
+	cmd, err := getRestoreCmd(proto)
+	if err != nil {
+		return err
+	}
+
+	_, err = exec.LookPath(cmd)
+	if err != nil {
+		return fmt.Errorf("iptables backend is not available, %s not found: %v", cmd, err)
+	}
+
+	return nil
+}
+
+// NewSession creates a new IPv4 Session object.
 func NewSession() (*Session, error) {
-	restorePath, err := exec.LookPath(restoreCmd)
+	return NewSessionForProtocol(ProtocolIPv4)
+}
+
+// NewSessionForProtocol creates a new Session object for the given protocol. IPv6 sessions are
+// committed with ip6tables-restore.
+func NewSessionForProtocol(proto Protocol) (*Session, error) {
+	cmd, err := getRestoreCmd(proto)
+	if err != nil {
+		return nil, err
+	}
+
+	restorePath, err := exec.LookPath(cmd)
 	if err != nil {
 		return nil, err
 	}
 
 	session := &Session{
 		restorePath: restorePath,
+		waitTimeout: defaultWaitTimeout,
 		Filter: &Table{
 			name: filter,
 		},
@@ -98,6 +208,9 @@ func NewSession() (*Session, error) {
 		Mangle: &Table{
 			name: mangle,
 		},
+		Raw: &Table{
+			name: raw,
+		},
 	}
 
 	session.Filter.Input, _ = NewChain(input)
@@ -127,6 +240,11 @@ func NewSession() (*Session, error) {
 	session.Mangle.Chains[idxOutput] = session.Mangle.Output
 	session.Mangle.Chains[idxPostrouting] = session.Mangle.Postrouting
 
+	session.Raw.Prerouting, _ = NewChain(prerouting)
+	session.Raw.Output, _ = NewChain(output)
+	session.Raw.Chains[idxPrerouting] = session.Raw.Prerouting
+	session.Raw.Chains[idxOutput] = session.Raw.Output
+
 	return session, nil
 }
 
@@ -134,7 +252,7 @@ func NewSession() (*Session, error) {
 func (s *Session) Serialize() string {
 	var str string
 
-	for _, tv := range []*Table{s.Filter, s.Nat, s.Mangle} {
+	for _, tv := range []*Table{s.Filter, s.Nat, s.Mangle, s.Raw} {
 		str += fmt.Sprintf("*%s\n", tv.name)
 		for _, cv := range tv.Chains {
 			if cv != nil {
@@ -145,7 +263,7 @@ func (s *Session) Serialize() string {
 			if cv != nil {
 				if cv.rules != nil {
 					for _, rv := range cv.rules {
-						str += rv + "\n"
+						str += s.renderRule(appendRulePrefix, cv, rv) + "\n"
 					}
 				}
 			}
@@ -156,15 +274,84 @@ func (s *Session) Serialize() string {
 	return str
 }
 
-// Commit loads all rules in this session atomically to iptables.
+// serializeDelete converts the session rules to a string in iptables-restore format that
+// deletes each of them. Chain policies are left unchanged.
+func (s *Session) serializeDelete() string {
+	var str string
+
+	for _, tv := range []*Table{s.Filter, s.Nat, s.Mangle, s.Raw} {
+		str += fmt.Sprintf("*%s\n", tv.name)
+		for _, cv := range tv.Chains {
+			if cv != nil {
+				for _, rv := range cv.rules {
+					str += s.renderRule(deleteRulePrefix, cv, rv) + "\n"
+				}
+			}
+		}
+		str += fmt.Sprintf("COMMIT\n")
+	}
+
+	return str
+}
+
+// SetWaitTimeout sets how long the restore command waits for the xtables lock when another
+// process holds it. The timeout is rounded up to whole seconds. A zero timeout disables waiting,
+// so that the restore command fails immediately if the lock is held.
+func (s *Session) SetWaitTimeout(d time.Duration) {
+	s.waitTimeout = d
+}
+
+// renderRule renders a rule in the given chain with the given operation prefix, tagged with the
+// session comment if there is one.
+func (s *Session) renderRule(prefix string, chain *Chain, rule string) string {
+	rule = strings.TrimPrefix(rule, fmt.Sprintf("%s%s ", appendRulePrefix, chain.name))
+	if s.comment != "" {
+		rule = fmt.Sprintf("-m comment --comment \"%s\" %s", s.comment, rule)
+	}
+
+	return fmt.Sprintf("%s%s %s", prefix, chain.name, rule)
+}
+
+// SetComment sets a comment that tags every rule in this session, so that the rules can be
+// attributed to their owner in the "iptables -L" output. An empty comment disables tagging.
+func (s *Session) SetComment(comment string) error {
+	if len(comment) >= maxCommentLength || strings.ContainsAny(comment, "\"\\\n") {
+		return fmt.Errorf("invalid rule comment %s", comment)
+	}
+
+	s.comment = comment
+	return nil
+}
+
+// Commit loads all rules in this session atomically to iptables. The whole session is applied
+// with a single exec of the restore command, regardless of the number of rules, and each table
+// is replaced as a unit, so an interrupted Commit never leaves a partial table behind.
 func (s *Session) Commit(stdout io.Writer) error {
+	return s.restore(s.Serialize(), nil, stdout)
+}
+
+// Delete removes all rules in this session atomically from iptables, leaving any other rules
+// in place. It undoes a prior Commit of a session built with the same rules.
+func (s *Session) Delete(stdout io.Writer) error {
+	return s.restore(s.serializeDelete(), []string{noflushFlag}, stdout)
+}
+
+// restore runs the restore command with the given flags and input.
+func (s *Session) restore(input string, flags []string, stdout io.Writer) error {
 	var stderr bytes.Buffer
 
+	args := []string{s.restorePath}
+	if s.waitTimeout > 0 {
+		seconds := int((s.waitTimeout + time.Second - 1) / time.Second)
+		args = append(args, waitFlag, strconv.Itoa(seconds))
+	}
+	args = append(args, flags...)
+
 	// Pass the serialized session state via stdin.
 	cmd := exec.Cmd{
 		Path:   s.restorePath,
-		Args:   nil,
-		Stdin:  bytes.NewBufferString(s.Serialize()),
+		Args:   args,
+		Stdin:  bytes.NewBufferString(input),
 		Stdout: stdout,
 		Stderr: &stderr,
 	}
@@ -204,3 +391,24 @@ func (chain *Chain) Appendf(rule string, args ...interface{}) {
 	rule = fmt.Sprintf("-A %s %s", chain.name, rule)
 	chain.rules = append(chain.rules, rule)
 }
+
+// AppendUnique appends a rule to the chain unless the session already appended it to the chain.
+// Rules in the kernel are not checked, as Commit flushes the table before restoring it. It
+// returns whether the rule was appended.
+func (chain *Chain) AppendUnique(rule string) bool {
+	rule = fmt.Sprintf("-A %s %s", chain.name, rule)
+	for _, r := range chain.rules {
+		if r == rule {
+			return false
+		}
+	}
+
+	chain.rules = append(chain.rules, rule)
+	return true
+}
+
+// AppendUniquef appends a rule with variadic arguments to the chain unless the chain already
+// contains it. It returns whether the rule was appended.
+func (chain *Chain) AppendUniquef(rule string, args ...interface{}) bool {
+	return chain.AppendUnique(fmt.Sprintf(rule, args...))
+}
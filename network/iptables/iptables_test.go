@@ -15,9 +15,346 @@ package iptables
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
+func TestCheckAvailableMissingBackend(t *testing.T) {
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", "")
+
+	if err := CheckAvailable(); err == nil {
+		t.Error("expected error when iptables-restore is not in PATH")
+	}
+}
+
+func TestNewSessionForProtocol(t *testing.T) {
+	// Install fake restore commands that record their name and input.
+	dir, err := ioutil.TempDir("", "iptables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, cmd := range []string{restoreCmd, restoreCmdIPv6} {
+		script := fmt.Sprintf("#!/bin/sh\necho %s > %s/invoked\ncat >> %s/invoked\n", cmd, dir, dir)
+		err = ioutil.WriteFile(filepath.Join(dir, cmd), []byte(script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+
+	testCases := []struct {
+		name     string
+		session  func() (*Session, error)
+		expected string
+	}{
+		{"default", NewSession, restoreCmd},
+		{"ipv4", func() (*Session, error) { return NewSessionForProtocol(ProtocolIPv4) }, restoreCmd},
+		{"ipv6", func() (*Session, error) { return NewSessionForProtocol(ProtocolIPv6) }, restoreCmdIPv6},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := tc.session()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Filter.Forward.Appendf("-i %s -j ACCEPT", "virbr0")
+			s.Nat.Postrouting.Appendf("-o %s -j MASQUERADE", "eth1.101")
+
+			err = s.Commit(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			invoked, err := ioutil.ReadFile(filepath.Join(dir, "invoked"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.SplitN(string(invoked), "\n", 2)
+			if lines[0] != tc.expected {
+				t.Errorf("expected %s to be invoked, got %s", tc.expected, lines[0])
+			}
+			if lines[1] != s.Serialize() {
+				t.Errorf("unexpected restore input %s", lines[1])
+			}
+		})
+	}
+
+	if _, err := NewSessionForProtocol(Protocol(2)); err == nil {
+		t.Error("expected error for invalid protocol")
+	}
+}
+
+func TestSave(t *testing.T) {
+	// Install fake save commands that print their name.
+	dir, err := ioutil.TempDir("", "iptables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, cmd := range []string{saveCmd, saveCmdIPv6} {
+		script := fmt.Sprintf("#!/bin/sh\necho '# Generated by %s'\n", cmd)
+		err = ioutil.WriteFile(filepath.Join(dir, cmd), []byte(script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+
+	for proto, cmd := range map[Protocol]string{ProtocolIPv4: saveCmd, ProtocolIPv6: saveCmdIPv6} {
+		output, err := Save(proto)
+		if err != nil {
+			t.Fatalf("Save(%d) failed: %v", proto, err)
+		}
+		if output != fmt.Sprintf("# Generated by %s\n", cmd) {
+			t.Errorf("Save(%d) returned %q", proto, output)
+		}
+	}
+
+	if _, err := Save(Protocol(2)); err == nil {
+		t.Error("expected error for an invalid protocol")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	// Install a fake restore command that records its arguments and input.
+	dir, err := ioutil.TempDir("", "iptables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s/invoked\ncat >> %s/invoked\n", dir, dir)
+	err = ioutil.WriteFile(filepath.Join(dir, restoreCmd), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+
+	s, err := NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Filter.Forward.Appendf("-i %s -j ACCEPT", "virbr0")
+	s.Nat.Postrouting.Appendf("-o %s -j MASQUERADE", "eth1.101")
+
+	err = s.Delete(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invoked, err := ioutil.ReadFile(filepath.Join(dir, "invoked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `-w 5 --noflush
+*filter
+-D FORWARD -i virbr0 -j ACCEPT
+COMMIT
+*nat
+-D POSTROUTING -o eth1.101 -j MASQUERADE
+COMMIT
+*mangle
+COMMIT
+*raw
+COMMIT
+`
+	if string(invoked) != expected {
+		t.Errorf("unexpected restore invocation %s", invoked)
+	}
+}
+
+func TestSetWaitTimeout(t *testing.T) {
+	// Install a fake restore command that simulates the xtables lock being held by another
+	// process: it records its arguments, and fails unless asked to wait for the lock.
+	dir, err := ioutil.TempDir("", "iptables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s/invoked\n"+
+		"[ \"$1\" = -w ] || { echo \"Another app is currently holding the xtables lock.\" >&2; exit 4; }\n",
+		dir)
+	err = ioutil.WriteFile(filepath.Join(dir, restoreCmd), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+
+	testCases := []struct {
+		name     string
+		timeout  *time.Duration
+		expected string
+		fails    bool
+	}{
+		{"default", nil, "-w 5", false},
+		{"rounded up", durationPtr(1500 * time.Millisecond), "-w 2", false},
+		{"no wait", durationPtr(0), "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.timeout != nil {
+				s.SetWaitTimeout(*tc.timeout)
+			}
+
+			err = s.Commit(nil)
+			if tc.fails && (err == nil || !strings.Contains(err.Error(), "xtables lock")) {
+				t.Errorf("expected xtables lock error, got %v", err)
+			}
+			if !tc.fails && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+
+			invoked, err := ioutil.ReadFile(filepath.Join(dir, "invoked"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(string(invoked)) != tc.expected {
+				t.Errorf("expected restore arguments %q, got %q", tc.expected, invoked)
+			}
+		})
+	}
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
+func TestSetComment(t *testing.T) {
+	s := &Session{
+		Filter: &Table{name: filter},
+		Nat:    &Table{name: nat},
+		Mangle: &Table{name: mangle},
+		Raw:    &Table{name: raw},
+	}
+	s.Filter.Forward, _ = NewChain(forward)
+	s.Filter.Chains[idxForward] = s.Filter.Forward
+	s.Filter.Forward.Appendf("-i %s -j ACCEPT", "virbr0")
+
+	if err := s.SetComment("vlan 101 branch eth1.101"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "-A FORWARD -m comment --comment \"vlan 101 branch eth1.101\" -i virbr0 -j ACCEPT\n"
+	if !strings.Contains(s.Serialize(), expected) {
+		t.Errorf("expected commented rule %s, got %s", expected, s.Serialize())
+	}
+	expected = "-D FORWARD -m comment --comment \"vlan 101 branch eth1.101\" -i virbr0 -j ACCEPT\n"
+	if !strings.Contains(s.serializeDelete(), expected) {
+		t.Errorf("expected commented rule %s, got %s", expected, s.serializeDelete())
+	}
+
+	for _, comment := range []string{"a \"quoted\" comment", "a\nnewline", strings.Repeat("a", 256)} {
+		if err := s.SetComment(comment); err == nil {
+			t.Errorf("expected error for invalid comment %q", comment)
+		}
+	}
+
+	if err := s.SetComment(""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s.Serialize(), "-A FORWARD -i virbr0 -j ACCEPT\n") {
+		t.Errorf("expected uncommented rule, got %s", s.Serialize())
+	}
+}
+
+func TestRawTable(t *testing.T) {
+	// Install a fake restore command that records its input.
+	dir, err := ioutil.TempDir("", "iptables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	script := fmt.Sprintf("#!/bin/sh\ncat > %s/invoked\n", dir)
+	err = ioutil.WriteFile(filepath.Join(dir, restoreCmd), []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+
+	s, err := NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Raw.Prerouting.Appendf("-i %s -p udp -m udp --dport 67 -j NOTRACK", "virbr0")
+	s.Raw.Output.Append("-d 224.0.0.0/4 -j NOTRACK")
+
+	err = s.Commit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invoked, err := ioutil.ReadFile(filepath.Join(dir, "invoked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `*raw
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+-A PREROUTING -i virbr0 -p udp -m udp --dport 67 -j NOTRACK
+-A OUTPUT -d 224.0.0.0/4 -j NOTRACK
+COMMIT
+`
+	if !strings.HasSuffix(string(invoked), expected) {
+		t.Errorf("expected raw table %s, got %s", expected, invoked)
+	}
+}
+
+func TestAppendUnique(t *testing.T) {
+	chain, _ := NewChain(forward)
+
+	if !chain.AppendUnique("-i virbr0 -o virbr0 -j ACCEPT") {
+		t.Error("expected first rule to be appended")
+	}
+	if chain.AppendUniquef("-i %s -o %s -j ACCEPT", "virbr0", "virbr0") {
+		t.Error("expected duplicate rule not to be appended")
+	}
+	if !chain.AppendUniquef("-i %s -j REJECT", "virbr0") {
+		t.Error("expected different rule to be appended")
+	}
+
+	expected := []string{
+		"-A FORWARD -i virbr0 -o virbr0 -j ACCEPT",
+		"-A FORWARD -i virbr0 -j REJECT",
+	}
+	if fmt.Sprint(chain.rules) != fmt.Sprint(expected) {
+		t.Errorf("expected rules %v, got %v", expected, chain.rules)
+	}
+}
+
 func TestAppend(t *testing.T) {
 	s, err := NewSession()
 	if err != nil {
@@ -78,6 +415,10 @@ COMMIT
 :POSTROUTING ACCEPT [0:0]
 -A POSTROUTING -o virbr0 -p udp -m udp --dport 68 -j CHECKSUM --checksum-fill
 COMMIT
+*raw
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+COMMIT
 `
 	result := s.Serialize()
 	if result != expected {
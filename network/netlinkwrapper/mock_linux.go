@@ -0,0 +1,426 @@
+// Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package netlinkwrapper
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// MockNetLink implements NetLink in memory, for tests. It keeps the links, addresses, routes and
+// neighbor entries added to it, and records the calls made to it as the method name followed by the link name,
+// e.g. "LinkAdd virbr0". A call fails with the error in Errors for its recorded name, or else for
+// its method name.
+type MockNetLink struct {
+	Errors map[string]error
+	Calls  []string
+	Routes []*netlink.Route
+	Neighs []netlink.Neigh
+
+	links     []netlink.Link
+	addrs     map[string][]netlink.Addr
+	lastIndex int
+}
+
+// NewMockNetLink creates a new MockNetLink object with the given existing links.
+func NewMockNetLink(links ...netlink.Link) *MockNetLink {
+	m := &MockNetLink{
+		Errors: make(map[string]error),
+		addrs:  make(map[string][]netlink.Addr),
+	}
+
+	for _, link := range links {
+		m.add(link)
+	}
+
+	return m
+}
+
+// call records a call and returns the error configured for it.
+func (m *MockNetLink) call(method string, linkName string) error {
+	name := method
+	if linkName != "" {
+		name += " " + linkName
+	}
+	m.Calls = append(m.Calls, name)
+
+	if err, ok := m.Errors[name]; ok {
+		return err
+	}
+	return m.Errors[method]
+}
+
+// add adds a link and assigns it an index.
+func (m *MockNetLink) add(link netlink.Link) {
+	m.lastIndex++
+	link.Attrs().Index = m.lastIndex
+	m.links = append(m.links, link)
+}
+
+// find returns the position of the given link by index, or by name if it has no index.
+func (m *MockNetLink) find(link netlink.Link) int {
+	for i, l := range m.links {
+		if link.Attrs().Index != 0 && l.Attrs().Index == link.Attrs().Index {
+			return i
+		}
+		if link.Attrs().Index == 0 && l.Attrs().Name == link.Attrs().Name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// lookup returns the stored link matching the given link.
+func (m *MockNetLink) lookup(link netlink.Link) (netlink.Link, error) {
+	i := m.find(link)
+	if i < 0 {
+		return nil, syscall.ENODEV
+	}
+	return m.links[i], nil
+}
+
+// LinkAdd creates the given link, and sets its index. The peers of veth links are also created,
+// and tuntap links are given file descriptors to the null device.
+func (m *MockNetLink) LinkAdd(link netlink.Link) error {
+	err := m.call("LinkAdd", link.Attrs().Name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.LinkByName(link.Attrs().Name); err == nil {
+		return syscall.EEXIST
+	}
+
+	switch l := link.(type) {
+	case *netlink.Veth:
+		m.add(l)
+		m.add(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: l.PeerName}, PeerName: l.Name})
+		return nil
+	case *netlink.Tuntap:
+		queues := l.Queues
+		if queues == 0 {
+			queues = 1
+		}
+		for i := 0; i < queues; i++ {
+			fd, err := os.Open(os.DevNull)
+			if err != nil {
+				return err
+			}
+			l.Fds = append(l.Fds, fd)
+		}
+	}
+
+	m.add(link)
+	return nil
+}
+
+// LinkDel deletes the given link.
+func (m *MockNetLink) LinkDel(link netlink.Link) error {
+	err := m.call("LinkDel", link.Attrs().Name)
+	if err != nil {
+		return err
+	}
+
+	i := m.find(link)
+	if i < 0 {
+		return syscall.ENODEV
+	}
+
+	delete(m.addrs, m.links[i].Attrs().Name)
+	m.links = append(m.links[:i], m.links[i+1:]...)
+	return nil
+}
+
+// LinkByName returns the link with the given name.
+func (m *MockNetLink) LinkByName(name string) (netlink.Link, error) {
+	for _, link := range m.links {
+		if link.Attrs().Name == name {
+			return link, nil
+		}
+	}
+
+	return nil, netlink.LinkNotFoundError{}
+}
+
+// LinkList returns all links.
+func (m *MockNetLink) LinkList() ([]netlink.Link, error) {
+	err := m.call("LinkList", "")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]netlink.Link(nil), m.links...), nil
+}
+
+// LinkSetUp sets the given link's operational state up.
+func (m *MockNetLink) LinkSetUp(link netlink.Link) error {
+	return m.update("LinkSetUp", link, func(attrs *netlink.LinkAttrs) {
+		attrs.Flags |= net.FlagUp
+		attrs.OperState = netlink.OperUp
+	})
+}
+
+// LinkSetName renames the given link.
+func (m *MockNetLink) LinkSetName(link netlink.Link, name string) error {
+	return m.update("LinkSetName", link, func(attrs *netlink.LinkAttrs) {
+		attrs.Name = name
+	})
+}
+
+// LinkSetMTU sets the given link's MTU.
+func (m *MockNetLink) LinkSetMTU(link netlink.Link, mtu int) error {
+	return m.update("LinkSetMTU", link, func(attrs *netlink.LinkAttrs) {
+		attrs.MTU = mtu
+	})
+}
+
+// LinkSetMaster enslaves the given link to the given master link.
+func (m *MockNetLink) LinkSetMaster(link netlink.Link, master netlink.Link) error {
+	master, err := m.lookup(master)
+	if err != nil {
+		m.call("LinkSetMaster", link.Attrs().Name)
+		return err
+	}
+
+	return m.update("LinkSetMaster", link, func(attrs *netlink.LinkAttrs) {
+		attrs.MasterIndex = master.Attrs().Index
+	})
+}
+
+// LinkSetAlias sets the given link's alias.
+func (m *MockNetLink) LinkSetAlias(link netlink.Link, alias string) error {
+	return m.update("LinkSetAlias", link, func(attrs *netlink.LinkAttrs) {
+		attrs.Alias = alias
+	})
+}
+
+// LinkSetHardwareAddr sets the given link's MAC address.
+func (m *MockNetLink) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	return m.update("LinkSetHardwareAddr", link, func(attrs *netlink.LinkAttrs) {
+		attrs.HardwareAddr = hwaddr
+	})
+}
+
+// LinkSetNsFd moves the given link out of the mock.
+func (m *MockNetLink) LinkSetNsFd(link netlink.Link, fd int) error {
+	err := m.call("LinkSetNsFd", link.Attrs().Name)
+	if err != nil {
+		return err
+	}
+
+	i := m.find(link)
+	if i < 0 {
+		return syscall.ENODEV
+	}
+
+	m.links = append(m.links[:i], m.links[i+1:]...)
+	return nil
+}
+
+// update applies the given change to the attributes of the stored link matching the given link.
+func (m *MockNetLink) update(method string, link netlink.Link, change func(*netlink.LinkAttrs)) error {
+	err := m.call(method, link.Attrs().Name)
+	if err != nil {
+		return err
+	}
+
+	stored, err := m.lookup(link)
+	if err != nil {
+		return err
+	}
+
+	change(stored.Attrs())
+	return nil
+}
+
+// AddrAdd assigns the given address to the given link.
+func (m *MockNetLink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	err := m.call("AddrAdd", link.Attrs().Name)
+	if err != nil {
+		return err
+	}
+
+	stored, err := m.lookup(link)
+	if err != nil {
+		return err
+	}
+
+	name := stored.Attrs().Name
+	for _, a := range m.addrs[name] {
+		if a.Equal(*addr) {
+			return syscall.EEXIST
+		}
+	}
+
+	m.addrs[name] = append(m.addrs[name], *addr)
+	return nil
+}
+
+// AddrList returns the addresses of the given family assigned to the given link.
+func (m *MockNetLink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	err := m.call("AddrList", link.Attrs().Name)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := m.lookup(link)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []netlink.Addr
+	for _, addr := range m.addrs[stored.Attrs().Name] {
+		isIPv4 := addr.IP.To4() != nil
+		if family == netlink.FAMILY_ALL ||
+			(family == unix.AF_INET && isIPv4) || (family == unix.AF_INET6 && !isIPv4) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs, nil
+}
+
+// RouteAdd adds the given route.
+func (m *MockNetLink) RouteAdd(route *netlink.Route) error {
+	err := m.call("RouteAdd", "")
+	if err != nil {
+		return err
+	}
+
+	m.Routes = append(m.Routes, route)
+	return nil
+}
+
+// RouteList returns the routes of the given family through the given link, or all routes of the
+// given family if link is nil. Like in the kernel, multipath routes are not through any link.
+func (m *MockNetLink) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	var linkName string
+	if link != nil {
+		linkName = link.Attrs().Name
+	}
+	err := m.call("RouteList", linkName)
+	if err != nil {
+		return nil, err
+	}
+
+	linkIndex := 0
+	if link != nil {
+		stored, err := m.lookup(link)
+		if err != nil {
+			return nil, err
+		}
+		linkIndex = stored.Attrs().Index
+	}
+
+	var routes []netlink.Route
+	for _, route := range m.Routes {
+		if linkIndex != 0 && route.LinkIndex != linkIndex {
+			continue
+		}
+
+		ip := route.Gw
+		if route.Dst != nil {
+			ip = route.Dst.IP
+		} else if len(route.MultiPath) != 0 {
+			ip = route.MultiPath[0].Gw
+		}
+		isIPv4 := ip.To4() != nil
+		if family == netlink.FAMILY_ALL ||
+			(family == unix.AF_INET && isIPv4) || (family == unix.AF_INET6 && !isIPv4) {
+			routes = append(routes, *route)
+		}
+	}
+
+	return routes, nil
+}
+
+// linkName returns the name of the link with the given index, or "" if there is none.
+func (m *MockNetLink) linkName(linkIndex int) string {
+	for _, link := range m.links {
+		if link.Attrs().Index == linkIndex {
+			return link.Attrs().Name
+		}
+	}
+
+	return ""
+}
+
+// findNeigh returns the position of the neighbor entry with the same link, family, IP address
+// and MAC address as the given one.
+func (m *MockNetLink) findNeigh(neigh *netlink.Neigh) int {
+	for i, n := range m.Neighs {
+		if n.LinkIndex == neigh.LinkIndex && n.Family == neigh.Family &&
+			n.IP.Equal(neigh.IP) && n.HardwareAddr.String() == neigh.HardwareAddr.String() {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// NeighList returns the neighbor entries of the given family on the link with the given index,
+// or on all links if the index is 0.
+func (m *MockNetLink) NeighList(linkIndex int, family int) ([]netlink.Neigh, error) {
+	err := m.call("NeighList", m.linkName(linkIndex))
+	if err != nil {
+		return nil, err
+	}
+
+	var neighs []netlink.Neigh
+	for _, neigh := range m.Neighs {
+		if (linkIndex == 0 || neigh.LinkIndex == linkIndex) &&
+			(family == netlink.FAMILY_ALL || neigh.Family == family) {
+			neighs = append(neighs, neigh)
+		}
+	}
+
+	return neighs, nil
+}
+
+// NeighSet adds or replaces the given neighbor entry.
+func (m *MockNetLink) NeighSet(neigh *netlink.Neigh) error {
+	err := m.call("NeighSet", m.linkName(neigh.LinkIndex))
+	if err != nil {
+		return err
+	}
+
+	if i := m.findNeigh(neigh); i >= 0 {
+		m.Neighs[i] = *neigh
+		return nil
+	}
+
+	m.Neighs = append(m.Neighs, *neigh)
+	return nil
+}
+
+// NeighDel deletes the given neighbor entry.
+func (m *MockNetLink) NeighDel(neigh *netlink.Neigh) error {
+	err := m.call("NeighDel", m.linkName(neigh.LinkIndex))
+	if err != nil {
+		return err
+	}
+
+	i := m.findNeigh(neigh)
+	if i < 0 {
+		return syscall.ENOENT
+	}
+
+	m.Neighs = append(m.Neighs[:i], m.Neighs[i+1:]...)
+	return nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package netlinkwrapper
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestMockNetLinkLinks(t *testing.T) {
+	nl := NewMockNetLink(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}})
+
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	require.NoError(t, nl.LinkAdd(bridge))
+	assert.Equal(t, 2, bridge.Index)
+	assert.Equal(t, syscall.EEXIST, nl.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}))
+
+	// Veth links are created with their peer.
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth0-2"}
+	require.NoError(t, nl.LinkAdd(veth))
+	peer, err := nl.LinkByName("veth0-2")
+	require.NoError(t, err)
+	assert.Equal(t, "veth", peer.Type())
+
+	// Links are updated by name, as links passed without an index are looked up by name.
+	require.NoError(t, nl.LinkSetMaster(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "veth0-2"}}, bridge))
+	require.NoError(t, nl.LinkSetUp(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "veth0-2"}}))
+	assert.Equal(t, bridge.Index, peer.Attrs().MasterIndex)
+	assert.NotZero(t, peer.Attrs().Flags&net.FlagUp)
+
+	// Links moved to another netns are gone.
+	require.NoError(t, nl.LinkSetNsFd(peer, 0))
+	_, err = nl.LinkByName("veth0-2")
+	assert.IsType(t, netlink.LinkNotFoundError{}, err)
+
+	require.NoError(t, nl.LinkDel(veth))
+	assert.Equal(t, syscall.ENODEV, nl.LinkDel(veth))
+
+	links, err := nl.LinkList()
+	require.NoError(t, err)
+	require.Len(t, links, 2)
+	assert.Equal(t, "eth0", links[0].Attrs().Name)
+	assert.Equal(t, "br0", links[1].Attrs().Name)
+}
+
+func TestMockNetLinkAddrs(t *testing.T) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	nl := NewMockNetLink(bridge)
+
+	for _, s := range []string{"192.168.122.1/24", "fd00::1/64"} {
+		addr, err := netlink.ParseAddr(s)
+		require.NoError(t, err)
+		require.NoError(t, nl.AddrAdd(bridge, addr))
+		assert.Equal(t, syscall.EEXIST, nl.AddrAdd(bridge, addr))
+	}
+
+	addrs, err := nl.AddrList(bridge, netlink.FAMILY_V4)
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	assert.Equal(t, "192.168.122.1/24", addrs[0].IPNet.String())
+
+	addrs, err = nl.AddrList(bridge, netlink.FAMILY_V6)
+	require.NoError(t, err)
+	require.Len(t, addrs, 1)
+	assert.Equal(t, "fd00::1/64", addrs[0].IPNet.String())
+
+	addrs, err = nl.AddrList(bridge, netlink.FAMILY_ALL)
+	require.NoError(t, err)
+	assert.Len(t, addrs, 2)
+}
+
+func TestMockNetLinkErrors(t *testing.T) {
+	nl := NewMockNetLink()
+	errBridge := errors.New("bridge failed")
+	errLinkAdd := errors.New("link add failed")
+	nl.Errors["LinkAdd br0"] = errBridge
+	nl.Errors["LinkAdd"] = errLinkAdd
+
+	assert.Equal(t, errBridge, nl.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}))
+	assert.Equal(t, errLinkAdd, nl.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "dummy0"}}))
+	assert.NoError(t, nl.RouteAdd(&netlink.Route{}))
+
+	assert.Equal(t, []string{"LinkAdd br0", "LinkAdd dummy0", "RouteAdd"}, nl.Calls)
+	assert.Len(t, nl.Routes, 1)
+}
+
+func TestMockNetLinkRoutes(t *testing.T) {
+	branch := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "eth1.101"}, VlanId: 101}
+	nl := NewMockNetLink(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}, branch)
+
+	require.NoError(t, nl.RouteAdd(&netlink.Route{Gw: net.ParseIP("10.0.1.1"), LinkIndex: branch.Index}))
+	require.NoError(t, nl.RouteAdd(&netlink.Route{Gw: net.ParseIP("fe80::1"), LinkIndex: branch.Index}))
+	_, dst, _ := net.ParseCIDR("10.0.2.0/24")
+	require.NoError(t, nl.RouteAdd(&netlink.Route{Dst: dst, LinkIndex: 1}))
+
+	routes, err := nl.RouteList(branch, netlink.FAMILY_V4)
+	require.NoError(t, err)
+	require.Len(t, routes, 1)
+	assert.Equal(t, "10.0.1.1", routes[0].Gw.String())
+
+	routes, err = nl.RouteList(branch, netlink.FAMILY_V6)
+	require.NoError(t, err)
+	require.Len(t, routes, 1)
+	assert.Equal(t, "fe80::1", routes[0].Gw.String())
+
+	// Without a link, the routes through all links are returned.
+	routes, err = nl.RouteList(nil, netlink.FAMILY_V4)
+	require.NoError(t, err)
+	assert.Len(t, routes, 2)
+}
+
+func TestMockNetLinkNeighs(t *testing.T) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+	port := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0"}, PeerName: "veth0-2"}
+	nl := NewMockNetLink(bridge, port)
+	macAddress, _ := net.ParseMAC("02:00:00:00:00:01")
+
+	fdb := &netlink.Neigh{LinkIndex: port.Index, Family: unix.AF_BRIDGE, HardwareAddr: macAddress}
+	arp := &netlink.Neigh{LinkIndex: bridge.Index, Family: netlink.FAMILY_V4,
+		IP: net.ParseIP("192.168.122.5"), HardwareAddr: macAddress}
+	require.NoError(t, nl.NeighSet(fdb))
+	require.NoError(t, nl.NeighSet(fdb))
+	require.NoError(t, nl.NeighSet(arp))
+
+	neighs, err := nl.NeighList(port.Index, unix.AF_BRIDGE)
+	require.NoError(t, err)
+	assert.Len(t, neighs, 1)
+	neighs, err = nl.NeighList(0, netlink.FAMILY_ALL)
+	require.NoError(t, err)
+	assert.Len(t, neighs, 2)
+
+	require.NoError(t, nl.NeighDel(arp))
+	assert.Equal(t, syscall.ENOENT, nl.NeighDel(arp))
+	assert.Equal(t, []string{"NeighSet veth0", "NeighSet veth0", "NeighSet br0",
+		"NeighList veth0", "NeighList", "NeighDel br0", "NeighDel br0"}, nl.Calls)
+}
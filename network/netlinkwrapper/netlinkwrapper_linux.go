@@ -0,0 +1,164 @@
+// Copyright 2017-2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package netlinkwrapper wraps the netlink functions used by the plugins behind an interface, so
+// that the code calling them can be tested without root privileges and real links.
+package netlinkwrapper
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// NetLink represents the netlink functions that manage links, addresses and routes.
+type NetLink interface {
+	// LinkAdd creates the given link, and sets its index.
+	LinkAdd(link netlink.Link) error
+	// LinkDel deletes the given link.
+	LinkDel(link netlink.Link) error
+	// LinkByName returns the link with the given name.
+	LinkByName(name string) (netlink.Link, error)
+	// LinkList returns all links in the current netns.
+	LinkList() ([]netlink.Link, error)
+	// LinkSetUp sets the given link's operational state up.
+	LinkSetUp(link netlink.Link) error
+	// LinkSetName renames the given link.
+	LinkSetName(link netlink.Link, name string) error
+	// LinkSetMTU sets the given link's MTU.
+	LinkSetMTU(link netlink.Link, mtu int) error
+	// LinkSetMaster enslaves the given link to the given master link.
+	LinkSetMaster(link netlink.Link, master netlink.Link) error
+	// LinkSetAlias sets the given link's alias.
+	LinkSetAlias(link netlink.Link, alias string) error
+	// LinkSetHardwareAddr sets the given link's MAC address.
+	LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error
+	// LinkSetNsFd moves the given link to the netns with the given file descriptor.
+	LinkSetNsFd(link netlink.Link, fd int) error
+	// AddrAdd assigns the given address to the given link.
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	// AddrList returns the addresses of the given family assigned to the given link.
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	// RouteAdd adds the given route.
+	RouteAdd(route *netlink.Route) error
+	// RouteList returns the routes of the given family through the given link, or all routes
+	// of the given family if link is nil.
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	// NeighList returns the neighbor entries of the given family on the link with the given
+	// index, or on all links if the index is 0.
+	NeighList(linkIndex int, family int) ([]netlink.Neigh, error)
+	// NeighSet adds or replaces the given neighbor entry.
+	NeighSet(neigh *netlink.Neigh) error
+	// NeighDel deletes the given neighbor entry.
+	NeighDel(neigh *netlink.Neigh) error
+}
+
+// netLink implements NetLink by calling the netlink package.
+type netLink struct{}
+
+// NewNetLink creates a new NetLink object that calls the netlink package.
+func NewNetLink() NetLink {
+	return &netLink{}
+}
+
+// LinkAdd creates the given link, and sets its index.
+func (*netLink) LinkAdd(link netlink.Link) error {
+	return netlink.LinkAdd(link)
+}
+
+// LinkDel deletes the given link.
+func (*netLink) LinkDel(link netlink.Link) error {
+	return netlink.LinkDel(link)
+}
+
+// LinkByName returns the link with the given name.
+func (*netLink) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+
+// LinkList returns all links in the current netns.
+func (*netLink) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+// LinkSetUp sets the given link's operational state up.
+func (*netLink) LinkSetUp(link netlink.Link) error {
+	return netlink.LinkSetUp(link)
+}
+
+// LinkSetName renames the given link.
+func (*netLink) LinkSetName(link netlink.Link, name string) error {
+	return netlink.LinkSetName(link, name)
+}
+
+// LinkSetMTU sets the given link's MTU.
+func (*netLink) LinkSetMTU(link netlink.Link, mtu int) error {
+	return netlink.LinkSetMTU(link, mtu)
+}
+
+// LinkSetMaster enslaves the given link to the given master link.
+func (*netLink) LinkSetMaster(link netlink.Link, master netlink.Link) error {
+	return netlink.LinkSetMaster(link, master)
+}
+
+// LinkSetAlias sets the given link's alias.
+func (*netLink) LinkSetAlias(link netlink.Link, alias string) error {
+	return netlink.LinkSetAlias(link, alias)
+}
+
+// LinkSetHardwareAddr sets the given link's MAC address.
+func (*netLink) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	return netlink.LinkSetHardwareAddr(link, hwaddr)
+}
+
+// LinkSetNsFd moves the given link to the netns with the given file descriptor.
+func (*netLink) LinkSetNsFd(link netlink.Link, fd int) error {
+	return netlink.LinkSetNsFd(link, fd)
+}
+
+// AddrAdd assigns the given address to the given link.
+func (*netLink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrAdd(link, addr)
+}
+
+// AddrList returns the addresses of the given family assigned to the given link.
+func (*netLink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, family)
+}
+
+// RouteAdd adds the given route.
+func (*netLink) RouteAdd(route *netlink.Route) error {
+	return netlink.RouteAdd(route)
+}
+
+// RouteList returns the routes of the given family through the given link, or all routes of the
+// given family if link is nil.
+func (*netLink) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	return netlink.RouteList(link, family)
+}
+
+// NeighList returns the neighbor entries of the given family on the link with the given index,
+// or on all links if the index is 0.
+func (*netLink) NeighList(linkIndex int, family int) ([]netlink.Neigh, error) {
+	return netlink.NeighList(linkIndex, family)
+}
+
+// NeighSet adds or replaces the given neighbor entry.
+func (*netLink) NeighSet(neigh *netlink.Neigh) error {
+	return netlink.NeighSet(neigh)
+}
+
+// NeighDel deletes the given neighbor entry.
+func (*netLink) NeighDel(neigh *netlink.Neigh) error {
+	return netlink.NeighDel(neigh)
+}
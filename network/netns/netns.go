@@ -13,6 +13,8 @@
 
 package netns
 
+import "context"
+
 // NetNS represents a network namespace.
 type NetNS interface {
 	// GetFd returns a file descriptor for the underlying netns.
@@ -25,4 +27,7 @@ type NetNS interface {
 	Set() error
 	// Run runs the given function in the underlying netns.
 	Run(toRun func() error) error
+	// RunContext runs the given function in the underlying netns, and returns ctx.Err() if the
+	// context is done before the function returns. The function is abandoned, not cancelled.
+	RunContext(ctx context.Context, toRun func() error) error
 }
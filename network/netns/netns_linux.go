@@ -14,7 +14,9 @@
 package netns
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"runtime"
@@ -122,17 +124,40 @@ func GetNetNSByPath(path string) (NetNS, error) {
 	return &netNS{file: fd, mounted: true}, nil
 }
 
-// Close releases the reference to the underlying netns.
+// ListNetNSNames returns the names of the netns mounted under the netns mount path.
+func ListNetNSNames() ([]string, error) {
+	files, err := ioutil.ReadDir(netNsMountPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+
+	return names, nil
+}
+
+// Close releases the reference to the underlying netns. If unmounting the netns fails, Close
+// can be called again to retry.
 func (ns *netNS) Close() error {
-	if ns.closed {
+	var err error
+
+	if ns.closed && !ns.mounted {
 		return fmt.Errorf("%s has already been closed", ns.file.Name())
 	}
 
-	err := ns.file.Close()
-	if err != nil {
-		return fmt.Errorf("Failed to close %s: %v", ns.file.Name(), err)
+	if !ns.closed {
+		err = ns.file.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to close %s: %v", ns.file.Name(), err)
+		}
+		ns.closed = true
 	}
-	ns.closed = true
 
 	if ns.mounted {
 		err = unix.Unmount(ns.file.Name(), unix.MNT_DETACH)
@@ -175,17 +200,37 @@ func (ns *netNS) Set() error {
 
 // Run runs the given function in the underlying netns.
 func (ns *netNS) Run(toRun func() error) error {
-	var err error
+	return ns.RunContext(context.Background(), toRun)
+}
 
+// RunContext runs the given function in the underlying netns, and returns ctx.Err() if the
+// context is done before the function returns.
+//
+// The function runs on a dedicated goroutine locked to its OS thread. The thread is never
+// returned to the runtime's thread pool, so it can't leak the underlying netns to unrelated
+// goroutines. When the context is done first, the function is abandoned rather than cancelled:
+// it keeps running in the underlying netns until it returns, and any changes it makes after
+// RunContext returns still take effect. Callers must not assume the work was not done, and must
+// not share state with the function without synchronization.
+func (ns *netNS) RunContext(ctx context.Context, toRun func() error) error {
 	if ns.closed {
 		return fmt.Errorf("%s has already been closed", ns.file.Name())
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The channel is buffered so that an abandoned goroutine can deliver its result and exit.
+	result := make(chan error, 1)
 
 	go func() {
-		defer wg.Done()
+		var err error
+		defer func() { result <- err }()
+
+		// The OS thread is never unlocked, which causes the runtime to terminate it when this
+		// goroutine exits instead of returning it to the pool, even if restoring the thread's
+		// original netns below fails.
 		runtime.LockOSThread()
 		var threadNS NetNS
 
@@ -205,13 +250,24 @@ func (ns *netNS) Run(toRun func() error) error {
 		}
 		defer threadNS.Set()
 
+		// Convert panics in the given function to errors. The deferred calls above restore
+		// the thread's original netns.
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("Recovered panic in netns %v: %v", ns.file.Name(), r)
+			}
+		}()
+
 		err = toRun()
 	}()
 
-	// Wait for the go routine to complete.
-	wg.Wait()
-
-	return err
+	// Wait for the go routine to complete or the context to be done.
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // getCurrentThreadNetNSPath returns the path to the caller thread's netns.
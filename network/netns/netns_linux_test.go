@@ -0,0 +1,116 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package netns
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRunRecoversPanic tests that a panic in the function passed to Run is returned as an error
+// and the netns remains usable afterwards.
+func TestRunRecoversPanic(t *testing.T) {
+	ns, err := GetNetNSByPath("/proc/self/ns/net")
+	require.NoError(t, err)
+
+	before, err := os.Readlink("/proc/self/ns/net")
+	require.NoError(t, err)
+
+	err = ns.Run(func() error {
+		var m map[string]int
+		m["panic"] = 1
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Recovered panic")
+
+	err = ns.Run(func() error {
+		return nil
+	})
+	assert.NoError(t, err)
+
+	after, err := os.Readlink("/proc/self/ns/net")
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+// TestListNetNSNames tests that mounted netns are listed by name.
+func TestListNetNSNames(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	ns, err := NewNetNS("test-list-netns")
+	require.NoError(t, err)
+
+	names, err := ListNetNSNames()
+	require.NoError(t, err)
+	assert.Contains(t, names, "test-list-netns")
+
+	require.NoError(t, ns.Close())
+	names, err = ListNetNSNames()
+	require.NoError(t, err)
+	assert.NotContains(t, names, "test-list-netns")
+}
+
+// TestRunContextDeadline tests that RunContext returns when the context deadline elapses, even if
+// the function is still running, and that the netns remains usable afterwards.
+func TestRunContextDeadline(t *testing.T) {
+	ns, err := GetNetNSByPath("/proc/self/ns/net")
+	require.NoError(t, err)
+
+	before, err := os.Readlink("/proc/self/ns/net")
+	require.NoError(t, err)
+
+	release := make(chan struct{})
+	done := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = ns.RunContext(ctx, func() error {
+		defer close(done)
+		<-release
+		return nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// The abandoned function keeps running until it returns.
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the abandoned function")
+	}
+
+	// A done context is reported without running the function.
+	err = ns.RunContext(ctx, func() error {
+		t.Error("Function ran with a done context")
+		return nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	err = ns.RunContext(context.Background(), func() error {
+		return nil
+	})
+	assert.NoError(t, err)
+
+	after, err := os.Readlink("/proc/self/ns/net")
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
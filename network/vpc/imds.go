@@ -0,0 +1,119 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package vpc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// IMDS paths and headers. Requests are made with an IMDSv2 session token when IMDS issues
+	// one, and fall back to IMDSv1 otherwise.
+	imdsTokenPath            = "/latest/api/token"
+	imdsTokenHeader          = "X-aws-ec2-metadata-token"
+	imdsTokenTTLHeader       = "X-aws-ec2-metadata-token-ttl-seconds"
+	imdsTokenTTLSeconds      = "60"
+	imdsSubnetCIDRPathFormat = "/latest/meta-data/network/interfaces/macs/%s/subnet-ipv4-cidr-block"
+
+	// imdsTimeout is the timeout of each IMDS request.
+	imdsTimeout = 2 * time.Second
+)
+
+// imdsURL is the base URL of IMDS. It is a variable so that it can be replaced in tests.
+var imdsURL = "http://169.254.169.254"
+
+// NewSubnetFromIMDS creates a new VPC subnet object for the ENI with the given MAC address, with
+// its prefix as reported by IMDS. IMDS does not report the VPC gateway, which is computed from
+// the prefix as in NewSubnet.
+func NewSubnetFromIMDS(macAddress net.HardwareAddr) (*Subnet, error) {
+	client := &http.Client{Timeout: imdsTimeout}
+
+	token, err := getIMDSToken(client)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := getIMDSMetadata(client, token, fmt.Sprintf(imdsSubnetCIDRPathFormat, macAddress))
+	if err != nil {
+		return nil, err
+	}
+
+	subnet, err := NewSubnetFromString(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %s from IMDS: %v", prefix, err)
+	}
+
+	return subnet, nil
+}
+
+// getIMDSToken returns an IMDSv2 session token. It returns an empty token if IMDS refuses to
+// issue one, for example because it only supports IMDSv1.
+func getIMDSToken(client *http.Client) (string, error) {
+	req, err := http.NewRequest(http.MethodPut, imdsURL+imdsTokenPath, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(imdsTokenTTLHeader, imdsTokenTTLSeconds)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get IMDS token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", nil
+	}
+
+	token, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read IMDS token: %v", err)
+	}
+
+	return string(token), nil
+}
+
+// getIMDSMetadata returns the metadata at the given IMDS path, using the given session token if
+// it is not empty.
+func getIMDSMetadata(client *http.Client, token string, path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, imdsURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set(imdsTokenHeader, token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s from IMDS: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get %s from IMDS: %s", path, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s from IMDS: %v", path, err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
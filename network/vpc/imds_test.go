@@ -0,0 +1,102 @@
+// Copyright 2018 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package vpc
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	anyMACAddress = "02:00:00:00:01:01"
+	anyIMDSToken  = "token"
+)
+
+// newIMDSServer starts a mock IMDS that reports the given subnet for anyMACAddress. It issues
+// session tokens and requires them on metadata requests, unless imdsV1 is set.
+func newIMDSServer(t *testing.T, subnet string, imdsV1 bool) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(imdsTokenPath, func(w http.ResponseWriter, r *http.Request) {
+		if imdsV1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, imdsTokenTTLSeconds, r.Header.Get(imdsTokenTTLHeader))
+		w.Write([]byte(anyIMDSToken))
+	})
+	subnetPath := fmt.Sprintf(imdsSubnetCIDRPathFormat, anyMACAddress)
+	mux.HandleFunc(subnetPath, func(w http.ResponseWriter, r *http.Request) {
+		if !imdsV1 && r.Header.Get(imdsTokenHeader) != anyIMDSToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(subnet))
+	})
+
+	server := httptest.NewServer(mux)
+	imdsURL = server.URL
+	return server
+}
+
+// TestNewSubnetFromIMDS tests subnet discovery through IMDSv2.
+func TestNewSubnetFromIMDS(t *testing.T) {
+	defer func(url string) { imdsURL = url }(imdsURL)
+	server := newIMDSServer(t, anySubnetPrefixString, false)
+	defer server.Close()
+
+	macAddress, _ := net.ParseMAC(anyMACAddress)
+	subnet, err := NewSubnetFromIMDS(macAddress)
+	require.NoError(t, err)
+	assert.Equal(t, anySubnetPrefixString, subnet.Prefix.String())
+	assert.Equal(t, anySubnetGateway, subnet.Gateways[0].String())
+
+	// Unknown MAC addresses are not found.
+	macAddress, _ = net.ParseMAC("02:00:00:00:01:02")
+	_, err = NewSubnetFromIMDS(macAddress)
+	assert.Error(t, err)
+}
+
+// TestNewSubnetFromIMDSv1 tests subnet discovery when IMDS does not issue session tokens.
+func TestNewSubnetFromIMDSv1(t *testing.T) {
+	defer func(url string) { imdsURL = url }(imdsURL)
+	server := newIMDSServer(t, anySubnetPrefixString, true)
+	defer server.Close()
+
+	macAddress, _ := net.ParseMAC(anyMACAddress)
+	subnet, err := NewSubnetFromIMDS(macAddress)
+	require.NoError(t, err)
+	assert.Equal(t, anySubnetPrefixString, subnet.Prefix.String())
+}
+
+// TestNewSubnetFromIMDSInvalid tests subnet discovery errors.
+func TestNewSubnetFromIMDSInvalid(t *testing.T) {
+	defer func(url string) { imdsURL = url }(imdsURL)
+	server := newIMDSServer(t, anyInvalidSubnetPrefixString, false)
+
+	macAddress, _ := net.ParseMAC(anyMACAddress)
+	_, err := NewSubnetFromIMDS(macAddress)
+	assert.Error(t, err)
+
+	// IMDS is unreachable.
+	server.Close()
+	_, err = NewSubnetFromIMDS(macAddress)
+	assert.Error(t, err)
+}
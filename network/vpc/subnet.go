@@ -18,8 +18,9 @@ import (
 )
 
 var (
-	// Well-known VPC default gateway host ID.
-	defaultGatewayHostID = []byte{0, 0, 0, 1}
+	// Well-known VPC default gateway host IDs.
+	defaultGatewayHostID     = []byte{0, 0, 0, 1}
+	defaultIPv6GatewayHostID = net.IP{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
 )
 
 // Subnet represents a VPC subnet.
@@ -31,7 +32,11 @@ type Subnet struct {
 // NewSubnet creates a new VPC subnet object given its prefix.
 func NewSubnet(prefix *net.IPNet) (*Subnet, error) {
 	// Compute default gateway address.
-	gateway := ComputeIPAddress(prefix, defaultGatewayHostID)
+	hostID := net.IP(defaultGatewayHostID)
+	if prefix.IP.To4() == nil {
+		hostID = defaultIPv6GatewayHostID
+	}
+	gateway := ComputeIPAddress(prefix, hostID)
 
 	subnet := &Subnet{
 		Prefix:   *prefix,
@@ -51,6 +56,35 @@ func NewSubnetFromString(prefixString string) (*Subnet, error) {
 	return NewSubnet(prefix)
 }
 
+// Overlaps returns whether the subnet overlaps the given prefix.
+func (subnet *Subnet) Overlaps(prefix *net.IPNet) bool {
+	return subnet.Prefix.Contains(prefix.IP.Mask(prefix.Mask)) ||
+		prefix.Contains(subnet.Prefix.IP.Mask(subnet.Prefix.Mask))
+}
+
+// GatewayFor returns the first subnet gateway in the same address family as the given IP address,
+// or nil if there is none.
+func (subnet *Subnet) GatewayFor(ip net.IP) net.IP {
+	gateways := subnet.GatewaysFor(ip)
+	if len(gateways) == 0 {
+		return nil
+	}
+
+	return gateways[0]
+}
+
+// GatewaysFor returns the subnet gateways in the same address family as the given IP address.
+func (subnet *Subnet) GatewaysFor(ip net.IP) []net.IP {
+	var gateways []net.IP
+	for _, gateway := range subnet.Gateways {
+		if (gateway.To4() == nil) == (ip.To4() == nil) {
+			gateways = append(gateways, gateway)
+		}
+	}
+
+	return gateways
+}
+
 // GetSubnetPrefix returns the subnet prefix of an IP address.
 func GetSubnetPrefix(ipAddress *net.IPNet) *net.IPNet {
 	return &net.IPNet{
@@ -62,8 +96,10 @@ func GetSubnetPrefix(ipAddress *net.IPNet) *net.IPNet {
 // ComputeIPAddress computes an IP address given its subnet prefix and host ID.
 func ComputeIPAddress(prefix *net.IPNet, hostID net.IP) net.IP {
 	// Always treat as IPv6 address to ensure compatibility with both IPv4 and IPv6.
+	// Copy the host ID, as To16 returns the same slice for IPv6 addresses.
 	prefixIP := prefix.IP.To16()
-	hostIP := hostID.To16()
+	hostIP := make(net.IP, net.IPv6len)
+	copy(hostIP, hostID.To16())
 
 	for i := 0; i < len(hostIP); i++ {
 		hostIP[i] |= prefixIP[i]
@@ -24,6 +24,8 @@ const (
 	anySubnetPrefixString        = "12.34.56.0/22"
 	anySubnetGateway             = "12.34.56.1"
 	anyInvalidSubnetPrefixString = "12.345.56.0/42"
+	anyIPv6SubnetPrefixString    = "2600:1f14:abc:de00::/64"
+	anyIPv6SubnetGateway         = "2600:1f14:abc:de00::1"
 )
 
 // TestNewSubnet tests subnet constructors.
@@ -44,8 +46,63 @@ func TestNewSubnet(t *testing.T) {
 	assert.Equal(t, 1, len(subnet.Gateways), "incorrect number of gateways")
 	assert.Equal(t, anySubnetGateway, subnet.Gateways[0].String(), "incorrect gateway")
 
+	// IPv6 subnet from valid string.
+	subnet, err = NewSubnetFromString(anyIPv6SubnetPrefixString)
+	assert.NoError(t, err)
+	assert.Equal(t, anyIPv6SubnetPrefixString, subnet.Prefix.String(), "incorrect prefix")
+	assert.Equal(t, 1, len(subnet.Gateways), "incorrect number of gateways")
+	assert.Equal(t, anyIPv6SubnetGateway, subnet.Gateways[0].String(), "incorrect gateway")
+
+	// The gateway of another IPv6 subnet is not affected by previous computations.
+	subnet, err = NewSubnetFromString("2600:1f14:abc:df00::/64")
+	assert.NoError(t, err)
+	assert.Equal(t, "2600:1f14:abc:df00::1", subnet.Gateways[0].String(), "incorrect gateway")
+
 	// Subnet from invalid string.
 	subnet, err = NewSubnetFromString(anyInvalidSubnetPrefixString)
 	assert.Error(t, err)
 	assert.Nil(t, subnet)
 }
+
+// TestSubnetGatewayFor tests gateway selection on dual-stack subnets.
+func TestSubnetGatewayFor(t *testing.T) {
+	subnet, _ := NewSubnetFromString(anySubnetPrefixString)
+	subnet.Gateways = []net.IP{
+		net.ParseIP(anyIPv6SubnetGateway),
+		net.ParseIP(anySubnetGateway),
+		net.ParseIP("12.34.56.2"),
+	}
+
+	ipv4 := net.ParseIP("12.34.56.10")
+	assert.Equal(t, anySubnetGateway, subnet.GatewayFor(ipv4).String())
+	assert.Len(t, subnet.GatewaysFor(ipv4), 2)
+
+	ipv6 := net.ParseIP("2600:1f14:abc:de00::10")
+	assert.Equal(t, anyIPv6SubnetGateway, subnet.GatewayFor(ipv6).String())
+	assert.Len(t, subnet.GatewaysFor(ipv6), 1)
+
+	// Computed gateways, which are 16-byte IPs, are matched as IPv4.
+	subnet, _ = NewSubnetFromString(anySubnetPrefixString)
+	assert.Equal(t, anySubnetGateway, subnet.GatewayFor(ipv4).String())
+	assert.Nil(t, subnet.GatewayFor(ipv6))
+}
+
+// TestSubnetOverlaps tests subnet overlap detection.
+func TestSubnetOverlaps(t *testing.T) {
+	subnet, _ := NewSubnetFromString(anySubnetPrefixString)
+
+	testCases := []struct {
+		prefix   string
+		overlaps bool
+	}{
+		{prefix: "12.34.56.0/22", overlaps: true},
+		{prefix: "12.34.57.0/24", overlaps: true},
+		{prefix: "12.34.0.0/16", overlaps: true},
+		{prefix: "12.34.60.0/24", overlaps: false},
+		{prefix: "192.168.122.1/24", overlaps: false},
+	}
+	for _, tc := range testCases {
+		_, prefix, _ := net.ParseCIDR(tc.prefix)
+		assert.Equal(t, tc.overlaps, subnet.Overlaps(prefix), "incorrect overlap for %s", tc.prefix)
+	}
+}
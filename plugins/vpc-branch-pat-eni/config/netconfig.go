@@ -16,42 +16,304 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net"
+	"os/user"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
 	"github.com/aws/amazon-vpc-cni-plugins/network/vpc"
 
 	log "github.com/cihub/seelog"
 	cniSkel "github.com/containernetworking/cni/pkg/skel"
 	cniTypes "github.com/containernetworking/cni/pkg/types"
+	cniTypesCurrent "github.com/containernetworking/cni/pkg/types/current"
+	cniVersion "github.com/containernetworking/cni/pkg/version"
 )
 
 // NetConfig defines the network configuration for the vpc-branch-pat-eni plugin.
 type NetConfig struct {
 	cniTypes.NetConf
-	TrunkName        string
-	TrunkMACAddress  net.HardwareAddr
-	BranchVlanID     int
-	BranchMACAddress net.HardwareAddr
-	BranchIPAddress  net.IPNet
-	Uid              int
-	Gid              int
-	CleanupPATNetNS  bool
+	TrunkName                string
+	TrunkMACAddress          net.HardwareAddr
+	BranchVlanID             int
+	BranchMACAddress         net.HardwareAddr
+	BranchIPAddress          net.IPNet
+	BridgeIPAddress          net.IPNet
+	Uid                      int
+	Gid                      int
+	CleanupPATNetNS          bool
+	AuditNetlink             bool
+	RelocateBridgeSubnet     bool
+	NetNSCloseAttempts       int
+	NetNSCloseRetryDelay     time.Duration
+	BranchUpBeforeAddress    bool
+	KernelCompatPolicy       string
+	TapOwnershipPolicy       string
+	BranchDropThreshold      uint64
+	TapFdSocket              string
+	BranchGatewayIPAddresses []net.IP
+	ECMP                     bool
+	SkipIptables             bool
+	TapAlias                 string
+	TapMACAddress            net.HardwareAddr
+	NeighBaseReachableTimeMs int
+	NeighGCStaleTime         int
+	EarlyTapCreation         bool
+	MTU                      int
+	RequireExistingNamespace bool
+	BridgeName               string
+	BranchIPv6Address        net.IPNet
+	BridgeIPv6Address        net.IPNet
+	GroupName                string
+	VerifyNAT                bool
+	NATVerifyTarget          string
+	NATVerifyTimeout         time.Duration
+	BranchIPv6LinkLocalOnly  bool
+	BranchIPv6UseTempAddr    int
+	MulticastQuerier         bool
+	MaxPATNetNS              int
+	TapReleaseTimeout        time.Duration
+	ConnMark                 uint32
+	AddRateLimit             float64
+	AddBurst                 int
+	AddOverflowPolicy        string
+	TrunkIsolationMode       eni.IsolationMode
+	EventSocket              string
+	PreserveBridgeFDB        bool
+	FDBCacheSize             int
+	BranchRxRingSize         uint32
+	BranchTxRingSize         uint32
+	VerifyTeardown           bool
+	StrayBranchPolicy        string
+	BranchDeleteOrder        string
+	BridgeEthertypeFilter    bool
+	DisableSTP               bool
+	MasqueradePortRange      string
+	NATMode                  string
+	CheckBranchIPConflict    bool
+	TapQueues                int
+	TapVhost                 bool
+	PersistTap               bool
+	DiscoverBranchSubnet     bool
+	MetricsFile              string
+	DSCPQueueMap             map[uint8]uint16
+	DNSPorts                 []int
+	AllowedInputPorts        []PortSpec
+	PrevResult               *cniTypesCurrent.Result
 }
 
 // netConfigJSON defines the network configuration JSON file format for the vpc-branch-pat-eni plugin.
 type netConfigJSON struct {
 	cniTypes.NetConf
-	TrunkName        string `json:"trunkName"`
-	TrunkMACAddress  string `json:"trunkMACAddress"`
-	BranchVlanID     string `json:"branchVlanID"`
-	BranchMACAddress string `json:"branchMACAddress"`
-	BranchIPAddress  string `json:"branchIPAddress"`
-	Uid              string `json:"uid"`
-	Gid              string `json:"gid"`
-	CleanupPATNetNS  bool   `json:"cleanupPATNetNS"`
+	TrunkName                string   `json:"trunkName"`
+	TrunkMACAddress          string   `json:"trunkMACAddress"`
+	BranchVlanID             string   `json:"branchVlanID"`
+	BranchMACAddress         string   `json:"branchMACAddress"`
+	BranchIPAddress          string   `json:"branchIPAddress"`
+	BridgeIPAddress          string   `json:"bridgeIPAddress"`
+	Uid                      string   `json:"uid"`
+	Gid                      string   `json:"gid"`
+	CleanupPATNetNS          bool     `json:"cleanupPATNetNS"`
+	AuditNetlink             bool     `json:"auditNetlink"`
+	RelocateBridgeSubnet     bool     `json:"relocateBridgeSubnet"`
+	NetNSCloseAttempts       string   `json:"netNSCloseAttempts"`
+	NetNSCloseRetryDelay     string   `json:"netNSCloseRetryDelay"`
+	MinUid                   string   `json:"minUid"`
+	MaxUid                   string   `json:"maxUid"`
+	BranchUpBeforeAddress    bool     `json:"branchUpBeforeAddress"`
+	KernelCompatPolicy       string   `json:"kernelCompatPolicy"`
+	TapOwnershipPolicy       string   `json:"tapOwnershipPolicy"`
+	BranchDropThreshold      string   `json:"branchDropThreshold"`
+	TapFdSocket              string   `json:"tapFdSocket"`
+	BranchGatewayIPAddresses []string `json:"branchGatewayIPAddresses"`
+	ECMP                     bool     `json:"ecmp"`
+	SkipIptables             bool     `json:"skipIptables"`
+	TapAlias                 string   `json:"tapAlias"`
+	TapMACAddress            string   `json:"tapMACAddress"`
+	NeighBaseReachableTimeMs string   `json:"neighBaseReachableTimeMs"`
+	NeighGCStaleTime         string   `json:"neighGCStaleTime"`
+	EarlyTapCreation         bool     `json:"earlyTapCreation"`
+	MTU                      string   `json:"mtu"`
+	RequireExistingNamespace bool     `json:"requireExistingNamespace"`
+	BridgeName               string   `json:"bridgeName"`
+	BranchIPv6Address        string   `json:"branchIPv6Address"`
+	BridgeIPv6Address        string   `json:"bridgeIPv6Address"`
+	GroupName                string   `json:"groupName"`
+	VerifyNAT                bool     `json:"verifyNAT"`
+	NATVerifyTarget          string   `json:"natVerifyTarget"`
+	NATVerifyTimeout         string   `json:"natVerifyTimeout"`
+	BranchIPv6LinkLocalOnly  bool     `json:"branchIPv6LinkLocalOnly"`
+	BranchIPv6UseTempAddr    string   `json:"branchIPv6UseTempAddr"`
+	MulticastQuerier         bool     `json:"multicastQuerier"`
+	MaxPATNetNS              string   `json:"maxPATNetNS"`
+	TapReleaseTimeout        string   `json:"tapReleaseTimeout"`
+	ConnMark                 string   `json:"connMark"`
+	AddRateLimit             string   `json:"addRateLimit"`
+	AddBurst                 string   `json:"addBurst"`
+	AddOverflowPolicy        string   `json:"addOverflowPolicy"`
+	TrunkIsolationMode       string   `json:"trunkIsolationMode"`
+	EventSocket              string   `json:"eventSocket"`
+	PreserveBridgeFDB        bool     `json:"preserveBridgeFDB"`
+	FDBCacheSize             string   `json:"fdbCacheSize"`
+	MinCNIVersion            string   `json:"minCNIVersion"`
+	BranchRxRingSize         string   `json:"branchRxRingSize"`
+	BranchTxRingSize         string   `json:"branchTxRingSize"`
+	VerifyTeardown           bool     `json:"verifyTeardown"`
+	StrayBranchPolicy        string   `json:"strayBranchPolicy"`
+	BranchDeleteOrder        string   `json:"branchDeleteOrder"`
+	BridgeEthertypeFilter    bool     `json:"bridgeEthertypeFilter"`
+	MasqueradePortRange      string   `json:"masqueradePortRange"`
+	NATMode                  string   `json:"natMode"`
+	TapQueues                string   `json:"tapQueues"`
+	TapVhost                 bool     `json:"tapVhost"`
+	PersistTap               bool     `json:"persistTap"`
+	DiscoverBranchSubnet     bool     `json:"discoverBranchSubnet"`
+	MetricsFile              string   `json:"metricsFile"`
+
+	// DNSPorts are the local ports that DNS queries from the PAT bridge are accepted on.
+	DNSPorts []string `json:"dnsPorts"`
+
+	// AllowedInputPorts are local services open to the PAT bridge, in addition to DNS and DHCP.
+	AllowedInputPorts []portSpecJSON `json:"allowedInputPorts"`
+
+	// DSCPQueueMap maps DSCP classes to tap queue indices, both as decimal strings.
+	DSCPQueueMap map[string]string `json:"dscpQueueMap"`
+
+	// These are pointers, as they default to true when not set.
+	DisableSTP            *bool `json:"disableSTP"`
+	CheckBranchIPConflict *bool `json:"checkBranchIPConflict"`
+
+	// RawPrevResult is the result of the previous plugin, set by the runtime when chained.
+	RawPrevResult map[string]interface{} `json:"prevResult"`
+}
+
+// PortSpec defines a transport layer port.
+type PortSpec struct {
+	Port     uint16
+	Protocol string
+}
+
+// portSpecJSON defines the JSON format of a PortSpec.
+type portSpecJSON struct {
+	Port     string `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// pcArgs defines the per-container arguments passed in CNI_ARGS environment variable.
+// UID and MTU override the uid and mtu network config fields for a single invocation, and are
+// validated the same way, including against minUid and maxUid.
+type pcArgs struct {
+	cniTypes.CommonArgs
+	K8S_POD_NAMESPACE cniTypes.UnmarshallableString
+	K8S_POD_NAME      cniTypes.UnmarshallableString
+	UID               cniTypes.UnmarshallableString
+	MTU               cniTypes.UnmarshallableString
 }
 
+const (
+	// Policies for requested features that are not supported by the running kernel.
+	KernelCompatPolicyFail    = "fail"
+	KernelCompatPolicyDegrade = "degrade"
+
+	// Policies for when the tap link ownership can't be changed due to insufficient permissions.
+	TapOwnershipPolicyFail     = "fail"
+	TapOwnershipPolicyFallback = "fallback"
+
+	// Trunk isolation modes, which select the link type of the branch.
+	TrunkIsolationModeVLAN    = "vlan"
+	TrunkIsolationModeMACVLAN = "macvlan"
+
+	// Policies for ADD operations in excess of the node-wide ADD rate limit.
+	AddOverflowPolicyWait = "wait"
+	AddOverflowPolicyFail = "fail"
+
+	// Policies for a branch link left behind by an earlier ADD when its PAT netns is recreated.
+	// Reuse keeps the branch link if it matches the requested branch, and recreates it otherwise.
+	StrayBranchPolicyReuse    = "reuse"
+	StrayBranchPolicyRecreate = "recreate"
+
+	// Orders of deleting the branch link when the PAT netns is deleted. NetNSClose relies on the
+	// kernel to delete the branch link with the PAT netns, which is deferred until the last
+	// reference to the netns is released. BranchFirst deletes the branch link explicitly first.
+	BranchDeleteOrderNetNSClose  = "netnsClose"
+	BranchDeleteOrderBranchFirst = "branchFirst"
+
+	// Modes of source NAT for traffic leaving the PAT bridge. None is for VPCs that route the
+	// PAT bridge subnet natively.
+	NATModeMasquerade = "masquerade"
+	NATModeNone       = "none"
+
+	// UnsetGid is the GID of the tap link when neither gid nor groupName is configured. The tap
+	// link group is left unchanged in that case.
+	UnsetGid = -1
+
+	// UnsetIPv6UseTempAddr is the branch IPv6 privacy extensions setting when
+	// branchIPv6UseTempAddr is not configured. The kernel default is left unchanged in that case.
+	UnsetIPv6UseTempAddr = -1
+
+	// Range of MTUs allowed for the links created by the plugin. The maximum is the VPC jumbo
+	// frame size, which is also the default.
+	minMTU = 576
+	maxMTU = vpc.JumboFrameMTU
+
+	// Range of valid 802.1Q VLAN IDs, which also bounds branch IDs in MACVLAN isolation mode.
+	minVlanID = 1
+	maxVlanID = 4094
+
+	// Default name and IP address of the PAT bridge.
+	defaultBridgeName      = "virbr0"
+	defaultBridgeIPAddress = "192.168.122.1/24"
+
+	// Default unique local IPv6 address assigned to the PAT bridge on dual-stack branches.
+	defaultBridgeIPv6Address = "fd00:c0a8:7a::1/64"
+
+	// The PAT bridge name is also used to derive the name of its dummy link, and both must fit
+	// in IFNAMSIZ including the terminating null character.
+	maxLinkNameLength   = 15
+	dummyLinkNameSuffix = "-dummy"
+
+	// Default number of attempts to close the PAT netns and delay before the first retry.
+	defaultNetNSCloseAttempts   = 3
+	defaultNetNSCloseRetryDelay = 100 * time.Millisecond
+
+	// Default time to wait for the NAT verification connection.
+	defaultNATVerifyTimeout = 2 * time.Second
+
+	// Default number of ADD operations admitted at once by the node-wide ADD rate limit.
+	defaultAddBurst = 1
+
+	// Default maximum number of PAT bridge FDB entries saved per VLAN ID.
+	defaultFDBCacheSize = 256
+
+	// Range of source ports that connections from the PAT bridge are masqueraded to. Ports below
+	// the minimum are reserved for the branch itself.
+	defaultMasqueradePortRange = "1024-65535"
+	minMasqueradePort          = 1024
+	maxMasqueradePort          = 65535
+
+	// Default local port that DNS queries from the PAT bridge are accepted on.
+	defaultDNSPort = 53
+
+	// Default and maximum number of queues of the tap link.
+	defaultTapQueues = 1
+	maxTapQueues     = 256
+
+	// Maximum DSCP class, which is a 6-bit field.
+	maxDSCP = 63
+
+	// Default minimum CNI version, which is the lowest version supported by the plugin.
+	defaultMinCNIVersion = "0.3.0"
+)
+
+var (
+	// checkKernelIsolationModeSupport checks that the running kernel supports a trunk isolation
+	// mode. It is a variable so that it can be replaced in tests.
+	checkKernelIsolationModeSupport = eni.CheckKernelIsolationModeSupport
+)
+
 // New creates a new NetConfig object by parsing the given CNI arguments.
 func New(args *cniSkel.CmdArgs, isAdd bool) (*NetConfig, error) {
 	var config netConfigJSON
@@ -60,6 +322,94 @@ func New(args *cniSkel.CmdArgs, isAdd bool) (*NetConfig, error) {
 		return nil, fmt.Errorf("failed to parse network config: %v", err)
 	}
 
+	// Parse optional per-container arguments.
+	if args.Args != "" {
+		var pca pcArgs
+		pca.IgnoreUnknown = true
+
+		if err := cniTypes.LoadArgs(args.Args, &pca); err != nil {
+			return nil, fmt.Errorf("failed to parse per-container args: %v", err)
+		}
+
+		// Default the tap alias to the pod name to correlate the tap with its pod.
+		if config.TapAlias == "" && pca.K8S_POD_NAME != "" {
+			config.TapAlias = string(pca.K8S_POD_NAME)
+			if pca.K8S_POD_NAMESPACE != "" {
+				config.TapAlias = fmt.Sprintf("%s/%s", pca.K8S_POD_NAMESPACE, pca.K8S_POD_NAME)
+			}
+		}
+
+		// Per-container arguments take precedence over the network config.
+		if pca.UID != "" {
+			config.Uid = string(pca.UID)
+		}
+		if pca.MTU != "" {
+			config.MTU = string(pca.MTU)
+		}
+	}
+
+	// Set defaults.
+	if config.BridgeName == "" {
+		config.BridgeName = defaultBridgeName
+	}
+	if config.BridgeIPAddress == "" {
+		config.BridgeIPAddress = defaultBridgeIPAddress
+	}
+	if config.BridgeIPv6Address == "" {
+		config.BridgeIPv6Address = defaultBridgeIPv6Address
+	}
+	if config.KernelCompatPolicy == "" {
+		config.KernelCompatPolicy = KernelCompatPolicyFail
+	}
+	if config.TapOwnershipPolicy == "" {
+		config.TapOwnershipPolicy = TapOwnershipPolicyFail
+	}
+	if config.AddOverflowPolicy == "" {
+		config.AddOverflowPolicy = AddOverflowPolicyWait
+	}
+	if config.StrayBranchPolicy == "" {
+		config.StrayBranchPolicy = StrayBranchPolicyReuse
+	}
+	if config.BranchDeleteOrder == "" {
+		config.BranchDeleteOrder = BranchDeleteOrderNetNSClose
+	}
+	if config.NATMode == "" {
+		config.NATMode = NATModeMasquerade
+	}
+	if config.TrunkIsolationMode == "" {
+		config.TrunkIsolationMode = TrunkIsolationModeVLAN
+	}
+	if config.MinCNIVersion == "" {
+		config.MinCNIVersion = defaultMinCNIVersion
+	}
+
+	// Validate that the CNI version negotiated with the runtime is recent enough. The CNI skel
+	// rejects configs without a version before calling the plugin, so only set versions are checked.
+	minCNIVersion, err := parseCNIVersion(config.MinCNIVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid minCNIVersion %s", config.MinCNIVersion)
+	}
+	if config.CNIVersion != "" {
+		cniVersion, err := parseCNIVersion(config.CNIVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cniVersion %s", config.CNIVersion)
+		}
+		if compareCNIVersions(cniVersion, minCNIVersion) < 0 {
+			return nil, fmt.Errorf("CNI version %s is older than the minimum required version %s, "+
+				"upgrade the container runtime or lower minCNIVersion",
+				config.CNIVersion, config.MinCNIVersion)
+		}
+	}
+
+	// Parse the result of the previous plugin when chained, converted to the current version.
+	var prevResult *cniTypesCurrent.Result
+	if config.RawPrevResult != nil {
+		prevResult, err = parsePrevResult(config.RawPrevResult, config.CNIVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prevResult: %v", err)
+		}
+	}
+
 	// Validate if all the required fields are present.
 	if config.TrunkName == "" && config.TrunkMACAddress == "" {
 		return nil, fmt.Errorf("missing required parameter trunkName or trunkMACAddress")
@@ -71,11 +421,95 @@ func New(args *cniSkel.CmdArgs, isAdd bool) (*NetConfig, error) {
 		return nil, fmt.Errorf("missing required parameter branchMACAddress")
 	}
 
+	if config.KernelCompatPolicy != KernelCompatPolicyFail &&
+		config.KernelCompatPolicy != KernelCompatPolicyDegrade {
+		return nil, fmt.Errorf("invalid kernelCompatPolicy %s", config.KernelCompatPolicy)
+	}
+	if config.TapOwnershipPolicy != TapOwnershipPolicyFail &&
+		config.TapOwnershipPolicy != TapOwnershipPolicyFallback {
+		return nil, fmt.Errorf("invalid tapOwnershipPolicy %s", config.TapOwnershipPolicy)
+	}
+	if config.AddOverflowPolicy != AddOverflowPolicyWait &&
+		config.AddOverflowPolicy != AddOverflowPolicyFail {
+		return nil, fmt.Errorf("invalid addOverflowPolicy %s", config.AddOverflowPolicy)
+	}
+	if config.StrayBranchPolicy != StrayBranchPolicyReuse &&
+		config.StrayBranchPolicy != StrayBranchPolicyRecreate {
+		return nil, fmt.Errorf("invalid strayBranchPolicy %s", config.StrayBranchPolicy)
+	}
+	if config.BranchDeleteOrder != BranchDeleteOrderNetNSClose &&
+		config.BranchDeleteOrder != BranchDeleteOrderBranchFirst {
+		return nil, fmt.Errorf("invalid branchDeleteOrder %s", config.BranchDeleteOrder)
+	}
+	if config.NATMode != NATModeMasquerade && config.NATMode != NATModeNone {
+		return nil, fmt.Errorf("invalid natMode %s", config.NATMode)
+	}
+
+	// Parse the trunk isolation mode. VLAN isolation is the long-standing default, and its
+	// support is only checked when the branch link is created. Other modes are checked up front.
+	var trunkIsolationMode eni.IsolationMode
+	switch config.TrunkIsolationMode {
+	case TrunkIsolationModeVLAN:
+		trunkIsolationMode = eni.TrunkIsolationModeVLAN
+	case TrunkIsolationModeMACVLAN:
+		trunkIsolationMode = eni.TrunkIsolationModeMACVLAN
+		if isAdd {
+			err = checkKernelIsolationModeSupport(trunkIsolationMode)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trunkIsolationMode %s: %v", config.TrunkIsolationMode, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid trunkIsolationMode %s", config.TrunkIsolationMode)
+	}
+
 	// Populate NetConfig.
 	netConfig := NetConfig{
-		NetConf:         config.NetConf,
-		TrunkName:       config.TrunkName,
-		CleanupPATNetNS: config.CleanupPATNetNS,
+		NetConf:                  config.NetConf,
+		TrunkName:                config.TrunkName,
+		CleanupPATNetNS:          config.CleanupPATNetNS,
+		AuditNetlink:             config.AuditNetlink,
+		RelocateBridgeSubnet:     config.RelocateBridgeSubnet,
+		NetNSCloseAttempts:       defaultNetNSCloseAttempts,
+		NetNSCloseRetryDelay:     defaultNetNSCloseRetryDelay,
+		BranchUpBeforeAddress:    config.BranchUpBeforeAddress,
+		KernelCompatPolicy:       config.KernelCompatPolicy,
+		TapOwnershipPolicy:       config.TapOwnershipPolicy,
+		AddBurst:                 defaultAddBurst,
+		AddOverflowPolicy:        config.AddOverflowPolicy,
+		TrunkIsolationMode:       trunkIsolationMode,
+		TapFdSocket:              config.TapFdSocket,
+		EventSocket:              config.EventSocket,
+		PreserveBridgeFDB:        config.PreserveBridgeFDB,
+		VerifyTeardown:           config.VerifyTeardown,
+		StrayBranchPolicy:        config.StrayBranchPolicy,
+		BranchDeleteOrder:        config.BranchDeleteOrder,
+		BridgeEthertypeFilter:    config.BridgeEthertypeFilter,
+		DisableSTP:               config.DisableSTP == nil || *config.DisableSTP,
+		MasqueradePortRange:      defaultMasqueradePortRange,
+		NATMode:                  config.NATMode,
+		TapQueues:                defaultTapQueues,
+		TapVhost:                 config.TapVhost,
+		PersistTap:               config.PersistTap,
+		DiscoverBranchSubnet:     config.DiscoverBranchSubnet,
+		MetricsFile:              config.MetricsFile,
+		CheckBranchIPConflict:    config.CheckBranchIPConflict == nil || *config.CheckBranchIPConflict,
+		PrevResult:               prevResult,
+		FDBCacheSize:             defaultFDBCacheSize,
+		ECMP:                     config.ECMP,
+		SkipIptables:             config.SkipIptables,
+		TapAlias:                 config.TapAlias,
+		EarlyTapCreation:         config.EarlyTapCreation,
+		MTU:                      vpc.JumboFrameMTU,
+		RequireExistingNamespace: config.RequireExistingNamespace,
+		BridgeName:               config.BridgeName,
+		GroupName:                config.GroupName,
+		VerifyNAT:                config.VerifyNAT,
+		NATVerifyTarget:          config.NATVerifyTarget,
+		NATVerifyTimeout:         defaultNATVerifyTimeout,
+		BranchIPv6LinkLocalOnly:  config.BranchIPv6LinkLocalOnly,
+		BranchIPv6UseTempAddr:    UnsetIPv6UseTempAddr,
+		MulticastQuerier:         config.MulticastQuerier,
 	}
 
 	// Parse the trunk MAC address.
@@ -88,8 +522,9 @@ func New(args *cniSkel.CmdArgs, isAdd bool) (*NetConfig, error) {
 
 	// Parse the branch VLAN ID.
 	netConfig.BranchVlanID, err = strconv.Atoi(config.BranchVlanID)
-	if err != nil {
-		return nil, fmt.Errorf("invalid branchVlanID %s", config.BranchVlanID)
+	if err != nil || netConfig.BranchVlanID < minVlanID || netConfig.BranchVlanID > maxVlanID {
+		return nil, fmt.Errorf("invalid branchVlanID %s, must be a number between %d and %d",
+			config.BranchVlanID, minVlanID, maxVlanID)
 	}
 
 	// Parse the optional branch MAC address.
@@ -100,13 +535,43 @@ func New(args *cniSkel.CmdArgs, isAdd bool) (*NetConfig, error) {
 		}
 	}
 
+	// Parse the optional tap MAC address. By default, it is derived from the branch VLAN ID, so that
+	// it is stable across tap link recreation.
+	if config.TapMACAddress != "" {
+		netConfig.TapMACAddress, err = net.ParseMAC(config.TapMACAddress)
+		if err != nil || len(netConfig.TapMACAddress) != 6 || netConfig.TapMACAddress[0]&0x01 != 0 {
+			return nil, fmt.Errorf("invalid tapMACAddress %s", config.TapMACAddress)
+		}
+	} else {
+		netConfig.TapMACAddress = newTapMACAddress(netConfig.BranchVlanID)
+	}
+
 	// Parse the optional branch IP address.
 	if config.BranchIPAddress != "" {
 		ipAddr, err := vpc.GetIPAddressFromString(config.BranchIPAddress)
-		netConfig.BranchIPAddress = *ipAddr
 		if err != nil {
 			return nil, fmt.Errorf("invalid branchIPAddress %s", config.BranchIPAddress)
 		}
+		netConfig.BranchIPAddress = *ipAddr
+	}
+
+	// The branch subnet is discovered for the branch IP address.
+	if isAdd && config.DiscoverBranchSubnet && config.BranchIPAddress == "" {
+		return nil, fmt.Errorf("discoverBranchSubnet requires branchIPAddress")
+	}
+
+	// Parse the optional branch IPv6 address.
+	if config.BranchIPv6Address != "" {
+		ipAddr, err := vpc.GetIPAddressFromString(config.BranchIPv6Address)
+		if err != nil || ipAddr.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid branchIPv6Address %s", config.BranchIPv6Address)
+		}
+		netConfig.BranchIPv6Address = *ipAddr
+	}
+
+	// Link-local-only branches get their global IPv6 address from RAs, not from the config.
+	if config.BranchIPv6LinkLocalOnly && config.BranchIPv6Address != "" {
+		return nil, fmt.Errorf("branchIPv6LinkLocalOnly and branchIPv6Address are mutually exclusive")
 	}
 
 	// Parse the optional TAP interface UID and GID.
@@ -117,6 +582,33 @@ func New(args *cniSkel.CmdArgs, isAdd bool) (*NetConfig, error) {
 		}
 	}
 
+	// Validate that the TAP interface UID is within the optional allowed range.
+	if config.MinUid != "" {
+		minUid, err := strconv.Atoi(config.MinUid)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minUid %s", config.MinUid)
+		}
+		if netConfig.Uid < minUid {
+			return nil, fmt.Errorf("UID %d is less than minUid %d", netConfig.Uid, minUid)
+		}
+	}
+
+	if config.MaxUid != "" {
+		maxUid, err := strconv.Atoi(config.MaxUid)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxUid %s", config.MaxUid)
+		}
+		if netConfig.Uid > maxUid {
+			return nil, fmt.Errorf("UID %d is greater than maxUid %d", netConfig.Uid, maxUid)
+		}
+	}
+
+	// Parse the optional TAP interface GID, given either directly or as a group name.
+	netConfig.Gid = UnsetGid
+	if config.Gid != "" && config.GroupName != "" {
+		return nil, fmt.Errorf("gid and groupName are mutually exclusive")
+	}
+
 	if config.Gid != "" {
 		netConfig.Gid, err = strconv.Atoi(config.Gid)
 		if err != nil {
@@ -124,7 +616,373 @@ func New(args *cniSkel.CmdArgs, isAdd bool) (*NetConfig, error) {
 		}
 	}
 
+	if config.GroupName != "" {
+		netConfig.Gid, err = lookupGroup(config.GroupName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid groupName %s: %v", config.GroupName, err)
+		}
+	}
+
+	// Parse the optional PAT netns close retry settings.
+	if config.NetNSCloseAttempts != "" {
+		netConfig.NetNSCloseAttempts, err = strconv.Atoi(config.NetNSCloseAttempts)
+		if err != nil || netConfig.NetNSCloseAttempts < 1 {
+			return nil, fmt.Errorf("invalid netNSCloseAttempts %s", config.NetNSCloseAttempts)
+		}
+	}
+
+	if config.NetNSCloseRetryDelay != "" {
+		netConfig.NetNSCloseRetryDelay, err = time.ParseDuration(config.NetNSCloseRetryDelay)
+		if err != nil || netConfig.NetNSCloseRetryDelay < 0 {
+			return nil, fmt.Errorf("invalid netNSCloseRetryDelay %s", config.NetNSCloseRetryDelay)
+		}
+	}
+
+	// Parse the optional time to wait for the tap link to be released on DEL.
+	if config.TapReleaseTimeout != "" {
+		netConfig.TapReleaseTimeout, err = time.ParseDuration(config.TapReleaseTimeout)
+		if err != nil || netConfig.TapReleaseTimeout < 0 {
+			return nil, fmt.Errorf("invalid tapReleaseTimeout %s", config.TapReleaseTimeout)
+		}
+	}
+
+	// Validate the PAT bridge name.
+	if !isValidLinkName(config.BridgeName) ||
+		len(config.BridgeName)+len(dummyLinkNameSuffix) > maxLinkNameLength {
+		return nil, fmt.Errorf("invalid bridgeName %s", config.BridgeName)
+	}
+
+	// Validate the optional NAT verification settings.
+	if config.VerifyNAT {
+		_, _, err = net.SplitHostPort(config.NATVerifyTarget)
+		if err != nil {
+			return nil, fmt.Errorf("invalid natVerifyTarget %s", config.NATVerifyTarget)
+		}
+		if config.NATMode == NATModeNone {
+			return nil, fmt.Errorf("verifyNAT requires natMode %s", NATModeMasquerade)
+		}
+	}
+
+	if config.NATVerifyTimeout != "" {
+		netConfig.NATVerifyTimeout, err = time.ParseDuration(config.NATVerifyTimeout)
+		if err != nil || netConfig.NATVerifyTimeout <= 0 {
+			return nil, fmt.Errorf("invalid natVerifyTimeout %s", config.NATVerifyTimeout)
+		}
+	}
+
+	// Parse the PAT bridge IP address.
+	bridgeIPAddress, err := vpc.GetIPAddressFromString(config.BridgeIPAddress)
+	if err != nil || bridgeIPAddress.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid bridgeIPAddress %s", config.BridgeIPAddress)
+	}
+	netConfig.BridgeIPAddress = *bridgeIPAddress
+
+	// Parse the PAT bridge IPv6 address. It is used only on dual-stack branches.
+	bridgeIPv6Address, err := vpc.GetIPAddressFromString(config.BridgeIPv6Address)
+	if err != nil || bridgeIPv6Address.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid bridgeIPv6Address %s", config.BridgeIPv6Address)
+	}
+	netConfig.BridgeIPv6Address = *bridgeIPv6Address
+
+	// Parse the optional branch gateway IP addresses.
+	for _, gateway := range config.BranchGatewayIPAddresses {
+		ip := net.ParseIP(gateway)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid branchGatewayIPAddresses %s", gateway)
+		}
+		netConfig.BranchGatewayIPAddresses = append(netConfig.BranchGatewayIPAddresses, ip)
+	}
+
+	// Parse the optional DNS ports.
+	for _, portString := range config.DNSPorts {
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid dnsPorts %s", portString)
+		}
+		netConfig.DNSPorts = append(netConfig.DNSPorts, int(port))
+	}
+	if len(netConfig.DNSPorts) == 0 {
+		netConfig.DNSPorts = []int{defaultDNSPort}
+	}
+
+	// Parse the optional input ports open to the PAT bridge.
+	for _, portSpec := range config.AllowedInputPorts {
+		port, err := strconv.ParseUint(portSpec.Port, 10, 16)
+		if err != nil || port == 0 || (portSpec.Protocol != "tcp" && portSpec.Protocol != "udp") {
+			return nil, fmt.Errorf("invalid allowedInputPorts %s/%s", portSpec.Port, portSpec.Protocol)
+		}
+		netConfig.AllowedInputPorts = append(netConfig.AllowedInputPorts,
+			PortSpec{Port: uint16(port), Protocol: portSpec.Protocol})
+	}
+
+	// Parse the optional branch backpressure drop threshold.
+	if config.BranchDropThreshold != "" {
+		netConfig.BranchDropThreshold, err = strconv.ParseUint(config.BranchDropThreshold, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid branchDropThreshold %s", config.BranchDropThreshold)
+		}
+	}
+
+	// Parse the optional limit on the number of PAT netns on this node. Zero means unlimited.
+	if config.MaxPATNetNS != "" {
+		netConfig.MaxPATNetNS, err = strconv.Atoi(config.MaxPATNetNS)
+		if err != nil || netConfig.MaxPATNetNS < 0 {
+			return nil, fmt.Errorf("invalid maxPATNetNS %s", config.MaxPATNetNS)
+		}
+	}
+
+	// Parse the optional conntrack mark for egress connections. Zero means no mark.
+	if config.ConnMark != "" {
+		connMark, err := strconv.ParseUint(config.ConnMark, 0, 32)
+		if err != nil || connMark == 0 {
+			return nil, fmt.Errorf("invalid connMark %s", config.ConnMark)
+		}
+		netConfig.ConnMark = uint32(connMark)
+	}
+
+	// Parse the optional masquerade port range.
+	if config.MasqueradePortRange != "" {
+		low, high, err := parsePortRange(config.MasqueradePortRange)
+		if err != nil || low < minMasqueradePort || low >= high || high > maxMasqueradePort {
+			return nil, fmt.Errorf("invalid masqueradePortRange %s", config.MasqueradePortRange)
+		}
+		netConfig.MasqueradePortRange = config.MasqueradePortRange
+	}
+
+	// Parse the optional number of tap queues.
+	if config.TapQueues != "" {
+		netConfig.TapQueues, err = strconv.Atoi(config.TapQueues)
+		if err != nil || netConfig.TapQueues < 1 || netConfig.TapQueues > maxTapQueues {
+			return nil, fmt.Errorf("invalid tapQueues %s", config.TapQueues)
+		}
+	}
+
+	// Parse the optional DSCP to tap queue mapping.
+	if len(config.DSCPQueueMap) != 0 {
+		netConfig.DSCPQueueMap = make(map[uint8]uint16)
+		for dscpString, queueString := range config.DSCPQueueMap {
+			dscp, err := strconv.ParseUint(dscpString, 10, 8)
+			if err != nil || dscp > maxDSCP {
+				return nil, fmt.Errorf("invalid dscpQueueMap DSCP %s", dscpString)
+			}
+			queue, err := strconv.ParseUint(queueString, 10, 16)
+			if err != nil || queue >= uint64(netConfig.TapQueues) {
+				return nil, fmt.Errorf("invalid dscpQueueMap queue %s", queueString)
+			}
+			netConfig.DSCPQueueMap[uint8(dscp)] = uint16(queue)
+		}
+	}
+
+	// Parse the optional node-wide ADD rate limit. Zero means unlimited.
+	if config.AddRateLimit != "" {
+		netConfig.AddRateLimit, err = strconv.ParseFloat(config.AddRateLimit, 64)
+		if err != nil || netConfig.AddRateLimit < 0 ||
+			math.IsNaN(netConfig.AddRateLimit) || math.IsInf(netConfig.AddRateLimit, 0) {
+			return nil, fmt.Errorf("invalid addRateLimit %s", config.AddRateLimit)
+		}
+	}
+
+	if config.AddBurst != "" {
+		netConfig.AddBurst, err = strconv.Atoi(config.AddBurst)
+		if err != nil || netConfig.AddBurst < 1 {
+			return nil, fmt.Errorf("invalid addBurst %s", config.AddBurst)
+		}
+	}
+
+	// Parse the optional maximum number of PAT bridge FDB entries saved per VLAN ID.
+	if config.FDBCacheSize != "" {
+		netConfig.FDBCacheSize, err = strconv.Atoi(config.FDBCacheSize)
+		if err != nil || netConfig.FDBCacheSize < 1 {
+			return nil, fmt.Errorf("invalid fdbCacheSize %s", config.FDBCacheSize)
+		}
+	}
+
+	// Parse the optional branch ring buffer sizes. Zero leaves the driver defaults unchanged.
+	// The sizes are validated against the driver maximums when they are applied.
+	if config.BranchRxRingSize != "" {
+		size, err := strconv.ParseUint(config.BranchRxRingSize, 10, 32)
+		if err != nil || size == 0 {
+			return nil, fmt.Errorf("invalid branchRxRingSize %s", config.BranchRxRingSize)
+		}
+		netConfig.BranchRxRingSize = uint32(size)
+	}
+
+	if config.BranchTxRingSize != "" {
+		size, err := strconv.ParseUint(config.BranchTxRingSize, 10, 32)
+		if err != nil || size == 0 {
+			return nil, fmt.Errorf("invalid branchTxRingSize %s", config.BranchTxRingSize)
+		}
+		netConfig.BranchTxRingSize = uint32(size)
+	}
+
+	// Parse the optional branch IPv6 privacy extensions setting for SLAAC addresses. 0 disables
+	// temporary addresses, 1 generates them and 2 also prefers them over public addresses.
+	if config.BranchIPv6UseTempAddr != "" {
+		netConfig.BranchIPv6UseTempAddr, err = strconv.Atoi(config.BranchIPv6UseTempAddr)
+		if err != nil || netConfig.BranchIPv6UseTempAddr < 0 || netConfig.BranchIPv6UseTempAddr > 2 {
+			return nil, fmt.Errorf("invalid branchIPv6UseTempAddr %s", config.BranchIPv6UseTempAddr)
+		}
+	}
+
+	// Parse the optional MTU.
+	if config.MTU != "" {
+		netConfig.MTU, err = strconv.Atoi(config.MTU)
+		if err != nil || netConfig.MTU < minMTU || netConfig.MTU > maxMTU {
+			return nil, fmt.Errorf("invalid mtu %s", config.MTU)
+		}
+	}
+
+	// Parse the optional branch neighbor table parameters. Zero keeps the kernel defaults.
+	if config.NeighBaseReachableTimeMs != "" {
+		netConfig.NeighBaseReachableTimeMs, err = strconv.Atoi(config.NeighBaseReachableTimeMs)
+		if err != nil || netConfig.NeighBaseReachableTimeMs <= 0 {
+			return nil, fmt.Errorf("invalid neighBaseReachableTimeMs %s", config.NeighBaseReachableTimeMs)
+		}
+	}
+
+	if config.NeighGCStaleTime != "" {
+		netConfig.NeighGCStaleTime, err = strconv.Atoi(config.NeighGCStaleTime)
+		if err != nil || netConfig.NeighGCStaleTime <= 0 {
+			return nil, fmt.Errorf("invalid neighGCStaleTime %s", config.NeighGCStaleTime)
+		}
+	}
+
+	// Validate the optional DNS nameservers echoed in the CNI result.
+	for _, nameserver := range config.DNS.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			return nil, fmt.Errorf("invalid dns nameserver %s", nameserver)
+		}
+	}
+
 	// Validation complete. Return the parsed NetConfig object.
 	log.Debugf("Created NetConfig: %+v", config)
 	return &netConfig, nil
 }
+
+// IsDualStack returns whether the branch has IPv6 connectivity, either through a static IPv6
+// address or through addresses configured from RAs in link-local-only mode.
+func (netConfig *NetConfig) IsDualStack() bool {
+	return netConfig.BranchIPv6Address.IP != nil || netConfig.BranchIPv6LinkLocalOnly
+}
+
+// lookupGroup returns the GID of the given group. Numeric group names are returned as is, so that
+// GIDs without a matching group entry on the host can be used.
+func lookupGroup(groupName string) (int, error) {
+	if gid, err := strconv.Atoi(groupName); err == nil {
+		return gid, nil
+	}
+
+	group, err := user.LookupGroup(groupName)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(group.Gid)
+}
+
+// parseCNIVersion parses a CNI version string of the form major.minor.patch.
+func parseCNIVersion(version string) ([3]int, error) {
+	var parsed [3]int
+	parts := strings.Split(version, ".")
+	if len(parts) != len(parsed) {
+		return parsed, fmt.Errorf("invalid version %s", version)
+	}
+
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, fmt.Errorf("invalid version %s", version)
+		}
+		parsed[i] = n
+	}
+
+	return parsed, nil
+}
+
+// parsePortRange parses a port range in low-high format.
+func parsePortRange(portRange string) (int, int, error) {
+	ports := strings.Split(portRange, "-")
+	if len(ports) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %s", portRange)
+	}
+
+	low, err := strconv.Atoi(ports[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	high, err := strconv.Atoi(ports[1])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return low, high, nil
+}
+
+// parsePrevResult parses the result of the previous plugin in a chain, and converts it to the
+// current result version. The result version defaults to the network config version. Version
+// 0.4.0 results have the same format as the current version, so they are parsed as such. Version
+// 1.0.0 results omit the IP address version, which is derived from the address instead.
+func parsePrevResult(rawPrevResult map[string]interface{}, version string) (*cniTypesCurrent.Result, error) {
+	if v, ok := rawPrevResult["cniVersion"].(string); ok && v != "" {
+		version = v
+	}
+	fillIPVersions := version == "1.0.0"
+	if version == "0.4.0" || version == "1.0.0" {
+		version = cniTypesCurrent.ImplementedSpecVersion
+	}
+
+	data, err := json.Marshal(rawPrevResult)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := cniVersion.NewResult(version, data)
+	if err != nil {
+		return nil, err
+	}
+
+	currentResult, err := cniTypesCurrent.NewResultFromResult(result)
+	if err != nil {
+		return nil, err
+	}
+
+	if fillIPVersions {
+		for _, ip := range currentResult.IPs {
+			ip.Version = "6"
+			if ip.Address.IP.To4() != nil {
+				ip.Version = "4"
+			}
+		}
+	}
+
+	return currentResult, nil
+}
+
+// compareCNIVersions returns -1, 0 or 1 if the first CNI version is older than, the same as,
+// or newer than the second one.
+func compareCNIVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		}
+		if a[i] > b[i] {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// isValidLinkName returns whether the given string is a legal Linux network interface name.
+func isValidLinkName(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > maxLinkNameLength {
+		return false
+	}
+	return !strings.ContainsAny(name, "/: \t\n")
+}
+
+// newTapMACAddress returns the default tap MAC address for the given branch VLAN ID. It is a
+// locally administered unicast address that encodes the VLAN ID in its last two octets.
+func newTapMACAddress(vlanID int) net.HardwareAddr {
+	return net.HardwareAddr{0x02, 0x00, 0x00, 0x00, byte(vlanID >> 8), byte(vlanID)}
+}
@@ -16,7 +16,11 @@
 package config
 
 import (
+	"fmt"
 	"testing"
+	"time"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/stretchr/testify/assert"
@@ -46,3 +50,994 @@ func TestValidConfig(t *testing.T) {
 	assert.Equal(t, "10.0.1.42/24", netConfig.BranchIPAddress.String())
 	assert.True(t, netConfig.CleanupPATNetNS)
 }
+
+func TestAuditNetlinkConfig(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.False(t, netConfig.AuditNetlink)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "auditNetlink":true}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.AuditNetlink)
+}
+
+func TestNetNSCloseRetryConfig(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(config),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultNetNSCloseAttempts, netConfig.NetNSCloseAttempts)
+	assert.Equal(t, defaultNetNSCloseRetryDelay, netConfig.NetNSCloseRetryDelay)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "netNSCloseAttempts":"5", "netNSCloseRetryDelay":"1s"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, netConfig.NetNSCloseAttempts)
+	assert.Equal(t, time.Second, netConfig.NetNSCloseRetryDelay)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "netNSCloseAttempts":"0"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "netNSCloseRetryDelay":"soon"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestUidRange(t *testing.T) {
+	testCases := []struct {
+		config  string
+		isValid bool
+	}{
+		{`{"trunkName":"eth0", "branchVlanID":"101", "uid":"0"}`, true},
+		{`{"trunkName":"eth0", "branchVlanID":"101", "uid":"1000", "minUid":"1000", "maxUid":"2000"}`, true},
+		{`{"trunkName":"eth0", "branchVlanID":"101", "uid":"2000", "minUid":"1000", "maxUid":"2000"}`, true},
+		{`{"trunkName":"eth0", "branchVlanID":"101", "uid":"999", "minUid":"1000"}`, false},
+		{`{"trunkName":"eth0", "branchVlanID":"101", "minUid":"1000"}`, false},
+		{`{"trunkName":"eth0", "branchVlanID":"101", "uid":"2001", "maxUid":"2000"}`, false},
+		{`{"trunkName":"eth0", "branchVlanID":"101", "uid":"1000", "minUid":"abc"}`, false},
+	}
+	for _, tc := range testCases {
+		args := &skel.CmdArgs{
+			StdinData: []byte(tc.config),
+		}
+		_, err := New(args, false)
+		if tc.isValid {
+			assert.NoError(t, err, tc.config)
+		} else {
+			assert.Error(t, err, tc.config)
+		}
+	}
+}
+
+func TestDNSNameservers(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101", "dns":{"nameservers":["10.0.0.2", "fd00::2"]}}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2", "fd00::2"}, netConfig.DNS.Nameservers)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "dns":{"nameservers":["resolver"]}}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestBranchDropThreshold(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchDropThreshold":"500"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(500), netConfig.BranchDropThreshold)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchDropThreshold":"-1"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestBranchGatewayIPAddresses(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101", "ecmp":true, "branchGatewayIPAddresses":["10.0.1.1", "10.0.1.2"]}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.ECMP)
+	assert.Len(t, netConfig.BranchGatewayIPAddresses, 2)
+	assert.Equal(t, "10.0.1.2", netConfig.BranchGatewayIPAddresses[1].String())
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchGatewayIPAddresses":["gateway"]}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestTapAliasFromPodName(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+		Args:      "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod-a",
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "default/pod-a", netConfig.TapAlias)
+
+	// An explicitly configured alias takes precedence.
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "tapAlias":"vm-1"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "vm-1", netConfig.TapAlias)
+}
+
+func TestNeighParams(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, netConfig.NeighBaseReachableTimeMs)
+	assert.Equal(t, 0, netConfig.NeighGCStaleTime)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "neighBaseReachableTimeMs":"60000", "neighGCStaleTime":"120"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 60000, netConfig.NeighBaseReachableTimeMs)
+	assert.Equal(t, 120, netConfig.NeighGCStaleTime)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "neighGCStaleTime":"0"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestBridgeIPAddress(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.122.1/24", netConfig.BridgeIPAddress.String())
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "bridgeIPAddress":"100.64.10.1/24"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "100.64.10.1/24", netConfig.BridgeIPAddress.String())
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "bridgeIPAddress":"100.64.10.1"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestEarlyTapCreation(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101", "earlyTapCreation":true}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.EarlyTapCreation)
+}
+
+func TestMTU(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 9001, netConfig.MTU)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "mtu":"1500"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1500, netConfig.MTU)
+
+	for _, mtu := range []string{"575", "9002", "jumbo"} {
+		args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "mtu":"` + mtu + `"}`)
+		_, err = New(args, false)
+		assert.Error(t, err, "mtu %s", mtu)
+	}
+}
+
+func TestRequireExistingNamespace(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.False(t, netConfig.RequireExistingNamespace)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "requireExistingNamespace":true}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.RequireExistingNamespace)
+}
+
+func TestBridgeName(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "virbr0", netConfig.BridgeName)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "bridgeName":"patbr101"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "patbr101", netConfig.BridgeName)
+
+	for _, name := range []string{"pat/br", "pat br", "..", "patbridge10", "averyverylongname"} {
+		args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "bridgeName":"` + name + `"}`)
+		_, err = New(args, false)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestIPv6Addresses(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Nil(t, netConfig.BranchIPv6Address.IP)
+	assert.Equal(t, "fd00:c0a8:7a::1/64", netConfig.BridgeIPv6Address.String())
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101",
+		"branchIPv6Address":"2600:1f14:abc:de00::10/64", "bridgeIPv6Address":"fd12:3456::1/64"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "2600:1f14:abc:de00::10/64", netConfig.BranchIPv6Address.String())
+	assert.Equal(t, "fd12:3456::1/64", netConfig.BridgeIPv6Address.String())
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchIPv6Address":"10.0.0.10/24"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "bridgeIPv6Address":"192.168.122.1/24"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestGroupName(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, UnsetGid, netConfig.Gid)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "gid":"1000"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, netConfig.Gid)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "groupName":"root"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, netConfig.Gid)
+	assert.Equal(t, "root", netConfig.GroupName)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "groupName":"65534"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 65534, netConfig.Gid)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "groupName":"no-such-group"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "gid":"0", "groupName":"root"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestVerifyNAT(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.False(t, netConfig.VerifyNAT)
+	assert.Equal(t, 2*time.Second, netConfig.NATVerifyTimeout)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "verifyNAT":true,
+		"natVerifyTarget":"10.0.0.2:443", "natVerifyTimeout":"500ms"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.VerifyNAT)
+	assert.Equal(t, "10.0.0.2:443", netConfig.NATVerifyTarget)
+	assert.Equal(t, 500*time.Millisecond, netConfig.NATVerifyTimeout)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "verifyNAT":true}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "natVerifyTimeout":"0s"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestBranchIPv6LinkLocalOnly(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchIPv6LinkLocalOnly":true}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.BranchIPv6LinkLocalOnly)
+	assert.Nil(t, netConfig.BranchIPv6Address.IP)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchIPv6LinkLocalOnly":true,
+		"branchIPv6Address":"2600:1f14:abc:de00::10/64"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestMulticastQuerier(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.False(t, netConfig.MulticastQuerier)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "multicastQuerier":true}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.MulticastQuerier)
+}
+
+func TestMaxPATNetNS(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, netConfig.MaxPATNetNS)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "maxPATNetNS":"64"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 64, netConfig.MaxPATNetNS)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "maxPATNetNS":"-1"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestTapReleaseTimeout(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), netConfig.TapReleaseTimeout)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "tapReleaseTimeout":"2s"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Second, netConfig.TapReleaseTimeout)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "tapReleaseTimeout":"-1s"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestConnMark(t *testing.T) {
+	testCases := []struct {
+		connMark string
+		expected uint32
+		valid    bool
+	}{
+		{"", 0, true},
+		{"42", 42, true},
+		{"0x2a", 0x2a, true},
+		{"0xffffffff", 0xffffffff, true},
+		{"0", 0, false},
+		{"0x100000000", 0, false},
+		{"-1", 0, false},
+		{"mark", 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.connMark, func(t *testing.T) {
+			args := &skel.CmdArgs{
+				StdinData: []byte(fmt.Sprintf(
+					`{"trunkName":"eth0", "branchVlanID":"101", "connMark":"%s"}`, tc.connMark)),
+			}
+			netConfig, err := New(args, false)
+			if !tc.valid {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, netConfig.ConnMark)
+		})
+	}
+}
+
+func TestAddRateLimit(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), netConfig.AddRateLimit)
+	assert.Equal(t, 1, netConfig.AddBurst)
+	assert.Equal(t, AddOverflowPolicyWait, netConfig.AddOverflowPolicy)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101",
+		"addRateLimit":"2.5", "addBurst":"10", "addOverflowPolicy":"fail"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, netConfig.AddRateLimit)
+	assert.Equal(t, 10, netConfig.AddBurst)
+	assert.Equal(t, AddOverflowPolicyFail, netConfig.AddOverflowPolicy)
+
+	for _, invalid := range []string{
+		`"addRateLimit":"-1"`,
+		`"addRateLimit":"NaN"`,
+		`"addBurst":"0"`,
+		`"addOverflowPolicy":"drop"`,
+	} {
+		args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", ` + invalid + `}`)
+		_, err = New(args, false)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestTrunkIsolationMode(t *testing.T) {
+	defer func(f func(eni.IsolationMode) error) { checkKernelIsolationModeSupport = f }(
+		checkKernelIsolationModeSupport)
+	supported := true
+	checkKernelIsolationModeSupport = func(eni.IsolationMode) error {
+		if !supported {
+			return fmt.Errorf("not supported by the running kernel")
+		}
+		return nil
+	}
+
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchMACAddress":"01:23:45:67:89:ab"}`),
+	}
+	netConfig, err := New(args, true)
+	assert.NoError(t, err)
+	assert.Equal(t, eni.TrunkIsolationModeVLAN, netConfig.TrunkIsolationMode)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchMACAddress":"01:23:45:67:89:ab",
+		"trunkIsolationMode":"macvlan"}`)
+	netConfig, err = New(args, true)
+	assert.NoError(t, err)
+	assert.Equal(t, eni.TrunkIsolationModeMACVLAN, netConfig.TrunkIsolationMode)
+
+	// The kernel support is checked only for ADD.
+	supported = false
+	_, err = New(args, true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not supported by the running kernel")
+	_, err = New(args, false)
+	assert.NoError(t, err)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "trunkIsolationMode":"gre"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestFDBCacheSize(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101", "preserveBridgeFDB":true}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.PreserveBridgeFDB)
+	assert.Equal(t, defaultFDBCacheSize, netConfig.FDBCacheSize)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "fdbCacheSize":"32"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 32, netConfig.FDBCacheSize)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "fdbCacheSize":"0"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestMinCNIVersion(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"cniVersion":"0.3.1", "trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	_, err := New(args, false)
+	assert.NoError(t, err)
+
+	// Versions older than the configured minimum are rejected.
+	args.StdinData = []byte(`{"cniVersion":"0.3.1", "trunkName":"eth0", "branchVlanID":"101",
+		"minCNIVersion":"0.4.0"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "CNI version 0.3.1 is older than the minimum required version 0.4.0")
+
+	// Versions older than the default minimum are rejected.
+	args.StdinData = []byte(`{"cniVersion":"0.2.0", "trunkName":"eth0", "branchVlanID":"101"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "minimum required version 0.3.0")
+
+	// Versions are compared numerically.
+	args.StdinData = []byte(`{"cniVersion":"0.10.0", "trunkName":"eth0", "branchVlanID":"101",
+		"minCNIVersion":"0.4.0"}`)
+	_, err = New(args, false)
+	assert.NoError(t, err)
+
+	args.StdinData = []byte(`{"cniVersion":"0.3.1", "trunkName":"eth0", "branchVlanID":"101",
+		"minCNIVersion":"latest"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestBranchRingSize(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), netConfig.BranchRxRingSize)
+	assert.Equal(t, uint32(0), netConfig.BranchTxRingSize)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101",
+		"branchRxRingSize":"8192", "branchTxRingSize":"1024"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(8192), netConfig.BranchRxRingSize)
+	assert.Equal(t, uint32(1024), netConfig.BranchTxRingSize)
+
+	for _, size := range []string{"0", "-1", "large"} {
+		args.StdinData = []byte(fmt.Sprintf(`{"trunkName":"eth0", "branchVlanID":"101",
+			"branchRxRingSize":"%s"}`, size))
+		_, err = New(args, false)
+		assert.Error(t, err)
+	}
+}
+
+func TestStrayBranchPolicy(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, StrayBranchPolicyReuse, netConfig.StrayBranchPolicy)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "strayBranchPolicy":"recreate"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, StrayBranchPolicyRecreate, netConfig.StrayBranchPolicy)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "strayBranchPolicy":"ignore"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestBranchIPv6UseTempAddr(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, UnsetIPv6UseTempAddr, netConfig.BranchIPv6UseTempAddr)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchIPv6UseTempAddr":"0"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, netConfig.BranchIPv6UseTempAddr)
+
+	for _, invalid := range []string{"-1", "3", "on"} {
+		args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchIPv6UseTempAddr":"` + invalid + `"}`)
+		_, err = New(args, false)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestBranchVlanID(t *testing.T) {
+	testCases := []struct {
+		vlanID   string
+		expected int
+		valid    bool
+	}{
+		{"1", 1, true},
+		{"2048", 2048, true},
+		{"4094", 4094, true},
+		{"0", 0, false},
+		{"4095", 0, false},
+		{"-1", 0, false},
+		{"abc", 0, false},
+		{"101a", 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.vlanID, func(t *testing.T) {
+			args := &skel.CmdArgs{
+				StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"` + tc.vlanID + `"}`),
+			}
+			netConfig, err := New(args, false)
+			if !tc.valid {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), "invalid branchVlanID "+tc.vlanID)
+					assert.Contains(t, err.Error(), "between 1 and 4094")
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, netConfig.BranchVlanID)
+		})
+	}
+}
+
+func TestMalformedBranchConfig(t *testing.T) {
+	for field, invalid := range map[string]string{
+		"branchVlanID":      `"branchVlanID":"abc", "branchMACAddress":"02:00:00:00:00:01"`,
+		"branchVlanID 0":    `"branchVlanID":"0", "branchMACAddress":"02:00:00:00:00:01"`,
+		"branchVlanID 4095": `"branchVlanID":"4095", "branchMACAddress":"02:00:00:00:00:01"`,
+		"branchMACAddress":  `"branchVlanID":"101", "branchMACAddress":"02:00:00:00:00"`,
+		"branchIPAddress":   `"branchVlanID":"101", "branchMACAddress":"02:00:00:00:00:01", "branchIPAddress":"10.0.1.5"`,
+	} {
+		args := &skel.CmdArgs{
+			StdinData: []byte(`{"trunkName":"eth0", ` + invalid + `}`),
+		}
+		_, err := New(args, true)
+		if assert.Error(t, err, field) {
+			assert.Contains(t, err.Error(), "invalid "+field, invalid)
+		}
+	}
+}
+
+func TestBranchDeleteOrder(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, BranchDeleteOrderNetNSClose, netConfig.BranchDeleteOrder)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchDeleteOrder":"branchFirst"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, BranchDeleteOrderBranchFirst, netConfig.BranchDeleteOrder)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchDeleteOrder":"last"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestPerContainerArgsOverrides(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101", "uid":"1000", "mtu":"1500",
+			"minUid":"1000", "maxUid":"2000"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, netConfig.Uid)
+	assert.Equal(t, 1500, netConfig.MTU)
+
+	// Per-container arguments override the network config.
+	args.Args = "IgnoreUnknown=1;K8S_POD_NAME=pod-a;UID=1500;MTU=9000"
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1500, netConfig.Uid)
+	assert.Equal(t, 9000, netConfig.MTU)
+
+	for _, invalid := range []string{
+		"UID",
+		"UID=1500;MTU",
+		"UID=1500=1",
+		"UID=abc",
+		"UID=3000",
+		"MTU=100",
+	} {
+		args.Args = invalid
+		_, err = New(args, false)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPrevResult(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"cniVersion":"0.3.1", "trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Nil(t, netConfig.PrevResult)
+
+	// Results of older versions are converted to the current version.
+	args.StdinData = []byte(`{"cniVersion":"0.3.1", "trunkName":"eth0", "branchVlanID":"101",
+		"prevResult":{"cniVersion":"0.2.0", "ip4":{"ip":"10.1.0.5/16", "gateway":"10.1.0.1"}}}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	if assert.NotNil(t, netConfig.PrevResult) && assert.Len(t, netConfig.PrevResult.IPs, 1) {
+		assert.Equal(t, "10.1.0.5/16", netConfig.PrevResult.IPs[0].Address.String())
+	}
+
+	// Results of version 1.0.0 omit the IP address version.
+	args.StdinData = []byte(`{"cniVersion":"1.0.0", "trunkName":"eth0", "branchVlanID":"101",
+		"prevResult":{"cniVersion":"1.0.0", "ips":[{"address":"10.1.0.5/16"}, {"address":"2001:db8::5/64"}]}}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	if assert.NotNil(t, netConfig.PrevResult) && assert.Len(t, netConfig.PrevResult.IPs, 2) {
+		assert.Equal(t, "4", netConfig.PrevResult.IPs[0].Version)
+		assert.Equal(t, "6", netConfig.PrevResult.IPs[1].Version)
+	}
+
+	for _, invalid := range []string{
+		`{"cniVersion":"9.9.9"}`,
+		`{"cniVersion":"0.4.0", "ips":[{"version":"4", "address":"10.1.0.5"}]}`,
+	} {
+		args.StdinData = []byte(`{"cniVersion":"0.3.1", "trunkName":"eth0", "branchVlanID":"101",
+			"prevResult":` + invalid + `}`)
+		_, err = New(args, false)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestDisableSTP(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.DisableSTP)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "disableSTP":false}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.False(t, netConfig.DisableSTP)
+}
+
+func TestTapVhost(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.False(t, netConfig.TapVhost)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "tapVhost":true}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.TapVhost)
+}
+
+func TestPersistTap(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.False(t, netConfig.PersistTap)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "persistTap":true}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.PersistTap)
+}
+
+func TestDiscoverBranchSubnet(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchMACAddress":"01:23:45:67:89:ab",
+			"branchIPAddress":"10.0.1.42/24", "discoverBranchSubnet":true}`),
+	}
+	netConfig, err := New(args, true)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.DiscoverBranchSubnet)
+
+	// The branch subnet is discovered for the branch IP address, so it is required.
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchMACAddress":"01:23:45:67:89:ab",
+		"discoverBranchSubnet":true}`)
+	_, err = New(args, true)
+	assert.Error(t, err)
+	_, err = New(args, false)
+	assert.NoError(t, err)
+}
+
+func TestMetricsFile(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchMACAddress":"01:23:45:67:89:ab",
+			"metricsFile":"/var/lib/node_exporter/vpc-branch-pat-eni.prom"}`),
+	}
+	netConfig, err := New(args, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "/var/lib/node_exporter/vpc-branch-pat-eni.prom", netConfig.MetricsFile)
+
+	// Metrics are disabled by default.
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "branchMACAddress":"01:23:45:67:89:ab"}`)
+	netConfig, err = New(args, true)
+	assert.NoError(t, err)
+	assert.Empty(t, netConfig.MetricsFile)
+}
+
+func TestMasqueradePortRange(t *testing.T) {
+	testCases := []struct {
+		portRange string
+		expected  string
+		valid     bool
+	}{
+		{"", "1024-65535", true},
+		{"1024-65535", "1024-65535", true},
+		{"32768-60999", "32768-60999", true},
+		{"2000-1500", "", false},
+		{"2000-2000", "", false},
+		{"80-65535", "", false},
+		{"1024-65536", "", false},
+		{"1024", "", false},
+		{"1024-2000-3000", "", false},
+		{"low-high", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.portRange, func(t *testing.T) {
+			args := &skel.CmdArgs{
+				StdinData: []byte(fmt.Sprintf(
+					`{"trunkName":"eth0", "branchVlanID":"101", "masqueradePortRange":"%s"}`, tc.portRange)),
+			}
+			netConfig, err := New(args, false)
+			if !tc.valid {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, netConfig.MasqueradePortRange)
+		})
+	}
+}
+
+func TestNATMode(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, NATModeMasquerade, netConfig.NATMode)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "natMode":"none"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, NATModeNone, netConfig.NATMode)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "natMode":"snat"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+
+	// NAT can't be verified when it is off.
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "natMode":"none",
+		"verifyNAT":true, "natVerifyTarget":"10.0.0.1:80"}`)
+	_, err = New(args, false)
+	assert.Error(t, err)
+}
+
+func TestCheckBranchIPConflict(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.True(t, netConfig.CheckBranchIPConflict)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "checkBranchIPConflict":false}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.False(t, netConfig.CheckBranchIPConflict)
+}
+
+func TestDSCPQueueMap(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, netConfig.TapQueues)
+	assert.Nil(t, netConfig.DSCPQueueMap)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "tapQueues":"4",
+		"dscpQueueMap":{"46":"3", "10":"1"}}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, netConfig.TapQueues)
+	assert.Equal(t, map[uint8]uint16{46: 3, 10: 1}, netConfig.DSCPQueueMap)
+
+	for _, invalid := range []string{
+		`"tapQueues":"0"`,
+		`"tapQueues":"257"`,
+		`"tapQueues":"4", "dscpQueueMap":{"46":"4"}`,
+		`"dscpQueueMap":{"46":"1"}`,
+		`"tapQueues":"4", "dscpQueueMap":{"64":"1"}`,
+		`"tapQueues":"4", "dscpQueueMap":{"ef":"1"}`,
+		`"tapQueues":"4", "dscpQueueMap":{"46":"-1"}`,
+	} {
+		args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", ` + invalid + `}`)
+		_, err = New(args, false)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestTapMACAddress(t *testing.T) {
+	// The default tap MAC address is derived from the branch VLAN ID.
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"1001"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "02:00:00:00:03:e9", netConfig.TapMACAddress.String())
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "tapMACAddress":"0a:58:a9:fe:ac:02"}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "0a:58:a9:fe:ac:02", netConfig.TapMACAddress.String())
+
+	for _, invalid := range []string{
+		"tap",
+		"01:00:5e:00:00:01",
+		"00:00:00:00:fe:80:00:00:00:00:00:00:00:00:00:01",
+	} {
+		args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "tapMACAddress":"` + invalid + `"}`)
+		_, err = New(args, false)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestDNSPorts(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{53}, netConfig.DNSPorts)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "dnsPorts":["53", "853"]}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{53, 853}, netConfig.DNSPorts)
+
+	for _, invalid := range []string{`["0"]`, `["-53"]`, `["53", "65536"]`, `["dns"]`, `[53]`} {
+		args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "dnsPorts":` + invalid + `}`)
+		_, err = New(args, false)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestAllowedInputPorts(t *testing.T) {
+	args := &skel.CmdArgs{
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101"}`),
+	}
+	netConfig, err := New(args, false)
+	assert.NoError(t, err)
+	assert.Empty(t, netConfig.AllowedInputPorts)
+
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "allowedInputPorts":[
+		{"port":"80", "protocol":"tcp"}, {"port":"8125", "protocol":"udp"}]}`)
+	netConfig, err = New(args, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []PortSpec{{Port: 80, Protocol: "tcp"}, {Port: 8125, Protocol: "udp"}},
+		netConfig.AllowedInputPorts)
+
+	for _, invalid := range []string{
+		`{"port":"0", "protocol":"tcp"}`,
+		`{"port":"65536", "protocol":"tcp"}`,
+		`{"port":"http", "protocol":"tcp"}`,
+		`{"port":"80", "protocol":"sctp"}`,
+		`{"port":"80"}`,
+	} {
+		args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "allowedInputPorts":[` +
+			invalid + `]}`)
+		_, err = New(args, false)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestIsDualStack(t *testing.T) {
+	for stdinData, dualStack := range map[string]bool{
+		`{"trunkName":"eth0", "branchVlanID":"101"}`:                                         false,
+		`{"trunkName":"eth0", "branchVlanID":"101", "branchIPv6LinkLocalOnly":true}`:         true,
+		`{"trunkName":"eth0", "branchVlanID":"101", "branchIPv6Address":"2600:1f14::10/64"}`: true,
+	} {
+		args := &skel.CmdArgs{StdinData: []byte(stdinData)}
+		netConfig, err := New(args, false)
+		assert.NoError(t, err, stdinData)
+		assert.Equal(t, dualStack, netConfig.IsDualStack(), stdinData)
+	}
+}
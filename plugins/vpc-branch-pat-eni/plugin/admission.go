@@ -0,0 +1,130 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// admissionStatePath is the file that holds the node-wide ADD rate limiter state.
+	admissionStatePath = "/var/run/vpc-branch-pat-eni/admission"
+)
+
+// admissionLimiter is a node-wide token bucket that bounds the rate of ADD operations. Each CNI
+// invocation runs in its own process, so the bucket state is kept in a file and updated under
+// an exclusive lock on it.
+type admissionLimiter struct {
+	path  string
+	rate  float64
+	burst int
+}
+
+// newAdmissionLimiter creates a new admissionLimiter that admits rate ADD operations per second
+// on average, and up to burst ADD operations at once.
+func newAdmissionLimiter(path string, rate float64, burst int) *admissionLimiter {
+	return &admissionLimiter{
+		path:  path,
+		rate:  rate,
+		burst: burst,
+	}
+}
+
+// admit admits an ADD operation. If no token is available, it either waits for one or fails
+// immediately, depending on the given overflow policy.
+func (l *admissionLimiter) admit(policy string) error {
+	for {
+		wait, err := l.take(time.Now())
+		if err != nil {
+			return err
+		}
+		if wait == 0 {
+			return nil
+		}
+
+		if policy == config.AddOverflowPolicyFail {
+			return fmt.Errorf("ADD rate limit of %g per second exceeded", l.rate)
+		}
+
+		log.Infof("ADD rate limit of %g per second exceeded, waiting %v.", l.rate, wait)
+		time.Sleep(wait)
+	}
+}
+
+// take takes a token from the bucket at the given time. If no token is available, it returns
+// how long to wait until one is.
+func (l *admissionLimiter) take(now time.Time) (time.Duration, error) {
+	err := os.MkdirAll(filepath.Dir(l.path), 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	// Closing the file also releases the lock.
+	defer file.Close()
+
+	err = unix.Flock(int(file.Fd()), unix.LOCK_EX)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lock %s: %v", l.path, err)
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+
+	// Refill the bucket for the time elapsed since it was last updated. A missing or corrupt
+	// state file starts with a full bucket.
+	tokens := float64(l.burst)
+	var lastUpdate int64
+	if n, _ := fmt.Sscanf(string(data), "%g %d", &tokens, &lastUpdate); n == 2 {
+		elapsed := now.Sub(time.Unix(0, lastUpdate))
+		if elapsed > 0 {
+			tokens += elapsed.Seconds() * l.rate
+		}
+	}
+	if tokens > float64(l.burst) {
+		tokens = float64(l.burst)
+	}
+
+	var wait time.Duration
+	if tokens >= 1 {
+		tokens--
+	} else {
+		wait = time.Duration((1 - tokens) / l.rate * float64(time.Second))
+	}
+
+	// Save the bucket state.
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(fmt.Sprintf("%g %d", tokens, now.UnixNano())), 0)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to save %s: %v", l.path, err)
+	}
+
+	return wait, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmissionLimiterTake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admission")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	limiter := newAdmissionLimiter(filepath.Join(dir, "state"), 2, 3)
+	now := time.Unix(1000, 0)
+
+	// The bucket starts full, and admits a burst of ADDs at once.
+	for i := 0; i < 3; i++ {
+		wait, err := limiter.take(now)
+		require.NoError(t, err)
+		assert.Equal(t, time.Duration(0), wait, "ADD %d in burst throttled", i)
+	}
+
+	// ADDs beyond the burst are throttled until a token is refilled.
+	wait, err := limiter.take(now)
+	require.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	wait, err = limiter.take(now.Add(500 * time.Millisecond))
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), wait)
+
+	// The bucket does not refill beyond the burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		wait, err = limiter.take(now)
+		require.NoError(t, err)
+		assert.Equal(t, time.Duration(0), wait)
+	}
+	wait, err = limiter.take(now)
+	require.NoError(t, err)
+	assert.NotEqual(t, time.Duration(0), wait)
+}
+
+func TestAdmissionLimiterAdmit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "admission")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state")
+
+	// ADDs beyond the limit are rejected with the fail policy.
+	limiter := newAdmissionLimiter(path, 0.001, 1)
+	assert.NoError(t, limiter.admit(config.AddOverflowPolicyFail))
+	err = limiter.admit(config.AddOverflowPolicyFail)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "rate limit")
+
+	// ADDs beyond the limit wait for a token with the wait policy.
+	limiter = newAdmissionLimiter(path, 10, 1)
+	assert.NoError(t, limiter.admit(config.AddOverflowPolicyWait))
+	start := time.Now()
+	assert.NoError(t, limiter.admit(config.AddOverflowPolicyWait))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond, "ADD was not throttled")
+}
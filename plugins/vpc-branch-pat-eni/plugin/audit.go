@@ -0,0 +1,40 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	log "github.com/cihub/seelog"
+)
+
+const (
+	// auditResultOK is the result recorded in audit entries for successful operations.
+	auditResultOK = "ok"
+)
+
+// audit records a netlink mutation with its parameters and result in the audit trail if
+// netlink auditing is enabled. It returns the given error unchanged so that it can wrap calls.
+func (plugin *Plugin) audit(op string, params interface{}, err error) error {
+	if !plugin.auditNetlink {
+		return err
+	}
+
+	result := auditResultOK
+	if err != nil {
+		result = err.Error()
+	}
+
+	log.Infof("Audit: op=%s params=%+v result=%s.", op, params, result)
+
+	return err
+}
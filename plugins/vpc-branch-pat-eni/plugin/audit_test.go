@@ -0,0 +1,72 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	log "github.com/cihub/seelog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureLogs replaces the logger with one writing to the returned buffer.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger, err := log.LoggerFromWriterWithMinLevelAndFormat(&buf, log.TraceLvl, "%Msg%n")
+	require.NoError(t, err)
+	log.ReplaceLogger(logger)
+	return &buf
+}
+
+func TestAuditEnabled(t *testing.T) {
+	buf := captureLogs(t)
+	plugin := &Plugin{auditNetlink: true}
+
+	ops := []struct {
+		op  string
+		err error
+	}{
+		{op: "LinkAdd", err: nil},
+		{op: "AddrAdd", err: nil},
+		{op: "RouteAdd", err: errors.New("file exists")},
+		{op: "LinkSetUp", err: nil},
+	}
+	for _, o := range ops {
+		err := plugin.audit(o.op, "params", o.err)
+		assert.Equal(t, o.err, err)
+	}
+	log.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, len(ops), len(lines))
+	for i, o := range ops {
+		assert.Contains(t, lines[i], "Audit: op="+o.op+" params=params")
+	}
+	assert.Contains(t, lines[2], "result=file exists")
+}
+
+func TestAuditDisabled(t *testing.T) {
+	buf := captureLogs(t)
+	plugin := &Plugin{}
+
+	err := plugin.audit("LinkAdd", "params", nil)
+	assert.NoError(t, err)
+	log.Flush()
+
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	"github.com/vishvananda/netlink"
+)
+
+// BranchBackpressure describes the queue and drop counters of a branch link.
+type BranchBackpressure struct {
+	LinkName   string
+	TxQueueLen int
+	TxDropped  uint64
+	RxDropped  uint64
+	Overloaded bool
+}
+
+// CheckBranchBackpressure reads the drop counters of the branch link in the given PAT netns and
+// reports whether the total number of dropped packets exceeds the given threshold. The counters
+// are totals since the link was created. The plugin checks them only during ADD, and does not
+// monitor branch links in the background.
+func CheckBranchBackpressure(patNetNS netns.NetNS, dropThreshold uint64) (*BranchBackpressure, error) {
+	var bp *BranchBackpressure
+	err := patNetNS.Run(func() error {
+		branches, err := eni.ListBranchLinks()
+		if err != nil {
+			return err
+		}
+		if len(branches) == 0 {
+			return fmt.Errorf("no branch link in PAT netns %s", patNetNS.GetPath())
+		}
+
+		link, err := netlink.LinkByName(branches[0].LinkName)
+		if err != nil {
+			return err
+		}
+
+		bp = evaluateBackpressure(link, dropThreshold)
+		return nil
+	})
+
+	return bp, err
+}
+
+// evaluateBackpressure returns the backpressure state of the given branch link.
+func evaluateBackpressure(link netlink.Link, dropThreshold uint64) *BranchBackpressure {
+	attrs := link.Attrs()
+	bp := &BranchBackpressure{
+		LinkName:   attrs.Name,
+		TxQueueLen: attrs.TxQLen,
+	}
+
+	if attrs.Statistics != nil {
+		bp.TxDropped = attrs.Statistics.TxDropped
+		bp.RxDropped = attrs.Statistics.RxDropped
+	}
+
+	bp.Overloaded = dropThreshold > 0 && bp.TxDropped+bp.RxDropped > dropThreshold
+
+	return bp
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+)
+
+func TestEvaluateBackpressure(t *testing.T) {
+	link := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:   "eth1.101",
+			TxQLen: 1000,
+			Statistics: &netlink.LinkStatistics{
+				TxDropped: 700,
+				RxDropped: 400,
+			},
+		},
+		VlanId: 101,
+	}
+
+	bp := evaluateBackpressure(link, 1000)
+	assert.Equal(t, "eth1.101", bp.LinkName)
+	assert.Equal(t, 1000, bp.TxQueueLen)
+	assert.Equal(t, uint64(700), bp.TxDropped)
+	assert.Equal(t, uint64(400), bp.RxDropped)
+	assert.True(t, bp.Overloaded)
+
+	bp = evaluateBackpressure(link, 2000)
+	assert.False(t, bp.Overloaded)
+
+	// A zero threshold disables the check.
+	bp = evaluateBackpressure(link, 0)
+	assert.False(t, bp.Overloaded)
+}
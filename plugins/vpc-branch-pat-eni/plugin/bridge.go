@@ -0,0 +1,132 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// The vendored netlink library does not support the bridge multicast querier and STP state
+// attributes, and sysfs does not reflect the netns of the calling thread. The attributes are set
+// and read with raw netlink messages instead.
+
+// setBridgeMulticastQuerier sets whether the given bridge link acts as the IGMP/MLD querier.
+func setBridgeMulticastQuerier(bridge netlink.Link, enabled bool) error {
+	var value byte
+	if enabled {
+		value = 1
+	}
+
+	return setBridgeAttr(bridge, nl.IFLA_BR_MCAST_QUERIER, []byte{value})
+}
+
+// getBridgeMulticastQuerier returns whether the given bridge link acts as the IGMP/MLD querier.
+func getBridgeMulticastQuerier(bridge netlink.Link) (bool, error) {
+	value, err := getBridgeAttr(bridge, nl.IFLA_BR_MCAST_QUERIER, "multicast querier")
+	if err != nil {
+		return false, err
+	}
+
+	return value[0] == 1, nil
+}
+
+// setBridgeSTP sets whether the spanning tree protocol is enabled on the given bridge link.
+func setBridgeSTP(bridge netlink.Link, enabled bool) error {
+	var value uint32
+	if enabled {
+		value = 1
+	}
+
+	return setBridgeAttr(bridge, nl.IFLA_BR_STP_STATE, nl.Uint32Attr(value))
+}
+
+// getBridgeSTP returns whether the spanning tree protocol is enabled on the given bridge link.
+func getBridgeSTP(bridge netlink.Link) (bool, error) {
+	value, err := getBridgeAttr(bridge, nl.IFLA_BR_STP_STATE, "STP state")
+	if err != nil {
+		return false, err
+	}
+
+	return nl.NativeEndian().Uint32(value) != 0, nil
+}
+
+// setBridgeAttr sets a bridge-specific attribute on the given bridge link.
+func setBridgeAttr(bridge netlink.Link, attrType int, value []byte) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(bridge.Attrs().Index)
+	req.AddData(msg)
+
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_KIND, nl.NonZeroTerminated(bridge.Type()))
+	data := nl.NewRtAttrChild(linkInfo, nl.IFLA_INFO_DATA, nil)
+	nl.NewRtAttrChild(data, attrType, value)
+	req.AddData(linkInfo)
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// getBridgeAttr returns the value of a bridge-specific attribute of the given bridge link.
+func getBridgeAttr(bridge netlink.Link, attrType int, attrName string) ([]byte, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(bridge.Attrs().Index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("unexpected number of link messages %d", len(msgs))
+	}
+
+	attrs, err := nl.ParseRouteAttr(msgs[0][unix.SizeofIfInfomsg:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attr := range attrs {
+		if attr.Attr.Type != unix.IFLA_LINKINFO {
+			continue
+		}
+		infos, err := nl.ParseRouteAttr(attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.Attr.Type != nl.IFLA_INFO_DATA {
+				continue
+			}
+			data, err := nl.ParseRouteAttr(info.Value)
+			if err != nil {
+				return nil, err
+			}
+			for _, datum := range data {
+				if int(datum.Attr.Type) == attrType {
+					return datum.Value, nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("link %s has no %s attribute", bridge.Attrs().Name, attrName)
+}
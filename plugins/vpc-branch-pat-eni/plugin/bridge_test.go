@@ -0,0 +1,88 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestBridgeMulticastQuerier(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-mcast-querier")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "virbr0"}}
+		require.NoError(t, netlink.LinkAdd(bridge))
+
+		// The kernel default is off.
+		querier, err := getBridgeMulticastQuerier(bridge)
+		require.NoError(t, err)
+		assert.False(t, querier)
+
+		require.NoError(t, setBridgeMulticastQuerier(bridge, true))
+		querier, err = getBridgeMulticastQuerier(bridge)
+		require.NoError(t, err)
+		assert.True(t, querier)
+
+		require.NoError(t, setBridgeMulticastQuerier(bridge, false))
+		querier, err = getBridgeMulticastQuerier(bridge)
+		require.NoError(t, err)
+		assert.False(t, querier)
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestBridgeSTP(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-stp")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "virbr0"}}
+		require.NoError(t, netlink.LinkAdd(bridge))
+
+		require.NoError(t, setBridgeSTP(bridge, true))
+		stp, err := getBridgeSTP(bridge)
+		require.NoError(t, err)
+		assert.True(t, stp)
+
+		// The bridge comes up with STP disabled.
+		require.NoError(t, setBridgeSTP(bridge, false))
+		require.NoError(t, netlink.LinkSetUp(bridge))
+		stp, err = getBridgeSTP(bridge)
+		require.NoError(t, err)
+		assert.False(t, stp)
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
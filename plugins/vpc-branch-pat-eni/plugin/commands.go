@@ -16,9 +16,14 @@ package plugin
 import (
 	"fmt"
 	"net"
+	"os"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/aws/amazon-vpc-cni-plugins/logger"
 	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
+	"github.com/aws/amazon-vpc-cni-plugins/network/ipcfg"
 	"github.com/aws/amazon-vpc-cni-plugins/network/iptables"
 	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
 	"github.com/aws/amazon-vpc-cni-plugins/network/vpc"
@@ -36,11 +41,10 @@ const (
 	// Name templates used for objects created by this plugin.
 	patNetNSNameFormat   = "vpc-pat-%d"
 	branchLinkNameFormat = "%s.%d"
-	bridgeName           = "virbr0"
 	tapBridgeNameFormat  = "tapbr%d"
 
-	// Static IP address assigned to the PAT bridge.
-	bridgeIPAddressString = "192.168.122.1/24"
+	// iptablesRuleCommentFormat is the comment that tags the iptables rules in a PAT netns.
+	iptablesRuleCommentFormat = "vpc-pat vlan %d branch %s"
 
 	// maxRetriesVethPairNameCollision specifies the maximum number of times
 	// veth pair creation will be retried if there's a name collision.
@@ -50,18 +54,147 @@ const (
 	// veth pair device. The names for different device types can be found
 	// by running the "ip link help" command.
 	linkDeviceTypeVethPair = "veth"
+
+	// tapReleasePollInterval is the interval at which DEL checks whether a deleted tap link
+	// is gone.
+	tapReleasePollInterval = 50 * time.Millisecond
+
+	// maxTapMasterChecks and tapMasterCheckInterval bound how long ADD waits for a tap link to
+	// be enslaved to its bridge.
+	maxTapMasterChecks     = 5
+	tapMasterCheckInterval = 50 * time.Millisecond
+
+	// vhostNetPath is the vhost-net device, which VMMs use to offload tap link packet processing
+	// to the kernel.
+	vhostNetPath = "/dev/vhost-net"
+
+	// procSelfFdPath lists the file descriptors open in this process.
+	procSelfFdPath = "/proc/self/fd"
+)
+
+var (
+	// ioctlSetInt sets tun device parameters. It is a variable so that it can be replaced in tests.
+	ioctlSetInt = unix.IoctlSetInt
+
+	// alternateBridgeIPAddressStrings are the IP addresses the PAT bridge is relocated to,
+	// in order of preference, when the static bridge subnet overlaps the branch subnet.
+	alternateBridgeIPAddressStrings = []string{
+		"192.168.123.1/24",
+		"192.168.124.1/24",
+		"172.30.122.1/24",
+		"10.255.122.1/24",
+	}
+
+	// checkIptablesAvailable checks that the iptables backend for a protocol is available on
+	// this host.
+	checkIptablesAvailable = iptables.CheckAvailableForProtocol
+
+	// checkVhostNetAvailable checks that the vhost-net device is available on this host.
+	checkVhostNetAvailable = func() error {
+		_, err := os.Stat(vhostNetPath)
+		return err
+	}
+
+	// newSubnetFromIMDS discovers the VPC subnet of an ENI. It is a variable so that it can be
+	// replaced in tests.
+	newSubnetFromIMDS = vpc.NewSubnetFromIMDS
 )
 
 // Add is the internal implementation of CNI ADD command.
-func (plugin *Plugin) Add(args *cniSkel.CmdArgs) error {
+func (plugin *Plugin) Add(args *cniSkel.CmdArgs) (err error) {
+	start := time.Now()
+
+	// Classify the remaining failures caused by contention on shared host resources as transient.
+	defer func() { err = classifyError(err) }()
+
 	// Parse network configuration.
 	netConfig, err := config.New(args, true)
 	if err != nil {
 		log.Errorf("Failed to parse netconfig from args: %v.", err)
-		return err
+		return &ErrConfigInvalid{Err: err}
 	}
 
+	setLogFields(args, netConfig)
 	log.Infof("Executing ADD with netconfig: %+v.", netConfig)
+	plugin.auditNetlink = netConfig.AuditNetlink
+
+	// Record the outcome and duration of ADD, attributing failures to the stage they occurred in.
+	plugin.stage = stagePreflight
+	defer func() {
+		newMetricsRecorder(netConfig.MetricsFile).record("add", start, plugin.stage, err)
+	}()
+
+	// Bound the rate of ADD operations on this node, to protect the host networking stack
+	// during mass scale-up.
+	if netConfig.AddRateLimit > 0 {
+		limiter := newAdmissionLimiter(admissionStatePath, netConfig.AddRateLimit, netConfig.AddBurst)
+		err = limiter.admit(netConfig.AddOverflowPolicy)
+		if err != nil {
+			log.Errorf("Failed to admit ADD: %v.", err)
+			return &ErrTransient{Err: err}
+		}
+	}
+
+	// Check that the running kernel supports the requested features.
+	var features []kernelFeature
+	if netConfig.TapQueues > 1 {
+		features = append(features, kernelFeatureMultiQueueTap)
+	}
+	unsupported, err := plugin.checkKernelCompat(netConfig, features)
+	if err != nil {
+		log.Errorf("Kernel compatibility check failed: %v.", err)
+		return &ErrHostUnsupported{Err: err}
+	}
+	// Degraded multi-queue taps fall back to a single queue, without a DSCP to queue mapping.
+	for _, feature := range unsupported {
+		if feature == kernelFeatureMultiQueueTap {
+			netConfig.TapQueues = 1
+			netConfig.DSCPQueueMap = nil
+		}
+	}
+
+	// Fail fast before any host mutation if the iptables backend is missing.
+	if !netConfig.SkipIptables {
+		protos := []iptables.Protocol{iptables.ProtocolIPv4}
+		if netConfig.IsDualStack() {
+			protos = append(protos, iptables.ProtocolIPv6)
+		}
+
+		for _, proto := range protos {
+			err = checkIptablesAvailable(proto)
+			if err != nil {
+				log.Errorf("Firewall pre-flight check failed: %v.", err)
+				return &ErrHostUnsupported{Err: err}
+			}
+		}
+	}
+
+	// Likewise if vhost-net is missing, when the tap link is requested to use it.
+	if netConfig.TapVhost {
+		err = checkVhostNetAvailable()
+		if err != nil {
+			log.Errorf("Vhost-net pre-flight check failed: %v.", err)
+			return &ErrHostUnsupported{Err: err}
+		}
+	}
+
+	// Likewise if ebtables is missing, when the bridge ethertype filter is enabled.
+	if netConfig.BridgeEthertypeFilter {
+		err = checkEbtablesAvailable()
+		if err != nil {
+			log.Errorf("Firewall pre-flight check failed: %v.", err)
+			return &ErrHostUnsupported{Err: err}
+		}
+	}
+
+	// Discover the branch subnet, instead of deriving it from the branch IP address.
+	if netConfig.DiscoverBranchSubnet {
+		err = discoverBranchSubnet(netConfig)
+		if err != nil {
+			log.Errorf("Failed to discover branch subnet: %v.", err)
+			return err
+		}
+	}
 
 	// Derive names from CNI network config.
 	patNetNSName := fmt.Sprintf(patNetNSNameFormat, netConfig.BranchVlanID)
@@ -74,95 +207,390 @@ func (plugin *Plugin) Add(args *cniSkel.CmdArgs) error {
 	targetNetNS, err := netns.GetNetNSByName(targetNetNSName)
 	if err != nil {
 		log.Errorf("Failed to find target netns %s.", targetNetNSName)
-		return err
+		return &ErrNetNSNotFound{Err: err}
 	}
 
 	// Create the trunk ENI.
-	trunk, err := eni.NewTrunk(netConfig.TrunkName, netConfig.TrunkMACAddress, eni.TrunkIsolationModeVLAN)
+	trunk, err := newTrunk(netConfig)
 	if err != nil {
-		log.Errorf("Failed to find trunk interface %s: %v.", netConfig.TrunkName, err)
-		return err
+		return &ErrTrunkNotFound{Err: err}
+	}
+
+	// Verify that the trunk link supports the requested isolation mode.
+	err = trunk.CheckIsolationMode()
+	if err != nil {
+		log.Errorf("Trunk interface %s isolation mode check failed: %v.", trunk.GetLinkName(), err)
+		return &ErrTrunkNotFound{Err: err}
+	}
+
+	// Log the trunk driver information, to help correlate behavior with driver versions.
+	if drvInfo, derr := trunk.GetDriverInfo(); derr != nil {
+		log.Warnf("Failed to get trunk interface %s driver info: %v.", trunk.GetLinkName(), derr)
+	} else {
+		log.Infof("Trunk interface %s driver info: %+v.", trunk.GetLinkName(), drvInfo)
+	}
+
+	// Create the veth pair in PAT network namespace and the tap link in target network namespace.
+	createTap := func(patNetNS netns.NetNS) error {
+		plugin.stage = stageTapCreate
+		var vethPeerName string
+		err := patNetNS.Run(func() error {
+			var verr error
+			vethPeerName, verr = plugin.createVethPair(
+				netConfig.BranchVlanID, args.ContainerID, netConfig.BridgeName, targetNetNS, netConfig.MTU)
+			return verr
+		})
+		if err != nil {
+			log.Errorf("Failed to create veth pair: %v.", err)
+			return err
+		}
+
+		log.Infof("Creating tap link %s.", tapLinkName)
+		err = targetNetNS.Run(func() error {
+			return plugin.createTapLink(tapBridgeName, vethPeerName, tapLinkName, netConfig)
+		})
+		if err != nil {
+			log.Errorf("Failed to create tap link: %v.", err)
+			return err
+		}
+
+		// Restore the PAT bridge FDB entries saved when this container's tap link was deleted.
+		// The bridge port accepts them only once the veth pair is up on both ends.
+		if netConfig.PreserveBridgeFDB {
+			cache := newFDBCache(fmt.Sprintf(fdbCachePathFormat, netConfig.BranchVlanID), netConfig.FDBCacheSize)
+			vethLinkName := strings.TrimSuffix(vethPeerName, vethLinkPeerNameSuffix)
+			ferr := patNetNS.Run(func() error {
+				return plugin.restoreBridgeFDB(cache, args.ContainerID, vethLinkName)
+			})
+			if ferr != nil {
+				log.Warnf("Failed to restore FDB entries on bridge port %s: %v.", vethLinkName, ferr)
+			}
+		}
+
+		return nil
+	}
+
+	// Generate CNI result, which signals that the tap link is ready.
+	ready := func() error {
+		result := newResult(netConfig, tapLinkName, targetNetNSName)
+		log.Infof("Writing CNI result to stdout: %+v.", result)
+		return printResult(result, netConfig.CNIVersion)
 	}
 
 	// Search for the PAT network namespace.
 	log.Infof("Searching for PAT netns %s.", patNetNSName)
 	patNetNS, err := netns.GetNetNSByName(patNetNSName)
+	if err != nil && netConfig.RequireExistingNamespace {
+		log.Errorf("PAT netns %s does not exist and creating it is not allowed: %v.", patNetNSName, err)
+		return &ErrConfigInvalid{Err: fmt.Errorf(
+			"PAT netns %s does not exist and requireExistingNamespace is set", patNetNSName)}
+	}
 	if err != nil {
 		// This is the first PAT interface request on this VLAN ID.
-		// Create the PAT network namespace.
+		// Create the PAT network namespace, unless the node is at its PAT netns limit.
+		if netConfig.MaxPATNetNS > 0 {
+			err = checkPATNetNSLimit(netConfig.MaxPATNetNS)
+			if err != nil {
+				log.Errorf("Failed to create PAT netns %s: %v.", patNetNSName, err)
+				return err
+			}
+		}
+
+		// Fail if the branch IP address is already assigned elsewhere on the host, instead of
+		// creating a conflicting assignment.
+		if netConfig.CheckBranchIPConflict && netConfig.BranchIPAddress.IP != nil {
+			err = checkBranchIPAddressConflict(netConfig.BranchIPAddress.IP, patNetNSName)
+			if err != nil {
+				log.Errorf("Failed to create PAT netns %s: %v.", patNetNSName, err)
+				return err
+			}
+		}
+
 		branchName := fmt.Sprintf(branchLinkNameFormat, trunk.GetLinkName(), netConfig.BranchVlanID)
 
 		// Compute the branch ENI's VPC subnet.
-		branchSubnetPrefix := vpc.GetSubnetPrefix(&netConfig.BranchIPAddress)
-		branchSubnet, _ := vpc.NewSubnet(branchSubnetPrefix)
-		bridgeIPAddress, _ := vpc.GetIPAddressFromString(bridgeIPAddressString)
+		branchSubnet := newBranchSubnet(netConfig)
+
+		// Select a bridge IP address that does not overlap the branch subnet.
+		bridgeIPAddress, err := selectBridgeIPAddress(
+			&netConfig.BridgeIPAddress, branchSubnet, netConfig.RelocateBridgeSubnet)
+		if err != nil {
+			log.Errorf("Failed to select PAT bridge IP address: %v.", err)
+			return err
+		}
+
+		setupPATNetNS := func(onBridgeUp func(netns.NetNS) error) (netns.NetNS, error) {
+			patNetNS, err := plugin.createPATNetworkNamespace(
+				patNetNSName, trunk,
+				branchName, netConfig.BranchMACAddress, netConfig.BranchVlanID,
+				&netConfig.BranchIPAddress, branchSubnet, bridgeIPAddress, netConfig, onBridgeUp)
+			if err != nil {
+				log.Errorf("Failed to setup PAT netns %s: %v.", patNetNSName, err)
+			}
+			return patNetNS, err
+		}
 
-		patNetNS, err = plugin.createPATNetworkNamespace(
-			patNetNSName, trunk,
-			branchName, netConfig.BranchMACAddress, netConfig.BranchVlanID,
-			&netConfig.BranchIPAddress, branchSubnet, bridgeIPAddress)
+		// Clean up the half-built PAT netns if any of the remaining steps fail, so that the next
+		// ADD on this VLAN ID does not reuse it.
+		committed := false
+		defer func() {
+			if !committed {
+				plugin.cleanupPATNetworkNamespace(patNetNSName, trunk, branchName, netConfig)
+			}
+		}()
 
+		err = runTapSetup(netConfig.EarlyTapCreation, setupPATNetNS, createTap, ready)
 		if err != nil {
-			log.Errorf("Failed to setup PAT netns %s: %v.", patNetNSName, err)
 			return err
 		}
-	} else {
-		// Reuse the PAT network namespace that was setup on this VLAN ID during a previous request.
-		log.Infof("Found PAT netns %s.", patNetNSName)
+
+		committed = true
+		sendEvent(netConfig.EventSocket, newAttachmentEvent(eventAttachmentCreated, args, netConfig))
+		return nil
 	}
 
-	// Create the veth pair in PAT network namespace.
-	var vethPeerName string
+	// Reuse the PAT network namespace that was setup on this VLAN ID during a previous request.
+	log.Infof("Found PAT netns %s.", patNetNSName)
+	log.Debugf("PAT netns %s is at %s.", patNetNSName, patNetNS.GetPath())
+
+	// PAT netns names include only the VLAN ID. Make sure the existing PAT netns was set up
+	// for the same trunk, and not for the same VLAN ID on a different trunk.
 	err = patNetNS.Run(func() error {
-		var verr error
-		vethPeerName, verr = plugin.createVethPair(
-			netConfig.BranchVlanID, args.ContainerID, bridgeName, targetNetNS)
-		return verr
+		branches, err := eni.ListBranchLinks()
+		if err != nil {
+			return err
+		}
+		return checkBranchTrunk(branches, netConfig.BranchVlanID, trunk)
 	})
 	if err != nil {
-		log.Errorf("Failed to create veth pair: %v.", err)
+		log.Errorf("Failed to reuse PAT netns %s: %v.", patNetNSName, err)
 		return err
 	}
 
-	// Create the tap link in target network namespace.
-	log.Infof("Creating tap link %s.", tapLinkName)
-	err = targetNetNS.Run(func() error {
-		return plugin.createTapLink(tapBridgeName, vethPeerName, tapLinkName, netConfig.Uid, netConfig.Gid)
-	})
+	// Repair the branch link, so that the tap link is not added to a PAT bridge without uplink.
+	branchReattached, err := plugin.repairPATBranch(patNetNS, trunk, netConfig)
 	if err != nil {
-		log.Errorf("Failed to create tap link: %v.", err)
+		log.Errorf("Failed to repair branch link in PAT netns %s: %v.", patNetNSName, err)
 		return err
 	}
 
-	// Generate CNI result.
-	// IP addresses, routes and DNS are configured by VPC DHCP servers.
+	// The iptables rules are deleted by DEL when the last tap link is removed from a kept PAT
+	// netns. Set them up again for the first tap link added after that, unless reattaching the
+	// branch link already did.
+	if !netConfig.SkipIptables && !branchReattached {
+		err = patNetNS.Run(func() error {
+			links, err := plugin.nl().LinkList()
+			if err != nil {
+				return err
+			}
+			if len(filterVethLinks(links, netConfig.BranchVlanID)) != 0 {
+				return nil
+			}
+			return plugin.updateBridgeIptablesRules(netConfig, false)
+		})
+		if err != nil {
+			log.Errorf("Failed to setup iptables rules in PAT netns %s: %v.", patNetNSName, err)
+			return err
+		}
+	}
+
+	// Warn early if the shared branch link is already dropping packets.
+	if netConfig.BranchDropThreshold > 0 {
+		bp, err := CheckBranchBackpressure(patNetNS, netConfig.BranchDropThreshold)
+		if err != nil {
+			log.Errorf("Failed to check branch backpressure: %v.", err)
+		} else if bp.Overloaded {
+			log.Warnf("Branch link %s is overloaded: %+v.", bp.LinkName, bp)
+		}
+	}
+
+	err = createTap(patNetNS)
+	if err != nil {
+		return err
+	}
+
+	err = ready()
+	if err != nil {
+		return err
+	}
+
+	sendEvent(netConfig.EventSocket, newAttachmentEvent(eventAttachmentCreated, args, netConfig))
+	return nil
+}
+
+// setLogFields adds the attachment to JSON format log lines, so that they can be correlated.
+func setLogFields(args *cniSkel.CmdArgs, netConfig *config.NetConfig) {
+	logger.SetField("vlanID", netConfig.BranchVlanID)
+	logger.SetField("netns", args.Netns)
+}
+
+// checkBranchTrunk returns an error if the branch link with the given VLAN ID is attached to a
+// trunk other than the given one.
+func checkBranchTrunk(branches []eni.BranchLink, branchVlanID int, trunk *eni.Trunk) error {
+	for _, branch := range branches {
+		if !isPATBranchLink(branch, branchVlanID) {
+			continue
+		}
+
+		if branch.TrunkIndex != trunk.GetLinkIndex() {
+			return &ErrConfigInvalid{Err: fmt.Errorf(
+				"branch link %s for VLAN ID %d is on trunk index %d, not on requested trunk %s index %d",
+				branch.LinkName, branchVlanID, branch.TrunkIndex, trunk.GetLinkName(), trunk.GetLinkIndex())}
+		}
+	}
+
+	return nil
+}
+
+// isPATBranchLink returns whether the given branch link in a PAT netns is the branch with the
+// given VLAN ID. MACVLAN branch links have no VLAN ID, but a PAT netns holds a single branch, so
+// a MACVLAN branch link in it is the one.
+func isPATBranchLink(branch eni.BranchLink, branchVlanID int) bool {
+	return branch.VlanID == branchVlanID || branch.IsolationMode == eni.TrunkIsolationModeMACVLAN
+}
+
+// runTapSetup sets up the PAT netns and creates the tap link. By default the tap link is created
+// after the PAT netns is fully set up. If early is set, the tap link is created as soon as the PAT
+// bridge is up, while the branch, NAT and routes are still being configured. Either way, ready is
+// called only after all steps complete.
+func runTapSetup(
+	early bool,
+	setupPATNetNS func(onBridgeUp func(netns.NetNS) error) (netns.NetNS, error),
+	createTap func(netns.NetNS) error,
+	ready func() error) error {
+
+	if early {
+		log.Infof("Creating tap link early, as soon as the PAT bridge is up.")
+		_, err := setupPATNetNS(createTap)
+		if err != nil {
+			return err
+		}
+	} else {
+		patNetNS, err := setupPATNetNS(nil)
+		if err != nil {
+			return err
+		}
+
+		err = createTap(patNetNS)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ready()
+}
+
+// newBranchSubnet returns the branch ENI's VPC subnet. The subnet gateways are computed from the
+// branch IP address unless they are configured explicitly. Explicit gateways may include IPv6
+// gateways for dual-stack branches, which are ignored for IPv4.
+func newBranchSubnet(netConfig *config.NetConfig) *vpc.Subnet {
+	branchSubnetPrefix := vpc.GetSubnetPrefix(&netConfig.BranchIPAddress)
+	branchSubnet, _ := vpc.NewSubnet(branchSubnetPrefix)
+	if len(netConfig.BranchGatewayIPAddresses) != 0 {
+		branchSubnet.Gateways = netConfig.BranchGatewayIPAddresses
+	}
+
+	return branchSubnet
+}
+
+// newBranchIPv6Subnet returns the branch IPv6 subnet from the network config. Its gateways are the
+// IPv6 gateways of the given branch subnet, if any were configured.
+func newBranchIPv6Subnet(netConfig *config.NetConfig, branchSubnet *vpc.Subnet) *vpc.Subnet {
+	branchIPv6Subnet, _ := vpc.NewSubnet(vpc.GetSubnetPrefix(&netConfig.BranchIPv6Address))
+	if gateways := branchSubnet.GatewaysFor(branchIPv6Subnet.Prefix.IP); len(gateways) != 0 {
+		branchIPv6Subnet.Gateways = gateways
+	}
+
+	return branchIPv6Subnet
+}
+
+// discoverBranchSubnet sets the prefix length of the branch IP address in the network config to
+// the one of the branch ENI's VPC subnet, as reported by IMDS. The branch subnet and its gateway
+// are then derived from the branch IP address as usual.
+func discoverBranchSubnet(netConfig *config.NetConfig) error {
+	subnet, err := newSubnetFromIMDS(netConfig.BranchMACAddress)
+	if err != nil {
+		return &ErrTransient{Err: err}
+	}
+
+	if !subnet.Prefix.Contains(netConfig.BranchIPAddress.IP) {
+		return &ErrConfigInvalid{Err: fmt.Errorf("branch IP address %s is not in subnet %s",
+			netConfig.BranchIPAddress.IP, subnet.Prefix.String())}
+	}
+
+	log.Infof("Discovered branch subnet %s.", subnet.Prefix.String())
+	netConfig.BranchIPAddress.Mask = subnet.Prefix.Mask
+	return nil
+}
+
+// newResult generates the CNI result for the given tap link.
+// IP addresses, routes and DNS are configured by VPC DHCP servers. The branch IP address and
+// default route are reported in the result, so that it is self-describing for IPAM bookkeeping.
+// The DNS configuration in the network config, if any, is echoed for static-config runtimes.
+// When chained, the result of the previous plugin is merged in ahead of the tap link.
+func newResult(netConfig *config.NetConfig, tapLinkName string, netNSName string) *cniTypesCurrent.Result {
 	result := &cniTypesCurrent.Result{
-		Interfaces: []*cniTypesCurrent.Interface{
-			{
-				Name:    tapLinkName,
-				Mac:     netConfig.BranchMACAddress.String(),
-				Sandbox: targetNetNSName,
-			},
-		},
+		DNS: netConfig.DNS,
+	}
+
+	if prevResult := netConfig.PrevResult; prevResult != nil {
+		result.Interfaces = append(result.Interfaces, prevResult.Interfaces...)
+		result.IPs = append(result.IPs, prevResult.IPs...)
+		result.Routes = append(result.Routes, prevResult.Routes...)
+		if len(result.DNS.Nameservers) == 0 {
+			result.DNS = prevResult.DNS
+		}
 	}
 
-	log.Infof("Writing CNI result to stdout: %+v.", result)
+	tapIndex := len(result.Interfaces)
+	result.Interfaces = append(result.Interfaces, &cniTypesCurrent.Interface{
+		Name:    tapLinkName,
+		Mac:     netConfig.TapMACAddress.String(),
+		Sandbox: netNSName,
+	})
+
+	if netConfig.BranchIPAddress.IP != nil {
+		gateway := newBranchSubnet(netConfig).GatewayFor(netConfig.BranchIPAddress.IP)
+		result.IPs = append(result.IPs, &cniTypesCurrent.IPConfig{
+			Version:   "4",
+			Interface: cniTypesCurrent.Int(tapIndex),
+			Address:   netConfig.BranchIPAddress,
+			Gateway:   gateway,
+		})
+		result.Routes = append(result.Routes, &cniTypes.Route{
+			Dst: net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			GW:  gateway,
+		})
+	}
 
-	return cniTypes.PrintResult(result, netConfig.CNIVersion)
+	return result
 }
 
 // Del is the internal implementation of CNI DEL command.
 // CNI DEL command can be called by the orchestrator agent multiple times for the same interface,
 // and thus must be best-effort and idempotent.
-func (plugin *Plugin) Del(args *cniSkel.CmdArgs) error {
+func (plugin *Plugin) Del(args *cniSkel.CmdArgs) (err error) {
+	start := time.Now()
+
+	// Classify the remaining failures caused by contention on shared host resources as transient.
+	defer func() { err = classifyError(err) }()
+
 	// Parse network configuration.
 	netConfig, err := config.New(args, false)
 	if err != nil {
 		log.Errorf("Failed to parse netconfig from args: %v.", err)
-		return err
+		return &ErrConfigInvalid{Err: err}
 	}
 
+	setLogFields(args, netConfig)
 	log.Infof("Executing DEL with netconfig: %+v.", netConfig)
+	plugin.auditNetlink = netConfig.AuditNetlink
+
+	// Record the outcome and duration of DEL.
+	plugin.stage = stageTeardown
+	defer func() {
+		newMetricsRecorder(netConfig.MetricsFile).record("del", start, plugin.stage, err)
+	}()
 
 	// Derive names from CNI network config.
 	patNetNSName := fmt.Sprintf(patNetNSNameFormat, netConfig.BranchVlanID)
@@ -170,94 +598,528 @@ func (plugin *Plugin) Del(args *cniSkel.CmdArgs) error {
 	tapLinkName := args.IfName
 	targetNetNSName := args.Netns
 
+	// Find the PAT bridge FDB entries learned for this tap link before it is deleted.
+	macAddresses, err := plugin.listContainerFDB(targetNetNSName, patNetNSName)
+	if err != nil {
+		log.Warnf("Failed to find FDB entries for container %s: %v.", args.ContainerID, err)
+	}
+
+	// Save them, so that they can be restored if the tap link is recreated.
+	if netConfig.PreserveBridgeFDB && len(macAddresses) != 0 {
+		cache := newFDBCache(fmt.Sprintf(fdbCachePathFormat, netConfig.BranchVlanID), netConfig.FDBCacheSize)
+		err = cache.save(args.ContainerID, macAddresses)
+		if err != nil {
+			log.Warnf("Failed to save FDB entries for container %s: %v.", args.ContainerID, err)
+		}
+	}
+
 	// Delete the tap link and veth pair from the target netns.
-	plugin.deleteTapVethLinks(targetNetNSName, tapLinkName, tapBridgeName)
+	tapReleased := plugin.deleteTapVethLinks(
+		targetNetNSName, tapLinkName, tapBridgeName, netConfig.TapReleaseTimeout)
+
+	// Notify the node agent. The tap link is gone at this point even if the PAT netns is kept.
+	sendEvent(netConfig.EventSocket, newAttachmentEvent(eventAttachmentDeleted, args, netConfig))
 
 	// Search for the PAT network namespace.
 	patNetNS, err := netns.GetNetNSByName(patNetNSName)
-	if err != nil {
+	if os.IsNotExist(err) {
 		// Log and ignore the failure. DEL can be called multiple times and thus must be idempotent.
 		log.Errorf("Failed to find netns %s, ignoring: %v.", patNetNSName, err)
+		if netConfig.VerifyTeardown {
+			return plugin.verifyTeardown(netConfig, patNetNSName, nil, true, false)
+		}
 		return nil
 	}
+	if err != nil {
+		// The PAT netns may still exist, so report the failure instead of leaking it.
+		log.Errorf("Failed to open netns %s: %v.", patNetNSName, err)
+		return err
+	}
+	log.Debugf("PAT netns %s is at %s.", patNetNSName, patNetNS.GetPath())
+
+	// Flush the neighbor entries of the deleted container on the PAT bridge, so that traffic to
+	// a container reusing its IP address is not sent to the stale MAC address.
+	if len(macAddresses) != 0 {
+		patNetNS.Run(func() error {
+			plugin.flushBridgeNeighs(netConfig.BridgeName, macAddresses)
+			return nil
+		})
+	}
+
 	lastVethLinkDeleted := false
+	patNetNSDeleted := false
+	iptablesRulesDeleted := false
 
 	// In PAT network namespace...
 	err = patNetNS.Run(func() error {
 		// Check whether there are any remaining veth links connected to this bridge.
-		ifaces, _ := net.Interfaces()
-		log.Infof("Number of remaining links: %v.", len(ifaces))
-		if len(ifaces) == 4 {
-			// Only VLAN link, bridge, dummy and loopback remain.
-			lastVethLinkDeleted = true
+		links, err := plugin.nl().LinkList()
+		if err != nil {
+			return err
 		}
 
+		var reason string
+		lastVethLinkDeleted, reason = isLastVethLinkDeleted(links, netConfig.BranchVlanID)
+		log.Infof("Remaining links in PAT netns %s: %v. Last veth link deleted: %t, because %s.",
+			patNetNSName, getLinkNames(links), lastVethLinkDeleted, reason)
+
 		return nil
 	})
+	if err != nil {
+		// Keep the PAT netns if its links can't be listed, as it may still be in use.
+		log.Errorf("Failed to list links in PAT netns %s: %v.", patNetNSName, err)
+	}
 
 	// If all veth links connected to this PAT bridge are deleted, clean up the PAT network
-	// namespace and all virtual interfaces in it. Otherwise, leave it running.
-	if lastVethLinkDeleted && netConfig.CleanupPATNetNS {
-		log.Infof("Deleting PAT network namespace: %v.", patNetNSName)
-		err = patNetNS.Close()
-		if err != nil {
-			log.Errorf("Failed to delete netns: %v.", err)
-		}
+	// namespace and all virtual interfaces in it. Otherwise, leave it running. The PAT netns is
+	// also kept if the tap link is still held open, as a VMM may still be using it.
+	if lastVethLinkDeleted && netConfig.CleanupPATNetNS && tapReleased {
+		plugin.deletePATNetNS(patNetNS, patNetNSName, netConfig)
+		patNetNSDeleted = true
 	} else {
-		log.Infof("Skipping PAT netns deletion. Last veth link deleted: %t, cleanup PAT netns: %t.",
-			lastVethLinkDeleted, netConfig.CleanupPATNetNS)
+		log.Infof("Skipping PAT netns deletion. Last veth link deleted: %t, cleanup PAT netns: %t, "+
+			"tap link released: %t.", lastVethLinkDeleted, netConfig.CleanupPATNetNS, tapReleased)
+
+		// Delete the iptables rules for the PAT bridge if no tap links remain, so that they
+		// are not left behind in the kept PAT netns.
+		if lastVethLinkDeleted && tapReleased && !netConfig.SkipIptables {
+			err = patNetNS.Run(func() error {
+				return plugin.updateBridgeIptablesRules(netConfig, true)
+			})
+			if err != nil {
+				log.Errorf("Failed to delete iptables rules in PAT netns %s: %v.", patNetNSName, err)
+			}
+			iptablesRulesDeleted = true
+		}
+	}
+
+	// Verify that the teardown completed, as failures above are otherwise only logged.
+	if netConfig.VerifyTeardown {
+		return plugin.verifyTeardown(netConfig, patNetNSName, patNetNS, patNetNSDeleted, iptablesRulesDeleted)
 	}
 
 	return nil
 }
 
-// createPATNetworkNamespace creates the PAT network namespace for the specified branch interface.
-func (plugin *Plugin) createPATNetworkNamespace(
+// newTrunk creates the trunk ENI. The trunk MAC address takes precedence over the trunk name, as
+// interface names are not stable across reboots.
+func newTrunk(netConfig *config.NetConfig) (*eni.Trunk, error) {
+	if netConfig.TrunkMACAddress != nil {
+		trunk, err := eni.NewTrunkByMAC(netConfig.TrunkMACAddress, netConfig.TrunkIsolationMode)
+		if err != nil {
+			log.Errorf("Failed to find trunk interface %s: %v.", netConfig.TrunkMACAddress, err)
+		}
+		return trunk, err
+	}
+
+	trunk, err := eni.NewTrunk(netConfig.TrunkName, nil, netConfig.TrunkIsolationMode)
+	if err != nil {
+		log.Errorf("Failed to find trunk interface %s: %v.", netConfig.TrunkName, err)
+	}
+	return trunk, err
+}
+
+// selectBridgeIPAddress returns the IP address to assign to the PAT bridge, given the configured
+// one. The bridge subnet must not overlap the branch subnet, otherwise routing in the PAT netns is
+// ambiguous. If relocate is set, the first non-overlapping alternate bridge subnet is selected
+// instead of failing.
+func selectBridgeIPAddress(
+	bridgeIPAddress *net.IPNet,
+	branchSubnet *vpc.Subnet,
+	relocate bool) (*net.IPNet, error) {
+
+	if !branchSubnet.Overlaps(bridgeIPAddress) {
+		return bridgeIPAddress, nil
+	}
+
+	if !relocate {
+		return nil, &ErrConfigInvalid{Err: fmt.Errorf("bridge subnet %s overlaps branch subnet %s",
+			bridgeIPAddress, &branchSubnet.Prefix)}
+	}
+
+	for _, s := range alternateBridgeIPAddressStrings {
+		bridgeIPAddress, err := vpc.GetIPAddressFromString(s)
+		if err != nil {
+			return nil, err
+		}
+		if !branchSubnet.Overlaps(bridgeIPAddress) {
+			log.Infof("Relocating PAT bridge to %s to avoid overlap with branch subnet %s.",
+				bridgeIPAddress, &branchSubnet.Prefix)
+			return bridgeIPAddress, nil
+		}
+	}
+
+	return nil, &ErrConfigInvalid{Err: fmt.Errorf(
+		"no bridge subnet available that does not overlap branch subnet %s", &branchSubnet.Prefix)}
+}
+
+// cleanupPATNetworkNamespace deletes the branch link and the PAT netns left behind by a failed
+// ADD. The branch link is deleted from both the current netns and the PAT netns, as the failure
+// can happen before or after the branch link is moved. Failures are logged and ignored.
+func (plugin *Plugin) cleanupPATNetworkNamespace(
 	patNetNSName string,
 	trunk *eni.Trunk,
 	branchName string,
-	branchMACAddress net.HardwareAddr,
-	branchVlanID int,
-	branchIPAddress *net.IPNet,
-	branchSubnet *vpc.Subnet,
-	bridgeIPAddress *net.IPNet) (netns.NetNS, error) {
-	// Create the PAT network namespace.
-	log.Infof("Creating PAT netns %s.", patNetNSName)
-	patNetNS, err := netns.NewNetNS(patNetNSName)
-	if err != nil {
-		log.Errorf("Failed to create PAT netns %s: %v.", patNetNSName, err)
-		return nil, err
-	}
+	netConfig *config.NetConfig) {
 
-	// Create the branch ENI.
-	branch, err := eni.NewBranch(trunk, branchName, branchMACAddress, branchVlanID)
+	log.Infof("Cleaning up PAT netns %s after failure.", patNetNSName)
+
+	branch, err := eni.NewBranch(trunk, branchName, nil, netConfig.BranchVlanID)
 	if err != nil {
-		log.Errorf("Failed to create branch interface %s in PAT netns %s: %v.",
-			branchName, patNetNSName, err)
-		return nil, err
+		log.Errorf("Failed to create branch interface %s: %v.", branchName, err)
+		return
 	}
 
-	// Create a link for the branch ENI.
-	log.Infof("Creating branch link %s in PAT netns %s.", branchName, patNetNSName)
-	if err = branch.AttachToLink(true); err != nil {
-		log.Errorf("Failed to attach branch interface %s in %s: %v.",
-			branchName, patNetNSName, err)
-		return nil, err
+	// Detach the branch from the trunk if it was not moved to the PAT netns yet.
+	if _, err := plugin.nl().LinkByName(branchName); err == nil {
+		plugin.audit("BranchDetachFromLink", branch, branch.DetachFromLink())
 	}
 
-	// Move branch ENI to the PAT network namespace.
-	log.Infof("Moving branch link %s to PAT netns %s.", branchName, patNetNSName)
-	if err = branch.SetNetNS(patNetNS); err != nil {
-		log.Errorf("Failed to move branch link %s to PAT netns %s: %v.",
-			branchName, patNetNSName, err)
-		return nil, err
+	patNetNS, err := netns.GetNetNSByName(patNetNSName)
+	if err != nil {
+		log.Infof("PAT netns %s was not created: %v.", patNetNSName, err)
+		return
 	}
 
-	// Configure the PAT network namespace.
-	log.Infof("Setting up PAT netns %s.", patNetNSName)
+	err = patNetNS.Run(func() error {
+		if _, err := plugin.nl().LinkByName(branchName); err != nil {
+			return nil
+		}
+		return plugin.audit("BranchDetachFromLink", branch, branch.DetachFromLink())
+	})
+	if err != nil {
+		log.Errorf("Failed to delete branch link %s in PAT netns %s: %v.",
+			branchName, patNetNSName, err)
+	}
+
+	err = closeNetNSWithRetry(patNetNS, netConfig.NetNSCloseAttempts, netConfig.NetNSCloseRetryDelay)
+	if err != nil {
+		log.Errorf("Failed to delete PAT netns %s: %v.", patNetNSName, err)
+		return
+	}
+
+	err = removePATNetNSStamp(patNetNSName)
+	if err != nil {
+		log.Errorf("Failed to remove stamp of PAT netns %s: %v.", patNetNSName, err)
+	}
+}
+
+// checkPATNetNSLimit returns an error if the number of PAT netns on this node has reached the
+// given limit.
+func checkPATNetNSLimit(limit int) error {
+	names, err := netns.ListNetNSNames()
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, name := range names {
+		var vlanID int
+		if n, _ := fmt.Sscanf(name, patNetNSNameFormat, &vlanID); n == 1 {
+			count++
+		}
+	}
+
+	// The limit is a capacity bound, so the command may succeed once other PAT netns are deleted.
+	if count >= limit {
+		return &ErrTransient{Err: fmt.Errorf(
+			"node has %d PAT netns, which reached maxPATNetNS %d", count, limit)}
+	}
+
+	return nil
+}
+
+// deletePATNetNS deletes the PAT netns and removes its branch from the trunk in the configured
+// order. Failures are logged and otherwise ignored, as DEL is best-effort.
+func (plugin *Plugin) deletePATNetNS(patNetNS netns.NetNS, patNetNSName string, netConfig *config.NetConfig) {
+	// Remove the branch from the trunk even if the PAT netns outlives its mount point.
+	if netConfig.BranchDeleteOrder == config.BranchDeleteOrderBranchFirst {
+		log.Infof("Deleting branch links in PAT netns %s.", patNetNSName)
+		err := patNetNS.Run(plugin.deleteBranchLinks)
+		if err != nil {
+			log.Errorf("Failed to delete branch links in PAT netns %s: %v.", patNetNSName, err)
+		}
+	}
+
+	log.Infof("Deleting PAT network namespace: %v.", patNetNSName)
+	err := closeNetNSWithRetry(patNetNS, netConfig.NetNSCloseAttempts, netConfig.NetNSCloseRetryDelay)
+	if err != nil {
+		log.Errorf("Failed to delete netns: %v.", err)
+		return
+	}
+
+	err = removePATNetNSStamp(patNetNSName)
+	if err != nil {
+		log.Errorf("Failed to remove stamp of PAT netns %s: %v.", patNetNSName, err)
+	}
+}
+
+// deleteBranchLinks deletes the branch links in the current netns, which also removes the
+// branches from their trunks.
+func (plugin *Plugin) deleteBranchLinks() error {
+	branches, err := eni.ListBranchLinks()
+	if err != nil {
+		return err
+	}
+
+	for _, branch := range branches {
+		link, err := plugin.nl().LinkByName(branch.LinkName)
+		if err != nil {
+			return err
+		}
+
+		err = plugin.audit("LinkDel", link, plugin.nl().LinkDel(link))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closeNetNSWithRetry closes the given netns, retrying with exponential backoff up to the given
+// number of attempts. Closing can transiently fail while a tap fd in the netns is being released.
+func closeNetNSWithRetry(ns netns.NetNS, attempts int, delay time.Duration) error {
+	var err error
+
+	for i := 1; i <= attempts; i++ {
+		err = ns.Close()
+		if err == nil {
+			return nil
+		}
+		if i < attempts {
+			log.Warnf("Failed to close netns on attempt %d of %d, retrying in %v: %v.",
+				i, attempts, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	return err
+}
+
+// Check is the internal implementation of CNI CHECK command.
+// It verifies that the PAT netns and the links created by ADD are present and up.
+func (plugin *Plugin) Check(args *cniSkel.CmdArgs) error {
+	// Parse network configuration.
+	netConfig, err := config.New(args, false)
+	if err != nil {
+		log.Errorf("Failed to parse netconfig from args: %v.", err)
+		return err
+	}
+
+	setLogFields(args, netConfig)
+	log.Infof("Executing CHECK with netconfig: %+v.", netConfig)
+
+	// Derive names from CNI network config.
+	patNetNSName := fmt.Sprintf(patNetNSNameFormat, netConfig.BranchVlanID)
+	tapLinkName := args.IfName
+	targetNetNSName := args.Netns
+
+	// Check the bridge and branch links in the PAT network namespace.
+	patNetNS, err := netns.GetNetNSByName(patNetNSName)
+	if err != nil {
+		log.Errorf("Failed to find PAT netns %s: %v.", patNetNSName, err)
+		return fmt.Errorf("PAT netns %s not found: %v", patNetNSName, err)
+	}
+
+	err = patNetNS.Run(func() error {
+		err := plugin.checkLinkUp(netConfig.BridgeName)
+		if err != nil {
+			return err
+		}
+
+		// Report which tap or veth port each bridge FDB entry was learned on, to help
+		// correlate L2 traffic with attachments sharing the bridge.
+		entries, err := plugin.listBridgeFDB(netConfig.BridgeName)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			log.Infof("Bridge %s FDB entry %s on %s alias %q.",
+				netConfig.BridgeName, entry.MACAddress, entry.LinkName, entry.LinkAlias)
+		}
+
+		branches, err := eni.ListBranchLinks()
+		if err != nil {
+			return err
+		}
+		for _, branch := range branches {
+			if isPATBranchLink(branch, netConfig.BranchVlanID) {
+				return checkBranchLink(branch.LinkName, netConfig.BranchMACAddress)
+			}
+		}
+
+		return fmt.Errorf("branch link for VLAN ID %d not found", netConfig.BranchVlanID)
+	})
+	if err != nil {
+		log.Errorf("Failed to check PAT netns %s: %v.", patNetNSName, err)
+		return fmt.Errorf("PAT netns %s: %v", patNetNSName, err)
+	}
+
+	// Check the tap link in the target network namespace.
+	targetNetNS, err := netns.GetNetNSByName(targetNetNSName)
+	if err != nil {
+		log.Errorf("Failed to find target netns %s: %v.", targetNetNSName, err)
+		return fmt.Errorf("target netns %s not found: %v", targetNetNSName, err)
+	}
+
+	err = targetNetNS.Run(func() error {
+		return plugin.checkLinkUp(tapLinkName)
+	})
+	if err != nil {
+		log.Errorf("Failed to check target netns %s: %v.", targetNetNSName, err)
+		return fmt.Errorf("target netns %s: %v", targetNetNSName, err)
+	}
+
+	return nil
+}
+
+// checkLinkUp returns an error if the link with the given name does not exist in the current
+// netns or is not up.
+func (plugin *Plugin) checkLinkUp(linkName string) error {
+	link, err := plugin.nl().LinkByName(linkName)
+	if err != nil {
+		return fmt.Errorf("link %s not found: %v", linkName, err)
+	}
+
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("link %s is not up", linkName)
+	}
+
+	return nil
+}
+
+// checkBranchLink returns an error if the branch link with the given name in the current netns
+// is not operationally up, or if its MAC address does not match the given one.
+func checkBranchLink(linkName string, macAddress net.HardwareAddr) error {
+	branch, err := eni.NewENI(linkName, nil)
+	if err != nil {
+		return err
+	}
+
+	up, err := branch.GetOpState()
+	if err != nil {
+		return fmt.Errorf("link %s not found: %v", linkName, err)
+	}
+	if !up {
+		return fmt.Errorf("link %s is not up", linkName)
+	}
+
+	if macAddress != nil {
+		linkMACAddress, err := branch.GetLinkMACAddress()
+		if err != nil {
+			return fmt.Errorf("link %s not found: %v", linkName, err)
+		}
+		if !vpc.CompareMACAddress(linkMACAddress, macAddress) {
+			return fmt.Errorf("link %s MAC address %s does not match branchMACAddress %s",
+				linkName, linkMACAddress, macAddress)
+		}
+	}
+
+	return nil
+}
+
+// isLastVethLinkDeleted returns whether the given remaining links in the PAT netns indicate that
+// the last veth link was deleted, along with the reason for the decision. Each veth link connects
+// one tap link to the PAT bridge. Other links in the PAT netns are ignored.
+func isLastVethLinkDeleted(links []netlink.Link, branchVlanID int) (bool, string) {
+	vethLinkNames := getLinkNames(filterVethLinks(links, branchVlanID))
+	if len(vethLinkNames) == 0 {
+		return true, "no veth links remain"
+	}
+
+	return false, fmt.Sprintf("%d veth links remain: %v", len(vethLinkNames), vethLinkNames)
+}
+
+// filterVethLinks returns the veth links created by this plugin for the given VLAN ID.
+func filterVethLinks(links []netlink.Link, branchVlanID int) []netlink.Link {
+	prefix := fmt.Sprintf(vethLinkNameFormat, branchVlanID)
+
+	var vethLinks []netlink.Link
+	for _, link := range links {
+		if link.Type() == "veth" && strings.HasPrefix(link.Attrs().Name, prefix) {
+			vethLinks = append(vethLinks, link)
+		}
+	}
+
+	return vethLinks
+}
+
+// getLinkNames returns the names of the given links.
+func getLinkNames(links []netlink.Link) []string {
+	var names []string
+	for _, link := range links {
+		names = append(names, link.Attrs().Name)
+	}
+
+	return names
+}
+
+// createPATNetworkNamespace creates the PAT network namespace for the specified branch interface.
+func (plugin *Plugin) createPATNetworkNamespace(
+	patNetNSName string,
+	trunk *eni.Trunk,
+	branchName string,
+	branchMACAddress net.HardwareAddr,
+	branchVlanID int,
+	branchIPAddress *net.IPNet,
+	branchSubnet *vpc.Subnet,
+	bridgeIPAddress *net.IPNet,
+	netConfig *config.NetConfig,
+	onBridgeUp func(patNetNS netns.NetNS) error) (netns.NetNS, error) {
+	// Create the PAT network namespace.
+	plugin.stage = stageNamespaceCreate
+	log.Infof("Creating PAT netns %s.", patNetNSName)
+	patNetNS, err := netns.NewNetNS(patNetNSName)
+	if err != nil {
+		log.Errorf("Failed to create PAT netns %s: %v.", patNetNSName, err)
+		return nil, err
+	}
+	log.Debugf("PAT netns %s is at %s.", patNetNSName, patNetNS.GetPath())
+
+	// Record the plugin version that created the PAT netns, for diagnostics.
+	err = writePATNetNSStamp(patNetNSName)
+	if err != nil {
+		log.Warnf("Failed to write stamp of PAT netns %s: %v.", patNetNSName, err)
+	}
+
+	// Create the branch ENI.
+	branch, err := eni.NewBranch(trunk, branchName, branchMACAddress, branchVlanID)
+	if err != nil {
+		log.Errorf("Failed to create branch interface %s in PAT netns %s: %v.",
+			branchName, patNetNSName, err)
+		return nil, err
+	}
+
+	// Create a link for the branch ENI.
+	log.Infof("Creating branch link %s in PAT netns %s.", branchName, patNetNSName)
+	err = plugin.attachBranch(branch, netConfig.StrayBranchPolicy)
+	if err != nil {
+		log.Errorf("Failed to attach branch interface %s in %s: %v.",
+			branchName, patNetNSName, err)
+		return nil, err
+	}
+
+	// Move branch ENI to the PAT network namespace.
+	log.Infof("Moving branch link %s to PAT netns %s.", branchName, patNetNSName)
+	err = plugin.audit("BranchSetNetNS", branch, branch.SetNetNS(patNetNS))
+	if err != nil {
+		log.Errorf("Failed to move branch link %s to PAT netns %s: %v.",
+			branchName, patNetNSName, err)
+		return nil, err
+	}
+
+	// Configure the PAT network namespace.
+	log.Infof("Setting up PAT netns %s.", patNetNSName)
+	var onPATBridgeUp func() error
+	if onBridgeUp != nil {
+		onPATBridgeUp = func() error { return onBridgeUp(patNetNS) }
+	}
 	err = patNetNS.Run(func() error {
 		return plugin.setupPATNetworkNamespace(patNetNSName,
-			bridgeName, bridgeIPAddress, branch, branchIPAddress, branchSubnet)
+			netConfig.BridgeName, bridgeIPAddress, branch, branchIPAddress, branchSubnet, netConfig,
+			onPATBridgeUp)
 	})
 	if err != nil {
 		log.Errorf("Failed to setup PAT netns %s: %v.", patNetNSName, err)
@@ -266,132 +1128,573 @@ func (plugin *Plugin) createPATNetworkNamespace(
 	return patNetNS, nil
 }
 
-// setupPATNetworkNamespace configures all networking inside the PAT network namespace.
-func (plugin *Plugin) setupPATNetworkNamespace(
-	patNetNSName string,
-	bridgeName string, bridgeIPAddress *net.IPNet,
-	branch *eni.Branch, branchIPAddress *net.IPNet, branchSubnet *vpc.Subnet) error {
+// attachBranch creates the link for the branch ENI. A branch link left behind by an earlier ADD,
+// for example one that crashed before moving it to the PAT netns, is handled according to the
+// given stray branch policy.
+func (plugin *Plugin) attachBranch(branch *eni.Branch, strayBranchPolicy string) error {
+	plugin.stage = stageBranchAttach
+	branchName := branch.GetLinkName()
+	if strayBranchPolicy == config.StrayBranchPolicyReuse {
+		// Reuse a compatible stray branch link, and recreate the link otherwise.
+		err := plugin.audit("BranchAttachToLinkIfAbsent", branch, branch.AttachToLinkIfAbsent(true))
+		if err == nil {
+			return nil
+		}
+		log.Warnf("Recreating branch link %s: %v.", branchName, err)
+	} else {
+		err := plugin.audit("BranchAttachToLink", branch, branch.AttachToLink(true))
+		if !os.IsExist(err) {
+			return err
+		}
+		log.Infof("Recreating stray branch link %s.", branchName)
+	}
+
+	err := plugin.audit("BranchDelete", branch, branch.Delete())
+	if err != nil {
+		return err
+	}
+
+	return plugin.audit("BranchAttachToLink", branch, branch.AttachToLink(true))
+}
+
+// setupPATNetworkNamespace configures all networking inside the PAT network namespace.
+func (plugin *Plugin) setupPATNetworkNamespace(
+	patNetNSName string,
+	bridgeName string, bridgeIPAddress *net.IPNet,
+	branch *eni.Branch, branchIPAddress *net.IPNet, branchSubnet *vpc.Subnet,
+	netConfig *config.NetConfig,
+	onBridgeUp func() error) error {
+
+	// Create the bridge link.
+	la := netlink.NewLinkAttrs()
+	la.Name = bridgeName
+	la.MTU = netConfig.MTU
+	bridgeLink := &netlink.Bridge{LinkAttrs: la}
+	log.Infof("Creating bridge link %+v in PAT netns %s.", bridgeLink, patNetNSName)
+	err := plugin.audit("LinkAdd", bridgeLink, plugin.nl().LinkAdd(bridgeLink))
+	if err != nil {
+		log.Errorf("Failed to create bridge link in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	// Set bridge link MTU.
+	err = plugin.audit("LinkSetMTU", bridgeLink, plugin.nl().LinkSetMTU(bridgeLink, netConfig.MTU))
+	if err != nil {
+		log.Errorf("Failed to set bridge link MTU in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	// Make the bridge act as the multicast querier, for IGMP/MLD snooping to work without an
+	// external querier. The kernel default is off.
+	if netConfig.MulticastQuerier {
+		log.Infof("Enabling multicast querier on bridge link in PAT netns %s.", patNetNSName)
+		err = plugin.audit("BridgeSetMulticastQuerier", bridgeLink,
+			setBridgeMulticastQuerier(bridgeLink, true))
+		if err != nil {
+			log.Errorf("Failed to enable multicast querier in PAT netns %s: %v.", patNetNSName, err)
+			return err
+		}
+	}
+
+	// Drop frames forwarded through the bridge other than IPv4, IPv6 and ARP. By default, all
+	// ethertypes are allowed.
+	if netConfig.BridgeEthertypeFilter {
+		log.Infof("Setting up ethertype filter on bridge link in PAT netns %s.", patNetNSName)
+		err = setupEthertypeFilter()
+		if err != nil {
+			log.Errorf("Failed to set up ethertype filter in PAT netns %s: %v.", patNetNSName, err)
+			return err
+		}
+	}
+
+	// Create the dummy link.
+	la = netlink.NewLinkAttrs()
+	la.Name = fmt.Sprintf("%s-dummy", bridgeName)
+	la.MTU = netConfig.MTU
+	la.MasterIndex = bridgeLink.Index
+	dummyLink := &netlink.Dummy{LinkAttrs: la}
+	log.Infof("Creating dummy link %+v in PAT netns %s.", dummyLink, patNetNSName)
+	err = plugin.audit("LinkAdd", dummyLink, plugin.nl().LinkAdd(dummyLink))
+	if err != nil {
+		log.Errorf("Failed to create dummy link in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	// Set dummy link MTU.
+	err = plugin.audit("LinkSetMTU", dummyLink, plugin.nl().LinkSetMTU(dummyLink, netConfig.MTU))
+	if err != nil {
+		log.Errorf("Failed to set dummy link MTU in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	// Assign IP address to PAT bridge.
+	log.Infof("Assigning IP address %v to bridge link %s in PAT netns %s.",
+		bridgeIPAddress, bridgeName, patNetNSName)
+	address := &netlink.Addr{IPNet: bridgeIPAddress}
+	err = plugin.audit("AddrAdd", address, plugin.nl().AddrAdd(bridgeLink, address))
+	if err != nil {
+		log.Errorf("Failed to assign IP address to bridge link in PAT netns %s: %v.",
+			patNetNSName, err)
+		return err
+	}
+
+	// On dual-stack branches, enable IPv6 forwarding and assign an IPv6 address to PAT bridge.
+	// Branches in link-local-only mode get their global address and route from RAs instead.
+	if netConfig.IsDualStack() {
+		log.Infof("Enabling IPv6 forwarding in PAT netns %s.", patNetNSName)
+		err = ipcfg.SetIPv6Forwarding("all", 1)
+		if err != nil {
+			log.Errorf("Failed to enable IPv6 forwarding in PAT netns %s: %v.", patNetNSName, err)
+			return err
+		}
+
+		log.Infof("Assigning IPv6 address %v to bridge link %s in PAT netns %s.",
+			&netConfig.BridgeIPv6Address, bridgeName, patNetNSName)
+		address := &netlink.Addr{IPNet: &netConfig.BridgeIPv6Address, Flags: unix.IFA_F_NODAD}
+		err = plugin.audit("AddrAdd", address, plugin.nl().AddrAdd(bridgeLink, address))
+		if err != nil {
+			log.Errorf("Failed to assign IPv6 address to bridge link in PAT netns %s: %v.",
+				patNetNSName, err)
+			return err
+		}
+	}
+
+	// Set bridge link operational state up.
+	log.Infof("Setting bridge link state up in PAT netns %s.", patNetNSName)
+	err = plugin.audit("LinkSetUp", bridgeLink, plugin.nl().LinkSetUp(bridgeLink))
+	if err != nil {
+		log.Errorf("Failed to set bridge link state in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	// Disable STP, which only adds forwarding delay on a bridge local to this host.
+	if netConfig.DisableSTP {
+		log.Infof("Disabling STP on bridge link in PAT netns %s.", patNetNSName)
+		err = plugin.audit("BridgeSetSTP", bridgeLink, setBridgeSTP(bridgeLink, false))
+		if err != nil {
+			log.Errorf("Failed to disable STP in PAT netns %s: %v.", patNetNSName, err)
+			return err
+		}
+	}
+
+	// Run the caller's hook, e.g. to create the tap link early while the rest is set up.
+	if onBridgeUp != nil {
+		err = onBridgeUp()
+		if err != nil {
+			return err
+		}
+	}
+
+	return plugin.configureBranch(patNetNSName, bridgeName, bridgeIPAddress,
+		branch, branchIPAddress, branchSubnet, netConfig)
+}
+
+// configureBranch configures the branch link in the PAT network namespace, and the iptables rules
+// and default routes through it. It must be called in the PAT netns, after the bridge is set up.
+func (plugin *Plugin) configureBranch(
+	patNetNSName string,
+	bridgeName string, bridgeIPAddress *net.IPNet,
+	branch *eni.Branch, branchIPAddress *net.IPNet, branchSubnet *vpc.Subnet,
+	netConfig *config.NetConfig) error {
+
+	staticIPv6 := netConfig.BranchIPv6Address.IP != nil
+
+	// Find the branch link, which was moved to the PAT netns.
+	branchLink, err := plugin.nl().LinkByName(branch.GetLinkName())
+	if err != nil {
+		log.Errorf("Failed to find branch link in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	// Set branch link MTU.
+	log.Infof("Setting branch link MTU to %d in PAT netns %s.", netConfig.MTU, patNetNSName)
+	err = plugin.audit("LinkSetMTU", branchLink, plugin.nl().LinkSetMTU(branchLink, netConfig.MTU))
+	if err != nil {
+		log.Errorf("Failed to set branch link MTU in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	// Assign IP address to branch interface.
+	assignBranchIPAddress := func() error {
+		log.Infof("Assigning IP address %v to branch link in PAT netns %s.",
+			branchIPAddress, patNetNSName)
+		address := &netlink.Addr{IPNet: branchIPAddress}
+		err := plugin.audit("AddrAdd", address, plugin.nl().AddrAdd(branchLink, address))
+		if err != nil {
+			log.Errorf("Failed to assign IP address to branch link in PAT netns %s: %v.",
+				patNetNSName, err)
+			return err
+		}
+
+		if staticIPv6 {
+			log.Infof("Assigning IPv6 address %v to branch link in PAT netns %s.",
+				&netConfig.BranchIPv6Address, patNetNSName)
+			address = &netlink.Addr{IPNet: &netConfig.BranchIPv6Address}
+			err = plugin.audit("AddrAdd", address, plugin.nl().AddrAdd(branchLink, address))
+			if err != nil {
+				log.Errorf("Failed to assign IPv6 address to branch link in PAT netns %s: %v.",
+					patNetNSName, err)
+			}
+		}
+		return err
+	}
+
+	// Set branch link operational state up.
+	setBranchUp := func() error {
+		log.Infof("Setting branch link state up in PAT netns %s.", patNetNSName)
+		err := plugin.audit("LinkSetUp", branchLink, plugin.nl().LinkSetUp(branchLink))
+		if err != nil {
+			log.Errorf("Failed to set branch link state in PAT netns %s: %v.", patNetNSName, err)
+		}
+		return err
+	}
+
+	// Configure RA and SLAAC handling on the branch before the link comes up.
+	err = setBranchIPv6Params(branch.GetLinkName(), netConfig)
+	if err != nil {
+		log.Errorf("Failed to set branch IPv6 params in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	// Resize the branch ring buffers before the link comes up, as drivers may reset the device.
+	err = setBranchRingParams(branch.GetLinkName(), netConfig)
+	if err != nil {
+		log.Errorf("Failed to set branch ring sizes in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	err = configureBranchLink(netConfig.BranchUpBeforeAddress, assignBranchIPAddress, setBranchUp)
+	if err != nil {
+		return err
+	}
+
+	// Tune the branch neighbor table for large subnets.
+	err = setBranchNeighParams(branch.GetLinkName(), netConfig)
+	if err != nil {
+		log.Errorf("Failed to set branch neighbor params in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	// Configure iptables rules. This is done before adding the default route, so that traffic
+	// from tap links created early never egresses the branch without NAT.
+	if netConfig.SkipIptables {
+		log.Infof("Skipping iptables rules in PAT netns %s.", patNetNSName)
+	} else {
+		log.Infof("Configuring iptables rules in PAT netns %s.", patNetNSName)
+		_, bridgeSubnet, _ := net.ParseCIDR(bridgeIPAddress.String())
+		err = plugin.setupIptablesRules(
+			bridgeName, bridgeSubnet.String(), branch.GetLinkName(), netConfig)
+		if err != nil {
+			log.Errorf("Unable to setup iptables rules in PAT netns %s: %v.", patNetNSName, err)
+			return err
+		}
+
+		if netConfig.IsDualStack() {
+			log.Infof("Configuring ip6tables rules in PAT netns %s.", patNetNSName)
+			bridgeIPv6Subnet := vpc.GetSubnetPrefix(&netConfig.BridgeIPv6Address)
+			err = plugin.setupIp6tablesRules(
+				bridgeName, bridgeIPv6Subnet.String(), branch.GetLinkName(), netConfig)
+			if err != nil {
+				log.Errorf("Unable to setup ip6tables rules in PAT netns %s: %v.", patNetNSName, err)
+				return err
+			}
+		}
+	}
+
+	// Add default route to PAT branch gateway.
+	route, err := newDefaultRoute(branchLink.Attrs().Index, branchSubnet, netConfig.ECMP)
+	if err != nil {
+		log.Errorf("Invalid default route in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+	log.Infof("Adding default route to %+v in PAT netns %s.", route, patNetNSName)
+	err = plugin.audit("RouteAdd", route, plugin.nl().RouteAdd(route))
+	if err != nil {
+		log.Errorf("Failed to add IP route in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	// Add IPv6 default route to PAT branch IPv6 subnet gateway.
+	if staticIPv6 {
+		branchIPv6Subnet := newBranchIPv6Subnet(netConfig, branchSubnet)
+		route, err = newDefaultRoute(branchLink.Attrs().Index, branchIPv6Subnet, false)
+		if err != nil {
+			log.Errorf("Invalid IPv6 default route in PAT netns %s: %v.", patNetNSName, err)
+			return err
+		}
+		log.Infof("Adding IPv6 default route to %+v in PAT netns %s.", route, patNetNSName)
+		err = plugin.audit("RouteAdd", route, plugin.nl().RouteAdd(route))
+		if err != nil {
+			log.Errorf("Failed to add IPv6 route in PAT netns %s: %v.", patNetNSName, err)
+			return err
+		}
+	}
+
+	// Verify that traffic from the PAT bridge subnet is masqueraded out of the branch link.
+	if netConfig.VerifyNAT {
+		err = verifyNAT(bridgeIPAddress.IP, netConfig.NATVerifyTarget, netConfig.NATVerifyTimeout)
+		if err != nil {
+			log.Errorf("NAT verification failed in PAT netns %s: %v.", patNetNSName, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setBranchNeighParams sets the neighbor table parameters of the branch link in the current
+// netns. Parameters that are not configured are left at the kernel defaults.
+func setBranchNeighParams(branchLinkName string, netConfig *config.NetConfig) error {
+	if netConfig.NeighBaseReachableTimeMs != 0 {
+		log.Infof("Setting branch link %s neighbor base reachable time to %dms.",
+			branchLinkName, netConfig.NeighBaseReachableTimeMs)
+		err := ipcfg.SetIPv4NeighBaseReachableTimeMs(branchLinkName, netConfig.NeighBaseReachableTimeMs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if netConfig.NeighGCStaleTime != 0 {
+		log.Infof("Setting branch link %s neighbor gc stale time to %ds.",
+			branchLinkName, netConfig.NeighGCStaleTime)
+		err := ipcfg.SetIPv4NeighGCStaleTime(branchLinkName, netConfig.NeighGCStaleTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setBranchRingParams sets the rx/tx ring buffer sizes of the branch link in the current netns.
+// Larger rings reduce drops under bursts at the cost of latency. Sizes that are not configured are
+// left at the driver defaults.
+func setBranchRingParams(branchLinkName string, netConfig *config.NetConfig) error {
+	if netConfig.BranchRxRingSize == 0 && netConfig.BranchTxRingSize == 0 {
+		return nil
+	}
+
+	log.Infof("Setting branch link %s ring sizes to rx %d tx %d.",
+		branchLinkName, netConfig.BranchRxRingSize, netConfig.BranchTxRingSize)
+	return eni.SetLinkRingParams(branchLinkName, netConfig.BranchRxRingSize, netConfig.BranchTxRingSize)
+}
+
+// setBranchIPv6Params sets the IPv6 parameters of the branch link in the current netns. Branches
+// in link-local-only mode accept RAs even though IPv6 forwarding is enabled in the PAT netns, so
+// that the kernel configures the global address and default route from them. The privacy
+// extensions setting applies to the addresses the kernel configures from RAs.
+func setBranchIPv6Params(branchLinkName string, netConfig *config.NetConfig) error {
+	if netConfig.BranchIPv6LinkLocalOnly {
+		log.Infof("Enabling IPv6 accept RA on branch link %s.", branchLinkName)
+		err := ipcfg.SetIPv6AcceptRA(branchLinkName, 2)
+		if err != nil {
+			return err
+		}
+	}
+
+	if netConfig.BranchIPv6UseTempAddr != config.UnsetIPv6UseTempAddr {
+		log.Infof("Setting IPv6 use_tempaddr on branch link %s to %d.",
+			branchLinkName, netConfig.BranchIPv6UseTempAddr)
+		return ipcfg.SetIPv6UseTempAddr(branchLinkName, netConfig.BranchIPv6UseTempAddr)
+	}
+
+	return nil
+}
+
+// newDefaultRoute returns the default route through the branch subnet gateways in the address
+// family of the subnet. Only the first gateway is used unless ECMP is enabled, in which case the
+// route has a nexthop per gateway.
+func newDefaultRoute(linkIndex int, branchSubnet *vpc.Subnet, ecmp bool) (*netlink.Route, error) {
+	gateways := branchSubnet.GatewaysFor(branchSubnet.Prefix.IP)
+	if len(gateways) == 0 {
+		return nil, fmt.Errorf("no gateway in subnet %s", branchSubnet.Prefix.String())
+	}
+	if !ecmp {
+		gateways = gateways[:1]
+	}
+
+	for _, gateway := range gateways {
+		if !branchSubnet.Prefix.Contains(gateway) {
+			return nil, fmt.Errorf("gateway %s is not in subnet %s",
+				gateway, branchSubnet.Prefix.String())
+		}
+	}
+
+	if len(gateways) == 1 {
+		return &netlink.Route{Gw: gateways[0], LinkIndex: linkIndex}, nil
+	}
+
+	// The multipath route needs an explicit default destination, as it has no single gateway.
+	_, defaultDst, _ := net.ParseCIDR("0.0.0.0/0")
+	route := &netlink.Route{Dst: defaultDst}
+	for _, gateway := range gateways {
+		route.MultiPath = append(route.MultiPath, &netlink.NexthopInfo{
+			LinkIndex: linkIndex,
+			Gw:        gateway,
+		})
+	}
+
+	return route, nil
+}
+
+// configureBranchLink assigns the IP address to and brings up the branch link in the requested
+// order. Some drivers behave better when the link is up before the address is assigned, for
+// example due to IPv6 duplicate address detection timing.
+func configureBranchLink(upBeforeAddress bool, assignAddress, setUp func() error) error {
+	steps := []func() error{assignAddress, setUp}
+	if upBeforeAddress {
+		steps = []func() error{setUp, assignAddress}
+	}
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateBridgeIptablesRules sets up or deletes the iptables rules for the PAT bridge, as found
+// in the current netns. It is used when the PAT netns outlives the tap links using it: the rules
+// are deleted when the last tap link is removed, and set up again when a tap link is added.
+func (plugin *Plugin) updateBridgeIptablesRules(netConfig *config.NetConfig, remove bool) error {
+	bridgeName := netConfig.BridgeName
 
-	// Create the bridge link.
-	la := netlink.NewLinkAttrs()
-	la.Name = bridgeName
-	la.MTU = vpc.JumboFrameMTU
-	bridgeLink := &netlink.Bridge{LinkAttrs: la}
-	log.Infof("Creating bridge link %+v in PAT netns %s.", bridgeLink, patNetNSName)
-	err := netlink.LinkAdd(bridgeLink)
+	// Find the PAT bridge subnet, which may have been relocated by ADD.
+	bridge, err := plugin.nl().LinkByName(bridgeName)
 	if err != nil {
-		log.Errorf("Failed to create bridge link in PAT netns %s: %v.", patNetNSName, err)
 		return err
 	}
-
-	// Set bridge link MTU.
-	err = netlink.LinkSetMTU(bridgeLink, vpc.JumboFrameMTU)
+	bridgeSubnet, err := plugin.getBridgeSubnet(bridge)
 	if err != nil {
-		log.Errorf("Failed to set bridge link MTU in PAT netns %s: %v.", patNetNSName, err)
 		return err
 	}
 
-	// Create the dummy link.
-	la = netlink.NewLinkAttrs()
-	la.Name = fmt.Sprintf("%s-dummy", bridgeName)
-	la.MTU = vpc.JumboFrameMTU
-	la.MasterIndex = bridgeLink.Index
-	dummyLink := &netlink.Dummy{LinkAttrs: la}
-	log.Infof("Creating dummy link %+v in PAT netns %s.", dummyLink, patNetNSName)
-	err = netlink.LinkAdd(dummyLink)
+	// Find the branch link.
+	branchLink, err := plugin.findPATBranchLink(netConfig.BranchVlanID)
 	if err != nil {
-		log.Errorf("Failed to create dummy link in PAT netns %s: %v.", patNetNSName, err)
 		return err
 	}
+	branchLinkName := branchLink.Attrs().Name
+
+	dualStack := netConfig.IsDualStack()
+	bridgeIPv6Subnet := vpc.GetSubnetPrefix(&netConfig.BridgeIPv6Address)
+
+	if remove {
+		log.Infof("Deleting iptables rules for bridge %s.", bridgeName)
+		err = plugin.deleteIptablesRules(
+			bridgeName, bridgeSubnet.String(), branchLinkName, netConfig)
+		if err == nil && dualStack {
+			err = plugin.deleteIp6tablesRules(
+				bridgeName, bridgeIPv6Subnet.String(), branchLinkName, netConfig)
+		}
+	} else {
+		log.Infof("Configuring iptables rules for bridge %s.", bridgeName)
+		err = plugin.setupIptablesRules(
+			bridgeName, bridgeSubnet.String(), branchLinkName, netConfig)
+		if err == nil && dualStack {
+			err = plugin.setupIp6tablesRules(
+				bridgeName, bridgeIPv6Subnet.String(), branchLinkName, netConfig)
+		}
+	}
 
-	// Set dummy link MTU.
-	err = netlink.LinkSetMTU(dummyLink, vpc.JumboFrameMTU)
+	return err
+}
+
+// getBridgeSubnet returns the IPv4 subnet of the given PAT bridge link.
+func (plugin *Plugin) getBridgeSubnet(bridge netlink.Link) (*net.IPNet, error) {
+	addrs, err := plugin.nl().AddrList(bridge, netlink.FAMILY_V4)
 	if err != nil {
-		log.Errorf("Failed to set dummy link MTU in PAT netns %s: %v.", patNetNSName, err)
-		return err
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("bridge %s has no IPv4 address", bridge.Attrs().Name)
 	}
 
-	// Assign IP address to PAT bridge.
-	log.Infof("Assigning IP address %v to bridge link %s in PAT netns %s.",
-		bridgeIPAddress, bridgeName, patNetNSName)
-	address := &netlink.Addr{IPNet: bridgeIPAddress}
-	err = netlink.AddrAdd(bridgeLink, address)
+	return vpc.GetSubnetPrefix(addrs[0].IPNet), nil
+}
+
+// findPATBranchLink returns the branch link with the given VLAN ID in the current netns.
+func (plugin *Plugin) findPATBranchLink(branchVlanID int) (netlink.Link, error) {
+	links, err := plugin.nl().LinkList()
 	if err != nil {
-		log.Errorf("Failed to assign IP address to bridge link in PAT netns %s: %v.",
-			patNetNSName, err)
-		return err
+		return nil, err
 	}
 
-	// Set bridge link operational state up.
-	log.Infof("Setting bridge link state up in PAT netns %s.", patNetNSName)
-	err = netlink.LinkSetUp(bridgeLink)
-	if err != nil {
-		log.Errorf("Failed to set bridge link state in PAT netns %s: %v.", patNetNSName, err)
-		return err
+	for _, branch := range eni.GetBranchLinks(links) {
+		if isPATBranchLink(branch, branchVlanID) {
+			return plugin.nl().LinkByName(branch.LinkName)
+		}
 	}
 
-	// TODO: brctl stp #{pat_bridge_interface_name} off
+	return nil, fmt.Errorf("branch link with VLAN ID %d not found", branchVlanID)
+}
 
-	// Assign IP address to branch interface.
-	log.Infof("Assigning IP address %v to branch link in PAT netns %s.",
-		branchIPAddress, patNetNSName)
-	address = &netlink.Addr{IPNet: branchIPAddress}
-	la = netlink.NewLinkAttrs()
-	la.Index = branch.GetLinkIndex()
-	link := &netlink.Dummy{LinkAttrs: la}
-	err = netlink.AddrAdd(link, address)
+// setupIptablesRules sets iptables rules in PAT network namespace.
+func (plugin *Plugin) setupIptablesRules(
+	bridgeName, bridgeSubnet, branchLinkName string,
+	netConfig *config.NetConfig) error {
+
+	plugin.stage = stageIptablesCommit
+	s, err := newIptablesSession(bridgeName, bridgeSubnet, branchLinkName, netConfig)
 	if err != nil {
-		log.Errorf("Failed to assign IP address to branch link in PAT netns %s: %v.",
-			patNetNSName, err)
 		return err
 	}
 
-	// Set branch link operational state up.
-	log.Infof("Setting branch link state up in PAT netns %s.", patNetNSName)
-	err = branch.SetOpState(true)
+	// Commit all rules in this session atomically.
+	err = s.Commit(nil)
 	if err != nil {
-		log.Errorf("Failed to set branch link state in PAT netns %s: %v.", patNetNSName, err)
-		return err
+		log.Errorf("Failed to commit iptables rules: %v.", err)
 	}
 
-	// Add default route to PAT branch gateway.
-	route := &netlink.Route{
-		Gw:        branchSubnet.Gateways[0],
-		LinkIndex: branch.GetLinkIndex(),
-	}
-	log.Infof("Adding default route to %+v in PAT netns %s.", route, patNetNSName)
-	err = netlink.RouteAdd(route)
+	return err
+}
+
+// deleteIptablesRules deletes the iptables rules set by setupIptablesRules with the same
+// arguments from PAT network namespace.
+func (plugin *Plugin) deleteIptablesRules(
+	bridgeName, bridgeSubnet, branchLinkName string,
+	netConfig *config.NetConfig) error {
+
+	s, err := newIptablesSession(bridgeName, bridgeSubnet, branchLinkName, netConfig)
 	if err != nil {
-		log.Errorf("Failed to add IP route in PAT netns %s: %v.", patNetNSName, err)
 		return err
 	}
 
-	// Configure iptables rules.
-	log.Infof("Configuring iptables rules in PAT netns %s.", patNetNSName)
-	_, bridgeSubnet, _ := net.ParseCIDR(bridgeIPAddress.String())
-	err = plugin.setupIptablesRules(bridgeName, bridgeSubnet.String(), branch.GetLinkName())
+	err = s.Delete(nil)
 	if err != nil {
-		log.Errorf("Unable to setup iptables rules in PAT netns %s: %v.", patNetNSName, err)
-		return err
+		log.Errorf("Failed to delete iptables rules: %v.", err)
 	}
 
-	return nil
+	return err
 }
 
-// setupIptablesRules sets iptables rules in PAT network namespace.
-func (plugin *Plugin) setupIptablesRules(bridgeName, bridgeSubnet, branchLinkName string) error {
+// newIptablesSession creates an iptables session with the rules for PAT network namespace.
+// The rule options, such as the NAT mode and the allowed input ports, come from the network config.
+func newIptablesSession(
+	bridgeName, bridgeSubnet, branchLinkName string,
+	netConfig *config.NetConfig) (*iptables.Session, error) {
+
 	// Create a new iptables session.
 	s, err := iptables.NewSession()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Tag the rules with the PAT netns they belong to.
+	err = s.SetComment(fmt.Sprintf(iptablesRuleCommentFormat, netConfig.BranchVlanID, branchLinkName))
+	if err != nil {
+		return nil, err
 	}
 
 	// Allow DNS.
-	s.Filter.Input.Appendf("-i %s -p udp -m udp --dport 53 -j ACCEPT", bridgeName)
-	s.Filter.Input.Appendf("-i %s -p tcp -m tcp --dport 53 -j ACCEPT", bridgeName)
+	appendDNSPorts(s, bridgeName, netConfig.DNSPorts)
 	// Allow BOOTP/DHCP server.
 	s.Filter.Input.Appendf("-i %s -p udp -m udp --dport 67 -j ACCEPT", bridgeName)
 	s.Filter.Input.Appendf("-i %s -p tcp -m tcp --dport 67 -j ACCEPT", bridgeName)
+	// Allow other local services.
+	appendAllowedInputPorts(s, bridgeName, netConfig.AllowedInputPorts)
 
 	//
 	s.Filter.Forward.Appendf("-d %s -i %s -o %s -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
@@ -407,38 +1710,155 @@ func (plugin *Plugin) setupIptablesRules(bridgeName, bridgeSubnet, branchLinkNam
 	// Allow BOOTP/DHCP client.
 	s.Filter.Output.Appendf("-o %s -p udp -m udp --dport 68 -j ACCEPT", bridgeName)
 
-	// Allow IPv4 multicast.
-	// TODO: Replace these two with a -unicast switch in MASQ rule.
-	s.Nat.Postrouting.Appendf("-s %s -d 224.0.0.0/24 -o %s -j RETURN", bridgeSubnet, branchLinkName)
-	// Allow IPv4 broadcast.
-	s.Nat.Postrouting.Appendf("-s %s -d 255.255.255.255/32 -o %s -j RETURN", bridgeSubnet, branchLinkName)
-
-	// Masquerade all unicast IP datagrams leaving the PAT bridge.
-	s.Nat.Postrouting.Appendf("-s %s ! -d %s -o %s -p tcp -j MASQUERADE --to-ports 1024-65535",
-		bridgeSubnet, bridgeSubnet, branchLinkName)
-	s.Nat.Postrouting.Appendf("-s %s ! -d %s -o %s -p udp -j MASQUERADE --to-ports 1024-65535",
-		bridgeSubnet, bridgeSubnet, branchLinkName)
-	s.Nat.Postrouting.Appendf("-s %s ! -d %s -o %s -j MASQUERADE",
-		bridgeSubnet, bridgeSubnet, branchLinkName)
+	// Without NAT, traffic leaving the PAT bridge is only forwarded by the rules above.
+	if netConfig.NATMode == config.NATModeMasquerade {
+		// Allow IPv4 multicast.
+		// TODO: Replace these two with a -unicast switch in MASQ rule.
+		s.Nat.Postrouting.Appendf("-s %s -d 224.0.0.0/24 -o %s -j RETURN", bridgeSubnet, branchLinkName)
+		// Allow IPv4 broadcast.
+		s.Nat.Postrouting.Appendf("-s %s -d 255.255.255.255/32 -o %s -j RETURN", bridgeSubnet, branchLinkName)
+
+		// Masquerade all unicast IP datagrams leaving the PAT bridge.
+		s.Nat.Postrouting.Appendf("-s %s ! -d %s -o %s -p tcp -j MASQUERADE --to-ports %s",
+			bridgeSubnet, bridgeSubnet, branchLinkName, netConfig.MasqueradePortRange)
+		s.Nat.Postrouting.Appendf("-s %s ! -d %s -o %s -p udp -j MASQUERADE --to-ports %s",
+			bridgeSubnet, bridgeSubnet, branchLinkName, netConfig.MasqueradePortRange)
+		s.Nat.Postrouting.Appendf("-s %s ! -d %s -o %s -j MASQUERADE",
+			bridgeSubnet, bridgeSubnet, branchLinkName)
+	}
 
 	// Compute UDP checksum for DHCP client traffic from bridge.
 	s.Mangle.Postrouting.Appendf("-o %s -p udp -m udp --dport 68 -j CHECKSUM --checksum-fill", bridgeName)
 
+	// Mark egress connections from the PAT bridge, so that flows can be attributed to it.
+	if netConfig.ConnMark != 0 {
+		s.Mangle.Prerouting.Appendf("-s %s -i %s -m conntrack --ctstate NEW -j CONNMARK --set-mark %#x",
+			bridgeSubnet, bridgeName, netConfig.ConnMark)
+	}
+
+	return s, nil
+}
+
+// setupIp6tablesRules sets ip6tables rules in PAT network namespace.
+func (plugin *Plugin) setupIp6tablesRules(
+	bridgeName, bridgeSubnet, branchLinkName string,
+	netConfig *config.NetConfig) error {
+
+	s, err := newIp6tablesSession(bridgeName, bridgeSubnet, branchLinkName, netConfig)
+	if err != nil {
+		return err
+	}
+
 	// Commit all rules in this session atomically.
 	err = s.Commit(nil)
 	if err != nil {
-		log.Errorf("Failed to commit iptables rules: %v.", err)
+		log.Errorf("Failed to commit ip6tables rules: %v.", err)
+	}
+
+	return err
+}
+
+// deleteIp6tablesRules deletes the ip6tables rules set by setupIp6tablesRules with the same
+// arguments from PAT network namespace.
+func (plugin *Plugin) deleteIp6tablesRules(
+	bridgeName, bridgeSubnet, branchLinkName string,
+	netConfig *config.NetConfig) error {
+
+	s, err := newIp6tablesSession(bridgeName, bridgeSubnet, branchLinkName, netConfig)
+	if err != nil {
+		return err
+	}
+
+	err = s.Delete(nil)
+	if err != nil {
+		log.Errorf("Failed to delete ip6tables rules: %v.", err)
 	}
 
 	return err
 }
 
+// newIp6tablesSession creates an ip6tables session with the rules for PAT network namespace.
+// These mirror the IPv4 rules, except for DHCP and broadcast, which do not exist in IPv6.
+func newIp6tablesSession(
+	bridgeName, bridgeSubnet, branchLinkName string,
+	netConfig *config.NetConfig) (*iptables.Session, error) {
+
+	// Create a new ip6tables session.
+	s, err := iptables.NewSessionForProtocol(iptables.ProtocolIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tag the rules with the PAT netns they belong to.
+	err = s.SetComment(fmt.Sprintf(iptablesRuleCommentFormat, netConfig.BranchVlanID, branchLinkName))
+	if err != nil {
+		return nil, err
+	}
+
+	// Allow DNS.
+	appendDNSPorts(s, bridgeName, netConfig.DNSPorts)
+	// Allow other local services.
+	appendAllowedInputPorts(s, bridgeName, netConfig.AllowedInputPorts)
+
+	// Allow traffic between the PAT bridge subnet and the branch.
+	s.Filter.Forward.Appendf("-d %s -i %s -o %s -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		bridgeSubnet, branchLinkName, bridgeName)
+	s.Filter.Forward.Appendf("-s %s -i %s -o %s -j ACCEPT",
+		bridgeSubnet, bridgeName, branchLinkName)
+	s.Filter.Forward.Appendf("-i %s -o %s -j ACCEPT", bridgeName, bridgeName)
+
+	// Reject all traffic originating from or delivered to the bridge itself.
+	s.Filter.Forward.Appendf("-o %s -j REJECT --reject-with icmp6-port-unreachable", bridgeName)
+	s.Filter.Forward.Appendf("-i %s -j REJECT --reject-with icmp6-port-unreachable", bridgeName)
+
+	// Without NAT, traffic leaving the PAT bridge is only forwarded by the rules above.
+	if netConfig.NATMode == config.NATModeMasquerade {
+		// Allow IPv6 multicast.
+		s.Nat.Postrouting.Appendf("-s %s -d ff00::/8 -o %s -j RETURN", bridgeSubnet, branchLinkName)
+
+		// Masquerade all unicast IP datagrams leaving the PAT bridge.
+		s.Nat.Postrouting.Appendf("-s %s ! -d %s -o %s -p tcp -j MASQUERADE --to-ports %s",
+			bridgeSubnet, bridgeSubnet, branchLinkName, netConfig.MasqueradePortRange)
+		s.Nat.Postrouting.Appendf("-s %s ! -d %s -o %s -p udp -j MASQUERADE --to-ports %s",
+			bridgeSubnet, bridgeSubnet, branchLinkName, netConfig.MasqueradePortRange)
+		s.Nat.Postrouting.Appendf("-s %s ! -d %s -o %s -j MASQUERADE",
+			bridgeSubnet, bridgeSubnet, branchLinkName)
+	}
+
+	// Mark egress connections from the PAT bridge, so that flows can be attributed to it.
+	if netConfig.ConnMark != 0 {
+		s.Mangle.Prerouting.Appendf("-s %s -i %s -m conntrack --ctstate NEW -j CONNMARK --set-mark %#x",
+			bridgeSubnet, bridgeName, netConfig.ConnMark)
+	}
+
+	return s, nil
+}
+
+// appendDNSPorts appends rules to the session that allow DNS queries over UDP and TCP from the PAT
+// bridge to the given local ports. Ports listed more than once are only allowed once.
+func appendDNSPorts(s *iptables.Session, bridgeName string, dnsPorts []int) {
+	for _, port := range dnsPorts {
+		s.Filter.Input.AppendUniquef("-i %s -p udp -m udp --dport %d -j ACCEPT", bridgeName, port)
+		s.Filter.Input.AppendUniquef("-i %s -p tcp -m tcp --dport %d -j ACCEPT", bridgeName, port)
+	}
+}
+
+// appendAllowedInputPorts appends rules to the session that allow traffic from the PAT bridge to
+// the given local ports. Ports that are already allowed, for example for DNS, are skipped.
+func appendAllowedInputPorts(s *iptables.Session, bridgeName string, allowedInputPorts []config.PortSpec) {
+	for _, portSpec := range allowedInputPorts {
+		s.Filter.Input.AppendUniquef("-i %s -p %s -m %s --dport %d -j ACCEPT",
+			bridgeName, portSpec.Protocol, portSpec.Protocol, portSpec.Port)
+	}
+}
+
 // createVethPair creates a veth pair to connect a PAT network namespace to a target network namespace.
 func (plugin *Plugin) createVethPair(
 	branchVlanID int,
 	containerID string,
 	bridgeName string,
-	targetNetNS netns.NetNS) (string, error) {
+	targetNetNS netns.NetNS,
+	mtu int) (string, error) {
 	var vethLinkName, vethPeerName string
 	var err error
 	// Attempt to create the veth pair. The create attempt will be retried if a device
@@ -446,7 +1866,7 @@ func (plugin *Plugin) createVethPair(
 	generateRandomName := false
 	for i := 0; i < maxRetriesVethPairNameCollision; i++ {
 		vethLinkName, vethPeerName = generateVethPairNames(branchVlanID, containerID, generateRandomName)
-		err = plugin.createVethPairOnce(bridgeName, targetNetNS, vethLinkName, vethPeerName)
+		err = plugin.createVethPairOnce(bridgeName, targetNetNS, vethLinkName, vethPeerName, mtu)
 		if err == nil {
 			// Successfully created veth pair, return.
 			return vethPeerName, nil
@@ -468,9 +1888,10 @@ func (plugin *Plugin) createVethPairOnce(
 	bridgeName string,
 	targetNetNS netns.NetNS,
 	vethLinkName string,
-	vethPeerName string) error {
+	vethPeerName string,
+	mtu int) error {
 	// Find the PAT bridge.
-	bridge, err := net.InterfaceByName(bridgeName)
+	bridge, err := plugin.nl().LinkByName(bridgeName)
 	if err != nil {
 		log.Errorf("Failed to find bridge %s: %v.", bridgeName, err)
 		return err
@@ -479,15 +1900,15 @@ func (plugin *Plugin) createVethPairOnce(
 	// Create the veth link and connect it to the bridge.
 	la := netlink.NewLinkAttrs()
 	la.Name = vethLinkName
-	la.MasterIndex = bridge.Index
-	la.MTU = vpc.JumboFrameMTU
+	la.MasterIndex = bridge.Attrs().Index
+	la.MTU = mtu
 	vethLink := &netlink.Veth{
 		LinkAttrs: la,
 		PeerName:  vethPeerName,
 	}
 
 	log.Infof("Creating veth pair %+v.", vethLink)
-	err = netlink.LinkAdd(vethLink)
+	err = plugin.audit("LinkAdd", vethLink, plugin.nl().LinkAdd(vethLink))
 	if err != nil {
 		log.Errorf("Failed to add veth pair (%s, %s): %v.",
 			vethLinkName, vethPeerName, err)
@@ -499,7 +1920,7 @@ func (plugin *Plugin) createVethPairOnce(
 	la = netlink.NewLinkAttrs()
 	la.Name = vethPeerName
 	vethPeer := &netlink.Dummy{LinkAttrs: la}
-	err = netlink.LinkSetNsFd(vethPeer, int(targetNetNS.GetFd()))
+	err = plugin.audit("LinkSetNsFd", vethPeer, plugin.nl().LinkSetNsFd(vethPeer, int(targetNetNS.GetFd())))
 	if err != nil {
 		log.Errorf("Failed to move veth link peer %s to target netns: %v.",
 			vethPeerName, err)
@@ -508,7 +1929,7 @@ func (plugin *Plugin) createVethPairOnce(
 
 	// Set the veth link operational state up
 	log.Infof("Setting the veth link %s state up.", vethLinkName)
-	err = netlink.LinkSetUp(vethLink)
+	err = plugin.audit("LinkSetUp", vethLink, plugin.nl().LinkSetUp(vethLink))
 	if err != nil {
 		log.Errorf("Failed to bring up veth link %s: %v.",
 			vethLinkName, err)
@@ -522,23 +1943,31 @@ func (plugin *Plugin) createTapLink(
 	bridgeName string,
 	vethLinkName string,
 	tapLinkName string,
-	uid int,
-	gid int) error {
+	netConfig *config.NetConfig) error {
+
+	// Make sure a file descriptor can be opened for each tap queue before creating any link.
+	if netConfig.TapFdSocket == "" {
+		err := checkTapQueueFdLimit(netConfig.TapQueues)
+		if err != nil {
+			log.Errorf("Failed to create tap link %s: %v.", tapLinkName, err)
+			return err
+		}
+	}
 
 	// Create the bridge link.
 	la := netlink.NewLinkAttrs()
 	la.Name = bridgeName
-	la.MTU = vpc.JumboFrameMTU
+	la.MTU = netConfig.MTU
 	bridge := &netlink.Bridge{LinkAttrs: la}
 	log.Infof("Creating tap bridge %+v.", bridge)
-	err := netlink.LinkAdd(bridge)
+	err := plugin.audit("LinkAdd", bridge, plugin.nl().LinkAdd(bridge))
 	if err != nil {
 		log.Errorf("Failed to create tap bridge %s: %v.", bridgeName, err)
 		return err
 	}
 
 	// Set bridge link MTU.
-	err = netlink.LinkSetMTU(bridge, vpc.JumboFrameMTU)
+	err = plugin.audit("LinkSetMTU", bridge, plugin.nl().LinkSetMTU(bridge, netConfig.MTU))
 	if err != nil {
 		log.Errorf("Failed to set tap bridge %s link MTU: %v.",
 			bridgeName, err)
@@ -549,56 +1978,114 @@ func (plugin *Plugin) createTapLink(
 	la = netlink.NewLinkAttrs()
 	la.Name = vethLinkName
 	vethLink := &netlink.Dummy{LinkAttrs: la}
-	err = netlink.LinkSetMaster(vethLink, bridge)
+	err = plugin.audit("LinkSetMaster", vethLink, plugin.nl().LinkSetMaster(vethLink, bridge))
 	if err != nil {
 		log.Errorf("Failed to set veth link %s master to %s: %v.",
 			vethLinkName, bridgeName, err)
 		return err
 	}
 
-	// Create the tap link.
-	la = netlink.NewLinkAttrs()
-	la.Name = tapLinkName
-	la.MasterIndex = bridge.Index
-	la.MTU = vpc.JumboFrameMTU
-	tapLink := &netlink.Tuntap{
-		LinkAttrs: la,
-		Mode:      netlink.TUNTAP_MODE_TAP,
-		Flags:     netlink.TUNTAP_ONE_QUEUE | netlink.TUNTAP_VNET_HDR,
-		Queues:    1,
+	// Create the tap link, or adopt the existing one passed by the runtime.
+	var tapLink netlink.Link
+	var tapFd int
+	if netConfig.TapFdSocket == "" {
+		tuntap := newTuntap(tapLinkName, bridge.Index, netConfig)
+
+		log.Infof("Creating tap link %+v.", tuntap)
+		err = plugin.audit("LinkAdd", tuntap, plugin.nl().LinkAdd(tuntap))
+		if err != nil {
+			log.Errorf("Failed to add tap link %s: %v.", tapLinkName, err)
+			return err
+		}
+		tapLink = tuntap
+		tapFd = int(tuntap.Fds[0].Fd())
+
+		// Delete the partially configured tap link if any of the remaining steps fail.
+		defer func() {
+			if err != nil {
+				log.Infof("Deleting tap link %s after failure.", tapLinkName)
+				plugin.audit("LinkDel", tuntap, plugin.nl().LinkDel(tuntap))
+			}
+		}()
+	} else {
+		log.Infof("Receiving tap fd from %s.", netConfig.TapFdSocket)
+		tapFile, err := receiveTapFd(netConfig.TapFdSocket)
+		if err != nil {
+			log.Errorf("Failed to receive tap fd from %s: %v.", netConfig.TapFdSocket, err)
+			return err
+		}
+		defer tapFile.Close()
+
+		tapLink, err = plugin.adoptTapLink(tapFile, tapLinkName, bridge)
+		if err != nil {
+			return err
+		}
+		tapFd = int(tapFile.Fd())
 	}
 
-	log.Infof("Creating tap link %+v.", tapLink)
-	err = netlink.LinkAdd(tapLink)
+	// Make sure the tap link is enslaved to the bridge, as the VM has no connectivity otherwise.
+	err = plugin.waitForLinkMaster(tapLinkName, bridge.Index)
 	if err != nil {
-		log.Errorf("Failed to add tap link %s: %v.", tapLinkName, err)
+		log.Errorf("Failed to verify tap link %s master: %v.", tapLinkName, err)
 		return err
 	}
 
 	// Set tap link MTU.
-	err = netlink.LinkSetMTU(tapLink, vpc.JumboFrameMTU)
+	err = plugin.audit("LinkSetMTU", tapLink, plugin.nl().LinkSetMTU(tapLink, netConfig.MTU))
 	if err != nil {
 		log.Errorf("Failed to set tap link %s MTU: %v.", tapLinkName, err)
 		return err
 	}
 
-	// Set tap link ownership.
-	log.Infof("Setting tap link %s owner to uid %d and gid %d.", tapLinkName, uid, gid)
-	fd := int(tapLink.Fds[0].Fd())
-	err = unix.IoctlSetInt(fd, unix.TUNSETOWNER, uid)
+	// Set tap link MAC address, so that it matches the MAC address reported in the result.
+	log.Infof("Setting tap link %s MAC address to %s.", tapLinkName, netConfig.TapMACAddress)
+	err = plugin.audit("LinkSetHardwareAddr", tapLink,
+		plugin.nl().LinkSetHardwareAddr(tapLink, netConfig.TapMACAddress))
 	if err != nil {
-		log.Errorf("Failed to set tap link %s uid: %v.", tapLinkName, err)
+		log.Errorf("Failed to set tap link %s MAC address: %v.", tapLinkName, err)
 		return err
 	}
-	err = unix.IoctlSetInt(fd, unix.TUNSETGROUP, gid)
+
+	// Set tap link ownership.
+	err = setTapLinkOwnership(tapLinkName, tapFd,
+		netConfig.Uid, netConfig.Gid, netConfig.TapOwnershipPolicy)
 	if err != nil {
-		log.Errorf("Failed to set tap link %s gid: %v.", tapLinkName, err)
 		return err
 	}
 
+	// Make the tap link persistent, so that it outlives the process holding its fd. Tap links
+	// created by netlink are already persistent, but those adopted from the runtime may not be.
+	if netConfig.PersistTap {
+		log.Infof("Setting tap link %s persistent.", tapLinkName)
+		err = ioctlSetInt(tapFd, unix.TUNSETPERSIST, 1)
+		if err != nil {
+			log.Errorf("Failed to set tap link %s persistent: %v.", tapLinkName, err)
+			return err
+		}
+	}
+
+	// Set tap link alias to correlate bridge FDB entries with the attachment.
+	if netConfig.TapAlias != "" {
+		log.Infof("Setting tap link %s alias to %s.", tapLinkName, netConfig.TapAlias)
+		err = plugin.audit("LinkSetAlias", tapLink, plugin.nl().LinkSetAlias(tapLink, netConfig.TapAlias))
+		if err != nil {
+			log.Errorf("Failed to set tap link %s alias: %v.", tapLinkName, err)
+			return err
+		}
+	}
+
+	// Map DSCP classes to tap queues, so that high-priority traffic uses a dedicated queue.
+	if len(netConfig.DSCPQueueMap) != 0 {
+		err = plugin.setupDSCPQueueMap(tapLink, netConfig.DSCPQueueMap)
+		if err != nil {
+			log.Errorf("Failed to map DSCP classes to tap link %s queues: %v.", tapLinkName, err)
+			return err
+		}
+	}
+
 	// Set the bridge link operational state up
 	log.Infof("Setting bridge link %s state up.", bridgeName)
-	err = netlink.LinkSetUp(bridge)
+	err = plugin.audit("LinkSetUp", bridge, plugin.nl().LinkSetUp(bridge))
 	if err != nil {
 		log.Errorf("Failed to set bridge link %s state: %v.", bridgeName, err)
 		return err
@@ -606,7 +2093,7 @@ func (plugin *Plugin) createTapLink(
 
 	// Set tap link operational state up.
 	log.Infof("Setting tap link %s state up.", tapLinkName)
-	err = netlink.LinkSetUp(tapLink)
+	err = plugin.audit("LinkSetUp", tapLink, plugin.nl().LinkSetUp(tapLink))
 	if err != nil {
 		log.Errorf("Failed to set tap link %s state: %v.", tapLinkName, err)
 		return err
@@ -614,7 +2101,7 @@ func (plugin *Plugin) createTapLink(
 
 	// Set the veth peer link operational state up.
 	log.Infof("Setting veth peer link %s state up.", vethLinkName)
-	err = netlink.LinkSetUp(vethLink)
+	err = plugin.audit("LinkSetUp", vethLink, plugin.nl().LinkSetUp(vethLink))
 	if err != nil {
 		log.Errorf("Failed to set veth peer %s link state: %v.", vethLinkName, err)
 		return err
@@ -623,19 +2110,120 @@ func (plugin *Plugin) createTapLink(
 	return nil
 }
 
+// newTuntap returns the tap link to create with the given name and master, with the queues
+// requested by the network config. Tap links always parse the virtio-net headers, which is also
+// required by vhost-net.
+func newTuntap(tapLinkName string, masterIndex int, netConfig *config.NetConfig) *netlink.Tuntap {
+	la := netlink.NewLinkAttrs()
+	la.Name = tapLinkName
+	la.MasterIndex = masterIndex
+	la.MTU = netConfig.MTU
+	tuntap := &netlink.Tuntap{
+		LinkAttrs: la,
+		Mode:      netlink.TUNTAP_MODE_TAP,
+		Flags:     netlink.TUNTAP_ONE_QUEUE | netlink.TUNTAP_VNET_HDR,
+		Queues:    1,
+	}
+	if netConfig.TapQueues > 1 {
+		tuntap.Flags = netlink.TUNTAP_MULTI_QUEUE_DEFAULTS | netlink.TUNTAP_VNET_HDR
+		tuntap.Queues = netConfig.TapQueues
+	}
+
+	return tuntap
+}
+
+// checkTapQueueFdLimit returns an error if this process cannot open a file descriptor for each of
+// the given number of tap queues within its open file limit. Creating a tap link with more queues
+// would otherwise fail with EMFILE part way through opening them.
+func checkTapQueueFdLimit(queues int) error {
+	var rlimit unix.Rlimit
+	err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlimit)
+	if err != nil {
+		return err
+	}
+	if rlimit.Cur == unix.RLIM_INFINITY {
+		return nil
+	}
+
+	dir, err := os.Open(procSelfFdPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	fds, err := dir.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+
+	available := int64(rlimit.Cur) - int64(len(fds))
+	if int64(queues) > available {
+		return fmt.Errorf("tap link with %d queues needs %d file descriptors, "+
+			"but only %d are available within the open file limit of %d",
+			queues, queues, available, rlimit.Cur)
+	}
+
+	return nil
+}
+
+// setTapLinkOwnership sets the owner uid and gid of the tap link with the given fd. The group is
+// left unchanged if gid is config.UnsetGid. On some hardened hosts, the ioctls fail with EPERM
+// even when the plugin is privileged. Under the fallback policy, such failures leave the tap link
+// owned by root instead of failing.
+func setTapLinkOwnership(tapLinkName string, fd int, uid int, gid int, policy string) error {
+	log.Infof("Setting tap link %s owner to uid %d and gid %d.", tapLinkName, uid, gid)
+
+	ownership := []struct {
+		name  string
+		req   uint
+		value int
+	}{
+		{name: "uid", req: unix.TUNSETOWNER, value: uid},
+		{name: "gid", req: unix.TUNSETGROUP, value: gid},
+	}
+
+	for _, o := range ownership {
+		if o.req == unix.TUNSETGROUP && o.value == config.UnsetGid {
+			continue
+		}
+		err := ioctlSetInt(fd, o.req, o.value)
+		if err == nil {
+			continue
+		}
+		if err == unix.EPERM && policy == config.TapOwnershipPolicyFallback {
+			log.Warnf("Not permitted to set tap link %s %s to %d, leaving it owned by root: %v.",
+				tapLinkName, o.name, o.value, err)
+			continue
+		}
+		if err == unix.EPERM {
+			log.Errorf("Not permitted to set tap link %s %s. The host may restrict tun device "+
+				"ownership changes, see tapOwnershipPolicy: %v.", tapLinkName, o.name, err)
+		} else {
+			log.Errorf("Failed to set tap link %s %s: %v.", tapLinkName, o.name, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
 // deleteTapVethLinks deletes tap link and veth peer link from the target netns.
+// If releaseTimeout is non-zero, it waits up to that long for the tap link to be gone after it
+// is deleted, and returns whether it is.
 func (plugin *Plugin) deleteTapVethLinks(
 	targetNetNSName string,
 	tapLinkName string,
-	tapBridgeName string) {
+	tapBridgeName string,
+	releaseTimeout time.Duration) bool {
 	// Search for the target network namespace.
 	targetNetNS, err := netns.GetNetNSByName(targetNetNSName)
 	if err != nil {
 		// Log and ignore the failure. DEL can be called multiple times and thus must be idempotent.
 		log.Errorf("Failed to find netns %s, ignoring: %v.", targetNetNSName, err)
-		return
+		return true
 	}
 
+	tapReleased := true
+
 	// In target network namespace...
 	err = targetNetNS.Run(func() error {
 		// Delete the tap link.
@@ -643,50 +2231,112 @@ func (plugin *Plugin) deleteTapVethLinks(
 		la.Name = tapLinkName
 		tapLink := &netlink.Tuntap{LinkAttrs: la}
 		log.Infof("Deleting tap link: %v.", tapLinkName)
-		err = netlink.LinkDel(tapLink)
+		err = plugin.audit("LinkDel", tapLink, plugin.nl().LinkDel(tapLink))
 		if err != nil {
 			log.Errorf("Failed to delete tap link %s: %v.", tapLinkName, err)
 		}
 
+		// Wait for the tap link to be released by any process still holding it open.
+		if releaseTimeout > 0 {
+			err = plugin.waitForLinkRelease(tapLinkName, releaseTimeout)
+			if err != nil {
+				log.Errorf("Failed to wait for tap link %s to be released: %v.", tapLinkName, err)
+				tapReleased = false
+			}
+		}
+
 		// Delete the veth peer.
-		deleteVethPeerByNameRegex(targetNetNSName)
+		plugin.deleteVethPeerByNameRegex(targetNetNSName)
 
 		// Delete the tap bridge.
 		la = netlink.NewLinkAttrs()
 		la.Name = tapBridgeName
 		tapBridge := &netlink.Bridge{LinkAttrs: la}
 		log.Infof("Deleting tap bridge: %v.", tapBridgeName)
-		err = netlink.LinkDel(tapBridge)
+		err = plugin.audit("LinkDel", tapBridge, plugin.nl().LinkDel(tapBridge))
 		if err != nil {
 			log.Errorf("Failed to delete tap bridge %s: %v.", tapBridgeName, err)
 		}
 
 		return nil
 	})
+
+	return tapReleased
+}
+
+// waitForLinkRelease waits up to the given timeout for the link with the given name to be gone.
+// A deleted tap link lingers until the last process holding its fd, such as a VMM, closes it.
+func (plugin *Plugin) waitForLinkRelease(linkName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		_, err := plugin.nl().LinkByName(linkName)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("link %s still present after %v", linkName, timeout)
+		}
+		time.Sleep(tapReleasePollInterval)
+	}
+}
+
+// waitForLinkMaster checks that the link with the given name is enslaved to the master with the
+// given index, retrying a bounded number of times in case the change is not visible yet.
+func (plugin *Plugin) waitForLinkMaster(linkName string, masterIndex int) error {
+	var err error
+
+	for i := 0; i < maxTapMasterChecks; i++ {
+		if i > 0 {
+			time.Sleep(tapMasterCheckInterval)
+		}
+
+		var link netlink.Link
+		link, err = plugin.nl().LinkByName(linkName)
+		if err != nil {
+			continue
+		}
+		if link.Attrs().MasterIndex == masterIndex {
+			return nil
+		}
+		err = fmt.Errorf("link %s master index is %d, expected %d",
+			linkName, link.Attrs().MasterIndex, masterIndex)
+	}
+
+	return err
 }
 
 // deleteVethPeerByNameRegex deletes a veth peer device in the target namespace
 // if the name matches the regex used to create the veth pair link device.
-func deleteVethPeerByNameRegex(targetNetNSName string) {
+func (plugin *Plugin) deleteVethPeerByNameRegex(targetNetNSName string) {
 	// Veth pair cannot be deleted by name as a random name could
 	// have been generated for it in Add(). Find it by type instead.
-	linkDevs, err := netlink.LinkList()
+	linkDevs, err := plugin.nl().LinkList()
 	if err != nil {
 		log.Errorf("Failed to list links in %s: %v.", targetNetNSName, err)
 		return
 	}
-	for _, link := range linkDevs {
-		linkName := link.Attrs().Name
-		if link.Type() == linkDeviceTypeVethPair && vethPeerNameRecognizable(linkName) {
-			log.Infof("Deleting veth link: %v.", linkName)
-			err = netlink.LinkDel(link)
-			if err != nil {
-				log.Errorf("Failed to delete veth pair%s: %v.", linkName, err)
-			}
-			// The veth pair device was found and an attempt was made to delete
-			// the same. Nothing left to do.
-			return
+	link := findVethPeerLink(linkDevs)
+	if link == nil {
+		return
+	}
+
+	linkName := link.Attrs().Name
+	log.Infof("Deleting veth link: %v.", linkName)
+	err = plugin.audit("LinkDel", link, plugin.nl().LinkDel(link))
+	if err != nil {
+		log.Errorf("Failed to delete veth pair%s: %v.", linkName, err)
+	}
+}
+
+// findVethPeerLink returns the veth link peer created by ADD in the target netns, or nil if
+// there is none.
+func findVethPeerLink(links []netlink.Link) netlink.Link {
+	for _, link := range links {
+		if link.Type() == linkDeviceTypeVethPair && vethPeerNameRecognizable(link.Attrs().Name) {
+			return link
 		}
 	}
 
+	return nil
 }
@@ -0,0 +1,2023 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
+	"github.com/aws/amazon-vpc-cni-plugins/network/iptables"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netlinkwrapper"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+	"github.com/aws/amazon-vpc-cni-plugins/network/vpc"
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	log "github.com/cihub/seelog"
+	cniSkel "github.com/containernetworking/cni/pkg/skel"
+	cniTypesCurrent "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestSelectBridgeIPAddress(t *testing.T) {
+	testCases := []struct {
+		name            string
+		bridgeAddress   string
+		branchSubnet    string
+		relocate        bool
+		expectedAddress string
+		expectError     bool
+	}{
+		{
+			name:            "non-overlapping branch subnet keeps configured bridge subnet",
+			bridgeAddress:   "192.168.122.1/24",
+			branchSubnet:    "10.0.1.0/24",
+			expectedAddress: "192.168.122.1/24",
+		},
+		{
+			name:            "custom bridge subnet is used",
+			bridgeAddress:   "100.64.10.1/24",
+			branchSubnet:    "192.168.122.0/24",
+			expectedAddress: "100.64.10.1/24",
+		},
+		{
+			name:          "overlapping branch subnet fails without relocation",
+			bridgeAddress: "192.168.122.1/24",
+			branchSubnet:  "192.168.0.0/16",
+			expectError:   true,
+		},
+		{
+			name:            "overlapping branch subnet relocates bridge subnet",
+			bridgeAddress:   "192.168.122.1/24",
+			branchSubnet:    "192.168.122.0/23",
+			relocate:        true,
+			expectedAddress: "192.168.124.1/24",
+		},
+		{
+			name:          "fully overlapping branch subnet fails with relocation",
+			bridgeAddress: "192.168.122.1/24",
+			branchSubnet:  "0.0.0.0/0",
+			relocate:      true,
+			expectError:   true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bridgeAddress, err := vpc.GetIPAddressFromString(tc.bridgeAddress)
+			assert.NoError(t, err)
+			branchSubnet, err := vpc.NewSubnetFromString(tc.branchSubnet)
+			assert.NoError(t, err)
+
+			bridgeIPAddress, err := selectBridgeIPAddress(bridgeAddress, branchSubnet, tc.relocate)
+			if tc.expectError {
+				assert.IsType(t, &ErrConfigInvalid{}, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedAddress, bridgeIPAddress.String())
+		})
+	}
+}
+
+// mockNetNS is a netns.NetNS whose Close fails with the given errors in order.
+type mockNetNS struct {
+	closeErrs  []error
+	closeCalls int
+}
+
+func (ns *mockNetNS) GetFd() uintptr               { return 0 }
+func (ns *mockNetNS) GetPath() string              { return "" }
+func (ns *mockNetNS) Set() error                   { return nil }
+func (ns *mockNetNS) Run(toRun func() error) error { return toRun() }
+
+func (ns *mockNetNS) RunContext(ctx context.Context, toRun func() error) error {
+	return toRun()
+}
+
+func (ns *mockNetNS) Close() error {
+	ns.closeCalls++
+	if len(ns.closeErrs) == 0 {
+		return nil
+	}
+	err := ns.closeErrs[0]
+	ns.closeErrs = ns.closeErrs[1:]
+	return err
+}
+
+func TestCloseNetNSWithRetry(t *testing.T) {
+	// Close succeeds on the second attempt.
+	ns := &mockNetNS{closeErrs: []error{errors.New("device or resource busy")}}
+	err := closeNetNSWithRetry(ns, 3, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, ns.closeCalls)
+
+	// Close fails on all attempts.
+	busy := errors.New("device or resource busy")
+	ns = &mockNetNS{closeErrs: []error{busy, busy, busy}}
+	err = closeNetNSWithRetry(ns, 3, time.Millisecond)
+	assert.Equal(t, busy, err)
+	assert.Equal(t, 3, ns.closeCalls)
+}
+
+func TestConfigureBranchLinkOrder(t *testing.T) {
+	for _, upBeforeAddress := range []bool{false, true} {
+		var steps []string
+		assignAddress := func() error {
+			steps = append(steps, "address")
+			return nil
+		}
+		setUp := func() error {
+			steps = append(steps, "up")
+			return nil
+		}
+
+		err := configureBranchLink(upBeforeAddress, assignAddress, setUp)
+		assert.NoError(t, err)
+		if upBeforeAddress {
+			assert.Equal(t, []string{"up", "address"}, steps)
+		} else {
+			assert.Equal(t, []string{"address", "up"}, steps)
+		}
+	}
+
+	// A failed step stops the sequence.
+	upCalled := false
+	err := configureBranchLink(false,
+		func() error { return errors.New("address failed") },
+		func() error { upCalled = true; return nil })
+	assert.Error(t, err)
+	assert.False(t, upCalled)
+}
+
+func TestSetTapLinkOwnershipEPERM(t *testing.T) {
+	defer func() { ioctlSetInt = unix.IoctlSetInt }()
+
+	var reqs []uint
+	ioctlSetInt = func(fd int, req uint, value int) error {
+		reqs = append(reqs, req)
+		if req == unix.TUNSETOWNER {
+			return unix.EPERM
+		}
+		return nil
+	}
+
+	// EPERM fails under the default policy.
+	err := setTapLinkOwnership("tap0", 3, 1000, 1000, config.TapOwnershipPolicyFail)
+	assert.Equal(t, unix.EPERM, err)
+	assert.Equal(t, []uint{unix.TUNSETOWNER}, reqs)
+
+	// EPERM is tolerated under the fallback policy.
+	reqs = nil
+	err = setTapLinkOwnership("tap0", 3, 1000, 1000, config.TapOwnershipPolicyFallback)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{unix.TUNSETOWNER, unix.TUNSETGROUP}, reqs)
+
+	// Other errors fail under the fallback policy.
+	ioctlSetInt = func(fd int, req uint, value int) error {
+		return unix.EBADF
+	}
+	err = setTapLinkOwnership("tap0", 3, 1000, 1000, config.TapOwnershipPolicyFallback)
+	assert.Equal(t, unix.EBADF, err)
+}
+
+func TestSetTapLinkOwnershipUnsetGid(t *testing.T) {
+	defer func() { ioctlSetInt = unix.IoctlSetInt }()
+
+	var reqs []uint
+	ioctlSetInt = func(fd int, req uint, value int) error {
+		reqs = append(reqs, req)
+		return nil
+	}
+
+	err := setTapLinkOwnership("tap0", 3, 1000, config.UnsetGid, config.TapOwnershipPolicyFail)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{unix.TUNSETOWNER}, reqs)
+}
+
+func TestNewResultDNS(t *testing.T) {
+	args := &cniSkel.CmdArgs{
+		StdinData: []byte(`{"cniVersion":"0.3.1", "trunkName":"eth0", "branchVlanID":"101",
+			"branchMACAddress":"01:23:45:67:89:ab", "branchIPAddress":"10.0.1.42/24",
+			"dns":{"nameservers":["10.0.0.2"], "search":["ec2.internal"]}}`),
+	}
+	netConfig, err := config.New(args, true)
+	assert.NoError(t, err)
+
+	result := newResult(netConfig, "tap0", "/var/run/netns/target")
+	data, err := json.Marshal(result)
+	assert.NoError(t, err)
+
+	var out struct {
+		DNS struct {
+			Nameservers []string `json:"nameservers"`
+			Search      []string `json:"search"`
+		} `json:"dns"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &out))
+	assert.Equal(t, []string{"10.0.0.2"}, out.DNS.Nameservers)
+	assert.Equal(t, []string{"ec2.internal"}, out.DNS.Search)
+}
+
+func TestNewResultIPs(t *testing.T) {
+	args := &cniSkel.CmdArgs{
+		StdinData: []byte(`{"cniVersion":"0.3.1", "trunkName":"eth0", "branchVlanID":"101",
+			"branchMACAddress":"01:23:45:67:89:ab", "branchIPAddress":"10.0.1.42/24"}`),
+	}
+	netConfig, err := config.New(args, true)
+	require.NoError(t, err)
+
+	result := newResult(netConfig, "tap0", "/var/run/netns/target")
+	require.Len(t, result.IPs, 1)
+	assert.Equal(t, "4", result.IPs[0].Version)
+	assert.Equal(t, 0, *result.IPs[0].Interface)
+	assert.Equal(t, "10.0.1.42/24", result.IPs[0].Address.String())
+	assert.Equal(t, "10.0.1.1", result.IPs[0].Gateway.String())
+	require.Len(t, result.Routes, 1)
+	assert.Equal(t, "0.0.0.0/0", result.Routes[0].Dst.String())
+	assert.Equal(t, "10.0.1.1", result.Routes[0].GW.String())
+
+	// Configured gateways take precedence.
+	netConfig.BranchGatewayIPAddresses = []net.IP{net.ParseIP("10.0.1.2")}
+	result = newResult(netConfig, "tap0", "/var/run/netns/target")
+	assert.Equal(t, "10.0.1.2", result.IPs[0].Gateway.String())
+	assert.Equal(t, "10.0.1.2", result.Routes[0].GW.String())
+
+	// The IPv4 gateway is reported when IPv6 gateways are also configured.
+	netConfig.BranchGatewayIPAddresses = []net.IP{
+		net.ParseIP("2600:1f14:abc:de00::1"), net.ParseIP("10.0.1.3")}
+	result = newResult(netConfig, "tap0", "/var/run/netns/target")
+	assert.Equal(t, "10.0.1.3", result.IPs[0].Gateway.String())
+
+	// Without a branch IP address, only the interface is reported.
+	netConfig.BranchIPAddress = net.IPNet{}
+	result = newResult(netConfig, "tap0", "/var/run/netns/target")
+	assert.Empty(t, result.IPs)
+	assert.Empty(t, result.Routes)
+}
+
+func TestDiscoverBranchSubnet(t *testing.T) {
+	defer func(f func(net.HardwareAddr) (*vpc.Subnet, error)) { newSubnetFromIMDS = f }(newSubnetFromIMDS)
+	newSubnetFromIMDS = func(net.HardwareAddr) (*vpc.Subnet, error) {
+		return vpc.NewSubnetFromString("10.0.0.0/20")
+	}
+
+	args := &cniSkel.CmdArgs{
+		StdinData: []byte(`{"cniVersion":"0.3.1", "trunkName":"eth0", "branchVlanID":"101",
+			"branchMACAddress":"01:23:45:67:89:ab", "branchIPAddress":"10.0.1.42/32",
+			"discoverBranchSubnet":true}`),
+	}
+	netConfig, err := config.New(args, true)
+	require.NoError(t, err)
+
+	// The branch IP address takes the prefix length of the discovered subnet.
+	require.NoError(t, discoverBranchSubnet(netConfig))
+	assert.Equal(t, "10.0.1.42/20", netConfig.BranchIPAddress.String())
+	gateway := newBranchSubnet(netConfig).GatewayFor(netConfig.BranchIPAddress.IP)
+	assert.Equal(t, "10.0.0.1", gateway.String())
+
+	// A subnet that does not contain the branch IP address is rejected.
+	netConfig.BranchIPAddress.IP = net.ParseIP("10.0.16.42")
+	assert.IsType(t, &ErrConfigInvalid{}, discoverBranchSubnet(netConfig))
+
+	// IMDS failures are returned.
+	errIMDS := errors.New("IMDS is unreachable")
+	newSubnetFromIMDS = func(net.HardwareAddr) (*vpc.Subnet, error) { return nil, errIMDS }
+	assert.Equal(t, &ErrTransient{Err: errIMDS}, discoverBranchSubnet(netConfig))
+}
+
+func TestNewResultPrevResult(t *testing.T) {
+	args := &cniSkel.CmdArgs{
+		StdinData: []byte(`{"cniVersion":"0.3.1", "trunkName":"eth0", "branchVlanID":"101",
+			"branchMACAddress":"01:23:45:67:89:ab", "branchIPAddress":"10.0.1.42/24",
+			"prevResult":{
+				"cniVersion":"0.4.0",
+				"interfaces":[{"name":"eth0", "sandbox":"/var/run/netns/target"}],
+				"ips":[{"version":"4", "interface":0, "address":"10.1.0.5/16", "gateway":"10.1.0.1"}],
+				"routes":[{"dst":"10.2.0.0/16", "gw":"10.1.0.1"}],
+				"dns":{"nameservers":["10.1.0.2"]}
+			}}`),
+	}
+	netConfig, err := config.New(args, true)
+	require.NoError(t, err)
+
+	// Emit the result and parse it back, as the next plugin in the chain would.
+	emitted, err := newResult(netConfig, "tap0", "/var/run/netns/target").GetAsVersion(netConfig.CNIVersion)
+	require.NoError(t, err)
+	data, err := json.Marshal(emitted)
+	require.NoError(t, err)
+	parsed, err := cniTypesCurrent.NewResult(data)
+	require.NoError(t, err)
+	result := parsed.(*cniTypesCurrent.Result)
+
+	// The previous result comes first, and the tap link IP refers to the tap link interface.
+	require.Len(t, result.Interfaces, 2)
+	assert.Equal(t, "eth0", result.Interfaces[0].Name)
+	assert.Equal(t, "tap0", result.Interfaces[1].Name)
+	require.Len(t, result.IPs, 2)
+	assert.Equal(t, "10.1.0.5/16", result.IPs[0].Address.String())
+	assert.Equal(t, 0, *result.IPs[0].Interface)
+	assert.Equal(t, "10.0.1.42/24", result.IPs[1].Address.String())
+	assert.Equal(t, 1, *result.IPs[1].Interface)
+	require.Len(t, result.Routes, 2)
+	assert.Equal(t, "10.2.0.0/16", result.Routes[0].Dst.String())
+	assert.Equal(t, "0.0.0.0/0", result.Routes[1].Dst.String())
+	assert.Equal(t, []string{"10.1.0.2"}, result.DNS.Nameservers)
+}
+
+func TestNewDefaultRoute(t *testing.T) {
+	subnet, err := vpc.NewSubnetFromString("10.0.1.0/24")
+	assert.NoError(t, err)
+	subnet.Gateways = []net.IP{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2")}
+
+	// Without ECMP only the first gateway is used.
+	route, err := newDefaultRoute(5, subnet, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.1.1", route.Gw.String())
+	assert.Equal(t, 5, route.LinkIndex)
+	assert.Empty(t, route.MultiPath)
+
+	route, err = newDefaultRoute(5, subnet, true)
+	assert.NoError(t, err)
+	assert.Nil(t, route.Gw)
+	assert.Len(t, route.MultiPath, 2)
+	assert.Equal(t, "10.0.1.2", route.MultiPath[1].Gw.String())
+	assert.Equal(t, 5, route.MultiPath[1].LinkIndex)
+
+	// Gateways in the other address family are ignored on dual-stack subnets.
+	subnet.Gateways = []net.IP{net.ParseIP("2600:1f14:abc:de00::1"), net.ParseIP("10.0.1.1")}
+	route, err = newDefaultRoute(5, subnet, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.1.1", route.Gw.String())
+
+	// Gateways outside the subnet are rejected.
+	subnet.Gateways = append(subnet.Gateways, net.ParseIP("10.0.2.1"))
+	_, err = newDefaultRoute(5, subnet, true)
+	assert.Error(t, err)
+}
+
+func TestInstallECMPDefaultRoute(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-ecmp-route")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "branch0"}}
+		require.NoError(t, netlink.LinkAdd(link))
+		address, _ := netlink.ParseAddr("10.0.1.10/24")
+		require.NoError(t, netlink.AddrAdd(link, address))
+		require.NoError(t, netlink.LinkSetUp(link))
+
+		subnet, _ := vpc.NewSubnetFromString("10.0.1.0/24")
+		subnet.Gateways = []net.IP{net.ParseIP("10.0.1.1"), net.ParseIP("10.0.1.2")}
+		route, err := newDefaultRoute(link.Attrs().Index, subnet, true)
+		require.NoError(t, err)
+		require.NoError(t, netlink.RouteAdd(route))
+
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+		require.NoError(t, err)
+		var defaultRoute *netlink.Route
+		for i := range routes {
+			if routes[i].Dst == nil {
+				defaultRoute = &routes[i]
+			}
+		}
+		require.NotNil(t, defaultRoute)
+		assert.Len(t, defaultRoute.MultiPath, 2)
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestInstallIPv6DefaultRoute(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-ipv6-route")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "branch0"}}
+		require.NoError(t, netlink.LinkAdd(link))
+		address, _ := netlink.ParseAddr("2600:1f14:abc:de00::10/64")
+		require.NoError(t, netlink.AddrAdd(link, address))
+		require.NoError(t, netlink.LinkSetUp(link))
+
+		subnet, _ := vpc.NewSubnet(vpc.GetSubnetPrefix(address.IPNet))
+		route, err := newDefaultRoute(link.Attrs().Index, subnet, false)
+		require.NoError(t, err)
+		require.NoError(t, netlink.RouteAdd(route))
+
+		routes, err := netlink.RouteList(nil, netlink.FAMILY_V6)
+		require.NoError(t, err)
+		var defaultRoute *netlink.Route
+		for i := range routes {
+			if routes[i].Dst == nil {
+				defaultRoute = &routes[i]
+			}
+		}
+		require.NotNil(t, defaultRoute)
+		assert.Equal(t, "2600:1f14:abc:de00::1", defaultRoute.Gw.String())
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestAddFailsFastWithoutIptables(t *testing.T) {
+	defer func(f func(iptables.Protocol) error) { checkIptablesAvailable = f }(checkIptablesAvailable)
+	errNoIptables := errors.New("iptables backend is not available")
+	checkIptablesAvailable = func(iptables.Protocol) error { return errNoIptables }
+
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "test-no-such-netns",
+		IfName:      "eth0",
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101",
+			"branchMACAddress":"01:23:45:67:89:ab", "branchIPAddress":"10.0.1.10/24"}`),
+	}
+
+	plugin := &Plugin{}
+	err := plugin.Add(args)
+	assert.Equal(t, &ErrHostUnsupported{Err: errNoIptables}, err)
+
+	// With iptables skipped, Add proceeds past the pre-flight check, up to the missing netns.
+	args.StdinData = []byte(`{"trunkName":"eth0", "branchVlanID":"101", "skipIptables":true,
+		"branchMACAddress":"01:23:45:67:89:ab", "branchIPAddress":"10.0.1.10/24"}`)
+	err = plugin.Add(args)
+	assert.IsType(t, &ErrNetNSNotFound{}, err)
+}
+
+func TestAddFailsFastWithoutVhostNet(t *testing.T) {
+	defer func(f func() error) { checkVhostNetAvailable = f }(checkVhostNetAvailable)
+	errNoVhostNet := errors.New("vhost-net is not available")
+	checkVhostNetAvailable = func() error { return errNoVhostNet }
+
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "test-no-such-netns",
+		IfName:      "eth0",
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"101", "skipIptables":true,
+			"tapVhost":true, "branchMACAddress":"01:23:45:67:89:ab",
+			"branchIPAddress":"10.0.1.10/24"}`),
+	}
+
+	plugin := &Plugin{}
+	err := plugin.Add(args)
+	assert.Equal(t, &ErrHostUnsupported{Err: errNoVhostNet}, err)
+}
+
+func TestIsLastVethLinkDeleted(t *testing.T) {
+	links := []netlink.Link{
+		&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "lo"}},
+		&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "virbr0"}},
+		&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "virbr0-dummy"}},
+		&netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "eth1.101"}, VlanId: 101},
+		&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "mon0"}},
+	}
+
+	last, reason := isLastVethLinkDeleted(links, 101)
+	assert.True(t, last)
+	assert.Equal(t, "no veth links remain", reason)
+
+	links = append(links,
+		&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ve101-abc"}},
+		&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ve101-def"}})
+	last, reason = isLastVethLinkDeleted(links, 101)
+	assert.False(t, last)
+	assert.Equal(t, "2 veth links remain: [ve101-abc ve101-def]", reason)
+
+	// Veth links for other VLAN IDs are ignored.
+	last, _ = isLastVethLinkDeleted(links, 102)
+	assert.True(t, last)
+}
+
+func TestDelKeepsPATNetNSUntilLastVethLinkDeleted(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	patNetNSName := fmt.Sprintf(patNetNSNameFormat, 4000)
+	patNetNS, err := netns.NewNetNS(patNetNSName)
+	require.NoError(t, err)
+	defer patNetNS.Close()
+
+	// Inject the bridge, dummy and an unrelated monitoring veth link along with two veth
+	// links for tap links.
+	err = patNetNS.Run(func() error {
+		for _, name := range []string{"virbr0", "virbr0-dummy"} {
+			require.NoError(t, netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}))
+		}
+		for _, name := range []string{"mon0", "ve4000-a", "ve4000-b"} {
+			require.NoError(t, netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: name},
+				PeerName:  name + "-2",
+			}))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	logs := captureLogs(t)
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "test-no-such-netns",
+		IfName:      "eth0",
+		StdinData:   []byte(`{"trunkName":"eth0", "branchVlanID":"4000", "cleanupPATNetNS":true}`),
+	}
+	plugin := &Plugin{}
+	patNetNSPath := patNetNS.GetPath()
+
+	for _, name := range []string{"ve4000-a", "ve4000-b"} {
+		assert.NoError(t, plugin.Del(args))
+		_, err = os.Stat(patNetNSPath)
+		assert.NoError(t, err, "PAT netns deleted while veth link %s remains", name)
+
+		err = patNetNS.Run(func() error {
+			link, err := netlink.LinkByName(name)
+			require.NoError(t, err)
+			return netlink.LinkDel(link)
+		})
+		require.NoError(t, err)
+	}
+
+	assert.NoError(t, plugin.Del(args))
+	_, err = os.Stat(patNetNSPath)
+	assert.True(t, os.IsNotExist(err))
+
+	log.Flush()
+	assert.Contains(t, logs.String(), "Last veth link deleted: false, because 2 veth links remain")
+	assert.Contains(t, logs.String(), "Last veth link deleted: true, because no veth links remain")
+}
+
+func TestDelLogsPATNetNSPath(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	patNetNSName := fmt.Sprintf(patNetNSNameFormat, 4013)
+	patNetNS, err := netns.NewNetNS(patNetNSName)
+	require.NoError(t, err)
+	defer patNetNS.Close()
+
+	var buf bytes.Buffer
+	logger, err := log.LoggerFromWriterWithMinLevelAndFormat(&buf, log.DebugLvl, "%Lev %Msg%n")
+	require.NoError(t, err)
+	log.ReplaceLogger(logger)
+
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "test-no-such-netns",
+		IfName:      "eth0",
+		StdinData:   []byte(`{"trunkName":"eth0", "branchVlanID":"4013"}`),
+	}
+	plugin := &Plugin{}
+	assert.NoError(t, plugin.Del(args))
+
+	log.Flush()
+	assert.Contains(t, buf.String(), "Dbg PAT netns vpc-pat-4013 is at /var/run/netns/vpc-pat-4013.")
+}
+
+func TestSetBranchNeighParams(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-neigh-params")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "eth1.101"}}
+		require.NoError(t, netlink.LinkAdd(link))
+
+		netConfig := &config.NetConfig{
+			NeighBaseReachableTimeMs: 60000,
+			NeighGCStaleTime:         120,
+		}
+		require.NoError(t, setBranchNeighParams("eth1.101", netConfig))
+
+		value, err := ioutil.ReadFile("/proc/sys/net/ipv4/neigh/eth1.101/base_reachable_time_ms")
+		require.NoError(t, err)
+		assert.Equal(t, "60000", strings.TrimSpace(string(value)))
+
+		value, err = ioutil.ReadFile("/proc/sys/net/ipv4/neigh/eth1.101/gc_stale_time")
+		require.NoError(t, err)
+		assert.Equal(t, "120", strings.TrimSpace(string(value)))
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestSetBranchRingParams(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-ring-params")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "eth1.101"}}
+		require.NoError(t, netlink.LinkAdd(link))
+
+		// Rings are left unchanged by default.
+		require.NoError(t, setBranchRingParams("eth1.101", &config.NetConfig{}))
+
+		// Branch links without configurable rings fail with a clear error.
+		err := setBranchRingParams("eth1.101", &config.NetConfig{BranchRxRingSize: 4096})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "does not support ring size configuration")
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestSetBranchIPv6ParamsLinkLocalOnly(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-ipv6-ll-only")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		for _, name := range []string{"eth1.101", "eth1.102"} {
+			link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}
+			require.NoError(t, netlink.LinkAdd(link))
+		}
+
+		// Link-local-only branches accept RAs despite IPv6 forwarding.
+		netConfig := &config.NetConfig{
+			BranchIPv6LinkLocalOnly: true,
+			BranchIPv6UseTempAddr:   config.UnsetIPv6UseTempAddr,
+		}
+		require.NoError(t, setBranchIPv6Params("eth1.101", netConfig))
+		value, err := ioutil.ReadFile("/proc/sys/net/ipv6/conf/eth1.101/accept_ra")
+		require.NoError(t, err)
+		assert.Equal(t, "2", strings.TrimSpace(string(value)))
+
+		// Other branches are left at the kernel default.
+		netConfig = &config.NetConfig{BranchIPv6UseTempAddr: config.UnsetIPv6UseTempAddr}
+		require.NoError(t, setBranchIPv6Params("eth1.102", netConfig))
+		value, err = ioutil.ReadFile("/proc/sys/net/ipv6/conf/eth1.102/accept_ra")
+		require.NoError(t, err)
+		assert.Equal(t, "1", strings.TrimSpace(string(value)))
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestSetBranchIPv6ParamsUseTempAddr(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-ipv6-tempaddr")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "eth1.101"}}
+		require.NoError(t, netlink.LinkAdd(link))
+
+		for _, useTempAddr := range []int{2, 1, 0} {
+			netConfig := &config.NetConfig{BranchIPv6UseTempAddr: useTempAddr}
+			require.NoError(t, setBranchIPv6Params("eth1.101", netConfig))
+			value, err := ioutil.ReadFile("/proc/sys/net/ipv6/conf/eth1.101/use_tempaddr")
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprint(useTempAddr), strings.TrimSpace(string(value)))
+		}
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestRunTapSetupOrder(t *testing.T) {
+	testCases := []struct {
+		name          string
+		early         bool
+		tapErr        error
+		expectedSteps []string
+	}{
+		{
+			name:          "tap created after PAT netns setup by default",
+			expectedSteps: []string{"bridge", "branch", "tap", "ready"},
+		},
+		{
+			name:          "tap created once bridge is up in early mode",
+			early:         true,
+			expectedSteps: []string{"bridge", "tap", "branch", "ready"},
+		},
+		{
+			name:          "no readiness signal if tap creation fails",
+			early:         true,
+			tapErr:        errors.New("tap"),
+			expectedSteps: []string{"bridge", "tap"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var steps []string
+			patNetNS := &mockNetNS{}
+
+			setupPATNetNS := func(onBridgeUp func(netns.NetNS) error) (netns.NetNS, error) {
+				steps = append(steps, "bridge")
+				if onBridgeUp != nil {
+					if err := onBridgeUp(patNetNS); err != nil {
+						return nil, err
+					}
+				}
+				steps = append(steps, "branch")
+				return patNetNS, nil
+			}
+			createTap := func(ns netns.NetNS) error {
+				assert.Equal(t, patNetNS, ns)
+				steps = append(steps, "tap")
+				return tc.tapErr
+			}
+			ready := func() error {
+				steps = append(steps, "ready")
+				return nil
+			}
+
+			err := runTapSetup(tc.early, setupPATNetNS, createTap, ready)
+			assert.Equal(t, tc.tapErr, err)
+			assert.Equal(t, tc.expectedSteps, steps)
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	patNetNS, err := netns.NewNetNS(fmt.Sprintf(patNetNSNameFormat, 4001))
+	require.NoError(t, err)
+	defer patNetNS.Close()
+
+	targetNetNS, err := netns.NewNetNS("test-check-target")
+	require.NoError(t, err)
+	defer targetNetNS.Close()
+
+	// Set up the PAT bridge and a branch link on a stand-in trunk link.
+	err = patNetNS.Run(func() error {
+		trunk := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "trunk0"}}
+		require.NoError(t, netlink.LinkAdd(trunk))
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "virbr0"}}
+		require.NoError(t, netlink.LinkAdd(bridge))
+		require.NoError(t, netlink.LinkSetUp(bridge))
+		branch := &netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{Name: "trunk0.4001", ParentIndex: trunk.Attrs().Index},
+			VlanId:    4001,
+		}
+		err := netlink.LinkAdd(branch)
+		if err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(branch)
+	})
+	if err == unix.EOPNOTSUPP {
+		t.Skip("Test requires kernel VLAN support.")
+	}
+	require.NoError(t, err)
+
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "test-check-target",
+		IfName:      "eth0",
+		StdinData:   []byte(`{"trunkName":"trunk0", "branchVlanID":"4001"}`),
+	}
+	plugin := &Plugin{}
+
+	// The tap link is missing.
+	err = plugin.Check(args)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "link eth0 not found")
+
+	var tapLink netlink.Link
+	err = targetNetNS.Run(func() error {
+		tapLink = &netlink.Tuntap{
+			LinkAttrs: netlink.LinkAttrs{Name: "eth0"},
+			Mode:      netlink.TUNTAP_MODE_TAP,
+		}
+		require.NoError(t, netlink.LinkAdd(tapLink))
+		return nil
+	})
+	require.NoError(t, err)
+
+	// The tap link is down.
+	err = plugin.Check(args)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "link eth0 is not up")
+
+	err = targetNetNS.Run(func() error {
+		return netlink.LinkSetUp(tapLink)
+	})
+	require.NoError(t, err)
+	assert.NoError(t, plugin.Check(args))
+
+	// The branch link is down.
+	err = patNetNS.Run(func() error {
+		branch, err := netlink.LinkByName("trunk0.4001")
+		require.NoError(t, err)
+		return netlink.LinkSetDown(branch)
+	})
+	require.NoError(t, err)
+	err = plugin.Check(args)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "link trunk0.4001 is not up")
+
+	// The PAT netns is missing.
+	args.StdinData = []byte(`{"trunkName":"trunk0", "branchVlanID":"4002"}`)
+	err = plugin.Check(args)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "PAT netns vpc-pat-4002 not found")
+}
+
+func TestCheckBranchLink(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-check-branch")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		// Use a veth pair as the stand-in trunk link, so that it has a carrier.
+		trunk := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "trunk0"}, PeerName: "trunk0-peer"}
+		require.NoError(t, netlink.LinkAdd(trunk))
+		peer, err := netlink.LinkByName("trunk0-peer")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetUp(peer))
+		require.NoError(t, netlink.LinkSetUp(trunk))
+
+		macAddress, _ := net.ParseMAC("02:00:00:00:01:01")
+		branch := &netlink.Macvlan{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:         "trunk0.101",
+				ParentIndex:  trunk.Attrs().Index,
+				HardwareAddr: macAddress,
+			},
+			Mode: netlink.MACVLAN_MODE_PRIVATE,
+		}
+		require.NoError(t, netlink.LinkAdd(branch))
+
+		err = checkBranchLink("trunk0.101", macAddress)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "link trunk0.101 is not up")
+
+		require.NoError(t, netlink.LinkSetUp(branch))
+		assert.NoError(t, checkBranchLink("trunk0.101", macAddress))
+		assert.NoError(t, checkBranchLink("trunk0.101", nil))
+
+		otherMACAddress, _ := net.ParseMAC("02:00:00:00:01:02")
+		err = checkBranchLink("trunk0.101", otherMACAddress)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "does not match branchMACAddress 02:00:00:00:01:02")
+
+		// The branch is operationally down when its trunk loses carrier.
+		require.NoError(t, netlink.LinkSetDown(peer))
+		err = checkBranchLink("trunk0.101", macAddress)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "link trunk0.101 is not up")
+
+		err = checkBranchLink("trunk0.102", nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "link trunk0.102 not found")
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestAttachStrayBranch(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-stray-branch")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		trunkLink := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "trunk0"}}
+		require.NoError(t, netlink.LinkAdd(trunkLink))
+		trunk, err := eni.NewTrunk("trunk0", nil, eni.TrunkIsolationModeMACVLAN)
+		require.NoError(t, err)
+
+		macAddress, _ := net.ParseMAC("02:00:00:00:01:01")
+		otherMACAddress, _ := net.ParseMAC("02:00:00:00:01:02")
+		plugin := &Plugin{}
+
+		// attachStray leaves a branch link behind, as an ADD that crashed would.
+		attachStray := func() int {
+			stray, err := eni.NewBranch(trunk, "trunk0.101", macAddress, 101)
+			require.NoError(t, err)
+			require.NoError(t, stray.AttachToLink(true))
+			return stray.GetLinkIndex()
+		}
+
+		// attach attaches a branch with the given MAC address according to the given policy.
+		attach := func(macAddress net.HardwareAddr, policy string) *eni.Branch {
+			branch, err := eni.NewBranch(trunk, "trunk0.101", macAddress, 101)
+			require.NoError(t, err)
+			require.NoError(t, plugin.attachBranch(branch, policy))
+
+			link, err := netlink.LinkByName("trunk0.101")
+			require.NoError(t, err)
+			assert.Equal(t, link.Attrs().Index, branch.GetLinkIndex())
+			assert.Equal(t, macAddress.String(), link.Attrs().HardwareAddr.String())
+			return branch
+		}
+
+		// A compatible stray branch link is reused.
+		strayIndex := attachStray()
+		branch := attach(macAddress, config.StrayBranchPolicyReuse)
+		assert.Equal(t, strayIndex, branch.GetLinkIndex())
+
+		// An incompatible stray branch link is recreated.
+		branch = attach(otherMACAddress, config.StrayBranchPolicyReuse)
+		assert.NotEqual(t, strayIndex, branch.GetLinkIndex())
+		require.NoError(t, branch.Delete())
+
+		// A stray branch link is always recreated with the recreate policy.
+		strayIndex = attachStray()
+		branch = attach(macAddress, config.StrayBranchPolicyRecreate)
+		assert.NotEqual(t, strayIndex, branch.GetLinkIndex())
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+// trunkHasBranches returns whether any MACVLAN branch link remains on the given trunk link in the
+// current netns, including branch links in other netns. Links with MACVLAN upper links can't be
+// enslaved to a bridge, so enslaving the trunk to a probe bridge fails until all are deleted.
+func trunkHasBranches(t *testing.T, trunkName string) bool {
+	trunk, err := netlink.LinkByName(trunkName)
+	require.NoError(t, err)
+
+	probe := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "probe0"}}
+	require.NoError(t, netlink.LinkAdd(probe))
+	defer netlink.LinkDel(probe)
+
+	err = netlink.LinkSetMasterByIndex(trunk, probe.Index)
+	if err == unix.EBUSY {
+		return true
+	}
+	require.NoError(t, err)
+	require.NoError(t, netlink.LinkSetNoMaster(trunk))
+	return false
+}
+
+func TestDeletePATNetNSBranchDeleteOrder(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-delete-order")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		trunk := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "trunk0"}, PeerName: "trunk0-peer"}
+		require.NoError(t, netlink.LinkAdd(trunk))
+		plugin := &Plugin{}
+
+		for _, order := range []string{config.BranchDeleteOrderNetNSClose, config.BranchDeleteOrderBranchFirst} {
+			// Create a PAT netns with a branch link on the trunk.
+			patNetNS, err := netns.NewNetNS("test-delete-order-pat")
+			require.NoError(t, err)
+
+			macAddress, _ := net.ParseMAC("02:00:00:00:01:01")
+			branch := &netlink.Macvlan{
+				LinkAttrs: netlink.LinkAttrs{
+					Name:         "trunk0.101",
+					ParentIndex:  trunk.Attrs().Index,
+					HardwareAddr: macAddress,
+				},
+				Mode: netlink.MACVLAN_MODE_PRIVATE,
+			}
+			require.NoError(t, netlink.LinkAdd(branch))
+			require.NoError(t, netlink.LinkSetNsFd(branch, int(patNetNS.GetFd())))
+			require.True(t, trunkHasBranches(t, "trunk0"), order)
+
+			// Hold a reference to the PAT netns, as a process still running in it would.
+			ref, err := os.Open(patNetNS.GetPath())
+			require.NoError(t, err)
+
+			netConfig := &config.NetConfig{NetNSCloseAttempts: 1, BranchDeleteOrder: order}
+			plugin.deletePATNetNS(patNetNS, "test-delete-order-pat", netConfig)
+
+			// Deleting the branch first leaves the trunk clean even while the PAT netns is held.
+			// Otherwise, the branch is deleted with the PAT netns once the last reference is released.
+			assert.Equal(t, order == config.BranchDeleteOrderNetNSClose, trunkHasBranches(t, "trunk0"), order)
+			ref.Close()
+
+			clean := false
+			for i := 0; i < 50 && !clean; i++ {
+				clean = !trunkHasBranches(t, "trunk0")
+				time.Sleep(20 * time.Millisecond)
+			}
+			assert.True(t, clean, order)
+		}
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestCreateTapLinkMTU(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-tap-mtu")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		veth := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "veth0", MTU: 1500},
+			PeerName:  "veth1",
+		}
+		require.NoError(t, netlink.LinkAdd(veth))
+
+		netConfig := &config.NetConfig{
+			TapOwnershipPolicy: config.TapOwnershipPolicyFail,
+			TapMACAddress:      net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x65},
+			MTU:                1500,
+		}
+		plugin := &Plugin{}
+		require.NoError(t, plugin.createTapLink("tapbr0", "veth0", "eth0", netConfig))
+
+		for _, name := range []string{"tapbr0", "eth0"} {
+			link, err := netlink.LinkByName(name)
+			require.NoError(t, err)
+			assert.Equal(t, 1500, link.Attrs().MTU, "link %s", name)
+		}
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestNewTuntap(t *testing.T) {
+	netConfig := &config.NetConfig{MTU: 9001, TapQueues: 1}
+	tuntap := newTuntap("tapbr0", 5, netConfig)
+	assert.Equal(t, "tapbr0", tuntap.Name)
+	assert.Equal(t, 5, tuntap.MasterIndex)
+	assert.Equal(t, 9001, tuntap.MTU)
+	assert.Equal(t, netlink.TUNTAP_MODE_TAP, tuntap.Mode)
+	assert.Equal(t, 1, tuntap.Queues)
+	assert.Equal(t, netlink.TUNTAP_ONE_QUEUE|netlink.TUNTAP_VNET_HDR, tuntap.Flags)
+
+	netConfig.TapQueues = 4
+	netConfig.TapVhost = true
+	tuntap = newTuntap("tapbr0", 5, netConfig)
+	assert.Equal(t, 4, tuntap.Queues)
+	assert.Equal(t, netlink.TUNTAP_MULTI_QUEUE_DEFAULTS|netlink.TUNTAP_VNET_HDR, tuntap.Flags)
+}
+
+func TestCheckTapQueueFdLimit(t *testing.T) {
+	var rlimit unix.Rlimit
+	require.NoError(t, unix.Getrlimit(unix.RLIMIT_NOFILE, &rlimit))
+	defer unix.Setrlimit(unix.RLIMIT_NOFILE, &rlimit)
+
+	// Constrain the open file limit to a few file descriptors more than are open.
+	fds, err := ioutil.ReadDir(procSelfFdPath)
+	require.NoError(t, err)
+	constrained := rlimit
+	constrained.Cur = uint64(len(fds) + 8)
+	require.NoError(t, unix.Setrlimit(unix.RLIMIT_NOFILE, &constrained))
+
+	assert.NoError(t, checkTapQueueFdLimit(2))
+	err = checkTapQueueFdLimit(64)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "tap link with 64 queues needs 64 file descriptors")
+	}
+
+	// No link is created when the tap queues would exceed the limit.
+	nl := netlinkwrapper.NewMockNetLink(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ve101-peer"}})
+	plugin := &Plugin{netLink: nl}
+	netConfig := &config.NetConfig{MTU: 9001, TapQueues: 64}
+	assert.Error(t, plugin.createTapLink("tapbr101", "ve101-peer", "tap0", netConfig))
+	assert.Empty(t, nl.Calls)
+}
+
+func TestCreateTapLinkPersist(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-tap-persist")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	var reqs []uint
+	defer func() { ioctlSetInt = unix.IoctlSetInt }()
+	ioctlSetInt = func(fd int, req uint, value int) error {
+		reqs = append(reqs, req)
+		return unix.IoctlSetInt(fd, req, value)
+	}
+
+	err = testNetNS.Run(func() error {
+		veth := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "veth0", MTU: 1500},
+			PeerName:  "veth1",
+		}
+		require.NoError(t, netlink.LinkAdd(veth))
+
+		netConfig := &config.NetConfig{
+			TapOwnershipPolicy: config.TapOwnershipPolicyFail,
+			TapMACAddress:      net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x65},
+			MTU:                1500,
+			PersistTap:         true,
+		}
+		plugin := &Plugin{}
+		return plugin.createTapLink("tapbr0", "veth0", "eth0", netConfig)
+	})
+	require.NoError(t, err)
+	assert.Contains(t, reqs, uint(unix.TUNSETPERSIST))
+
+	// DEL removes the persistent tap link.
+	plugin := &Plugin{}
+	assert.True(t, plugin.deleteTapVethLinks("test-tap-persist", "eth0", "tapbr0", time.Second))
+	err = testNetNS.Run(func() error {
+		_, err := netlink.LinkByName("eth0")
+		assert.IsType(t, netlink.LinkNotFoundError{}, err)
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestCreateTapLinkCleanupOnOwnershipFailure(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	defer func() { ioctlSetInt = unix.IoctlSetInt }()
+	ioctlSetInt = func(fd int, req uint, value int) error {
+		if req == unix.TUNSETGROUP {
+			return unix.EINVAL
+		}
+		return nil
+	}
+
+	testNetNS, err := netns.NewNetNS("test-tap-cleanup")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		veth := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "veth0"},
+			PeerName:  "veth1",
+		}
+		require.NoError(t, netlink.LinkAdd(veth))
+
+		netConfig := &config.NetConfig{
+			Gid:                1000,
+			TapOwnershipPolicy: config.TapOwnershipPolicyFail,
+			MTU:                1500,
+		}
+		plugin := &Plugin{}
+		err := plugin.createTapLink("tapbr0", "veth0", "eth0", netConfig)
+		assert.Equal(t, unix.EINVAL, err)
+
+		_, err = netlink.LinkByName("eth0")
+		assert.Error(t, err)
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestAddRequireExistingNamespace(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	hostNetNS, err := netns.NewNetNS("test-require-ns-host")
+	require.NoError(t, err)
+	defer hostNetNS.Close()
+
+	targetNetNS, err := netns.NewNetNS("test-require-ns-target")
+	require.NoError(t, err)
+	defer targetNetNS.Close()
+
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "test-require-ns-target",
+		IfName:      "eth0",
+		StdinData: []byte(`{"trunkName":"trunk0", "branchVlanID":"4002", "skipIptables":true,
+			"branchMACAddress":"02:23:45:67:89:ab", "branchIPAddress":"10.0.1.10/24",
+			"requireExistingNamespace":true}`),
+	}
+	plugin := &Plugin{}
+
+	// Run ADD with a stand-in trunk link in a host netns without the PAT netns.
+	err = hostNetNS.Run(func() error {
+		trunk := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "trunk0"}}
+		require.NoError(t, netlink.LinkAdd(trunk))
+		return plugin.Add(args)
+	})
+	assert.IsType(t, &ErrConfigInvalid{}, err)
+	assert.Contains(t, err.Error(), "PAT netns vpc-pat-4002 does not exist")
+
+	_, err = os.Stat("/var/run/netns/vpc-pat-4002")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAddCleansUpPATNetNSOnFailure(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	hostNetNS, err := netns.NewNetNS("test-cleanup-host")
+	require.NoError(t, err)
+	defer hostNetNS.Close()
+
+	targetNetNS, err := netns.NewNetNS("test-cleanup-target")
+	require.NoError(t, err)
+	defer targetNetNS.Close()
+
+	// The tap fd socket does not exist, so createTapLink fails after the PAT netns is set up.
+	// On kernels without VLAN support, ADD fails earlier when creating the branch link.
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "test-cleanup-target",
+		IfName:      "eth0",
+		StdinData: []byte(`{"trunkName":"trunk0", "branchVlanID":"4003", "skipIptables":true,
+			"branchMACAddress":"02:23:45:67:89:ab", "branchIPAddress":"10.0.1.10/24",
+			"tapFdSocket":"/nonexistent/tap.sock"}`),
+	}
+	plugin := &Plugin{}
+
+	err = hostNetNS.Run(func() error {
+		trunk := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "trunk0"}}
+		require.NoError(t, netlink.LinkAdd(trunk))
+		return plugin.Add(args)
+	})
+	assert.Error(t, err)
+
+	_, err = os.Stat("/var/run/netns/vpc-pat-4003")
+	assert.True(t, os.IsNotExist(err))
+
+	// The branch link is not left behind on the trunk.
+	err = hostNetNS.Run(func() error {
+		_, err := netlink.LinkByName("trunk0.4003")
+		assert.Error(t, err)
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestCheckBranchTrunk(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-branch-trunk")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		// Two stand-in trunk links carrying the same VLAN ID.
+		for _, name := range []string{"trunk0", "trunk1"} {
+			link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}
+			require.NoError(t, netlink.LinkAdd(link))
+		}
+		trunk0, err := eni.NewTrunk("trunk0", nil, eni.TrunkIsolationModeVLAN)
+		require.NoError(t, err)
+		trunk1, err := eni.NewTrunk("trunk1", nil, eni.TrunkIsolationModeVLAN)
+		require.NoError(t, err)
+
+		branches := []eni.BranchLink{
+			{LinkName: "trunk0.101", VlanID: 101, TrunkIndex: trunk0.GetLinkIndex()},
+		}
+
+		assert.NoError(t, checkBranchTrunk(branches, 101, trunk0))
+		assert.IsType(t, &ErrConfigInvalid{}, checkBranchTrunk(branches, 101, trunk1))
+		assert.NoError(t, checkBranchTrunk(branches, 102, trunk1))
+
+		// MACVLAN branch links have no VLAN ID, and are checked as the only branch in a PAT netns.
+		branches = []eni.BranchLink{
+			{LinkName: "trunk0.101", TrunkIndex: trunk0.GetLinkIndex(), IsolationMode: eni.TrunkIsolationModeMACVLAN},
+		}
+		assert.NoError(t, checkBranchTrunk(branches, 101, trunk0))
+		assert.IsType(t, &ErrConfigInvalid{}, checkBranchTrunk(branches, 101, trunk1))
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestSetupIp6tablesRules(t *testing.T) {
+	comment := `-m comment --comment "vpc-pat vlan 101 branch eth1.101" `
+
+	// Install a fake ip6tables-restore that records its input.
+	dir, err := ioutil.TempDir("", "ip6tables")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	script := fmt.Sprintf("#!/bin/sh\ncat > %s/rules\n", dir)
+	require.NoError(t, ioutil.WriteFile(dir+"/ip6tables-restore", []byte(script), 0755))
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+":"+path)
+
+	plugin := &Plugin{}
+	err = plugin.setupIp6tablesRules("virbr0", "fd00:c0a8:7a::/64", "eth1.101", &config.NetConfig{
+		BranchVlanID:        101,
+		NATMode:             config.NATModeMasquerade,
+		MasqueradePortRange: "1024-65535",
+		DNSPorts:            []int{53},
+	})
+	require.NoError(t, err)
+
+	rules, err := ioutil.ReadFile(dir + "/rules")
+	require.NoError(t, err)
+	assert.Contains(t, string(rules),
+		"-A POSTROUTING "+comment+"-s fd00:c0a8:7a::/64 ! -d fd00:c0a8:7a::/64 -o eth1.101 -j MASQUERADE\n")
+	assert.Contains(t, string(rules),
+		"-A FORWARD "+comment+"-s fd00:c0a8:7a::/64 -i virbr0 -o eth1.101 -j ACCEPT\n")
+	assert.Contains(t, string(rules),
+		"-A FORWARD "+comment+"-o virbr0 -j REJECT --reject-with icmp6-port-unreachable\n")
+	assert.NotContains(t, string(rules), "--dport 67")
+}
+
+func TestAddPATNetNSLimit(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	hostNetNS, err := netns.NewNetNS("test-limit-host")
+	require.NoError(t, err)
+	defer hostNetNS.Close()
+
+	targetNetNS, err := netns.NewNetNS("test-limit-target")
+	require.NoError(t, err)
+	defer targetNetNS.Close()
+
+	// An existing PAT netns on another VLAN ID uses up the limit.
+	patNetNS, err := netns.NewNetNS(fmt.Sprintf(patNetNSNameFormat, 4010))
+	require.NoError(t, err)
+	defer patNetNS.Close()
+
+	assert.NoError(t, checkPATNetNSLimit(2))
+	assert.IsType(t, &ErrTransient{}, checkPATNetNSLimit(1))
+
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "test-limit-target",
+		IfName:      "eth0",
+		StdinData: []byte(`{"trunkName":"trunk0", "branchVlanID":"4011", "skipIptables":true,
+			"branchMACAddress":"02:23:45:67:89:ab", "branchIPAddress":"10.0.1.10/24",
+			"maxPATNetNS":"1"}`),
+	}
+	plugin := &Plugin{}
+
+	err = hostNetNS.Run(func() error {
+		trunk := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "trunk0"}}
+		require.NoError(t, netlink.LinkAdd(trunk))
+		return plugin.Add(args)
+	})
+	require.Error(t, err)
+	assert.True(t, IsRetriable(err))
+	assert.Contains(t, err.Error(), "reached maxPATNetNS 1")
+
+	_, err = os.Stat("/var/run/netns/vpc-pat-4011")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// linkByNameNetLink wraps a NetLink to replace its LinkByName lookups in tests.
+type linkByNameNetLink struct {
+	netlinkwrapper.NetLink
+	linkByName func(name string) (netlink.Link, error)
+}
+
+func (nl *linkByNameNetLink) LinkByName(name string) (netlink.Link, error) {
+	return nl.linkByName(name)
+}
+
+func TestDelWaitsForTapRelease(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	patNetNS, err := netns.NewNetNS(fmt.Sprintf(patNetNSNameFormat, 4012))
+	require.NoError(t, err)
+	defer patNetNS.Close()
+
+	targetNetNS, err := netns.NewNetNS("test-tap-release")
+	require.NoError(t, err)
+	defer targetNetNS.Close()
+
+	// Simulate a tap link that lingers after deletion because a VMM still holds its fd.
+	nl := &linkByNameNetLink{
+		NetLink: netlinkwrapper.NewNetLink(),
+		linkByName: func(name string) (netlink.Link, error) {
+			if name == "tap0" {
+				return &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: name}}, nil
+			}
+			return netlink.LinkByName(name)
+		},
+	}
+
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "test-tap-release",
+		IfName:      "tap0",
+		StdinData: []byte(`{"trunkName":"eth0", "branchVlanID":"4012", "cleanupPATNetNS":true,
+			"tapReleaseTimeout":"100ms"}`),
+	}
+	plugin := &Plugin{netLink: nl}
+	patNetNSPath := patNetNS.GetPath()
+
+	assert.NoError(t, plugin.Del(args))
+	_, err = os.Stat(patNetNSPath)
+	assert.NoError(t, err, "PAT netns deleted while tap link is held open")
+
+	// Release the tap link.
+	nl.linkByName = netlink.LinkByName
+
+	assert.NoError(t, plugin.Del(args))
+	_, err = os.Stat(patNetNSPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWaitForLinkRelease(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	ns, err := netns.NewNetNS("test-link-release")
+	require.NoError(t, err)
+	defer ns.Close()
+
+	plugin := &Plugin{}
+	err = ns.Run(func() error {
+		assert.NoError(t, plugin.waitForLinkRelease("tap0", time.Second))
+
+		link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "tap0"}}
+		require.NoError(t, netlink.LinkAdd(link))
+		assert.Error(t, plugin.waitForLinkRelease("tap0", 100*time.Millisecond))
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			ns.Run(func() error { return netlink.LinkDel(link) })
+		}()
+		assert.NoError(t, plugin.waitForLinkRelease("tap0", time.Second))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestWaitForLinkMaster(t *testing.T) {
+	nl := &linkByNameNetLink{NetLink: netlinkwrapper.NewMockNetLink()}
+	plugin := &Plugin{netLink: nl}
+
+	// The tap link is never enslaved to the bridge.
+	checks := 0
+	nl.linkByName = func(name string) (netlink.Link, error) {
+		checks++
+		return &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: name}}, nil
+	}
+	err := plugin.waitForLinkMaster("tap0", 7)
+	assert.EqualError(t, err, "link tap0 master index is 0, expected 7")
+	assert.Equal(t, maxTapMasterChecks, checks)
+
+	// The tap link is enslaved to the bridge on a retry.
+	checks = 0
+	nl.linkByName = func(name string) (netlink.Link, error) {
+		checks++
+		link := &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: name}}
+		if checks == 2 {
+			link.MasterIndex = 7
+		}
+		return link, nil
+	}
+	assert.NoError(t, plugin.waitForLinkMaster("tap0", 7))
+	assert.Equal(t, 2, checks)
+}
+
+func TestDeleteIptablesRules(t *testing.T) {
+	comment := `-m comment --comment "vpc-pat vlan 101 branch eth1.101" `
+
+	// Install a fake iptables-restore that records its arguments and input.
+	dir, err := ioutil.TempDir("", "iptables")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s/rules\ncat >> %s/rules\n", dir, dir)
+	require.NoError(t, ioutil.WriteFile(dir+"/iptables-restore", []byte(script), 0755))
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+":"+path)
+
+	plugin := &Plugin{}
+	err = plugin.deleteIptablesRules("virbr0", "192.168.122.0/24", "eth1.101", &config.NetConfig{
+		BranchVlanID:        101,
+		NATMode:             config.NATModeMasquerade,
+		MasqueradePortRange: "1024-65535",
+		DNSPorts:            []int{53},
+	})
+	require.NoError(t, err)
+
+	rules, err := ioutil.ReadFile(dir + "/rules")
+	require.NoError(t, err)
+	assert.Contains(t, strings.SplitN(string(rules), "\n", 2)[0], "--noflush")
+	assert.Contains(t, string(rules),
+		"-D POSTROUTING "+comment+"-s 192.168.122.0/24 ! -d 192.168.122.0/24 -o eth1.101 -j MASQUERADE\n")
+	assert.Contains(t, string(rules), "-D INPUT "+comment+"-i virbr0 -p udp -m udp --dport 53 -j ACCEPT\n")
+	assert.NotContains(t, string(rules), "-A ")
+	assert.NotContains(t, string(rules), ":FORWARD")
+}
+
+func TestNewIptablesSessionConnMark(t *testing.T) {
+	comment := `-m comment --comment "vpc-pat vlan 101 branch eth1.101" `
+
+	// Install fake restore commands, so that sessions can be created.
+	dir, err := ioutil.TempDir("", "iptables")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, cmd := range []string{"iptables-restore", "ip6tables-restore"} {
+		require.NoError(t, ioutil.WriteFile(dir+"/"+cmd, []byte("#!/bin/sh\n"), 0755))
+	}
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+":"+path)
+
+	netConfig := &config.NetConfig{
+		BranchVlanID:        101,
+		NATMode:             config.NATModeMasquerade,
+		MasqueradePortRange: "1024-65535",
+		DNSPorts:            []int{53},
+	}
+	s, err := newIptablesSession("virbr0", "192.168.122.0/24", "eth1.101", netConfig)
+	require.NoError(t, err)
+	assert.NotContains(t, s.Serialize(), "CONNMARK")
+
+	netConfig.ConnMark = 0x2a
+	s, err = newIptablesSession("virbr0", "192.168.122.0/24", "eth1.101", netConfig)
+	require.NoError(t, err)
+	assert.Contains(t, s.Serialize(), "*mangle\n:PREROUTING ACCEPT [0:0]\n")
+	assert.Contains(t, s.Serialize(),
+		"-A PREROUTING "+comment+"-s 192.168.122.0/24 -i virbr0 -m conntrack --ctstate NEW -j CONNMARK --set-mark 0x2a\n")
+
+	s, err = newIp6tablesSession("virbr0", "fd00:c0a8:7a::/64", "eth1.101", netConfig)
+	require.NoError(t, err)
+	assert.Contains(t, s.Serialize(),
+		"-A PREROUTING "+comment+"-s fd00:c0a8:7a::/64 -i virbr0 -m conntrack --ctstate NEW -j CONNMARK --set-mark 0x2a\n")
+}
+
+func TestSetupIptablesRulesWithoutNAT(t *testing.T) {
+	// Install fake restore commands that record the committed rules.
+	dir, err := ioutil.TempDir("", "iptables")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, cmd := range []string{"iptables-restore", "ip6tables-restore"} {
+		script := fmt.Sprintf("#!/bin/sh\ncat > %s/%s.rules\n", dir, cmd)
+		require.NoError(t, ioutil.WriteFile(dir+"/"+cmd, []byte(script), 0755))
+	}
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+":"+path)
+
+	plugin := &Plugin{}
+	netConfig := &config.NetConfig{
+		BranchVlanID:        101,
+		NATMode:             config.NATModeNone,
+		MasqueradePortRange: "1024-65535",
+		DNSPorts:            []int{53},
+	}
+	err = plugin.setupIptablesRules("virbr0", "192.168.122.0/24", "eth1.101", netConfig)
+	require.NoError(t, err)
+	err = plugin.setupIp6tablesRules("virbr0", "fd00:c0a8:7a::/64", "eth1.101", netConfig)
+	require.NoError(t, err)
+
+	for _, cmd := range []string{"iptables-restore", "ip6tables-restore"} {
+		rules, err := ioutil.ReadFile(dir + "/" + cmd + ".rules")
+		require.NoError(t, err)
+		assert.NotContains(t, string(rules), "MASQUERADE", cmd)
+		assert.NotContains(t, string(rules), "-j RETURN", cmd)
+		assert.Contains(t, string(rules), "-i virbr0 -o eth1.101 -j ACCEPT\n", cmd)
+	}
+}
+
+func TestNewIptablesSessionAllowedInputPorts(t *testing.T) {
+	comment := `-m comment --comment "vpc-pat vlan 101 branch eth1.101" `
+
+	// Install fake restore commands, so that sessions can be created.
+	dir, err := ioutil.TempDir("", "iptables")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, cmd := range []string{"iptables-restore", "ip6tables-restore"} {
+		require.NoError(t, ioutil.WriteFile(dir+"/"+cmd, []byte("#!/bin/sh\n"), 0755))
+	}
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+":"+path)
+
+	inputRules := func(s *iptables.Session) []string {
+		var rules []string
+		for _, line := range strings.Split(s.Serialize(), "\n") {
+			if strings.HasPrefix(line, "-A INPUT ") {
+				rules = append(rules, strings.TrimPrefix(line, "-A INPUT "+comment))
+			}
+		}
+		return rules
+	}
+
+	// With an empty list, only DNS and DHCP are allowed.
+	netConfig := &config.NetConfig{
+		BranchVlanID:        101,
+		NATMode:             config.NATModeMasquerade,
+		MasqueradePortRange: "1024-65535",
+		DNSPorts:            []int{53},
+	}
+	s, err := newIptablesSession("virbr0", "192.168.122.0/24", "eth1.101", netConfig)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"-i virbr0 -p udp -m udp --dport 53 -j ACCEPT",
+		"-i virbr0 -p tcp -m tcp --dport 53 -j ACCEPT",
+		"-i virbr0 -p udp -m udp --dport 67 -j ACCEPT",
+		"-i virbr0 -p tcp -m tcp --dport 67 -j ACCEPT",
+	}, inputRules(s))
+
+	// Custom ports are allowed in addition to the defaults.
+	allowedInputPorts := []config.PortSpec{
+		{Port: 80, Protocol: "tcp"},
+		{Port: 8125, Protocol: "udp"},
+	}
+	netConfig.AllowedInputPorts = allowedInputPorts
+	s, err = newIptablesSession("virbr0", "192.168.122.0/24", "eth1.101", netConfig)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"-i virbr0 -p udp -m udp --dport 53 -j ACCEPT",
+		"-i virbr0 -p tcp -m tcp --dport 53 -j ACCEPT",
+		"-i virbr0 -p udp -m udp --dport 67 -j ACCEPT",
+		"-i virbr0 -p tcp -m tcp --dport 67 -j ACCEPT",
+		"-i virbr0 -p tcp -m tcp --dport 80 -j ACCEPT",
+		"-i virbr0 -p udp -m udp --dport 8125 -j ACCEPT",
+	}, inputRules(s))
+
+	// Ports that are already allowed are not allowed again.
+	netConfig.DNSPorts = []int{53, 53}
+	netConfig.AllowedInputPorts = []config.PortSpec{{Port: 53, Protocol: "udp"}}
+	s, err = newIptablesSession("virbr0", "192.168.122.0/24", "eth1.101", netConfig)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"-i virbr0 -p udp -m udp --dport 53 -j ACCEPT",
+		"-i virbr0 -p tcp -m tcp --dport 53 -j ACCEPT",
+		"-i virbr0 -p udp -m udp --dport 67 -j ACCEPT",
+		"-i virbr0 -p tcp -m tcp --dport 67 -j ACCEPT",
+	}, inputRules(s))
+
+	netConfig.DNSPorts = []int{53}
+	netConfig.AllowedInputPorts = allowedInputPorts
+	s, err = newIp6tablesSession("virbr0", "fd00:c0a8:7a::/64", "eth1.101", netConfig)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"-i virbr0 -p udp -m udp --dport 53 -j ACCEPT",
+		"-i virbr0 -p tcp -m tcp --dport 53 -j ACCEPT",
+		"-i virbr0 -p tcp -m tcp --dport 80 -j ACCEPT",
+		"-i virbr0 -p udp -m udp --dport 8125 -j ACCEPT",
+	}, inputRules(s))
+}
+
+func TestNewIptablesSessionDNSPorts(t *testing.T) {
+	comment := `-m comment --comment "vpc-pat vlan 101 branch eth1.101" `
+
+	// Install fake restore commands, so that sessions can be created.
+	dir, err := ioutil.TempDir("", "iptables")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, cmd := range []string{"iptables-restore", "ip6tables-restore"} {
+		require.NoError(t, ioutil.WriteFile(dir+"/"+cmd, []byte("#!/bin/sh\n"), 0755))
+	}
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+":"+path)
+
+	dnsRules := []string{
+		"-A INPUT " + comment + "-i virbr0 -p udp -m udp --dport 53 -j ACCEPT\n",
+		"-A INPUT " + comment + "-i virbr0 -p tcp -m tcp --dport 53 -j ACCEPT\n",
+		"-A INPUT " + comment + "-i virbr0 -p udp -m udp --dport 853 -j ACCEPT\n",
+		"-A INPUT " + comment + "-i virbr0 -p tcp -m tcp --dport 853 -j ACCEPT\n",
+	}
+
+	netConfig := &config.NetConfig{
+		BranchVlanID:        101,
+		NATMode:             config.NATModeMasquerade,
+		MasqueradePortRange: "1024-65535",
+		DNSPorts:            []int{53, 853},
+	}
+	s, err := newIptablesSession("virbr0", "192.168.122.0/24", "eth1.101", netConfig)
+	require.NoError(t, err)
+	for _, rule := range dnsRules {
+		assert.Contains(t, s.Serialize(), rule)
+	}
+
+	s, err = newIp6tablesSession("virbr0", "fd00:c0a8:7a::/64", "eth1.101", netConfig)
+	require.NoError(t, err)
+	for _, rule := range dnsRules {
+		assert.Contains(t, s.Serialize(), rule)
+	}
+}
+
+func TestNewIptablesSessionMasqueradePortRange(t *testing.T) {
+	comment := `-m comment --comment "vpc-pat vlan 101 branch eth1.101" `
+
+	// Install fake restore commands, so that sessions can be created.
+	dir, err := ioutil.TempDir("", "iptables")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, cmd := range []string{"iptables-restore", "ip6tables-restore"} {
+		require.NoError(t, ioutil.WriteFile(dir+"/"+cmd, []byte("#!/bin/sh\n"), 0755))
+	}
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+":"+path)
+
+	netConfig := &config.NetConfig{
+		BranchVlanID:        101,
+		NATMode:             config.NATModeMasquerade,
+		MasqueradePortRange: "32768-60999",
+		DNSPorts:            []int{53},
+	}
+	s, err := newIptablesSession("virbr0", "192.168.122.0/24", "eth1.101", netConfig)
+	require.NoError(t, err)
+	for _, proto := range []string{"tcp", "udp"} {
+		assert.Contains(t, s.Serialize(), "-A POSTROUTING "+comment+"-s 192.168.122.0/24 ! -d 192.168.122.0/24 "+
+			"-o eth1.101 -p "+proto+" -j MASQUERADE --to-ports 32768-60999\n")
+	}
+	assert.NotContains(t, s.Serialize(), "1024-65535", nil)
+
+	s, err = newIp6tablesSession("virbr0", "fd00:c0a8:7a::/64", "eth1.101", netConfig)
+	require.NoError(t, err)
+	assert.Contains(t, s.Serialize(), "-p tcp -j MASQUERADE --to-ports 32768-60999\n")
+	assert.Contains(t, s.Serialize(), "-p udp -j MASQUERADE --to-ports 32768-60999\n")
+}
+
+func TestSetupPATNetworkNamespaceMockNetlink(t *testing.T) {
+	bridgeIPAddress, _ := vpc.GetIPAddressFromString("192.168.122.1/24")
+	branchIPAddress, _ := vpc.GetIPAddressFromString("10.0.1.5/24")
+	branchSubnet, err := vpc.NewSubnetFromString("10.0.1.0/24")
+	require.NoError(t, err)
+	netConfig := &config.NetConfig{
+		BridgeName:            "virbr0",
+		MTU:                   9001,
+		SkipIptables:          true,
+		BranchIPv6UseTempAddr: config.UnsetIPv6UseTempAddr,
+	}
+	errNetlink := errors.New("netlink failed")
+
+	bridgeCalls := []string{
+		"LinkAdd virbr0", "LinkSetMTU virbr0",
+		"LinkAdd virbr0-dummy", "LinkSetMTU virbr0-dummy",
+		"AddrAdd virbr0", "LinkSetUp virbr0",
+	}
+	testCases := []struct {
+		failingCall string
+		calls       []string
+	}{
+		{"", append(bridgeCalls,
+			"LinkSetMTU eth1.101", "AddrAdd eth1.101", "LinkSetUp eth1.101", "RouteAdd")},
+		{"LinkAdd virbr0", bridgeCalls[:1]},
+		{"LinkSetMTU virbr0", bridgeCalls[:2]},
+		{"LinkAdd virbr0-dummy", bridgeCalls[:3]},
+		{"LinkSetMTU virbr0-dummy", bridgeCalls[:4]},
+		{"AddrAdd virbr0", bridgeCalls[:5]},
+		{"LinkSetUp virbr0", bridgeCalls},
+		{"LinkSetMTU eth1.101", append(bridgeCalls, "LinkSetMTU eth1.101")},
+		{"AddrAdd eth1.101", append(bridgeCalls, "LinkSetMTU eth1.101", "AddrAdd eth1.101")},
+		{"LinkSetUp eth1.101", append(bridgeCalls,
+			"LinkSetMTU eth1.101", "AddrAdd eth1.101", "LinkSetUp eth1.101")},
+		{"RouteAdd", append(bridgeCalls,
+			"LinkSetMTU eth1.101", "AddrAdd eth1.101", "LinkSetUp eth1.101", "RouteAdd")},
+	}
+
+	for _, tc := range testCases {
+		name := tc.failingCall
+		if name == "" {
+			name = "success"
+		}
+		t.Run(name, func(t *testing.T) {
+			nl := netlinkwrapper.NewMockNetLink(&netlink.Vlan{
+				LinkAttrs: netlink.LinkAttrs{Name: "eth1.101", MTU: 1500},
+				VlanId:    101,
+			})
+			if tc.failingCall != "" {
+				nl.Errors[tc.failingCall] = errNetlink
+			}
+			plugin := &Plugin{netLink: nl}
+			branch, err := eni.NewBranch(&eni.Trunk{}, "eth1.101", nil, 101)
+			require.NoError(t, err)
+
+			err = plugin.setupPATNetworkNamespace("vpc-pat-101", "virbr0", bridgeIPAddress,
+				branch, branchIPAddress, branchSubnet, netConfig, nil)
+			assert.Equal(t, tc.calls, nl.Calls)
+			if tc.failingCall != "" {
+				assert.Equal(t, errNetlink, err)
+				return
+			}
+			require.NoError(t, err)
+
+			bridge, err := nl.LinkByName("virbr0")
+			require.NoError(t, err)
+			assert.Equal(t, 9001, bridge.Attrs().MTU)
+			assert.NotZero(t, bridge.Attrs().Flags&net.FlagUp)
+			addrs, err := nl.AddrList(bridge, netlink.FAMILY_V4)
+			require.NoError(t, err)
+			require.Len(t, addrs, 1)
+			assert.Equal(t, "192.168.122.1/24", addrs[0].IPNet.String())
+
+			dummy, err := nl.LinkByName("virbr0-dummy")
+			require.NoError(t, err)
+			assert.Equal(t, bridge.Attrs().Index, dummy.Attrs().MasterIndex)
+
+			branchLink, err := nl.LinkByName("eth1.101")
+			require.NoError(t, err)
+			assert.Equal(t, 9001, branchLink.Attrs().MTU)
+			assert.NotZero(t, branchLink.Attrs().Flags&net.FlagUp)
+			addrs, err = nl.AddrList(branchLink, netlink.FAMILY_V4)
+			require.NoError(t, err)
+			require.Len(t, addrs, 1)
+			assert.Equal(t, "10.0.1.5/24", addrs[0].IPNet.String())
+
+			require.Len(t, nl.Routes, 1)
+			assert.Equal(t, branchLink.Attrs().Index, nl.Routes[0].LinkIndex)
+			assert.Equal(t, "10.0.1.1", nl.Routes[0].Gw.String())
+		})
+	}
+}
+
+func TestCreateTapLinkMockNetlink(t *testing.T) {
+	defer func(f func(int, uint, int) error) { ioctlSetInt = f }(ioctlSetInt)
+	ioctlSetInt = func(int, uint, int) error { return nil }
+
+	netConfig := &config.NetConfig{MTU: 9001, Gid: config.UnsetGid, TapAlias: "attachment0",
+		TapMACAddress: net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x65}}
+	errNetlink := errors.New("netlink failed")
+
+	testCases := []struct {
+		failingCall string
+		calls       []string
+	}{
+		{"", []string{
+			"LinkAdd tapbr101", "LinkSetMTU tapbr101", "LinkSetMaster ve101-peer",
+			"LinkAdd tap0", "LinkSetMTU tap0", "LinkSetHardwareAddr tap0", "LinkSetAlias tap0",
+			"LinkSetUp tapbr101", "LinkSetUp tap0", "LinkSetUp ve101-peer",
+		}},
+		{"LinkAdd tapbr101", []string{"LinkAdd tapbr101"}},
+		{"LinkSetMTU tapbr101", []string{"LinkAdd tapbr101", "LinkSetMTU tapbr101"}},
+		{"LinkSetMaster ve101-peer", []string{
+			"LinkAdd tapbr101", "LinkSetMTU tapbr101", "LinkSetMaster ve101-peer",
+		}},
+		{"LinkAdd tap0", []string{
+			"LinkAdd tapbr101", "LinkSetMTU tapbr101", "LinkSetMaster ve101-peer", "LinkAdd tap0",
+		}},
+		{"LinkSetMTU tap0", []string{
+			"LinkAdd tapbr101", "LinkSetMTU tapbr101", "LinkSetMaster ve101-peer",
+			"LinkAdd tap0", "LinkSetMTU tap0", "LinkDel tap0",
+		}},
+		{"LinkSetHardwareAddr tap0", []string{
+			"LinkAdd tapbr101", "LinkSetMTU tapbr101", "LinkSetMaster ve101-peer",
+			"LinkAdd tap0", "LinkSetMTU tap0", "LinkSetHardwareAddr tap0", "LinkDel tap0",
+		}},
+		{"LinkSetAlias tap0", []string{
+			"LinkAdd tapbr101", "LinkSetMTU tapbr101", "LinkSetMaster ve101-peer",
+			"LinkAdd tap0", "LinkSetMTU tap0", "LinkSetHardwareAddr tap0", "LinkSetAlias tap0",
+			"LinkDel tap0",
+		}},
+		{"LinkSetUp tap0", []string{
+			"LinkAdd tapbr101", "LinkSetMTU tapbr101", "LinkSetMaster ve101-peer",
+			"LinkAdd tap0", "LinkSetMTU tap0", "LinkSetHardwareAddr tap0", "LinkSetAlias tap0",
+			"LinkSetUp tapbr101", "LinkSetUp tap0", "LinkDel tap0",
+		}},
+	}
+
+	for _, tc := range testCases {
+		name := tc.failingCall
+		if name == "" {
+			name = "success"
+		}
+		t.Run(name, func(t *testing.T) {
+			vethLink := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ve101-peer"}}
+			nl := netlinkwrapper.NewMockNetLink(vethLink)
+			if tc.failingCall != "" {
+				nl.Errors[tc.failingCall] = errNetlink
+			}
+			plugin := &Plugin{netLink: nl}
+
+			err := plugin.createTapLink("tapbr101", "ve101-peer", "tap0", netConfig)
+			assert.Equal(t, tc.calls, nl.Calls)
+			if tc.failingCall != "" {
+				assert.Equal(t, errNetlink, err)
+
+				// A partially configured tap link is deleted.
+				_, err = nl.LinkByName("tap0")
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			bridge, err := nl.LinkByName("tapbr101")
+			require.NoError(t, err)
+			assert.NotZero(t, bridge.Attrs().Flags&net.FlagUp)
+
+			tapLink, err := nl.LinkByName("tap0")
+			require.NoError(t, err)
+			defer tapLink.(*netlink.Tuntap).Fds[0].Close()
+			assert.Equal(t, bridge.Attrs().Index, tapLink.Attrs().MasterIndex)
+			assert.Equal(t, 9001, tapLink.Attrs().MTU)
+			assert.Equal(t, "attachment0", tapLink.Attrs().Alias)
+
+			// The tap link MAC address is the one reported in the result.
+			result := newResult(netConfig, "tap0", "/var/run/netns/target")
+			assert.Equal(t, result.Interfaces[0].Mac, tapLink.Attrs().HardwareAddr.String())
+			assert.NotZero(t, tapLink.Attrs().Flags&net.FlagUp)
+
+			assert.Equal(t, bridge.Attrs().Index, vethLink.MasterIndex)
+			assert.NotZero(t, vethLink.Flags&net.FlagUp)
+		})
+	}
+}
+
+func TestDeleteVethPeerByNameRegexMockNetlink(t *testing.T) {
+	vethPeerName := "ve101-container-2"
+	require.True(t, vethPeerNameRecognizable(vethPeerName))
+
+	nl := netlinkwrapper.NewMockNetLink(
+		&netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: "tap0"}},
+		&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "other-veth"}},
+		&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: vethPeerName}})
+	plugin := &Plugin{netLink: nl}
+
+	// Failures are logged and ignored.
+	nl.Errors["LinkDel"] = errors.New("netlink failed")
+	plugin.deleteVethPeerByNameRegex("target")
+	_, err := nl.LinkByName(vethPeerName)
+	assert.NoError(t, err)
+
+	// Only the veth peer created by ADD is deleted.
+	delete(nl.Errors, "LinkDel")
+	plugin.deleteVethPeerByNameRegex("target")
+	_, err = nl.LinkByName(vethPeerName)
+	assert.Error(t, err)
+	for _, name := range []string{"tap0", "other-veth"} {
+		_, err = nl.LinkByName(name)
+		assert.NoError(t, err, name)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"sort"
+
+	log "github.com/cihub/seelog"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// DSCP classes are mapped to tap queues with u32 filters that set the queue mapping of matching
+// packets, under a multiq root qdisc that dequeues each packet to the tap queue it is mapped to.
+// The vendored netlink library does not support the multiq qdisc, which is added with a raw
+// netlink message instead.
+
+const (
+	// dscpQueueQdiscMajor is the major handle of the multiq root qdisc on the tap link.
+	dscpQueueQdiscMajor = 1
+
+	// Priorities of the IPv4 and IPv6 DSCP filters. Filters for different protocols must have
+	// different priorities.
+	dscpQueueFilterPriorityIPv4 = 1
+	dscpQueueFilterPriorityIPv6 = 2
+)
+
+// setupDSCPQueueMap maps the DSCP classes of packets sent to the given multi-queue tap link to
+// its queues. Queue indices are validated against the number of tap queues by the config.
+func (plugin *Plugin) setupDSCPQueueMap(tapLink netlink.Link, dscpQueueMap map[uint8]uint16) error {
+	tapLinkName := tapLink.Attrs().Name
+
+	log.Infof("Adding multiq qdisc to tap link %s.", tapLinkName)
+	err := plugin.audit("QdiscAdd", tapLinkName, addMultiqQdisc(tapLink, dscpQueueQdiscMajor))
+	if err != nil {
+		return err
+	}
+
+	for _, filter := range newDSCPQueueFilters(tapLink.Attrs().Index, dscpQueueMap) {
+		log.Infof("Adding DSCP queue filter %+v to tap link %s.", filter, tapLinkName)
+		err = plugin.audit("FilterAdd", filter, netlink.FilterAdd(filter))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newDSCPQueueFilters returns the IPv4 and IPv6 filters that map each DSCP class to a queue of
+// the link with the given index, ordered by DSCP class.
+func newDSCPQueueFilters(linkIndex int, dscpQueueMap map[uint8]uint16) []*netlink.U32 {
+	var dscps []int
+	for dscp := range dscpQueueMap {
+		dscps = append(dscps, int(dscp))
+	}
+	sort.Ints(dscps)
+
+	newFilter := func(protocol uint16, priority uint16, key nl.TcU32Key, queue uint16) *netlink.U32 {
+		action := netlink.NewSkbEditAction()
+		action.QueueMapping = &queue
+
+		return &netlink.U32{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: linkIndex,
+				Parent:    netlink.MakeHandle(dscpQueueQdiscMajor, 0),
+				Priority:  priority,
+				Protocol:  protocol,
+			},
+			Sel: &nl.TcU32Sel{
+				Flags: nl.TC_U32_TERMINAL,
+				Keys:  []nl.TcU32Key{key},
+			},
+			Actions: []netlink.Action{action},
+		}
+	}
+
+	var filters []*netlink.U32
+	for _, dscp := range dscps {
+		queue := dscpQueueMap[uint8(dscp)]
+
+		// DSCP is the upper six bits of the IPv4 TOS field, in the second byte of the header.
+		filters = append(filters, newFilter(unix.ETH_P_IP, dscpQueueFilterPriorityIPv4,
+			nl.TcU32Key{Mask: 0x00fc0000, Val: uint32(dscp) << 18}, queue))
+
+		// DSCP is the upper six bits of the IPv6 traffic class field, after the 4-bit version.
+		filters = append(filters, newFilter(unix.ETH_P_IPV6, dscpQueueFilterPriorityIPv6,
+			nl.TcU32Key{Mask: 0x0fc00000, Val: uint32(dscp) << 22}, queue))
+	}
+
+	return filters
+}
+
+// addMultiqQdisc adds a multiq root qdisc with the given major handle to the given link.
+func addMultiqQdisc(link netlink.Link, major uint16) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWQDISC, unix.NLM_F_CREATE|unix.NLM_F_EXCL|unix.NLM_F_ACK)
+
+	msg := &nl.TcMsg{
+		Family:  nl.FAMILY_ALL,
+		Ifindex: int32(link.Attrs().Index),
+		Handle:  netlink.MakeHandle(major, 0),
+		Parent:  netlink.HANDLE_ROOT,
+	}
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(nl.TCA_KIND, nl.ZeroTerminated("multiq")))
+
+	// The kernel sets the number of bands to the number of queues of the link. The options must
+	// be present regardless, as struct tc_multiq_qopt with the bands and max_bands fields.
+	req.AddData(nl.NewRtAttr(nl.TCA_OPTIONS, make([]byte, 4)))
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"os"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestNewDSCPQueueFilters(t *testing.T) {
+	filters := newDSCPQueueFilters(7, map[uint8]uint16{46: 1, 10: 2})
+	require.Len(t, filters, 4)
+
+	expected := []struct {
+		protocol uint16
+		priority uint16
+		mask     uint32
+		val      uint32
+		queue    uint16
+	}{
+		{unix.ETH_P_IP, 1, 0x00fc0000, 0x00280000, 2},
+		{unix.ETH_P_IPV6, 2, 0x0fc00000, 0x02800000, 2},
+		{unix.ETH_P_IP, 1, 0x00fc0000, 0x00b80000, 1},
+		{unix.ETH_P_IPV6, 2, 0x0fc00000, 0x0b800000, 1},
+	}
+
+	for i, e := range expected {
+		filter := filters[i]
+		assert.Equal(t, 7, filter.LinkIndex)
+		assert.Equal(t, netlink.MakeHandle(1, 0), filter.Parent)
+		assert.Equal(t, e.protocol, filter.Protocol)
+		assert.Equal(t, e.priority, filter.Priority)
+		require.Len(t, filter.Sel.Keys, 1)
+		assert.Equal(t, e.mask, filter.Sel.Keys[0].Mask)
+		assert.Equal(t, e.val, filter.Sel.Keys[0].Val)
+		require.Len(t, filter.Actions, 1)
+		action, ok := filter.Actions[0].(*netlink.SkbEditAction)
+		require.True(t, ok)
+		assert.Equal(t, e.queue, *action.QueueMapping)
+	}
+}
+
+func TestSetupDSCPQueueMap(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-dscp-queue")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		tap := &netlink.Tuntap{
+			LinkAttrs: netlink.LinkAttrs{Name: "tap0"},
+			Mode:      netlink.TUNTAP_MODE_TAP,
+			Flags:     netlink.TUNTAP_MULTI_QUEUE_DEFAULTS | netlink.TUNTAP_VNET_HDR,
+			Queues:    4,
+		}
+		require.NoError(t, netlink.LinkAdd(tap))
+
+		plugin := &Plugin{}
+		err = plugin.setupDSCPQueueMap(tap, map[uint8]uint16{46: 3})
+		if err == unix.ENOENT || err == unix.EOPNOTSUPP {
+			t.Skipf("Kernel does not support multiq qdisc or skbedit action: %v.", err)
+		}
+		require.NoError(t, err)
+
+		filters, err := netlink.FilterList(tap, netlink.MakeHandle(1, 0))
+		require.NoError(t, err)
+		var queues []uint16
+		for _, filter := range filters {
+			u32, ok := filter.(*netlink.U32)
+			if !ok {
+				continue
+			}
+			for _, action := range u32.Actions {
+				if skbedit, ok := action.(*netlink.SkbEditAction); ok && skbedit.QueueMapping != nil {
+					queues = append(queues, *skbedit.QueueMapping)
+				}
+			}
+		}
+		assert.Equal(t, []uint16{3, 3}, queues)
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
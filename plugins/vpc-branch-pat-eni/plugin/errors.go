@@ -0,0 +1,181 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"strings"
+
+	"github.com/aws/amazon-vpc-cni-plugins/cni"
+)
+
+// transientErrorMessages are the messages of errors caused by contention on shared host
+// resources, which are likely to succeed if retried.
+var transientErrorMessages = []string{
+	"xtables lock",
+	"device or resource busy",
+	"resource temporarily unavailable",
+	"interrupted system call",
+}
+
+// ClassifiedError is an error returned by CNI commands that tells whether retrying the command
+// may succeed.
+type ClassifiedError interface {
+	error
+	Retriable() bool
+}
+
+// ErrConfigInvalid is returned when the network config is invalid, or conflicts with the host.
+type ErrConfigInvalid struct {
+	Err error
+}
+
+// Error returns the error message.
+func (e *ErrConfigInvalid) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrConfigInvalid) Unwrap() error {
+	return e.Err
+}
+
+// Retriable returns whether retrying the command may succeed.
+func (e *ErrConfigInvalid) Retriable() bool {
+	return false
+}
+
+// CNIErrorCode returns the CNI error code reported to the container runtime.
+func (e *ErrConfigInvalid) CNIErrorCode() uint {
+	return cni.ErrCodeInvalidNetworkConfig
+}
+
+// ErrTrunkNotFound is returned when the trunk ENI is missing, or does not support the requested
+// isolation mode.
+type ErrTrunkNotFound struct {
+	Err error
+}
+
+// Error returns the error message.
+func (e *ErrTrunkNotFound) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrTrunkNotFound) Unwrap() error {
+	return e.Err
+}
+
+// Retriable returns whether retrying the command may succeed.
+func (e *ErrTrunkNotFound) Retriable() bool {
+	return false
+}
+
+// ErrNetNSNotFound is returned when the target netns is missing.
+type ErrNetNSNotFound struct {
+	Err error
+}
+
+// Error returns the error message.
+func (e *ErrNetNSNotFound) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrNetNSNotFound) Unwrap() error {
+	return e.Err
+}
+
+// Retriable returns whether retrying the command may succeed.
+func (e *ErrNetNSNotFound) Retriable() bool {
+	return false
+}
+
+// CNIErrorCode returns the CNI error code reported to the container runtime.
+func (e *ErrNetNSNotFound) CNIErrorCode() uint {
+	return cni.ErrCodeUnknownContainer
+}
+
+// ErrHostUnsupported is returned when the host lacks a tool or kernel feature required by the
+// network config.
+type ErrHostUnsupported struct {
+	Err error
+}
+
+// Error returns the error message.
+func (e *ErrHostUnsupported) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrHostUnsupported) Unwrap() error {
+	return e.Err
+}
+
+// Retriable returns whether retrying the command may succeed.
+func (e *ErrHostUnsupported) Retriable() bool {
+	return false
+}
+
+// ErrTransient is returned when a command failed on a condition that is expected to clear, such
+// as contention on the xtables lock or a busy netlink device.
+type ErrTransient struct {
+	Err error
+}
+
+// Error returns the error message.
+func (e *ErrTransient) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrTransient) Unwrap() error {
+	return e.Err
+}
+
+// Retriable returns whether retrying the command may succeed.
+func (e *ErrTransient) Retriable() bool {
+	return true
+}
+
+// CNIErrorCode returns the CNI error code reported to the container runtime.
+func (e *ErrTransient) CNIErrorCode() uint {
+	return cni.ErrCodeTryAgainLater
+}
+
+// IsRetriable returns whether retrying the command that returned the given error may succeed.
+// Unclassified errors are not retriable.
+func IsRetriable(err error) bool {
+	e, ok := err.(ClassifiedError)
+	return ok && e.Retriable()
+}
+
+// classifyError classifies an error returned by a CNI command as transient if it was caused by
+// contention on shared host resources. Other errors are returned unchanged.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(ClassifiedError); ok {
+		return err
+	}
+
+	msg := err.Error()
+	for _, transientMsg := range transientErrorMessages {
+		if strings.Contains(msg, transientMsg) {
+			return &ErrTransient{Err: err}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/cni"
+
+	cniSkel "github.com/containernetworking/cni/pkg/skel"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifiedErrors(t *testing.T) {
+	errCause := errors.New("cause")
+
+	testCases := []struct {
+		err       ClassifiedError
+		retriable bool
+		code      uint
+	}{
+		{&ErrConfigInvalid{Err: errCause}, false, cni.ErrCodeInvalidNetworkConfig},
+		{&ErrTrunkNotFound{Err: errCause}, false, 0},
+		{&ErrNetNSNotFound{Err: errCause}, false, cni.ErrCodeUnknownContainer},
+		{&ErrHostUnsupported{Err: errCause}, false, 0},
+		{&ErrTransient{Err: errCause}, true, cni.ErrCodeTryAgainLater},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%T", tc.err), func(t *testing.T) {
+			assert.Equal(t, "cause", tc.err.Error())
+			assert.Equal(t, tc.retriable, tc.err.Retriable())
+			assert.Equal(t, tc.retriable, IsRetriable(tc.err))
+			assert.Equal(t, errCause, tc.err.(interface{ Unwrap() error }).Unwrap())
+
+			// Errors without a well-known CNI error code are reported with the generic one.
+			coded, ok := tc.err.(cni.CodedError)
+			assert.Equal(t, tc.code != 0, ok)
+			if ok {
+				assert.Equal(t, tc.code, coded.CNIErrorCode())
+			}
+		})
+	}
+
+	assert.False(t, IsRetriable(errCause))
+	assert.False(t, IsRetriable(nil))
+}
+
+func TestClassifyError(t *testing.T) {
+	assert.NoError(t, classifyError(nil))
+
+	// Contention on shared host resources is transient.
+	for _, err := range []error{
+		errors.New("exit status 4 iptables-restore: Another app is currently holding the xtables lock"),
+		syscall.EBUSY,
+		&os.SyscallError{Syscall: "ioctl", Err: syscall.EAGAIN},
+		fmt.Errorf("failed to set link up: %v", syscall.EINTR),
+	} {
+		classified := classifyError(err)
+		assert.Equal(t, &ErrTransient{Err: err}, classified, err.Error())
+		assert.True(t, IsRetriable(classified))
+	}
+
+	// Other errors are returned unchanged.
+	errOther := syscall.ENODEV
+	assert.Equal(t, errOther, classifyError(errOther))
+
+	// Classified errors are not reclassified.
+	errConfig := &ErrConfigInvalid{Err: errors.New("device or resource busy")}
+	assert.Equal(t, errConfig, classifyError(errConfig))
+}
+
+func TestCommandsClassifyInvalidConfig(t *testing.T) {
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "test-no-such-netns",
+		IfName:      "eth0",
+		StdinData:   []byte(`{"trunkName":"eth0"}`),
+	}
+
+	plugin := &Plugin{}
+	assert.IsType(t, &ErrConfigInvalid{}, plugin.Add(args))
+	assert.IsType(t, &ErrConfigInvalid{}, plugin.Del(args))
+}
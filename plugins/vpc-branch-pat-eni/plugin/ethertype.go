@@ -0,0 +1,51 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"github.com/aws/amazon-vpc-cni-plugins/network/ebtables"
+)
+
+var (
+	// checkEbtablesAvailable checks that ebtables is available on this host.
+	checkEbtablesAvailable = ebtables.CheckAvailable
+
+	// appendEbtablesRule appends an ebtables rule. It is a variable so that it can be replaced
+	// in tests.
+	appendEbtablesRule = ebtables.Filter.Append
+)
+
+// ethertypeFilterRules returns the ebtables filter rules that drop frames forwarded through the
+// PAT bridge, except for IPv4, IPv6 and ARP. Each PAT netns has a single bridge, so the rules
+// are not scoped to a bridge port.
+func ethertypeFilterRules() []*ebtables.Rule {
+	return []*ebtables.Rule{
+		{Protocol: "IPv4", Target: ebtables.Accept},
+		{Protocol: "IPv6", Target: ebtables.Accept},
+		{Protocol: "ARP", Target: ebtables.Accept},
+		{Target: ebtables.Drop},
+	}
+}
+
+// setupEthertypeFilter sets up the ethertype filter rules in the current netns.
+func setupEthertypeFilter() error {
+	for _, rule := range ethertypeFilterRules() {
+		err := appendEbtablesRule(ebtables.Forward, rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/ebtables"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEthertypeFilterRules(t *testing.T) {
+	var rules []string
+	for _, rule := range ethertypeFilterRules() {
+		rules = append(rules, rule.String())
+	}
+
+	assert.Equal(t, []string{
+		"-p IPv4 -j ACCEPT",
+		"-p IPv6 -j ACCEPT",
+		"-p ARP -j ACCEPT",
+		"-j DROP",
+	}, rules)
+}
+
+func TestSetupEthertypeFilter(t *testing.T) {
+	defer func(f func(ebtables.Chain, *ebtables.Rule) error) { appendEbtablesRule = f }(appendEbtablesRule)
+
+	var chains []ebtables.Chain
+	var rules []string
+	appendEbtablesRule = func(chain ebtables.Chain, rule *ebtables.Rule) error {
+		chains = append(chains, chain)
+		rules = append(rules, rule.String())
+		return nil
+	}
+
+	assert.NoError(t, setupEthertypeFilter())
+	for _, chain := range chains {
+		assert.Equal(t, ebtables.Forward, chain)
+	}
+	assert.Len(t, rules, 4)
+	assert.Equal(t, "-j DROP", rules[len(rules)-1])
+
+	// Setup stops at the first rule that fails to apply.
+	errAppend := errors.New("ebtables failed")
+	rules = nil
+	appendEbtablesRule = func(chain ebtables.Chain, rule *ebtables.Rule) error {
+		rules = append(rules, rule.String())
+		return errAppend
+	}
+
+	assert.Equal(t, errAppend, setupEthertypeFilter())
+	assert.Len(t, rules, 1)
+}
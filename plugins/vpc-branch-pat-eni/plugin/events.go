@@ -0,0 +1,126 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	log "github.com/cihub/seelog"
+	cniSkel "github.com/containernetworking/cni/pkg/skel"
+)
+
+const (
+	// Types of attachment events sent to the node agent.
+	eventAttachmentCreated = "AttachmentCreated"
+	eventAttachmentDeleted = "AttachmentDeleted"
+
+	// eventSendTimeout is the maximum time to wait for the node agent to accept an event.
+	eventSendTimeout = time.Second
+)
+
+// attachmentEvent is an event sent to the node agent when a tap link is attached to or
+// detached from a branch.
+type attachmentEvent struct {
+	Type             string    `json:"type"`
+	Time             time.Time `json:"time"`
+	ContainerID      string    `json:"containerID"`
+	NetNS            string    `json:"netns"`
+	IfName           string    `json:"ifName"`
+	PATNetNS         string    `json:"patNetNS"`
+	TrunkName        string    `json:"trunkName,omitempty"`
+	TrunkMACAddress  string    `json:"trunkMACAddress,omitempty"`
+	BranchVlanID     int       `json:"branchVlanID"`
+	BranchMACAddress string    `json:"branchMACAddress,omitempty"`
+	BranchIPAddress  string    `json:"branchIPAddress,omitempty"`
+	BridgeName       string    `json:"bridgeName"`
+	TapAlias         string    `json:"tapAlias,omitempty"`
+}
+
+// newAttachmentEvent creates a new attachmentEvent of the given type for the given CNI command.
+func newAttachmentEvent(eventType string, args *cniSkel.CmdArgs, netConfig *config.NetConfig) *attachmentEvent {
+	event := &attachmentEvent{
+		Type:         eventType,
+		Time:         time.Now().UTC(),
+		ContainerID:  args.ContainerID,
+		NetNS:        args.Netns,
+		IfName:       args.IfName,
+		PATNetNS:     fmt.Sprintf(patNetNSNameFormat, netConfig.BranchVlanID),
+		TrunkName:    netConfig.TrunkName,
+		BranchVlanID: netConfig.BranchVlanID,
+		BridgeName:   netConfig.BridgeName,
+		TapAlias:     netConfig.TapAlias,
+	}
+
+	if netConfig.TrunkMACAddress != nil {
+		event.TrunkMACAddress = netConfig.TrunkMACAddress.String()
+	}
+	if netConfig.BranchMACAddress != nil {
+		event.BranchMACAddress = netConfig.BranchMACAddress.String()
+	}
+	if netConfig.BranchIPAddress.IP != nil {
+		event.BranchIPAddress = netConfig.BranchIPAddress.String()
+	}
+
+	return event
+}
+
+// sendEvent sends the given event to the node agent listening on the unix socket at the given
+// path. Events are best-effort notifications, so failures are logged and otherwise ignored.
+// Nothing is sent if no node agent is listening.
+func sendEvent(socketPath string, event *attachmentEvent) {
+	if socketPath == "" {
+		return
+	}
+
+	if _, err := os.Stat(socketPath); os.IsNotExist(err) {
+		log.Infof("Event socket %s does not exist, skipping %s event.", socketPath, event.Type)
+		return
+	}
+
+	err := writeEvent(socketPath, event)
+	if err != nil {
+		log.Warnf("Failed to send %s event to %s: %v.", event.Type, socketPath, err)
+		return
+	}
+
+	log.Infof("Sent %s event to %s: %+v.", event.Type, socketPath, event)
+}
+
+// writeEvent writes the given event as a single line of JSON to the unix socket at the given path.
+func writeEvent(socketPath string, event *attachmentEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, eventSendTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.SetWriteDeadline(time.Now().Add(eventSendTimeout))
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
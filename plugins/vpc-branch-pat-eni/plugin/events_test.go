@@ -0,0 +1,148 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	cniSkel "github.com/containernetworking/cni/pkg/skel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiveEvents listens on a unix socket at the given path as a node agent would, and returns a
+// channel that receives the events sent to it.
+func receiveEvents(t *testing.T, socketPath string) (<-chan attachmentEvent, func()) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	require.NoError(t, err)
+
+	events := make(chan attachmentEvent, 1)
+	go func() {
+		for {
+			conn, err := l.AcceptUnix()
+			if err != nil {
+				return
+			}
+			var event attachmentEvent
+			line, err := bufio.NewReader(conn).ReadBytes('\n')
+			if err == nil && json.Unmarshal(line, &event) == nil {
+				events <- event
+			}
+			conn.Close()
+		}
+	}()
+
+	return events, func() { l.Close() }
+}
+
+func TestSendEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "agent.sock")
+	events, stop := receiveEvents(t, socketPath)
+	defer stop()
+
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "/var/run/netns/target",
+		IfName:      "tap0",
+		StdinData: []byte(`{"trunkName":"eth1", "branchVlanID":"101",
+			"branchMACAddress":"02:00:00:00:00:01", "branchIPAddress":"10.0.1.5/24"}`),
+	}
+	netConfig, err := config.New(args, false)
+	require.NoError(t, err)
+
+	sendEvent(socketPath, newAttachmentEvent(eventAttachmentCreated, args, netConfig))
+
+	select {
+	case event := <-events:
+		assert.Equal(t, eventAttachmentCreated, event.Type)
+		assert.Equal(t, "container", event.ContainerID)
+		assert.Equal(t, "/var/run/netns/target", event.NetNS)
+		assert.Equal(t, "tap0", event.IfName)
+		assert.Equal(t, fmt.Sprintf(patNetNSNameFormat, 101), event.PATNetNS)
+		assert.Equal(t, "eth1", event.TrunkName)
+		assert.Equal(t, 101, event.BranchVlanID)
+		assert.Equal(t, "02:00:00:00:00:01", event.BranchMACAddress)
+		assert.Equal(t, "10.0.1.5/24", event.BranchIPAddress)
+		assert.Equal(t, "virbr0", event.BridgeName)
+		assert.False(t, event.Time.IsZero())
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+}
+
+func TestSendEventWithoutAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		IfName:      "tap0",
+		StdinData:   []byte(`{"trunkName":"eth1", "branchVlanID":"101"}`),
+	}
+	netConfig, err := config.New(args, false)
+	require.NoError(t, err)
+	event := newAttachmentEvent(eventAttachmentDeleted, args, netConfig)
+
+	// Neither a missing socket nor a socket without a listener is an error.
+	sendEvent(filepath.Join(dir, "missing.sock"), event)
+
+	socketPath := filepath.Join(dir, "stale.sock")
+	_, stop := receiveEvents(t, socketPath)
+	stop()
+	sendEvent(socketPath, event)
+}
+
+func TestDelSendsEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "agent.sock")
+	events, stop := receiveEvents(t, socketPath)
+	defer stop()
+
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "test-no-such-netns",
+		IfName:      "tap0",
+		StdinData: []byte(fmt.Sprintf(`{"trunkName":"eth1", "branchVlanID":"4001",
+			"eventSocket":%q}`, socketPath)),
+	}
+	plugin := &Plugin{}
+	assert.NoError(t, plugin.Del(args))
+
+	select {
+	case event := <-events:
+		assert.Equal(t, eventAttachmentDeleted, event.Type)
+		assert.Equal(t, "container", event.ContainerID)
+		assert.Equal(t, 4001, event.BranchVlanID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+}
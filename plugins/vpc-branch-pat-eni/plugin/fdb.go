@@ -0,0 +1,75 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// FDBEntry maps a bridge forwarding database entry to the bridge port it was learned on.
+type FDBEntry struct {
+	MACAddress net.HardwareAddr
+	LinkName   string
+	LinkAlias  string
+}
+
+// listBridgeFDB returns the forwarding database entries of the bridge with the given name in
+// the current netns, along with the name and alias of the tap or veth port they belong to.
+func (plugin *Plugin) listBridgeFDB(bridgeName string) ([]FDBEntry, error) {
+	bridge, err := plugin.nl().LinkByName(bridgeName)
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := plugin.nl().LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []FDBEntry
+	for _, link := range links {
+		if link.Attrs().MasterIndex != bridge.Attrs().Index {
+			continue
+		}
+
+		neighs, err := plugin.nl().NeighList(link.Attrs().Index, unix.AF_BRIDGE)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, mapFDBEntries(link, neighs)...)
+	}
+
+	return entries, nil
+}
+
+// mapFDBEntries returns the FDB entries for the given neighbors learned on the given bridge port.
+func mapFDBEntries(port netlink.Link, neighs []netlink.Neigh) []FDBEntry {
+	var entries []FDBEntry
+	for _, neigh := range neighs {
+		if neigh.LinkIndex != port.Attrs().Index || neigh.HardwareAddr == nil {
+			continue
+		}
+		entries = append(entries, FDBEntry{
+			MACAddress: neigh.HardwareAddr,
+			LinkName:   port.Attrs().Name,
+			LinkAlias:  port.Attrs().Alias,
+		})
+	}
+
+	return entries
+}
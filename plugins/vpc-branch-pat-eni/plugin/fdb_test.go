@@ -0,0 +1,101 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netlinkwrapper"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+	"github.com/aws/amazon-vpc-cni-plugins/network/vpc"
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestTapAliasInBridgeFDB(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-tap-alias")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		veth := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "veth0"},
+			PeerName:  "veth1",
+		}
+		require.NoError(t, netlink.LinkAdd(veth))
+
+		netConfig := &config.NetConfig{
+			TapAlias:           "default/pod-a",
+			TapOwnershipPolicy: config.TapOwnershipPolicyFail,
+			TapMACAddress:      net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x65},
+			MTU:                vpc.JumboFrameMTU,
+		}
+		plugin := &Plugin{}
+		require.NoError(t, plugin.createTapLink("tapbr0", "veth0", "eth0", netConfig))
+
+		tapLink, err := netlink.LinkByName("eth0")
+		require.NoError(t, err)
+		assert.Equal(t, "default/pod-a", tapLink.Attrs().Alias)
+
+		entries, err := plugin.listBridgeFDB("tapbr0")
+		require.NoError(t, err)
+
+		var found bool
+		for _, entry := range entries {
+			if entry.MACAddress.String() == tapLink.Attrs().HardwareAddr.String() {
+				assert.Equal(t, "eth0", entry.LinkName)
+				assert.Equal(t, "default/pod-a", entry.LinkAlias)
+				found = true
+			}
+		}
+		assert.True(t, found, "tap link FDB entry not found in %+v", entries)
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestListBridgeFDBMockNetlink(t *testing.T) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "tapbr0"}}
+	tap := &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Alias: "default/pod-a"}}
+	other := &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: "eth1"}}
+	nl := netlinkwrapper.NewMockNetLink(bridge, tap, other)
+	tap.MasterIndex = bridge.Index
+
+	tapMAC := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x65}
+	nl.Neighs = []netlink.Neigh{
+		{LinkIndex: tap.Index, Family: unix.AF_BRIDGE, HardwareAddr: tapMAC},
+		{LinkIndex: other.Index, Family: unix.AF_BRIDGE,
+			HardwareAddr: net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x66}},
+	}
+	plugin := &Plugin{netLink: nl}
+
+	// Only entries learned on ports of the bridge are reported.
+	entries, err := plugin.listBridgeFDB("tapbr0")
+	require.NoError(t, err)
+	assert.Equal(t, []FDBEntry{{MACAddress: tapMAC, LinkName: "eth0", LinkAlias: "default/pod-a"}}, entries)
+
+	_, err = plugin.listBridgeFDB("tapbr1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,265 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	log "github.com/cihub/seelog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// fdbCachePathFormat is the file that holds the PAT bridge FDB entries saved for a VLAN ID.
+	fdbCachePathFormat = "/var/run/vpc-branch-pat-eni/fdb-%d"
+)
+
+// fdbCacheEntry is a MAC address learned on the PAT bridge port of a container's tap link.
+type fdbCacheEntry struct {
+	ContainerID string `json:"containerID"`
+	MACAddress  string `json:"macAddress"`
+}
+
+// fdbCache holds the PAT bridge FDB entries of deleted tap links, so that they can be restored
+// when the tap link is recreated instead of being relearned by flooding. Each CNI invocation runs
+// in its own process, so the cache is kept in a file and updated under an exclusive lock on it.
+// The cache holds at most maxEntries entries, and the oldest entries are evicted first.
+type fdbCache struct {
+	path       string
+	maxEntries int
+}
+
+// newFDBCache creates a new fdbCache.
+func newFDBCache(path string, maxEntries int) *fdbCache {
+	return &fdbCache{
+		path:       path,
+		maxEntries: maxEntries,
+	}
+}
+
+// save adds the given MAC addresses learned for a container to the cache, replacing any entries
+// previously saved for it.
+func (c *fdbCache) save(containerID string, macAddresses []net.HardwareAddr) error {
+	if len(macAddresses) == 0 {
+		return nil
+	}
+
+	return c.update(func(entries []fdbCacheEntry) []fdbCacheEntry {
+		entries, _ = removeFDBCacheEntries(entries, containerID)
+		for _, macAddress := range macAddresses {
+			entries = append(entries, fdbCacheEntry{
+				ContainerID: containerID,
+				MACAddress:  macAddress.String(),
+			})
+		}
+
+		if len(entries) > c.maxEntries {
+			entries = entries[len(entries)-c.maxEntries:]
+		}
+		return entries
+	})
+}
+
+// take removes the entries saved for a container from the cache and returns their MAC addresses.
+func (c *fdbCache) take(containerID string) ([]net.HardwareAddr, error) {
+	var macAddresses []net.HardwareAddr
+	err := c.update(func(entries []fdbCacheEntry) []fdbCacheEntry {
+		var taken []fdbCacheEntry
+		entries, taken = removeFDBCacheEntries(entries, containerID)
+		for _, entry := range taken {
+			macAddress, err := net.ParseMAC(entry.MACAddress)
+			if err == nil {
+				macAddresses = append(macAddresses, macAddress)
+			}
+		}
+		return entries
+	})
+
+	return macAddresses, err
+}
+
+// update replaces the cache entries with the ones returned by the given function.
+func (c *fdbCache) update(fn func([]fdbCacheEntry) []fdbCacheEntry) error {
+	err := os.MkdirAll(filepath.Dir(c.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(c.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// Closing the file also releases the lock.
+	defer file.Close()
+
+	err = unix.Flock(int(file.Fd()), unix.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %v", c.path, err)
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	// A missing or corrupt cache file starts with an empty cache.
+	var entries []fdbCacheEntry
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			log.Warnf("Discarding corrupt FDB cache %s: %v.", c.path, err)
+			entries = nil
+		}
+	}
+
+	data, err = json.Marshal(fn(entries))
+	if err == nil {
+		err = file.Truncate(0)
+	}
+	if err == nil {
+		_, err = file.WriteAt(data, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %v", c.path, err)
+	}
+
+	return nil
+}
+
+// removeFDBCacheEntries splits the given entries into the ones that belong to other containers
+// and the ones that belong to the given container.
+func removeFDBCacheEntries(
+	entries []fdbCacheEntry,
+	containerID string) ([]fdbCacheEntry, []fdbCacheEntry) {
+
+	var kept, removed []fdbCacheEntry
+	for _, entry := range entries {
+		if entry.ContainerID == containerID {
+			removed = append(removed, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+
+	return kept, removed
+}
+
+// listContainerFDB returns the MAC addresses learned on the PAT bridge port of a container's tap
+// link. It must be called before the tap link and its veth pair are deleted.
+func (plugin *Plugin) listContainerFDB(targetNetNSName string, patNetNSName string) ([]net.HardwareAddr, error) {
+	targetNetNS, err := netns.GetNetNSByName(targetNetNSName)
+	if err != nil {
+		return nil, err
+	}
+
+	patNetNS, err := netns.GetNetNSByName(patNetNSName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the veth link peer in the target netns. Its name is derived from the veth link name.
+	var vethPeerName string
+	err = targetNetNS.Run(func() error {
+		links, err := plugin.nl().LinkList()
+		if err != nil {
+			return err
+		}
+		if link := findVethPeerLink(links); link != nil {
+			vethPeerName = link.Attrs().Name
+		}
+		return nil
+	})
+	if err != nil || vethPeerName == "" {
+		return nil, err
+	}
+
+	var macAddresses []net.HardwareAddr
+	vethLinkName := strings.TrimSuffix(vethPeerName, vethLinkPeerNameSuffix)
+	err = patNetNS.Run(func() error {
+		var err error
+		macAddresses, err = plugin.listLearnedFDB(vethLinkName)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Found FDB entries learned on bridge port %s: %v.", vethLinkName, macAddresses)
+	return macAddresses, nil
+}
+
+// restoreBridgeFDB restores the MAC addresses saved for a container on the PAT bridge port of
+// its recreated tap link. It must be called in the PAT netns, after the veth pair is up.
+func (plugin *Plugin) restoreBridgeFDB(cache *fdbCache, containerID string, vethLinkName string) error {
+	macAddresses, err := cache.take(containerID)
+	if err != nil || len(macAddresses) == 0 {
+		return err
+	}
+
+	link, err := plugin.nl().LinkByName(vethLinkName)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Restoring FDB entries on bridge port %s: %v.", vethLinkName, macAddresses)
+	for _, macAddress := range macAddresses {
+		// Restored entries are dynamic, so they age out like learned ones if no longer valid.
+		neigh := &netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       unix.AF_BRIDGE,
+			Flags:        netlink.NTF_MASTER,
+			State:        netlink.NUD_REACHABLE,
+			HardwareAddr: macAddress,
+		}
+		err = plugin.audit("NeighSet", neigh, plugin.nl().NeighSet(neigh))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listLearnedFDB returns the MAC addresses learned on the given bridge port in the current netns.
+// Permanent entries, such as the port's own MAC address, are not included.
+func (plugin *Plugin) listLearnedFDB(linkName string) ([]net.HardwareAddr, error) {
+	link, err := plugin.nl().LinkByName(linkName)
+	if err != nil {
+		return nil, err
+	}
+
+	neighs, err := plugin.nl().NeighList(link.Attrs().Index, unix.AF_BRIDGE)
+	if err != nil {
+		return nil, err
+	}
+
+	var macAddresses []net.HardwareAddr
+	for _, neigh := range neighs {
+		if neigh.LinkIndex != link.Attrs().Index || neigh.HardwareAddr == nil ||
+			neigh.State&(netlink.NUD_PERMANENT|netlink.NUD_NOARP) != 0 {
+			continue
+		}
+		macAddresses = append(macAddresses, neigh.HardwareAddr)
+	}
+
+	return macAddresses, nil
+}
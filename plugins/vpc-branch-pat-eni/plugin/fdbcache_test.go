@@ -0,0 +1,199 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netlinkwrapper"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestFDBCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fdbcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mac := func(s string) net.HardwareAddr {
+		macAddress, err := net.ParseMAC(s)
+		require.NoError(t, err)
+		return macAddress
+	}
+
+	cache := newFDBCache(filepath.Join(dir, "fdb"), 3)
+	require.NoError(t, cache.save("c1", []net.HardwareAddr{mac("02:00:00:00:00:01")}))
+	require.NoError(t, cache.save("c2", []net.HardwareAddr{mac("02:00:00:00:00:02")}))
+
+	// Saving again for a container replaces its entries.
+	require.NoError(t, cache.save("c1", []net.HardwareAddr{mac("02:00:00:00:00:03")}))
+
+	// The oldest entries are evicted when the cache is full.
+	require.NoError(t, cache.save("c3", []net.HardwareAddr{
+		mac("02:00:00:00:00:04"), mac("02:00:00:00:00:05"),
+	}))
+
+	macAddresses, err := cache.take("c2")
+	require.NoError(t, err)
+	assert.Empty(t, macAddresses)
+
+	macAddresses, err = cache.take("c1")
+	require.NoError(t, err)
+	assert.Equal(t, []net.HardwareAddr{mac("02:00:00:00:00:03")}, macAddresses)
+
+	// Entries are removed once taken.
+	macAddresses, err = cache.take("c1")
+	require.NoError(t, err)
+	assert.Empty(t, macAddresses)
+
+	macAddresses, err = cache.take("c3")
+	require.NoError(t, err)
+	assert.Equal(t, []net.HardwareAddr{mac("02:00:00:00:00:04"), mac("02:00:00:00:00:05")}, macAddresses)
+}
+
+func TestRestoreBridgeFDBAfterPATNetNSRecreation(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	dir, err := ioutil.TempDir("", "fdbcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	targetNetNS, err := netns.NewNetNS("test-fdb-target")
+	require.NoError(t, err)
+	defer targetNetNS.Close()
+
+	learnedMAC, _ := net.ParseMAC("02:00:00:00:aa:01")
+	cache := newFDBCache(filepath.Join(dir, "fdb"), 16)
+	plugin := &Plugin{}
+
+	// setupPATNetNS creates a PAT netns with a bridge port for the tap link.
+	setupPATNetNS := func(vethLinkName string) netns.NetNS {
+		patNetNS, err := netns.NewNetNS("test-fdb-pat")
+		require.NoError(t, err)
+
+		err = patNetNS.Run(func() error {
+			bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "virbr0"}}
+			require.NoError(t, netlink.LinkAdd(bridge))
+			require.NoError(t, netlink.LinkSetUp(bridge))
+
+			la := netlink.NewLinkAttrs()
+			la.Name = vethLinkName
+			la.MasterIndex = bridge.Index
+			veth := &netlink.Veth{LinkAttrs: la, PeerName: vethLinkName + vethLinkPeerNameSuffix}
+			require.NoError(t, netlink.LinkAdd(veth))
+			require.NoError(t, netlink.LinkSetUp(veth))
+
+			peer, err := netlink.LinkByName(veth.PeerName)
+			require.NoError(t, err)
+			require.NoError(t, netlink.LinkSetNsFd(peer, int(targetNetNS.GetFd())))
+			return nil
+		})
+		require.NoError(t, err)
+
+		// The bridge port accepts FDB entries only once the veth pair is up on both ends.
+		err = targetNetNS.Run(func() error {
+			peer, err := netlink.LinkByName(vethLinkName + vethLinkPeerNameSuffix)
+			require.NoError(t, err)
+			return netlink.LinkSetUp(peer)
+		})
+		require.NoError(t, err)
+
+		return patNetNS
+	}
+
+	patNetNS := setupPATNetNS("ve101-first")
+	err = patNetNS.Run(func() error {
+		// Simulate a MAC address learned on the bridge port.
+		link, err := netlink.LinkByName("ve101-first")
+		require.NoError(t, err)
+		require.NoError(t, netlink.NeighSet(&netlink.Neigh{
+			LinkIndex:    link.Attrs().Index,
+			Family:       unix.AF_BRIDGE,
+			Flags:        netlink.NTF_MASTER,
+			State:        netlink.NUD_REACHABLE,
+			HardwareAddr: learnedMAC,
+		}))
+		return nil
+	})
+	require.NoError(t, err)
+
+	macAddresses, err := plugin.listContainerFDB("test-fdb-target", "test-fdb-pat")
+	require.NoError(t, err)
+	require.NoError(t, cache.save("container", macAddresses))
+
+	// Tear down the PAT netns and the veth peer, then recreate them with a new bridge port.
+	require.NoError(t, patNetNS.Close())
+	err = targetNetNS.Run(func() error {
+		link, err := netlink.LinkByName("ve101-first-2")
+		if err == nil {
+			netlink.LinkDel(link)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	patNetNS = setupPATNetNS("ve101-second")
+	defer patNetNS.Close()
+
+	err = patNetNS.Run(func() error {
+		require.NoError(t, plugin.restoreBridgeFDB(cache, "container", "ve101-second"))
+
+		macAddresses, err := plugin.listLearnedFDB("ve101-second")
+		require.NoError(t, err)
+		assert.Contains(t, macAddresses, learnedMAC)
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestRestoreBridgeFDBMockNetlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fdbcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	savedMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	cache := newFDBCache(filepath.Join(dir, "fdb-101"), 8)
+	require.NoError(t, cache.save("container", []net.HardwareAddr{savedMAC}))
+
+	port := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "ve101-second"}}
+	nl := netlinkwrapper.NewMockNetLink(port)
+	nl.Neighs = []netlink.Neigh{
+		{LinkIndex: port.Index, Family: unix.AF_BRIDGE, State: netlink.NUD_PERMANENT,
+			HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 0x65}},
+	}
+	plugin := &Plugin{netLink: nl}
+
+	require.NoError(t, plugin.restoreBridgeFDB(cache, "container", "ve101-second"))
+	assert.Equal(t, []string{"NeighSet ve101-second"}, nl.Calls)
+
+	// The port's own permanent entry is not reported as learned.
+	macAddresses, err := plugin.listLearnedFDB("ve101-second")
+	require.NoError(t, err)
+	assert.Equal(t, []net.HardwareAddr{savedMAC}, macAddresses)
+
+	// Entries are only restored once.
+	nl.Calls = nil
+	require.NoError(t, plugin.restoreBridgeFDB(cache, "container", "ve101-second"))
+	assert.Empty(t, nl.Calls)
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/iptables"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	log "github.com/cihub/seelog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// conntrackCountPath is the number of conntrack entries in the current netns.
+	conntrackCountPath = "/proc/sys/net/netfilter/nf_conntrack_count"
+)
+
+// AttachmentFootprint describes the kernel resources consumed by the PAT netns of a branch, which
+// are shared by all tap links attached to the branch.
+type AttachmentFootprint struct {
+	TrunkName        string
+	VlanID           int
+	PATNetNSName     string
+	PluginVersion    string
+	Links            int
+	IptablesRules    int
+	ConntrackEntries int
+	Routes           int
+}
+
+// NodeFootprint describes the kernel resources consumed by all attachments on the host.
+type NodeFootprint struct {
+	Attachments      []AttachmentFootprint
+	BranchesPerTrunk map[string]int
+	Links            int
+	IptablesRules    int
+	ConntrackEntries int
+	Routes           int
+}
+
+// Footprint is the FOOTPRINT command handler. It estimates the kernel resources consumed by each
+// attachment in the inventory, and their totals across the host. It must be called in the host
+// netns.
+func (plugin *Plugin) Footprint() (interface{}, error) {
+	trunks, err := listTrunks()
+	if err != nil {
+		return nil, err
+	}
+
+	var attachments []AttachmentFootprint
+	for _, trunk := range trunks {
+		for _, branch := range trunk.Branches {
+			footprint := AttachmentFootprint{
+				TrunkName:     trunk.TrunkName,
+				VlanID:        branch.VlanID,
+				PATNetNSName:  branch.PATNetNSName,
+				PluginVersion: branch.PluginVersion,
+			}
+
+			// Branches in the host netns have no PAT netns of their own.
+			if branch.PATNetNSName != "" {
+				err = getPATNetNSFootprint(&footprint)
+				if err != nil {
+					log.Errorf("Failed to get footprint of PAT netns %s, skipping: %v.",
+						branch.PATNetNSName, err)
+				}
+			}
+			attachments = append(attachments, footprint)
+		}
+	}
+
+	return sumFootprints(attachments), nil
+}
+
+// getPATNetNSFootprint counts the links, iptables rules, conntrack entries and routes in the PAT
+// netns of the given attachment.
+func getPATNetNSFootprint(footprint *AttachmentFootprint) error {
+	patNetNS, err := netns.GetNetNSByName(footprint.PATNetNSName)
+	if err != nil {
+		return err
+	}
+
+	return patNetNS.Run(func() error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		footprint.Links = len(links)
+
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL,
+			&netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return err
+		}
+		footprint.Routes = len(routes)
+
+		for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+			rules, err := saveIptables(proto)
+			if err != nil {
+				// The PAT netns of IPv4-only branches may have no IPv6 rules to count.
+				log.Debugf("Failed to list iptables rules in PAT netns %s: %v.",
+					footprint.PATNetNSName, err)
+				continue
+			}
+			footprint.IptablesRules += countIptablesRules(rules)
+		}
+
+		// The conntrack table is empty until the conntrack module is loaded.
+		data, err := ioutil.ReadFile(conntrackCountPath)
+		if err == nil {
+			footprint.ConntrackEntries, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+
+		return nil
+	})
+}
+
+// countIptablesRules returns the number of rules in the given iptables-save output.
+func countIptablesRules(rules string) int {
+	count := 0
+	for _, line := range strings.Split(rules, "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			count++
+		}
+	}
+
+	return count
+}
+
+// sumFootprints returns the node footprint of the given attachments.
+func sumFootprints(attachments []AttachmentFootprint) *NodeFootprint {
+	node := &NodeFootprint{
+		Attachments:      attachments,
+		BranchesPerTrunk: make(map[string]int),
+	}
+
+	for _, footprint := range attachments {
+		node.BranchesPerTrunk[footprint.TrunkName]++
+		node.Links += footprint.Links
+		node.IptablesRules += footprint.IptablesRules
+		node.ConntrackEntries += footprint.ConntrackEntries
+		node.Routes += footprint.Routes
+	}
+
+	return node
+}
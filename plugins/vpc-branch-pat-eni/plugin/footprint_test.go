@@ -0,0 +1,55 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountIptablesRules(t *testing.T) {
+	rules := `# Generated by iptables-save
+*nat
+:PREROUTING ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+-A POSTROUTING -s 192.168.122.0/24 -o eth1.101 -j MASQUERADE
+COMMIT
+*filter
+:FORWARD ACCEPT [0:0]
+-A FORWARD -i virbr0 -o eth1.101 -j ACCEPT
+-A FORWARD -d 192.168.122.0/24 -i eth1.101 -o virbr0 -j ACCEPT
+COMMIT
+`
+	assert.Equal(t, 3, countIptablesRules(rules))
+	assert.Equal(t, 0, countIptablesRules(""))
+}
+
+func TestSumFootprints(t *testing.T) {
+	attachments := []AttachmentFootprint{
+		{TrunkName: "eth1", VlanID: 101, PATNetNSName: "vpc-pat-101",
+			Links: 5, IptablesRules: 6, ConntrackEntries: 120, Routes: 9},
+		{TrunkName: "eth1", VlanID: 102, PATNetNSName: "vpc-pat-102",
+			Links: 7, IptablesRules: 6, ConntrackEntries: 30, Routes: 9},
+		{TrunkName: "eth2", VlanID: 200},
+	}
+
+	node := sumFootprints(attachments)
+	assert.Equal(t, attachments, node.Attachments)
+	assert.Equal(t, map[string]int{"eth1": 2, "eth2": 1}, node.BranchesPerTrunk)
+	assert.Equal(t, 12, node.Links)
+	assert.Equal(t, 12, node.IptablesRules)
+	assert.Equal(t, 150, node.ConntrackEntries)
+	assert.Equal(t, 18, node.Routes)
+}
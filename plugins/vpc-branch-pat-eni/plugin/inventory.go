@@ -0,0 +1,187 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	log "github.com/cihub/seelog"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// patNetNSNamePrefix is the common prefix of PAT netns names.
+	patNetNSNamePrefix = "vpc-pat-"
+
+	// netNSMountPath is the directory where named netns are mounted.
+	netNSMountPath = "/var/run/netns"
+)
+
+// TrunkInventory describes a trunk ENI on the host and the branch ENIs attached to it.
+type TrunkInventory struct {
+	TrunkIndex      int
+	TrunkName       string
+	TrunkMACAddress net.HardwareAddr
+	Branches        []BranchInventory
+}
+
+// BranchInventory describes a branch ENI and the PAT netns it is in.
+// PATNetNSName is empty for branches in the host netns. PluginVersion is the version of the
+// plugin that created the PAT netns, and is empty if it predates version stamps.
+type BranchInventory struct {
+	LinkName      string
+	VlanID        int
+	PATNetNSName  string
+	PluginVersion string
+}
+
+// listTrunks lists every trunk ENI on the host with its branch VLANs and the PAT netns they map to.
+// It must be called in the host netns.
+func listTrunks() ([]*TrunkInventory, error) {
+	branches := make(map[string][]eni.BranchLink)
+
+	// Find branches in the host netns.
+	hostBranches, err := eni.ListBranchLinks()
+	if err != nil {
+		log.Errorf("Failed to list branch links in host netns: %v.", err)
+		return nil, err
+	}
+	branches[""] = hostBranches
+
+	// Find branches in PAT netns.
+	patNetNSNames, err := listPATNetNSNames()
+	if err != nil {
+		log.Errorf("Failed to list PAT netns: %v.", err)
+		return nil, err
+	}
+
+	for _, patNetNSName := range patNetNSNames {
+		patNetNS, err := netns.GetNetNSByName(patNetNSName)
+		if err != nil {
+			log.Errorf("Failed to find PAT netns %s, skipping: %v.", patNetNSName, err)
+			continue
+		}
+
+		err = patNetNS.Run(func() error {
+			var err error
+			branches[patNetNSName], err = eni.ListBranchLinks()
+			return err
+		})
+		if err != nil {
+			log.Errorf("Failed to list branch links in PAT netns %s, skipping: %v.", patNetNSName, err)
+		}
+	}
+
+	trunks := groupBranchesByTrunk(branches, netlink.LinkByIndex)
+	setPluginVersions(trunks)
+
+	return trunks, nil
+}
+
+// setPluginVersions sets the version of the plugin that created the PAT netns of each branch,
+// as recorded in its stamp.
+func setPluginVersions(trunks []*TrunkInventory) {
+	for _, trunk := range trunks {
+		for i := range trunk.Branches {
+			branch := &trunk.Branches[i]
+			if branch.PATNetNSName == "" {
+				continue
+			}
+
+			stamp, err := readPATNetNSStamp(branch.PATNetNSName)
+			if err != nil {
+				log.Warnf("Failed to read stamp of PAT netns %s: %v.", branch.PATNetNSName, err)
+				continue
+			}
+			if stamp != nil {
+				branch.PluginVersion = stamp.Version
+			}
+		}
+	}
+}
+
+// listPATNetNSNames returns the names of all PAT netns on the host.
+func listPATNetNSNames() ([]string, error) {
+	files, err := ioutil.ReadDir(netNSMountPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), patNetNSNamePrefix) {
+			names = append(names, file.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// groupBranchesByTrunk groups branch links found in each netns by their trunk. Trunk links are
+// looked up by index with the given function.
+func groupBranchesByTrunk(
+	branches map[string][]eni.BranchLink,
+	linkByIndex func(int) (netlink.Link, error)) []*TrunkInventory {
+	trunks := make(map[int]*TrunkInventory)
+
+	for netNSName, links := range branches {
+		for _, branch := range links {
+			trunk, ok := trunks[branch.TrunkIndex]
+			if !ok {
+				trunk = &TrunkInventory{TrunkIndex: branch.TrunkIndex}
+				link, err := linkByIndex(branch.TrunkIndex)
+				if err == nil {
+					trunk.TrunkName = link.Attrs().Name
+					trunk.TrunkMACAddress = link.Attrs().HardwareAddr
+				} else {
+					log.Warnf("Failed to find trunk link with index %d: %v.", branch.TrunkIndex, err)
+				}
+				trunks[branch.TrunkIndex] = trunk
+			}
+
+			// MACVLAN branch links have no VLAN ID. Take it from the PAT netns name instead.
+			vlanID := branch.VlanID
+			if branch.IsolationMode == eni.TrunkIsolationModeMACVLAN {
+				fmt.Sscanf(netNSName, patNetNSNameFormat, &vlanID)
+			}
+
+			trunk.Branches = append(trunk.Branches, BranchInventory{
+				LinkName:     branch.LinkName,
+				VlanID:       vlanID,
+				PATNetNSName: netNSName,
+			})
+		}
+	}
+
+	// Return trunks and branches in a stable order.
+	var inventory []*TrunkInventory
+	for _, trunk := range trunks {
+		sort.Slice(trunk.Branches, func(i, j int) bool {
+			return trunk.Branches[i].VlanID < trunk.Branches[j].VlanID
+		})
+		inventory = append(inventory, trunk)
+	}
+	sort.Slice(inventory, func(i, j int) bool {
+		return inventory[i].TrunkIndex < inventory[j].TrunkIndex
+	})
+
+	return inventory
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+)
+
+func TestGroupBranchesByTrunk(t *testing.T) {
+	branches := map[string][]eni.BranchLink{
+		"": {
+			{LinkName: "eth2.200", VlanID: 200, TrunkIndex: 3},
+		},
+		"vpc-pat-102": {
+			{LinkName: "eth1.102", VlanID: 102, TrunkIndex: 2},
+		},
+		"vpc-pat-101": {
+			{LinkName: "eth1.101", VlanID: 101, TrunkIndex: 2},
+		},
+		"vpc-pat-103": {
+			{LinkName: "eth1.103", TrunkIndex: 2, IsolationMode: eni.TrunkIsolationModeMACVLAN},
+		},
+	}
+
+	linkByIndex := func(index int) (netlink.Link, error) {
+		switch index {
+		case 2:
+			return &netlink.Device{LinkAttrs: netlink.LinkAttrs{Index: 2, Name: "eth1"}}, nil
+		default:
+			return nil, fmt.Errorf("link not found")
+		}
+	}
+
+	inventory := groupBranchesByTrunk(branches, linkByIndex)
+	assert.Equal(t, 2, len(inventory))
+
+	assert.Equal(t, "eth1", inventory[0].TrunkName)
+	assert.Equal(t, []BranchInventory{
+		{LinkName: "eth1.101", VlanID: 101, PATNetNSName: "vpc-pat-101"},
+		{LinkName: "eth1.102", VlanID: 102, PATNetNSName: "vpc-pat-102"},
+		{LinkName: "eth1.103", VlanID: 103, PATNetNSName: "vpc-pat-103"},
+	}, inventory[0].Branches)
+
+	assert.Equal(t, 3, inventory[1].TrunkIndex)
+	assert.Equal(t, "", inventory[1].TrunkName)
+	assert.Equal(t, []BranchInventory{
+		{LinkName: "eth2.200", VlanID: 200, PATNetNSName: ""},
+	}, inventory[1].Branches)
+}
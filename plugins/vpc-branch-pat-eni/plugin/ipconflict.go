@@ -0,0 +1,94 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	log "github.com/cihub/seelog"
+	"github.com/vishvananda/netlink"
+)
+
+// checkBranchIPAddressConflict returns an error if the given branch IP address is already
+// assigned to an interface in the current netns, or in a PAT netns other than the given one,
+// for example by a misconfiguration or a leaked branch. It must be called in the host netns.
+func checkBranchIPAddressConflict(ipAddress net.IP, patNetNSName string) error {
+	linkName, err := findIPAddressOwner(ipAddress)
+	if err != nil {
+		return err
+	}
+	if linkName != "" {
+		return &ErrConfigInvalid{Err: fmt.Errorf(
+			"branch IP address %s is already assigned to interface %s in host netns", ipAddress, linkName)}
+	}
+
+	patNetNSNames, err := listPATNetNSNames()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range patNetNSNames {
+		if name == patNetNSName {
+			continue
+		}
+
+		otherNetNS, err := netns.GetNetNSByName(name)
+		if err != nil {
+			log.Warnf("Failed to find PAT netns %s, skipping: %v.", name, err)
+			continue
+		}
+
+		err = otherNetNS.Run(func() error {
+			linkName, err = findIPAddressOwner(ipAddress)
+			return err
+		})
+		if err != nil {
+			log.Warnf("Failed to list addresses in PAT netns %s, skipping: %v.", name, err)
+			continue
+		}
+		if linkName != "" {
+			return &ErrConfigInvalid{Err: fmt.Errorf(
+				"branch IP address %s is already assigned to interface %s in netns %s",
+				ipAddress, linkName, name)}
+		}
+	}
+
+	return nil
+}
+
+// findIPAddressOwner returns the name of the link the given IP address is assigned to in the
+// current netns, or an empty string if it is not assigned.
+func findIPAddressOwner(ipAddress net.IP) (string, error) {
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return "", err
+	}
+
+	for _, addr := range addrs {
+		if !addr.IP.Equal(ipAddress) {
+			continue
+		}
+
+		link, err := netlink.LinkByIndex(addr.LinkIndex)
+		if err != nil {
+			return "", err
+		}
+		return link.Attrs().Name, nil
+	}
+
+	return "", nil
+}
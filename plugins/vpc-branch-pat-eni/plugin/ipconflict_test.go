@@ -0,0 +1,55 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestCheckBranchIPAddressConflict(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-ip-conflict")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		// Assign the branch IP address to another interface.
+		link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "leaked0"}}
+		require.NoError(t, netlink.LinkAdd(link))
+		ipAddress, ipNet, err := net.ParseCIDR("10.0.1.10/24")
+		require.NoError(t, err)
+		ipNet.IP = ipAddress
+		require.NoError(t, netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet}))
+
+		err = checkBranchIPAddressConflict(ipAddress, "vpc-pat-101")
+		if assert.IsType(t, &ErrConfigInvalid{}, err) {
+			assert.Contains(t, err.Error(), "leaked0")
+		}
+
+		assert.NoError(t, checkBranchIPAddressConflict(net.ParseIP("10.0.1.11"), "vpc-pat-101"))
+		return nil
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/sys/unix"
+)
+
+// kernelVersion represents a Linux kernel version.
+type kernelVersion struct {
+	major int
+	minor int
+}
+
+// kernelFeature represents a plugin feature that requires a minimum kernel version.
+type kernelFeature struct {
+	name       string
+	minVersion kernelVersion
+}
+
+var (
+	// kernelFeatureMultiQueueTap is the support for tap links with multiple queues.
+	kernelFeatureMultiQueueTap = kernelFeature{name: "multi-queue tap", minVersion: kernelVersion{3, 8}}
+)
+
+// String returns a string representation of the kernel version.
+func (v kernelVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// atLeast returns whether the kernel version is greater than or equal to the given version.
+func (v kernelVersion) atLeast(other kernelVersion) bool {
+	return v.major > other.major || (v.major == other.major && v.minor >= other.minor)
+}
+
+// parseKernelVersion parses a kernel release string such as "4.14.133-113.105.amzn2.x86_64".
+func parseKernelVersion(release string) (kernelVersion, error) {
+	var v kernelVersion
+	var err error
+
+	fields := strings.SplitN(release, ".", 3)
+	if len(fields) < 2 {
+		return v, fmt.Errorf("invalid kernel release %s", release)
+	}
+
+	v.major, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return v, fmt.Errorf("invalid kernel release %s", release)
+	}
+
+	// The minor version may be directly followed by a suffix, e.g. "5.4-rc1".
+	minor := strings.FieldsFunc(fields[1], func(r rune) bool { return r < '0' || r > '9' })
+	if len(minor) == 0 || !strings.HasPrefix(fields[1], minor[0]) {
+		return v, fmt.Errorf("invalid kernel release %s", release)
+	}
+	v.minor, _ = strconv.Atoi(minor[0])
+
+	return v, nil
+}
+
+// getKernelVersion returns the version of the running kernel.
+func getKernelVersion() (kernelVersion, error) {
+	var uts unix.Utsname
+	err := unix.Uname(&uts)
+	if err != nil {
+		return kernelVersion{}, err
+	}
+
+	release := string(uts.Release[:])
+	if i := strings.IndexByte(release, 0); i >= 0 {
+		release = release[:i]
+	}
+
+	return parseKernelVersion(release)
+}
+
+// checkKernelFeatures checks whether the given kernel version supports the requested features.
+// Under the fail policy, it returns an error for the first unsupported feature. Under the
+// degrade policy, it logs a warning and returns the unsupported features so that the caller
+// can fall back to a supported configuration.
+func checkKernelFeatures(
+	version kernelVersion,
+	features []kernelFeature,
+	policy string) ([]kernelFeature, error) {
+	var unsupported []kernelFeature
+
+	for _, feature := range features {
+		if version.atLeast(feature.minVersion) {
+			continue
+		}
+
+		if policy != config.KernelCompatPolicyDegrade {
+			return nil, fmt.Errorf("%s requires kernel version %s or later, running %s",
+				feature.name, feature.minVersion, version)
+		}
+
+		log.Warnf("Disabling %s, which requires kernel version %s or later, running %s.",
+			feature.name, feature.minVersion, version)
+		unsupported = append(unsupported, feature)
+	}
+
+	return unsupported, nil
+}
+
+// checkKernelCompat reports the running kernel version and checks that it supports the
+// features requested by the network configuration. It returns the unsupported features
+// when they are degraded per the configured policy.
+func (plugin *Plugin) checkKernelCompat(
+	netConfig *config.NetConfig,
+	features []kernelFeature) ([]kernelFeature, error) {
+	version, err := getKernelVersion()
+	if err != nil {
+		log.Errorf("Failed to get kernel version: %v.", err)
+		return nil, err
+	}
+
+	log.Infof("Running on kernel version %s.", version)
+
+	return checkKernelFeatures(version, features, netConfig.KernelCompatPolicy)
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKernelVersion(t *testing.T) {
+	testCases := []struct {
+		release  string
+		expected kernelVersion
+		isValid  bool
+	}{
+		{"4.14.133-113.105.amzn2.x86_64", kernelVersion{4, 14}, true},
+		{"5.4-rc1", kernelVersion{5, 4}, true},
+		{"3.10.0", kernelVersion{3, 10}, true},
+		{"linux", kernelVersion{}, false},
+		{"4.x", kernelVersion{}, false},
+	}
+	for _, tc := range testCases {
+		version, err := parseKernelVersion(tc.release)
+		if tc.isValid {
+			assert.NoError(t, err, tc.release)
+			assert.Equal(t, tc.expected, version, tc.release)
+		} else {
+			assert.Error(t, err, tc.release)
+		}
+	}
+}
+
+func TestCheckKernelFeatures(t *testing.T) {
+	oldKernel := kernelVersion{3, 2}
+	newKernel := kernelVersion{4, 14}
+	features := []kernelFeature{kernelFeatureMultiQueueTap}
+
+	// Supported features pass under both policies.
+	unsupported, err := checkKernelFeatures(newKernel, features, config.KernelCompatPolicyFail)
+	assert.NoError(t, err)
+	assert.Empty(t, unsupported)
+
+	// Unsupported features fail under the fail policy.
+	_, err = checkKernelFeatures(oldKernel, features, config.KernelCompatPolicyFail)
+	assert.Error(t, err)
+
+	// Unsupported features are returned under the degrade policy.
+	unsupported, err = checkKernelFeatures(oldKernel, features, config.KernelCompatPolicyDegrade)
+	assert.NoError(t, err)
+	assert.Equal(t, features, unsupported)
+}
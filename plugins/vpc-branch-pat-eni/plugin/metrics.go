@@ -0,0 +1,238 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// metricsStatePathSuffix is appended to the metrics file path to get the file that holds the
+	// metrics state.
+	metricsStatePathSuffix = ".state"
+
+	// metricsNamePrefix is the prefix of the names of the metrics exported by this plugin.
+	metricsNamePrefix = "vpc_branch_pat_eni_"
+
+	// Stages of commands, which failures are attributed to. They map to the log checkpoints of ADD.
+	stagePreflight       = "preflight"
+	stageNamespaceCreate = "namespace-create"
+	stageBranchAttach    = "branch-attach"
+	stageIptablesCommit  = "iptables-commit"
+	stageTapCreate       = "tap-create"
+	stageTeardown        = "teardown"
+)
+
+// metricsDurationBuckets are the upper bounds in seconds of the command duration histogram.
+var metricsDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metricsState holds the counters and duration histograms of CNI commands, by command.
+type metricsState struct {
+	Commands  map[string]uint64             `json:"commands"`
+	Failures  map[string]map[string]uint64  `json:"failures"`
+	Durations map[string]*durationHistogram `json:"durations"`
+}
+
+// durationHistogram is a cumulative histogram of command durations.
+type durationHistogram struct {
+	Buckets []uint64 `json:"buckets"`
+	Sum     float64  `json:"sum"`
+	Count   uint64   `json:"count"`
+}
+
+// metricsRecorder records CNI command metrics in a file in the Prometheus text format, which the
+// node agent can scrape, for example with the node exporter textfile collector. Each CNI
+// invocation runs in its own process, so the metrics are accumulated in a state file next to it
+// and updated under an exclusive lock on the state file. A recorder with no path is a no-op.
+type metricsRecorder struct {
+	path string
+}
+
+// newMetricsRecorder creates a new metricsRecorder that writes metrics to the given file.
+func newMetricsRecorder(path string) *metricsRecorder {
+	return &metricsRecorder{
+		path: path,
+	}
+}
+
+// record records a command that started at the given time. If the command failed, the failure is
+// attributed to the given stage.
+func (r *metricsRecorder) record(command string, start time.Time, stage string, cmdErr error) {
+	if r.path == "" {
+		return
+	}
+
+	duration := time.Since(start).Seconds()
+	err := r.update(func(state *metricsState) {
+		state.Commands[command]++
+
+		if cmdErr != nil {
+			if state.Failures[command] == nil {
+				state.Failures[command] = make(map[string]uint64)
+			}
+			state.Failures[command][stage]++
+		}
+
+		h := state.Durations[command]
+		if h == nil || len(h.Buckets) != len(metricsDurationBuckets) {
+			h = &durationHistogram{Buckets: make([]uint64, len(metricsDurationBuckets))}
+			state.Durations[command] = h
+		}
+		for i, bound := range metricsDurationBuckets {
+			if duration <= bound {
+				h.Buckets[i]++
+			}
+		}
+		h.Sum += duration
+		h.Count++
+	})
+	if err != nil {
+		log.Warnf("Failed to record %s metrics in %s: %v.", command, r.path, err)
+	}
+}
+
+// update updates the metrics state with the given function, and rewrites the metrics file.
+func (r *metricsRecorder) update(fn func(*metricsState)) error {
+	err := os.MkdirAll(filepath.Dir(r.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	statePath := r.path + metricsStatePathSuffix
+	file, err := os.OpenFile(statePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// Closing the file also releases the lock.
+	defer file.Close()
+
+	err = unix.Flock(int(file.Fd()), unix.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %v", statePath, err)
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	// A missing or corrupt state file starts the metrics over.
+	var state metricsState
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &state); err != nil {
+			log.Warnf("Discarding corrupt metrics state %s: %v.", statePath, err)
+			state = metricsState{}
+		}
+	}
+	if state.Commands == nil {
+		state.Commands = make(map[string]uint64)
+	}
+	if state.Failures == nil {
+		state.Failures = make(map[string]map[string]uint64)
+	}
+	if state.Durations == nil {
+		state.Durations = make(map[string]*durationHistogram)
+	}
+
+	fn(&state)
+
+	data, err = json.Marshal(&state)
+	if err == nil {
+		err = file.Truncate(0)
+	}
+	if err == nil {
+		_, err = file.WriteAt(data, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %v", statePath, err)
+	}
+
+	// Replace the metrics file atomically, so that scrapers never read a partial file.
+	tmpPath := r.path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, formatMetrics(&state), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, r.path)
+}
+
+// formatMetrics formats the metrics state in the Prometheus text format.
+func formatMetrics(state *metricsState) []byte {
+	var buf bytes.Buffer
+
+	name := metricsNamePrefix + "commands_total"
+	fmt.Fprintf(&buf, "# HELP %s Number of CNI commands executed.\n", name)
+	fmt.Fprintf(&buf, "# TYPE %s counter\n", name)
+	for _, command := range sortedKeys(state.Commands) {
+		fmt.Fprintf(&buf, "%s{command=%q} %d\n", name, command, state.Commands[command])
+	}
+
+	name = metricsNamePrefix + "command_failures_total"
+	fmt.Fprintf(&buf, "# HELP %s Number of failed CNI commands, by the stage that failed.\n", name)
+	fmt.Fprintf(&buf, "# TYPE %s counter\n", name)
+	for _, command := range sortedKeys(state.Failures) {
+		failures := state.Failures[command]
+		for _, stage := range sortedKeys(failures) {
+			fmt.Fprintf(&buf, "%s{command=%q,stage=%q} %d\n", name, command, stage, failures[stage])
+		}
+	}
+
+	name = metricsNamePrefix + "command_duration_seconds"
+	fmt.Fprintf(&buf, "# HELP %s Duration of CNI commands.\n", name)
+	fmt.Fprintf(&buf, "# TYPE %s histogram\n", name)
+	for _, command := range sortedKeys(state.Durations) {
+		h := state.Durations[command]
+		for i, bound := range metricsDurationBuckets {
+			fmt.Fprintf(&buf, "%s_bucket{command=%q,le=\"%g\"} %d\n", name, command, bound, h.Buckets[i])
+		}
+		fmt.Fprintf(&buf, "%s_bucket{command=%q,le=\"+Inf\"} %d\n", name, command, h.Count)
+		fmt.Fprintf(&buf, "%s_sum{command=%q} %g\n", name, command, h.Sum)
+		fmt.Fprintf(&buf, "%s_count{command=%q} %d\n", name, command, h.Count)
+	}
+
+	return buf.Bytes()
+}
+
+// sortedKeys returns the keys of the given map in sorted order, so that the metrics file is stable.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]uint64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]map[string]uint64:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]*durationHistogram:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
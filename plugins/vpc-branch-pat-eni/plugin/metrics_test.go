@@ -0,0 +1,109 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/iptables"
+
+	cniSkel "github.com/containernetworking/cni/pkg/skel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "vpc-branch-pat-eni.prom")
+	r := newMetricsRecorder(path)
+
+	start := time.Now()
+	r.record("add", start, stageTapCreate, nil)
+	r.record("add", start, stageTapCreate, errors.New("failed"))
+	r.record("add", start, stageNamespaceCreate, errors.New("failed"))
+	r.record("add", start, stageNamespaceCreate, errors.New("failed"))
+	r.record("del", start, stageTeardown, nil)
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	metrics := string(data)
+
+	assert.Contains(t, metrics, "# TYPE vpc_branch_pat_eni_commands_total counter\n")
+	assert.Contains(t, metrics, `vpc_branch_pat_eni_commands_total{command="add"} 4`+"\n")
+	assert.Contains(t, metrics, `vpc_branch_pat_eni_commands_total{command="del"} 1`+"\n")
+	assert.Contains(t, metrics,
+		`vpc_branch_pat_eni_command_failures_total{command="add",stage="namespace-create"} 2`+"\n")
+	assert.Contains(t, metrics,
+		`vpc_branch_pat_eni_command_failures_total{command="add",stage="tap-create"} 1`+"\n")
+	assert.NotContains(t, metrics, `vpc_branch_pat_eni_command_failures_total{command="del"`)
+	assert.Contains(t, metrics, "# TYPE vpc_branch_pat_eni_command_duration_seconds histogram\n")
+	assert.Contains(t, metrics,
+		`vpc_branch_pat_eni_command_duration_seconds_bucket{command="add",le="0.1"} 4`+"\n")
+	assert.Contains(t, metrics,
+		`vpc_branch_pat_eni_command_duration_seconds_bucket{command="add",le="+Inf"} 4`+"\n")
+	assert.Contains(t, metrics, `vpc_branch_pat_eni_command_duration_seconds_count{command="del"} 1`+"\n")
+
+	// A new recorder, as in the next CNI invocation, continues from the saved state.
+	newMetricsRecorder(path).record("del", start, stageTeardown, nil)
+	data, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `vpc_branch_pat_eni_commands_total{command="del"} 2`+"\n")
+}
+
+func TestMetricsRecorderDisabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	newMetricsRecorder("").record("add", time.Now(), stagePreflight, nil)
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestAddRecordsFailureMetrics(t *testing.T) {
+	defer func(f func(iptables.Protocol) error) { checkIptablesAvailable = f }(checkIptablesAvailable)
+	checkIptablesAvailable = func(iptables.Protocol) error { return errors.New("no iptables") }
+
+	dir, err := ioutil.TempDir("", "metrics")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vpc-branch-pat-eni.prom")
+
+	args := &cniSkel.CmdArgs{
+		ContainerID: "container",
+		Netns:       "test-no-such-netns",
+		IfName:      "eth0",
+		StdinData: []byte(fmt.Sprintf(`{"trunkName":"eth0", "branchVlanID":"101",
+			"branchMACAddress":"01:23:45:67:89:ab", "metricsFile":%q}`, path)),
+	}
+	plugin := &Plugin{}
+	assert.Error(t, plugin.Add(args))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `vpc_branch_pat_eni_commands_total{command="add"} 1`+"\n")
+	assert.Contains(t, string(data),
+		`vpc_branch_pat_eni_command_failures_total{command="add",stage="preflight"} 1`+"\n")
+}
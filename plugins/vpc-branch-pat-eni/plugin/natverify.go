@@ -0,0 +1,52 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// verifyNAT opens a TCP connection to the given target from the PAT bridge IP address in the
+// current netns. The connection leaves through the branch link and is masqueraded, so it can
+// complete only if the NAT rules work. A refused connection also counts as success, as the
+// target's reply made it back through NAT.
+func verifyNAT(bridgeIP net.IP, target string, timeout time.Duration) error {
+	log.Infof("Verifying NAT with a connection from %s to %s.", bridgeIP, target)
+
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: bridgeIP},
+		Timeout:   timeout,
+	}
+
+	conn, err := dialer.Dial("tcp", target)
+	if err == nil {
+		conn.Close()
+		return nil
+	}
+
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok && sysErr.Err == syscall.ECONNREFUSED {
+			log.Infof("Connection to %s was refused, NAT works.", target)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("failed to connect to %s from %s through NAT: %v", target, bridgeIP, err)
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/iptables"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestVerifyNAT(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	patNetNS, err := netns.NewNetNS("test-nat-pat")
+	require.NoError(t, err)
+	defer patNetNS.Close()
+
+	remoteNetNS, err := netns.NewNetNS("test-nat-remote")
+	require.NoError(t, err)
+	defer remoteNetNS.Close()
+
+	bridgeIP := net.ParseIP("192.168.122.1")
+
+	// Set up the PAT bridge, and a branch link connected to a remote netns.
+	err = patNetNS.Run(func() error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "virbr0"}}
+		require.NoError(t, netlink.LinkAdd(bridge))
+		address, _ := netlink.ParseAddr("192.168.122.1/24")
+		require.NoError(t, netlink.AddrAdd(bridge, address))
+		require.NoError(t, netlink.LinkSetUp(bridge))
+
+		branch := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "branch0"}, PeerName: "remote0"}
+		require.NoError(t, netlink.LinkAdd(branch))
+		address, _ = netlink.ParseAddr("10.0.1.10/24")
+		require.NoError(t, netlink.AddrAdd(branch, address))
+		require.NoError(t, netlink.LinkSetUp(branch))
+
+		peer, err := netlink.LinkByName("remote0")
+		require.NoError(t, err)
+		return netlink.LinkSetNsFd(peer, int(remoteNetNS.GetFd()))
+	})
+	require.NoError(t, err)
+
+	var listener net.Listener
+	err = remoteNetNS.Run(func() error {
+		peer, err := netlink.LinkByName("remote0")
+		require.NoError(t, err)
+		address, _ := netlink.ParseAddr("10.0.1.1/24")
+		require.NoError(t, netlink.AddrAdd(peer, address))
+		require.NoError(t, netlink.LinkSetUp(peer))
+
+		listener, err = net.Listen("tcp", "10.0.1.1:8080")
+		return err
+	})
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// Without NAT, the remote has no route back to the PAT bridge subnet.
+	err = patNetNS.Run(func() error {
+		return verifyNAT(bridgeIP, "10.0.1.1:8080", 200*time.Millisecond)
+	})
+	assert.Error(t, err)
+
+	// Set up NAT. Fall back to a return route on hosts without iptables, which has the same
+	// effect on the verification connection.
+	if iptables.CheckAvailable() == nil {
+		err = patNetNS.Run(func() error {
+			plugin := &Plugin{}
+			return plugin.setupIptablesRules("virbr0", "192.168.122.0/24", "branch0", &config.NetConfig{
+				BranchVlanID:        101,
+				NATMode:             config.NATModeMasquerade,
+				MasqueradePortRange: "1024-65535",
+				DNSPorts:            []int{53},
+			})
+		})
+	} else {
+		err = remoteNetNS.Run(func() error {
+			_, dst, _ := net.ParseCIDR("192.168.122.0/24")
+			peer, err := netlink.LinkByName("remote0")
+			if err != nil {
+				return err
+			}
+			return netlink.RouteAdd(&netlink.Route{
+				LinkIndex: peer.Attrs().Index,
+				Dst:       dst,
+				Gw:        net.ParseIP("10.0.1.10"),
+			})
+		})
+	}
+	require.NoError(t, err)
+
+	err = patNetNS.Run(func() error {
+		// A connection that is accepted or refused by the remote succeeds.
+		assert.NoError(t, verifyNAT(bridgeIP, "10.0.1.1:8080", time.Second))
+		assert.NoError(t, verifyNAT(bridgeIP, "10.0.1.1:8081", time.Second))
+		return nil
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"net"
+	"os"
+
+	log "github.com/cihub/seelog"
+	"github.com/vishvananda/netlink"
+)
+
+// flushBridgeNeighs deletes the ARP and NDP neighbor entries with the given MAC addresses on the
+// bridge with the given name in the current netns. It is best-effort and idempotent: entries that
+// are already gone are skipped, and failures are only logged.
+func (plugin *Plugin) flushBridgeNeighs(bridgeName string, macAddresses []net.HardwareAddr) {
+	bridge, err := plugin.nl().LinkByName(bridgeName)
+	if err != nil {
+		log.Warnf("Failed to find bridge %s to flush neighbor entries: %v.", bridgeName, err)
+		return
+	}
+
+	neighs, err := plugin.nl().NeighList(bridge.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		log.Warnf("Failed to list neighbor entries on bridge %s: %v.", bridgeName, err)
+		return
+	}
+
+	for _, neigh := range filterNeighsByMAC(neighs, macAddresses) {
+		log.Infof("Deleting neighbor entry %s on bridge %s.", neigh.String(), bridgeName)
+		err = plugin.audit("NeighDel", neigh, plugin.nl().NeighDel(&neigh))
+		if err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to delete neighbor entry %s on bridge %s: %v.",
+				neigh.String(), bridgeName, err)
+		}
+	}
+}
+
+// filterNeighsByMAC returns the dynamic IPv4 and IPv6 neighbor entries with the given MAC
+// addresses. Permanent entries are configured explicitly, and are left alone.
+func filterNeighsByMAC(neighs []netlink.Neigh, macAddresses []net.HardwareAddr) []netlink.Neigh {
+	var filtered []netlink.Neigh
+	for _, neigh := range neighs {
+		if neigh.Family != netlink.FAMILY_V4 && neigh.Family != netlink.FAMILY_V6 {
+			continue
+		}
+		if neigh.State&(netlink.NUD_PERMANENT|netlink.NUD_NOARP) != 0 {
+			continue
+		}
+
+		for _, macAddress := range macAddresses {
+			if neigh.HardwareAddr.String() == macAddress.String() {
+				filtered = append(filtered, neigh)
+				break
+			}
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netlinkwrapper"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+	"github.com/aws/amazon-vpc-cni-plugins/network/vpc"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestFilterNeighsByMAC(t *testing.T) {
+	departedMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	otherMAC, _ := net.ParseMAC("02:00:00:00:00:02")
+
+	neighs := []netlink.Neigh{
+		{Family: netlink.FAMILY_V4, State: netlink.NUD_REACHABLE, HardwareAddr: departedMAC,
+			IP: net.ParseIP("192.168.122.10")},
+		{Family: netlink.FAMILY_V6, State: netlink.NUD_STALE, HardwareAddr: departedMAC,
+			IP: net.ParseIP("fe80::1")},
+		{Family: netlink.FAMILY_V4, State: netlink.NUD_PERMANENT, HardwareAddr: departedMAC,
+			IP: net.ParseIP("192.168.122.11")},
+		{Family: unix.AF_BRIDGE, State: netlink.NUD_REACHABLE, HardwareAddr: departedMAC},
+		{Family: netlink.FAMILY_V4, State: netlink.NUD_REACHABLE, HardwareAddr: otherMAC,
+			IP: net.ParseIP("192.168.122.12")},
+	}
+
+	filtered := filterNeighsByMAC(neighs, []net.HardwareAddr{departedMAC})
+	assert.Equal(t, neighs[:2], filtered)
+}
+
+func TestFlushBridgeNeighs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-flush-neighs")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	departedMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	otherMAC, _ := net.ParseMAC("02:00:00:00:00:02")
+
+	err = testNetNS.Run(func() error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "virbr0"}}
+		require.NoError(t, netlink.LinkAdd(bridge))
+		bridgeIPAddress, _ := vpc.GetIPAddressFromString("192.168.122.1/24")
+		require.NoError(t, netlink.AddrAdd(bridge, &netlink.Addr{IPNet: bridgeIPAddress}))
+		require.NoError(t, netlink.LinkSetUp(bridge))
+
+		// Simulate ARP entries for the departed container and another one on the same bridge.
+		for ip, macAddress := range map[string]net.HardwareAddr{
+			"192.168.122.10": departedMAC,
+			"192.168.122.11": otherMAC,
+		} {
+			require.NoError(t, netlink.NeighSet(&netlink.Neigh{
+				LinkIndex:    bridge.Index,
+				Family:       netlink.FAMILY_V4,
+				State:        netlink.NUD_REACHABLE,
+				IP:           net.ParseIP(ip),
+				HardwareAddr: macAddress,
+			}))
+		}
+
+		// Only the departed container's entry is flushed, and flushing again is a no-op.
+		plugin := &Plugin{}
+		plugin.flushBridgeNeighs("virbr0", []net.HardwareAddr{departedMAC})
+		plugin.flushBridgeNeighs("virbr0", []net.HardwareAddr{departedMAC})
+
+		neighs, err := netlink.NeighList(bridge.Index, netlink.FAMILY_V4)
+		require.NoError(t, err)
+		var remaining []string
+		for _, neigh := range neighs {
+			if neigh.State&(netlink.NUD_REACHABLE|netlink.NUD_STALE) != 0 {
+				remaining = append(remaining, neigh.IP.String())
+			}
+		}
+		assert.Equal(t, []string{"192.168.122.11"}, remaining)
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestFlushBridgeNeighsMockNetlink(t *testing.T) {
+	departedMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	otherMAC, _ := net.ParseMAC("02:00:00:00:00:02")
+
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "virbr0"}}
+	nl := netlinkwrapper.NewMockNetLink(bridge)
+	nl.Neighs = []netlink.Neigh{
+		{LinkIndex: bridge.Index, Family: netlink.FAMILY_V4, State: netlink.NUD_REACHABLE,
+			IP: net.ParseIP("192.168.122.10"), HardwareAddr: departedMAC},
+		{LinkIndex: bridge.Index, Family: netlink.FAMILY_V4, State: netlink.NUD_REACHABLE,
+			IP: net.ParseIP("192.168.122.11"), HardwareAddr: otherMAC},
+	}
+
+	plugin := &Plugin{netLink: nl}
+	plugin.flushBridgeNeighs("virbr0", []net.HardwareAddr{departedMAC})
+	plugin.flushBridgeNeighs("virbr0", []net.HardwareAddr{departedMAC})
+
+	require.Len(t, nl.Neighs, 1)
+	assert.Equal(t, "192.168.122.11", nl.Neighs[0].IP.String())
+	assert.Equal(t, []string{"NeighList virbr0", "NeighDel virbr0", "NeighList virbr0"}, nl.Calls)
+}
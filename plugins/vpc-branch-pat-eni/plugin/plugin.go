@@ -15,6 +15,7 @@ package plugin
 
 import (
 	"github.com/aws/amazon-vpc-cni-plugins/cni"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netlinkwrapper"
 
 	cniVersion "github.com/containernetworking/cni/pkg/version"
 )
@@ -29,18 +30,23 @@ const (
 
 var (
 	// specVersions is the set of CNI spec versions supported by this plugin.
-	specVersions = cniVersion.PluginSupports("0.3.0", "0.3.1")
+	specVersions = cniVersion.PluginSupports("0.3.0", "0.3.1", "0.4.0", "1.0.0")
 )
 
 // Plugin represents a vpc-branch-pat-eni CNI plugin.
 type Plugin struct {
 	*cni.Plugin
+	auditNetlink bool
+	// stage is the stage of the current command, which failures are attributed to in metrics.
+	stage string
+	// netLink manages links, addresses and routes. It is replaced by a mock in tests.
+	netLink netlinkwrapper.NetLink
 }
 
 // NewPlugin creates a new Plugin object.
 func NewPlugin() (*Plugin, error) {
 	var err error
-	plugin := &Plugin{}
+	plugin := &Plugin{netLink: netlinkwrapper.NewNetLink()}
 
 	plugin.Plugin, err = cni.NewPlugin(pluginName, specVersions, logFilePath, plugin)
 	if err != nil {
@@ -49,3 +55,11 @@ func NewPlugin() (*Plugin, error) {
 
 	return plugin, nil
 }
+
+// nl returns the netlink interface of the plugin, which defaults to the netlink package.
+func (plugin *Plugin) nl() netlinkwrapper.NetLink {
+	if plugin.netLink == nil {
+		plugin.netLink = netlinkwrapper.NewNetLink()
+	}
+	return plugin.netLink
+}
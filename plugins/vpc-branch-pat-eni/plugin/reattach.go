@@ -0,0 +1,153 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	log "github.com/cihub/seelog"
+	"github.com/vishvananda/netlink"
+)
+
+// Reattach recreates the branch of an existing PAT netns on the trunk in the given netconfig, and
+// restores the branch IP addresses, default routes and iptables rules. It is used for maintenance
+// when the trunk ENI is replaced or reconfigured. The PAT bridge and the tap links attached to it
+// are left as is, so open tap file descriptors remain valid.
+func (plugin *Plugin) Reattach(netConfig *config.NetConfig) error {
+	patNetNSName := fmt.Sprintf(patNetNSNameFormat, netConfig.BranchVlanID)
+
+	log.Infof("Reattaching branch in PAT netns %s with netconfig: %+v.", patNetNSName, netConfig)
+	plugin.auditNetlink = netConfig.AuditNetlink
+
+	// Search for the PAT network namespace.
+	patNetNS, err := netns.GetNetNSByName(patNetNSName)
+	if err != nil {
+		log.Errorf("Failed to find PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	// Discover the branch subnet, instead of deriving it from the branch IP address.
+	if netConfig.DiscoverBranchSubnet {
+		err = discoverBranchSubnet(netConfig)
+		if err != nil {
+			log.Errorf("Failed to discover branch subnet: %v.", err)
+			return err
+		}
+	}
+
+	// Find the trunk ENI the branch is reattached to.
+	trunk, err := newTrunk(netConfig)
+	if err != nil {
+		return err
+	}
+
+	// Delete the old branch link, and the iptables rules that refer to it by name.
+	err = patNetNS.Run(func() error {
+		if !netConfig.SkipIptables {
+			err := plugin.updateBridgeIptablesRules(netConfig, true)
+			if err != nil {
+				log.Warnf("Failed to delete iptables rules in PAT netns %s: %v.", patNetNSName, err)
+			}
+		}
+
+		return plugin.deleteBranchLinks()
+	})
+	if err != nil {
+		log.Errorf("Failed to delete branch links in PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	// Create the new branch link on the trunk and move it to the PAT netns.
+	branchName := fmt.Sprintf(branchLinkNameFormat, trunk.GetLinkName(), netConfig.BranchVlanID)
+	branch, err := eni.NewBranch(trunk, branchName, netConfig.BranchMACAddress, netConfig.BranchVlanID)
+	if err != nil {
+		log.Errorf("Failed to create branch interface %s: %v.", branchName, err)
+		return err
+	}
+
+	log.Infof("Creating branch link %s for PAT netns %s.", branchName, patNetNSName)
+	err = plugin.attachBranch(branch, netConfig.StrayBranchPolicy)
+	if err != nil {
+		log.Errorf("Failed to attach branch interface %s: %v.", branchName, err)
+		return err
+	}
+
+	log.Infof("Moving branch link %s to PAT netns %s.", branchName, patNetNSName)
+	err = plugin.audit("BranchSetNetNS", branch, branch.SetNetNS(patNetNS))
+	if err != nil {
+		log.Errorf("Failed to move branch link %s to PAT netns %s: %v.", branchName, patNetNSName, err)
+		return err
+	}
+
+	// Restore the branch configuration behind the existing PAT bridge.
+	return patNetNS.Run(func() error {
+		bridge, err := netlink.LinkByName(netConfig.BridgeName)
+		if err != nil {
+			return err
+		}
+		addrs, err := netlink.AddrList(bridge, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		if len(addrs) == 0 {
+			return fmt.Errorf("bridge %s has no IPv4 address", netConfig.BridgeName)
+		}
+
+		err = plugin.configureBranch(patNetNSName, netConfig.BridgeName, addrs[0].IPNet,
+			branch, &netConfig.BranchIPAddress, newBranchSubnet(netConfig), netConfig)
+		if err != nil {
+			log.Errorf("Failed to configure branch link %s in PAT netns %s: %v.",
+				branchName, patNetNSName, err)
+		}
+		return err
+	})
+}
+
+// repairPATBranch makes sure that the branch link of an existing PAT netns is present and up
+// before a tap link is added to the PAT bridge. A partial ADD can leave the PAT netns without its
+// branch link, which is then reattached. It returns whether the branch link was reattached.
+func (plugin *Plugin) repairPATBranch(
+	patNetNS netns.NetNS, trunk *eni.Trunk, netConfig *config.NetConfig) (bool, error) {
+	branchName := fmt.Sprintf(branchLinkNameFormat, trunk.GetLinkName(), netConfig.BranchVlanID)
+	branch, err := eni.NewBranch(trunk, branchName, netConfig.BranchMACAddress, netConfig.BranchVlanID)
+	if err != nil {
+		return false, err
+	}
+
+	missing := false
+	err = patNetNS.Run(func() error {
+		up, err := branch.GetOpState()
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			missing = true
+			return nil
+		}
+		if err != nil || up {
+			return err
+		}
+
+		log.Warnf("Branch link %s is down, setting it up.", branchName)
+		return plugin.audit("BranchSetOpState", branch, branch.SetOpState(true))
+	})
+	if err != nil || !missing {
+		return false, err
+	}
+
+	log.Warnf("Branch link %s is missing from PAT netns %s, reattaching it.",
+		branchName, patNetNS.GetPath())
+	return true, plugin.Reattach(netConfig)
+}
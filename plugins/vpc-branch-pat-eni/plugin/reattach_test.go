@@ -0,0 +1,229 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/eni"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+	"github.com/aws/amazon-vpc-cni-plugins/network/vpc"
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestReattach(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-reattach")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	patNetNS, err := netns.NewNetNS("vpc-pat-4021")
+	require.NoError(t, err)
+	defer patNetNS.Close()
+
+	branchMACAddress, _ := net.ParseMAC("02:00:00:00:40:21")
+	branchIPAddress, _ := vpc.GetIPAddressFromString("10.0.1.5/24")
+	netConfig := &config.NetConfig{
+		TrunkName:          "trunk1",
+		TrunkIsolationMode: eni.TrunkIsolationModeMACVLAN,
+		BranchVlanID:       4021,
+		BranchMACAddress:   branchMACAddress,
+		BranchIPAddress:    *branchIPAddress,
+		BridgeName:         "virbr0",
+		MTU:                1500,
+		SkipIptables:       true,
+		StrayBranchPolicy:  config.StrayBranchPolicyReuse,
+	}
+
+	err = testNetNS.Run(func() error {
+		// Create the old and new trunks, using veth pairs as stand-ins for the trunk ENIs.
+		trunks := make(map[string]netlink.Link)
+		for _, name := range []string{"trunk0", "trunk1"} {
+			trunk := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "-peer"}
+			require.NoError(t, netlink.LinkAdd(trunk))
+			peer, err := netlink.LinkByName(trunk.PeerName)
+			require.NoError(t, err)
+			require.NoError(t, netlink.LinkSetUp(peer))
+			require.NoError(t, netlink.LinkSetUp(trunk))
+			trunks[name] = trunk
+		}
+
+		// Attach the branch to the old trunk in the PAT netns.
+		branch := &netlink.Macvlan{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:         "trunk0.4021",
+				ParentIndex:  trunks["trunk0"].Attrs().Index,
+				HardwareAddr: branchMACAddress,
+			},
+			Mode: netlink.MACVLAN_MODE_PRIVATE,
+		}
+		require.NoError(t, netlink.LinkAdd(branch))
+		require.NoError(t, netlink.LinkSetNsFd(branch, int(patNetNS.GetFd())))
+
+		// Create the PAT bridge with a tap link attached to it, held open as a VMM would.
+		var tuntap *netlink.Tuntap
+		err = patNetNS.Run(func() error {
+			bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "virbr0"}}
+			require.NoError(t, netlink.LinkAdd(bridge))
+			bridgeIPAddress, _ := vpc.GetIPAddressFromString("192.168.122.1/24")
+			require.NoError(t, netlink.AddrAdd(bridge, &netlink.Addr{IPNet: bridgeIPAddress}))
+			require.NoError(t, netlink.LinkSetUp(bridge))
+
+			tuntap = &netlink.Tuntap{
+				LinkAttrs: netlink.LinkAttrs{Name: "tap0", MasterIndex: bridge.Index},
+				Mode:      netlink.TUNTAP_MODE_TAP,
+				Flags:     netlink.TUNTAP_ONE_QUEUE | netlink.TUNTAP_VNET_HDR,
+				Queues:    1,
+			}
+			require.NoError(t, netlink.LinkAdd(tuntap))
+			return nil
+		})
+		require.NoError(t, err)
+		defer tuntap.Fds[0].Close()
+
+		plugin := &Plugin{}
+		require.NoError(t, plugin.Reattach(netConfig))
+
+		// The old trunk is clean.
+		assert.False(t, trunkHasBranches(t, "trunk0"))
+
+		return patNetNS.Run(func() error {
+			// The branch is on the new trunk, with its IP address and default route.
+			_, err := netlink.LinkByName("trunk0.4021")
+			assert.IsType(t, netlink.LinkNotFoundError{}, err)
+
+			link, err := netlink.LinkByName("trunk1.4021")
+			require.NoError(t, err)
+			assert.Equal(t, trunks["trunk1"].Attrs().Index, link.Attrs().ParentIndex)
+			assert.Equal(t, branchMACAddress.String(), link.Attrs().HardwareAddr.String())
+
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			require.NoError(t, err)
+			require.Len(t, addrs, 1)
+			assert.Equal(t, "10.0.1.5/24", addrs[0].IPNet.String())
+
+			routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+			require.NoError(t, err)
+			var gateways []string
+			for _, route := range routes {
+				if route.Dst == nil {
+					gateways = append(gateways, route.Gw.String())
+				}
+			}
+			assert.Equal(t, []string{"10.0.1.1"}, gateways)
+
+			// The tap link is untouched and its file descriptor is still valid.
+			tapLink, err := netlink.LinkByName("tap0")
+			require.NoError(t, err)
+			assert.Equal(t, tuntap.Attrs().Index, tapLink.Attrs().Index)
+			bridge, err := netlink.LinkByName("virbr0")
+			require.NoError(t, err)
+			assert.Equal(t, bridge.Attrs().Index, tapLink.Attrs().MasterIndex)
+
+			tapLinkName, err := getTapLinkName(int(tuntap.Fds[0].Fd()))
+			assert.NoError(t, err)
+			assert.Equal(t, "tap0", tapLinkName)
+
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
+
+func TestRepairPATBranch(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	testNetNS, err := netns.NewNetNS("test-repair-branch")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	patNetNS, err := netns.NewNetNS("vpc-pat-4022")
+	require.NoError(t, err)
+	defer patNetNS.Close()
+
+	branchMACAddress, _ := net.ParseMAC("02:00:00:00:40:22")
+	branchIPAddress, _ := vpc.GetIPAddressFromString("10.0.1.6/24")
+	netConfig := &config.NetConfig{
+		TrunkName:          "trunk0",
+		TrunkIsolationMode: eni.TrunkIsolationModeMACVLAN,
+		BranchVlanID:       4022,
+		BranchMACAddress:   branchMACAddress,
+		BranchIPAddress:    *branchIPAddress,
+		BridgeName:         "virbr0",
+		MTU:                1500,
+		SkipIptables:       true,
+		StrayBranchPolicy:  config.StrayBranchPolicyReuse,
+	}
+
+	// Simulate a PAT netns left behind by a partial ADD, with the PAT bridge but no branch link.
+	err = patNetNS.Run(func() error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "virbr0"}}
+		require.NoError(t, netlink.LinkAdd(bridge))
+		bridgeIPAddress, _ := vpc.GetIPAddressFromString("192.168.122.1/24")
+		require.NoError(t, netlink.AddrAdd(bridge, &netlink.Addr{IPNet: bridgeIPAddress}))
+		return netlink.LinkSetUp(bridge)
+	})
+	require.NoError(t, err)
+
+	err = testNetNS.Run(func() error {
+		// Use a veth pair as a stand-in for the trunk ENI.
+		trunkLink := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "trunk0"}, PeerName: "trunk0-peer"}
+		require.NoError(t, netlink.LinkAdd(trunkLink))
+		peer, err := netlink.LinkByName(trunkLink.PeerName)
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetUp(peer))
+		require.NoError(t, netlink.LinkSetUp(trunkLink))
+
+		trunk, err := eni.NewTrunk("trunk0", nil, eni.TrunkIsolationModeMACVLAN)
+		require.NoError(t, err)
+
+		// The missing branch link is reattached.
+		plugin := &Plugin{}
+		reattached, err := plugin.repairPATBranch(patNetNS, trunk, netConfig)
+		require.NoError(t, err)
+		assert.True(t, reattached)
+
+		// A branch link that is down is set up in place.
+		err = patNetNS.Run(func() error {
+			link, err := netlink.LinkByName("trunk0.4022")
+			require.NoError(t, err)
+			assert.NotZero(t, link.Attrs().Flags&net.FlagUp)
+			return netlink.LinkSetDown(link)
+		})
+		require.NoError(t, err)
+
+		reattached, err = plugin.repairPATBranch(patNetNS, trunk, netConfig)
+		require.NoError(t, err)
+		assert.False(t, reattached)
+
+		return patNetNS.Run(func() error {
+			link, err := netlink.LinkByName("trunk0.4022")
+			require.NoError(t, err)
+			assert.NotZero(t, link.Attrs().Flags&net.FlagUp)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+}
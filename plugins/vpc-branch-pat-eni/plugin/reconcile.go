@@ -0,0 +1,255 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/iptables"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+	"github.com/aws/amazon-vpc-cni-plugins/network/vpc"
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	log "github.com/cihub/seelog"
+	cniSkel "github.com/containernetworking/cni/pkg/skel"
+	"github.com/vishvananda/netlink"
+)
+
+// Reconcile brings the PAT netns of an existing attachment back in line with its network config.
+// Unlike CHECK, which only reports drift, it re-applies the pieces set up by ADD that went missing:
+// the bridge and branch links are set up, the iptables rules are committed, and the default routes
+// through the branch are added. Pieces already in place are left untouched, so that it is safe to
+// run periodically.
+func (plugin *Plugin) Reconcile(args *cniSkel.CmdArgs) (err error) {
+	// Classify the remaining failures caused by contention on shared host resources as transient.
+	defer func() { err = classifyError(err) }()
+
+	// Parse network configuration.
+	netConfig, err := config.New(args, true)
+	if err != nil {
+		log.Errorf("Failed to parse netconfig from args: %v.", err)
+		return &ErrConfigInvalid{Err: err}
+	}
+
+	setLogFields(args, netConfig)
+	log.Infof("Executing RECONCILE with netconfig: %+v.", netConfig)
+	plugin.auditNetlink = netConfig.AuditNetlink
+
+	// Discover the branch subnet, as ADD did, so that the default route has the same gateway.
+	if netConfig.DiscoverBranchSubnet {
+		err = discoverBranchSubnet(netConfig)
+		if err != nil {
+			log.Errorf("Failed to discover branch subnet: %v.", err)
+			return err
+		}
+	}
+
+	// Reconcile the PAT network namespace, which must have been created by ADD.
+	patNetNSName := fmt.Sprintf(patNetNSNameFormat, netConfig.BranchVlanID)
+	patNetNS, err := netns.GetNetNSByName(patNetNSName)
+	if err != nil {
+		log.Errorf("Failed to find PAT netns %s: %v.", patNetNSName, err)
+		return &ErrNetNSNotFound{Err: fmt.Errorf("PAT netns %s not found: %v", patNetNSName, err)}
+	}
+
+	err = patNetNS.Run(func() error {
+		return plugin.reconcilePATNetworkNamespace(netConfig)
+	})
+	if err != nil {
+		log.Errorf("Failed to reconcile PAT netns %s: %v.", patNetNSName, err)
+		return err
+	}
+
+	log.Infof("Reconciled PAT netns %s.", patNetNSName)
+	return nil
+}
+
+// reconcilePATNetworkNamespace re-applies the missing pieces of the PAT netns configuration in
+// the current netns. As in ADD, the iptables rules are in place before the default routes, so that
+// traffic never egresses the branch without NAT.
+func (plugin *Plugin) reconcilePATNetworkNamespace(netConfig *config.NetConfig) error {
+	bridge, err := plugin.nl().LinkByName(netConfig.BridgeName)
+	if err != nil {
+		return fmt.Errorf("bridge link %s not found: %v", netConfig.BridgeName, err)
+	}
+	err = plugin.reconcileLinkUp(bridge)
+	if err != nil {
+		return err
+	}
+
+	branchLink, err := plugin.findPATBranchLink(netConfig.BranchVlanID)
+	if err != nil {
+		return err
+	}
+	err = plugin.reconcileLinkUp(branchLink)
+	if err != nil {
+		return err
+	}
+
+	if !netConfig.SkipIptables {
+		err = plugin.reconcileIptablesRules(netConfig, bridge, branchLink.Attrs().Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	branchSubnet := newBranchSubnet(netConfig)
+	err = plugin.reconcileDefaultRoute(branchLink, branchSubnet, netConfig.ECMP)
+	if err != nil {
+		return err
+	}
+
+	if netConfig.BranchIPv6Address.IP != nil {
+		err = plugin.reconcileDefaultRoute(branchLink, newBranchIPv6Subnet(netConfig, branchSubnet), false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reconcileLinkUp sets the given link up, unless it already is.
+func (plugin *Plugin) reconcileLinkUp(link netlink.Link) error {
+	if link.Attrs().Flags&net.FlagUp != 0 {
+		return nil
+	}
+
+	log.Infof("Repairing link %s, which is not up.", link.Attrs().Name)
+	err := plugin.audit("LinkSetUp", link, plugin.nl().LinkSetUp(link))
+	if err != nil {
+		log.Errorf("Failed to set link %s up: %v.", link.Attrs().Name, err)
+	}
+
+	return err
+}
+
+// reconcileIptablesRules commits the iptables rules for the PAT bridge again if any of them is
+// missing from the current netns. The rules are compared by counting those tagged with the comment
+// of the branch, as iptables-save prints rules in a canonical form that differs from the one they
+// were committed in. Committing replaces the tables as a whole, so the rules are never duplicated.
+func (plugin *Plugin) reconcileIptablesRules(
+	netConfig *config.NetConfig,
+	bridge netlink.Link,
+	branchLinkName string) error {
+
+	bridgeName := bridge.Attrs().Name
+	bridgeSubnet, err := plugin.getBridgeSubnet(bridge)
+	if err != nil {
+		return err
+	}
+
+	s, err := newIptablesSession(
+		bridgeName, bridgeSubnet.String(), branchLinkName, netConfig)
+	if err != nil {
+		return err
+	}
+	sessions := map[iptables.Protocol]*iptables.Session{iptables.ProtocolIPv4: s}
+
+	if netConfig.IsDualStack() {
+		bridgeIPv6Subnet := vpc.GetSubnetPrefix(&netConfig.BridgeIPv6Address)
+		s, err = newIp6tablesSession(
+			bridgeName, bridgeIPv6Subnet.String(), branchLinkName, netConfig)
+		if err != nil {
+			return err
+		}
+		sessions[iptables.ProtocolIPv6] = s
+	}
+
+	comment := fmt.Sprintf(iptablesRuleCommentFormat, netConfig.BranchVlanID, branchLinkName)
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		s, ok := sessions[proto]
+		if !ok {
+			continue
+		}
+
+		saved, err := saveIptables(proto)
+		if err != nil {
+			return err
+		}
+
+		expected := countTaggedRules(s.Serialize(), comment)
+		present := countTaggedRules(saved, comment)
+		if present >= expected {
+			continue
+		}
+
+		log.Infof("Repairing iptables rules for bridge %s, %d of %d rules present.",
+			bridgeName, present, expected)
+		err = s.Commit(nil)
+		if err != nil {
+			log.Errorf("Failed to commit iptables rules: %v.", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// countTaggedRules returns the number of rules in the given iptables-restore or iptables-save
+// formatted text that are tagged with the given comment.
+func countTaggedRules(rules string, comment string) int {
+	tag := fmt.Sprintf("--comment \"%s\"", comment)
+
+	count := 0
+	for _, line := range strings.Split(rules, "\n") {
+		if strings.HasPrefix(line, "-A ") && strings.Contains(line, tag) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// reconcileDefaultRoute adds the default route through the gateways of the given branch subnet,
+// unless there already is a default route in the address family of the subnet. The existing route
+// is looked up regardless of its link, as multipath routes are not through any single link.
+func (plugin *Plugin) reconcileDefaultRoute(
+	branchLink netlink.Link,
+	branchSubnet *vpc.Subnet,
+	ecmp bool) error {
+
+	family := netlink.FAMILY_V4
+	if branchSubnet.Prefix.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+
+	routes, err := plugin.nl().RouteList(nil, family)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if route.Dst == nil {
+			return nil
+		}
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 {
+			return nil
+		}
+	}
+
+	route, err := newDefaultRoute(branchLink.Attrs().Index, branchSubnet, ecmp)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Repairing missing default route, adding %+v.", route)
+	err = plugin.audit("RouteAdd", route, plugin.nl().RouteAdd(route))
+	if err != nil {
+		log.Errorf("Failed to add default route: %v.", err)
+	}
+
+	return err
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/iptables"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netlinkwrapper"
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	cniSkel "github.com/containernetworking/cni/pkg/skel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestReconcilePATNetworkNamespace(t *testing.T) {
+	// Install a fake iptables-restore that records its input, and a fake iptables-save.
+	dir, err := ioutil.TempDir("", "iptables")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	script := fmt.Sprintf("#!/bin/sh\ncat > %s/rules\n", dir)
+	require.NoError(t, ioutil.WriteFile(dir+"/iptables-restore", []byte(script), 0755))
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+":"+path)
+
+	defer func(f func(iptables.Protocol) (string, error)) { saveIptables = f }(saveIptables)
+	saved := ""
+	saveIptables = func(iptables.Protocol) (string, error) { return saved, nil }
+
+	args := &cniSkel.CmdArgs{
+		StdinData: []byte(`{"cniVersion":"0.3.1", "trunkName":"eth0", "branchVlanID":"101",
+			"branchMACAddress":"02:00:00:00:01:01", "branchIPAddress":"10.0.1.42/24"}`),
+	}
+	netConfig, err := config.New(args, true)
+	require.NoError(t, err)
+
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "virbr0", Flags: net.FlagUp}}
+	branch := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "eth1.101"}, VlanId: 101}
+	nl := netlinkwrapper.NewMockNetLink(bridge, branch)
+	bridgeAddr, err := netlink.ParseAddr("192.168.122.1/24")
+	require.NoError(t, err)
+	require.NoError(t, nl.AddrAdd(bridge, bridgeAddr))
+	plugin := &Plugin{netLink: nl}
+
+	// Everything missing is repaired: the branch link is set up, the rules are committed and the
+	// default route is added.
+	require.NoError(t, plugin.reconcilePATNetworkNamespace(netConfig))
+	assert.NotZero(t, branch.Flags&net.FlagUp)
+	assert.Contains(t, nl.Calls, "LinkSetUp eth1.101")
+	assert.NotContains(t, nl.Calls, "LinkSetUp virbr0")
+	require.Len(t, nl.Routes, 1)
+	assert.Equal(t, "10.0.1.1", nl.Routes[0].Gw.String())
+	assert.Equal(t, branch.Index, nl.Routes[0].LinkIndex)
+
+	rules, err := ioutil.ReadFile(dir + "/rules")
+	require.NoError(t, err)
+	dnsRule := `-A INPUT -m comment --comment "vpc-pat vlan 101 branch eth1.101" ` +
+		"-i virbr0 -p udp -m udp --dport 53 -j ACCEPT\n"
+	assert.Contains(t, string(rules), dnsRule)
+
+	// Nothing is changed when everything is in place.
+	saved = string(rules)
+	require.NoError(t, os.Remove(dir+"/rules"))
+	nl.Calls = nil
+	require.NoError(t, plugin.reconcilePATNetworkNamespace(netConfig))
+	for _, call := range nl.Calls {
+		assert.False(t, strings.HasPrefix(call, "LinkSetUp") || call == "RouteAdd", call)
+	}
+	assert.Len(t, nl.Routes, 1)
+	_, err = os.Stat(dir + "/rules")
+	assert.True(t, os.IsNotExist(err))
+
+	// A deleted default route and a flushed rule are restored.
+	nl.Routes = nil
+	saved = strings.Replace(saved, dnsRule, "", 1)
+	require.NoError(t, plugin.reconcilePATNetworkNamespace(netConfig))
+	require.Len(t, nl.Routes, 1)
+	assert.Equal(t, "10.0.1.1", nl.Routes[0].Gw.String())
+
+	rules, err = ioutil.ReadFile(dir + "/rules")
+	require.NoError(t, err)
+	assert.Contains(t, string(rules), dnsRule)
+}
+
+func TestReconcileDefaultRouteMultipath(t *testing.T) {
+	branch := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "eth1.101"}, VlanId: 101}
+	nl := netlinkwrapper.NewMockNetLink(branch)
+	plugin := &Plugin{netLink: nl}
+
+	args := &cniSkel.CmdArgs{
+		StdinData: []byte(`{"cniVersion":"0.3.1", "trunkName":"eth0", "branchVlanID":"101",
+			"branchMACAddress":"02:00:00:00:01:01", "branchIPAddress":"10.0.1.42/24",
+			"branchGatewayIPAddresses":["10.0.1.1", "10.0.1.2"], "ecmp":true}`),
+	}
+	netConfig, err := config.New(args, true)
+	require.NoError(t, err)
+
+	// The multipath default route is not through the branch link, but is found nevertheless.
+	require.NoError(t, plugin.reconcileDefaultRoute(branch, newBranchSubnet(netConfig), true))
+	require.Len(t, nl.Routes, 1)
+	assert.Len(t, nl.Routes[0].MultiPath, 2)
+
+	require.NoError(t, plugin.reconcileDefaultRoute(branch, newBranchSubnet(netConfig), true))
+	assert.Len(t, nl.Routes, 1)
+}
+
+func TestCountTaggedRules(t *testing.T) {
+	comment := "vpc-pat vlan 101 branch eth1.101"
+	saved := `*filter
+:INPUT ACCEPT [0:0]
+-A INPUT -i virbr0 -p udp -m comment --comment "vpc-pat vlan 101 branch eth1.101" -m udp --dport 53 -j ACCEPT
+-A INPUT -i virbr0 -p udp -m comment --comment "vpc-pat vlan 102 branch eth1.102" -m udp --dport 53 -j ACCEPT
+-A INPUT -i virbr0 -p udp -m udp --dport 67 -j ACCEPT
+COMMIT
+`
+	assert.Equal(t, 1, countTaggedRules(saved, comment))
+	assert.Equal(t, 0, countTaggedRules("", comment))
+}
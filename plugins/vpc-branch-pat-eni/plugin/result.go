@@ -0,0 +1,101 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	cniTypesCurrent "github.com/containernetworking/cni/pkg/types/current"
+)
+
+const (
+	// cniSpecVersion040 is the CNI spec version whose results have the same format as the
+	// current result version of the vendored CNI library.
+	cniSpecVersion040 = "0.4.0"
+	// cniSpecVersion100 is the CNI spec version whose results omit the IP address version.
+	cniSpecVersion100 = "1.0.0"
+)
+
+// result100 is a CNI spec version 1.0.0 result.
+type result100 struct {
+	CNIVersion string                       `json:"cniVersion,omitempty"`
+	Interfaces []*cniTypesCurrent.Interface `json:"interfaces,omitempty"`
+	IPs        []*ipConfig100               `json:"ips,omitempty"`
+	Routes     []*cniTypes.Route            `json:"routes,omitempty"`
+	DNS        cniTypes.DNS                 `json:"dns,omitempty"`
+}
+
+// ipConfig100 is an IP address configuration in a CNI spec version 1.0.0 result.
+type ipConfig100 struct {
+	Interface *int           `json:"interface,omitempty"`
+	Address   cniTypes.IPNet `json:"address"`
+	Gateway   net.IP         `json:"gateway,omitempty"`
+}
+
+// printResult prints the CNI result to stdout in the format of the given CNI spec version.
+func printResult(result *cniTypesCurrent.Result, version string) error {
+	return writeResult(os.Stdout, result, version)
+}
+
+// writeResult writes the CNI result in the format of the given CNI spec version.
+// The vendored CNI library converts results only up to version 0.3.1. Version 0.4.0 results
+// have the same format, and version 1.0.0 results differ only in omitting the IP address version.
+func writeResult(w io.Writer, result *cniTypesCurrent.Result, version string) error {
+	var versioned interface{}
+	switch version {
+	case cniSpecVersion040:
+		result.CNIVersion = version
+		versioned = result
+	case cniSpecVersion100:
+		versioned = newResult100(result)
+	default:
+		var err error
+		versioned, err = result.GetAsVersion(version)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(versioned, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// newResult100 converts a current version CNI result to a version 1.0.0 result.
+func newResult100(result *cniTypesCurrent.Result) *result100 {
+	converted := &result100{
+		CNIVersion: cniSpecVersion100,
+		Interfaces: result.Interfaces,
+		Routes:     result.Routes,
+		DNS:        result.DNS,
+	}
+
+	for _, ip := range result.IPs {
+		converted.IPs = append(converted.IPs, &ipConfig100{
+			Interface: ip.Interface,
+			Address:   cniTypes.IPNet(ip.Address),
+			Gateway:   ip.Gateway,
+		})
+	}
+
+	return converted
+}
@@ -0,0 +1,93 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	cniSkel "github.com/containernetworking/cni/pkg/skel"
+	cniTypesCurrent "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteResult(t *testing.T) {
+	testCases := []struct {
+		version  string
+		expected string
+	}{
+		{
+			version: "0.3.0",
+			expected: `{"cniVersion":"0.3.0",
+				"interfaces":[{"name":"tap0", "mac":"02:00:00:00:00:65", "sandbox":"/var/run/netns/target"}],
+				"ips":[{"version":"4", "interface":0, "address":"10.0.1.42/24", "gateway":"10.0.1.1"}],
+				"routes":[{"dst":"0.0.0.0/0", "gw":"10.0.1.1"}],
+				"dns":{"nameservers":["10.0.0.2"]}}`,
+		},
+		{
+			version: "0.3.1",
+			expected: `{"cniVersion":"0.3.1",
+				"interfaces":[{"name":"tap0", "mac":"02:00:00:00:00:65", "sandbox":"/var/run/netns/target"}],
+				"ips":[{"version":"4", "interface":0, "address":"10.0.1.42/24", "gateway":"10.0.1.1"}],
+				"routes":[{"dst":"0.0.0.0/0", "gw":"10.0.1.1"}],
+				"dns":{"nameservers":["10.0.0.2"]}}`,
+		},
+		{
+			version: "0.4.0",
+			expected: `{"cniVersion":"0.4.0",
+				"interfaces":[{"name":"tap0", "mac":"02:00:00:00:00:65", "sandbox":"/var/run/netns/target"}],
+				"ips":[{"version":"4", "interface":0, "address":"10.0.1.42/24", "gateway":"10.0.1.1"}],
+				"routes":[{"dst":"0.0.0.0/0", "gw":"10.0.1.1"}],
+				"dns":{"nameservers":["10.0.0.2"]}}`,
+		},
+		{
+			version: "1.0.0",
+			expected: `{"cniVersion":"1.0.0",
+				"interfaces":[{"name":"tap0", "mac":"02:00:00:00:00:65", "sandbox":"/var/run/netns/target"}],
+				"ips":[{"interface":0, "address":"10.0.1.42/24", "gateway":"10.0.1.1"}],
+				"routes":[{"dst":"0.0.0.0/0", "gw":"10.0.1.1"}],
+				"dns":{"nameservers":["10.0.0.2"]}}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.version, func(t *testing.T) {
+			args := &cniSkel.CmdArgs{
+				StdinData: []byte(`{"cniVersion":"` + tc.version + `", "trunkName":"eth0",
+					"branchVlanID":"101", "branchMACAddress":"02:00:00:00:01:01",
+					"branchIPAddress":"10.0.1.42/24", "dns":{"nameservers":["10.0.0.2"]}}`),
+			}
+			netConfig, err := config.New(args, true)
+			require.NoError(t, err)
+
+			var buf bytes.Buffer
+			result := newResult(netConfig, "tap0", "/var/run/netns/target")
+			require.NoError(t, writeResult(&buf, result, netConfig.CNIVersion))
+			assert.JSONEq(t, tc.expected, buf.String())
+		})
+	}
+
+	// Versions the plugin does not support are rejected.
+	result := &cniTypesCurrent.Result{}
+	assert.Error(t, writeResult(&bytes.Buffer{}, result, "9.9.9"))
+}
+
+func TestSpecVersions(t *testing.T) {
+	for _, version := range []string{"0.3.0", "0.3.1", "0.4.0", "1.0.0"} {
+		assert.Contains(t, specVersions.SupportedVersions(), version)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/amazon-vpc-cni-plugins/version"
+)
+
+var (
+	// patNetNSStampDir is the directory that holds the stamp file of each PAT netns. It is a
+	// variable so that it can be replaced in tests.
+	patNetNSStampDir = "/var/run/vpc-branch-pat-eni/netns"
+)
+
+// patNetNSStamp records the plugin build that created a PAT netns, so that PAT netns created by
+// an older version can be identified during rolling upgrades.
+type patNetNSStamp struct {
+	Version      string    `json:"version"`
+	GitShortHash string    `json:"gitShortHash"`
+	Created      time.Time `json:"created"`
+}
+
+// writePATNetNSStamp records the running plugin version as the creator of the given PAT netns.
+func writePATNetNSStamp(patNetNSName string) error {
+	stamp := patNetNSStamp{
+		Version:      version.Version,
+		GitShortHash: version.GitShortHash,
+		Created:      time.Now(),
+	}
+
+	data, err := json.Marshal(stamp)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(patNetNSStampDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(patNetNSStampDir, patNetNSName), data, 0644)
+}
+
+// readPATNetNSStamp returns the stamp of the given PAT netns. A PAT netns created by a plugin
+// version that predates stamps has none, in which case nil is returned without an error.
+func readPATNetNSStamp(patNetNSName string) (*patNetNSStamp, error) {
+	data, err := ioutil.ReadFile(filepath.Join(patNetNSStampDir, patNetNSName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var stamp patNetNSStamp
+	err = json.Unmarshal(data, &stamp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stamp, nil
+}
+
+// removePATNetNSStamp removes the stamp of the given PAT netns, if any.
+func removePATNetNSStamp(patNetNSName string) error {
+	err := os.Remove(filepath.Join(patNetNSStampDir, patNetNSName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
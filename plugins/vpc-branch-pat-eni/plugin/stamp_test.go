@@ -0,0 +1,67 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/version"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPATNetNSStamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stamp")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(d string) { patNetNSStampDir = d }(patNetNSStampDir)
+	patNetNSStampDir = dir
+
+	defer func(v string) { version.Version = v }(version.Version)
+	version.Version = "1.2.3"
+
+	require.NoError(t, writePATNetNSStamp("vpc-pat-101"))
+	stamp, err := readPATNetNSStamp("vpc-pat-101")
+	require.NoError(t, err)
+	require.NotNil(t, stamp)
+	assert.Equal(t, "1.2.3", stamp.Version)
+	assert.False(t, stamp.Created.IsZero())
+
+	// The version is reported for PAT netns with a stamp only.
+	trunks := []*TrunkInventory{
+		{
+			TrunkName: "eth1",
+			Branches: []BranchInventory{
+				{LinkName: "eth1.101", VlanID: 101, PATNetNSName: "vpc-pat-101"},
+				{LinkName: "eth1.102", VlanID: 102, PATNetNSName: "vpc-pat-102"},
+				{LinkName: "eth1.200", VlanID: 200},
+			},
+		},
+	}
+	setPluginVersions(trunks)
+	assert.Equal(t, "1.2.3", trunks[0].Branches[0].PluginVersion)
+	assert.Empty(t, trunks[0].Branches[1].PluginVersion)
+	assert.Empty(t, trunks[0].Branches[2].PluginVersion)
+
+	// Removing the stamp is idempotent.
+	require.NoError(t, removePATNetNSStamp("vpc-pat-101"))
+	require.NoError(t, removePATNetNSStamp("vpc-pat-101"))
+	stamp, err = readPATNetNSStamp("vpc-pat-101")
+	assert.NoError(t, err)
+	assert.Nil(t, stamp)
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"unsafe"
+
+	log "github.com/cihub/seelog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// tapIfReq is the ifreq structure returned by the TUNGETIFF ioctl.
+type tapIfReq struct {
+	Name  [unix.IFNAMSIZ]byte
+	Flags uint16
+	_     [40 - unix.IFNAMSIZ - 2]byte
+}
+
+// receiveTapFd connects to the unix socket at the given path and receives a single tap fd
+// passed by the runtime in an SCM_RIGHTS control message.
+func receiveTapFd(socketPath string) (*os.File, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1)
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("expected a single control message, received %d", len(msgs))
+	}
+
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		return nil, fmt.Errorf("expected a single tap fd, received %d", len(fds))
+	}
+
+	return os.NewFile(uintptr(fds[0]), "tap"), nil
+}
+
+// getTapLinkName returns the name of the tap link the given fd is attached to. It returns an
+// error if the fd does not refer to a tap device.
+func getTapLinkName(fd int) (string, error) {
+	var req tapIfReq
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL, uintptr(fd), uintptr(unix.TUNGETIFF), uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		return "", fmt.Errorf("fd %d is not a tun/tap device: %v", fd, errno)
+	}
+
+	if req.Flags&unix.IFF_TAP == 0 {
+		return "", fmt.Errorf("fd %d is not a tap device, flags 0x%x", fd, req.Flags)
+	}
+
+	return string(bytes.TrimRight(req.Name[:], "\x00")), nil
+}
+
+// adoptTapLink configures an existing tap link, referred to by the given fd, to be used as the
+// tap link with the given name. The tap link is renamed if necessary and enslaved to the bridge.
+func (plugin *Plugin) adoptTapLink(
+	tapFile *os.File,
+	tapLinkName string,
+	bridge netlink.Link) (netlink.Link, error) {
+
+	name, err := getTapLinkName(int(tapFile.Fd()))
+	if err != nil {
+		log.Errorf("Invalid tap fd: %v.", err)
+		return nil, err
+	}
+
+	tapLink, err := plugin.nl().LinkByName(name)
+	if err != nil {
+		log.Errorf("Failed to find tap link %s: %v.", name, err)
+		return nil, err
+	}
+
+	if name != tapLinkName {
+		log.Infof("Renaming tap link %s to %s.", name, tapLinkName)
+		err = plugin.audit("LinkSetName", tapLink, plugin.nl().LinkSetName(tapLink, tapLinkName))
+		if err != nil {
+			log.Errorf("Failed to rename tap link %s to %s: %v.", name, tapLinkName, err)
+			return nil, err
+		}
+		tapLink.Attrs().Name = tapLinkName
+	}
+
+	log.Infof("Setting tap link %s master to %s.", tapLinkName, bridge.Attrs().Name)
+	err = plugin.audit("LinkSetMaster", tapLink, plugin.nl().LinkSetMaster(tapLink, bridge))
+	if err != nil {
+		log.Errorf("Failed to set tap link %s master to %s: %v.",
+			tapLinkName, bridge.Attrs().Name, err)
+		return nil, err
+	}
+
+	return tapLink, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// serveTapFd listens on a unix socket at the given path and passes the given fd to the first
+// client that connects.
+func serveTapFd(t *testing.T, socketPath string, fd int) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	require.NoError(t, err)
+
+	go func() {
+		defer l.Close()
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMsgUnix([]byte{0}, unix.UnixRights(fd), nil)
+	}()
+}
+
+func TestAdoptTapLink(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	dir, err := ioutil.TempDir("", "tapfd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	testNetNS, err := netns.NewNetNS("test-adopt-tap")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	err = testNetNS.Run(func() error {
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}
+		require.NoError(t, netlink.LinkAdd(bridge))
+
+		// Pre-create the tap link as a runtime would.
+		tuntap := &netlink.Tuntap{
+			LinkAttrs: netlink.LinkAttrs{Name: "rttap0"},
+			Mode:      netlink.TUNTAP_MODE_TAP,
+			Flags:     netlink.TUNTAP_ONE_QUEUE | netlink.TUNTAP_VNET_HDR,
+			Queues:    1,
+		}
+		require.NoError(t, netlink.LinkAdd(tuntap))
+
+		socketPath := filepath.Join(dir, "tap.sock")
+		serveTapFd(t, socketPath, int(tuntap.Fds[0].Fd()))
+
+		tapFile, err := receiveTapFd(socketPath)
+		require.NoError(t, err)
+		defer tapFile.Close()
+
+		plugin := &Plugin{}
+		_, err = plugin.adoptTapLink(tapFile, "eth1", bridge)
+		require.NoError(t, err)
+
+		tapLink, err := netlink.LinkByName("eth1")
+		require.NoError(t, err)
+		assert.Equal(t, bridge.Attrs().Index, tapLink.Attrs().MasterIndex)
+
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestGetTapLinkNameRejectsNonTapFd(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = getTapLinkName(int(f.Fd()))
+	assert.Error(t, err)
+}
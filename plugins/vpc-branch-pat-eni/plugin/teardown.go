@@ -0,0 +1,118 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/iptables"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	log "github.com/cihub/seelog"
+)
+
+var (
+	// saveIptables dumps the iptables rules in the current netns. It is a variable so that it
+	// can be replaced in tests.
+	saveIptables = iptables.Save
+)
+
+// verifyTeardown checks that a DEL command left no residue behind. The PAT netns must be gone if
+// it was deleted, the branch link must not remain on the trunk, and no iptables rules tagged for
+// the branch must remain in a kept PAT netns if they were deleted. Any residue is logged and
+// returned as an error.
+func (plugin *Plugin) verifyTeardown(
+	netConfig *config.NetConfig,
+	patNetNSName string,
+	patNetNS netns.NetNS,
+	patNetNSDeleted bool,
+	iptablesRulesDeleted bool) error {
+
+	var residue []string
+
+	if patNetNSDeleted {
+		// Look the netns up by listing, as closing a netns obtained by name would delete it.
+		names, err := netns.ListNetNSNames()
+		if err != nil {
+			residue = append(residue, fmt.Sprintf("failed to list netns: %v", err))
+		}
+		for _, name := range names {
+			if name == patNetNSName {
+				residue = append(residue, fmt.Sprintf("PAT netns %s still exists", patNetNSName))
+			}
+		}
+	}
+
+	branchName, err := getBranchLinkName(netConfig)
+	if err != nil {
+		residue = append(residue, fmt.Sprintf("failed to find trunk: %v", err))
+	} else if _, err := plugin.nl().LinkByName(branchName); err == nil {
+		residue = append(residue, fmt.Sprintf("branch link %s still exists", branchName))
+	}
+
+	if iptablesRulesDeleted && patNetNS != nil {
+		protos := []iptables.Protocol{iptables.ProtocolIPv4}
+		if netConfig.IsDualStack() {
+			protos = append(protos, iptables.ProtocolIPv6)
+		}
+
+		// All rules for the branch are tagged with a comment that starts with this prefix.
+		comment := fmt.Sprintf(iptablesRuleCommentFormat, netConfig.BranchVlanID, "")
+		for _, proto := range protos {
+			protoName := "iptables"
+			if proto == iptables.ProtocolIPv6 {
+				protoName = "ip6tables"
+			}
+
+			var rules string
+			err = patNetNS.Run(func() error {
+				var err error
+				rules, err = saveIptables(proto)
+				return err
+			})
+			if err != nil {
+				residue = append(residue, fmt.Sprintf("failed to list %s rules: %v", protoName, err))
+			} else if strings.Contains(rules, comment) {
+				residue = append(residue, fmt.Sprintf("%s rules for VLAN %d remain in PAT netns %s",
+					protoName, netConfig.BranchVlanID, patNetNSName))
+			}
+		}
+	}
+
+	if len(residue) != 0 {
+		err = fmt.Errorf("teardown of PAT netns %s left residue: %s",
+			patNetNSName, strings.Join(residue, ", "))
+		log.Warnf("Failed to verify teardown: %v.", err)
+		return err
+	}
+
+	log.Infof("Verified teardown of PAT netns %s.", patNetNSName)
+	return nil
+}
+
+// getBranchLinkName returns the name of the branch link on the trunk in the host netns.
+func getBranchLinkName(netConfig *config.NetConfig) (string, error) {
+	trunkName := netConfig.TrunkName
+	if netConfig.TrunkMACAddress != nil {
+		trunk, err := newTrunk(netConfig)
+		if err != nil {
+			return "", err
+		}
+		trunkName = trunk.GetLinkName()
+	}
+
+	return fmt.Sprintf(branchLinkNameFormat, trunkName, netConfig.BranchVlanID), nil
+}
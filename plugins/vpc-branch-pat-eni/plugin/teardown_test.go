@@ -0,0 +1,97 @@
+// Copyright 2019 Amazon.com, Inc. or its affiliates. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"). You may
+// not use this file except in compliance with the License. A copy of the
+// License is located at
+//
+//     http://aws.amazon.com/apache2.0/
+//
+// or in the "license" file accompanying this file. This file is distributed
+// on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+// express or implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/aws/amazon-vpc-cni-plugins/network/iptables"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netlinkwrapper"
+	"github.com/aws/amazon-vpc-cni-plugins/network/netns"
+	"github.com/aws/amazon-vpc-cni-plugins/plugins/vpc-branch-pat-eni/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func TestVerifyTeardown(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Test requires root privileges.")
+	}
+
+	defer func(f func(iptables.Protocol) (string, error)) { saveIptables = f }(saveIptables)
+	rules := ""
+	saveIptables = func(iptables.Protocol) (string, error) { return rules, nil }
+
+	testNetNS, err := netns.NewNetNS("test-teardown-host")
+	require.NoError(t, err)
+	defer testNetNS.Close()
+
+	patNetNS, err := netns.NewNetNS("test-teardown-pat")
+	require.NoError(t, err)
+	defer patNetNS.Close()
+
+	netConfig := &config.NetConfig{TrunkName: "trunk0", BranchVlanID: 101}
+	plugin := &Plugin{}
+
+	err = testNetNS.Run(func() error {
+		// Simulate a teardown that left the PAT netns, the branch link and a rule behind.
+		branch := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "trunk0.101"}}
+		require.NoError(t, netlink.LinkAdd(branch))
+		rules = fmt.Sprintf("-A POSTROUTING -m comment --comment \""+
+			iptablesRuleCommentFormat+"\" -j MASQUERADE\n", 101, "10.0.1.5")
+
+		err := plugin.verifyTeardown(netConfig, "test-teardown-pat", patNetNS, true, false)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "PAT netns test-teardown-pat still exists")
+		assert.Contains(t, err.Error(), "branch link trunk0.101 still exists")
+
+		err = plugin.verifyTeardown(netConfig, "test-teardown-pat", patNetNS, false, true)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "iptables rules for VLAN 101 remain")
+
+		// Rules of other VLANs are not residue.
+		require.NoError(t, netlink.LinkDel(branch))
+		rules = fmt.Sprintf("-A POSTROUTING -m comment --comment \""+
+			iptablesRuleCommentFormat+"\" -j MASQUERADE\n", 1010, "10.0.1.5")
+		assert.NoError(t, plugin.verifyTeardown(netConfig, "test-teardown-pat", patNetNS, false, true))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Nothing is left once the PAT netns is deleted.
+	require.NoError(t, patNetNS.Close())
+	err = testNetNS.Run(func() error {
+		return plugin.verifyTeardown(netConfig, "test-teardown-pat", nil, true, false)
+	})
+	assert.NoError(t, err)
+}
+
+func TestVerifyTeardownMockNetlink(t *testing.T) {
+	netConfig := &config.NetConfig{TrunkName: "trunk0", BranchVlanID: 101}
+	branch := &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "trunk0.101"}, VlanId: 101}
+	nl := netlinkwrapper.NewMockNetLink(branch)
+	plugin := &Plugin{netLink: nl}
+
+	err := plugin.verifyTeardown(netConfig, "vpc-pat-101", nil, false, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "branch link trunk0.101 still exists")
+
+	require.NoError(t, nl.LinkDel(branch))
+	assert.NoError(t, plugin.verifyTeardown(netConfig, "vpc-pat-101", nil, false, false))
+}